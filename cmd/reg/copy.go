@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newCopyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "copy <repo>:<tag>|<repo>@<digest> <repo>[:<tag>]",
+		Short: "Copy or retag an image within the bucket without re-uploading blobs",
+		Args:  cobra.ExactArgs(2),
+		Run:   runCopy,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runCopy(cmd *cobra.Command, args []string) {
+	srcRepo, srcRef, err := reg.ParseImageReference(args[0])
+	if err != nil {
+		log.Fatalf("Invalid source: %v", err)
+	}
+	dstRepo, dstTag, err := reg.ParseImageReference(args[1])
+	if err != nil {
+		log.Fatalf("Invalid destination: %v", err)
+	}
+
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	sha, err := registry.CopyImage(ctx, srcRepo, srcRef, dstRepo, dstTag)
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Copy failed: %v", err)
+	}
+	fmt.Printf("%s:%s@%s\n", dstRepo, dstTag, sha)
+}
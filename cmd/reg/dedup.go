@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newDedupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dedup",
+		Short: "Show how much storage layer sharing saves, overall and per repository, from the local cache",
+		Args:  cobra.NoArgs,
+		Run:   runDedup,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().IntP("top", "n", 10, "Number of shared layers to list")
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runDedup(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	report, err := registry.DedupReport(getInt(cmd, "top"))
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Failed to compute dedup report: %v", err)
+	}
+
+	if getBool(cmd, "json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Logical size:\t%s (%d bytes)\n", formatSize(report.LogicalSize), report.LogicalSize)
+	fmt.Fprintf(w, "Physical size:\t%s (%d bytes)\n", formatSize(report.PhysicalSize), report.PhysicalSize)
+	fmt.Fprintf(w, "Saved:\t%s (%.2fx)\n", formatSize(report.SavedSize), report.Ratio)
+	w.Flush()
+
+	if len(report.SharedLayers) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LAYER\tSIZE\tREPOSITORIES\tMANIFESTS\tSAVED")
+		for _, layer := range report.SharedLayers {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", layer.Digest, formatSize(layer.Size), layer.Repositories, layer.Manifests, formatSize(layer.SavedSize))
+		}
+		w.Flush()
+	}
+
+	if len(report.Repositories) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REPOSITORY\tMANIFESTS\tLOGICAL\tPHYSICAL\tRATIO")
+		for _, repo := range report.Repositories {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%.2fx\n", repo.Repository, repo.Manifests, formatSize(repo.LogicalSize), formatSize(repo.PhysicalSize), repo.Ratio)
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newExportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export <repo>:<tag>|<repo>@<digest>",
+		Short: "Export an image as an OCI layout tarball that docker load also understands",
+		Args:  cobra.ExactArgs(1),
+		Run:   runExport,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().StringP("output", "o", "", "Output file, - for stdout (required)")
+	cmd.MarkFlagRequired("bucket")
+	cmd.MarkFlagRequired("output")
+	return cmd
+}
+
+func runExport(cmd *cobra.Command, args []string) {
+	repo, reference, err := reg.ParseImageReference(args[0])
+	if err != nil {
+		log.Fatalf("Invalid image: %v", err)
+	}
+
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	output := getString(cmd, "output")
+	out := os.Stdout
+	if output != "-" {
+		out, err = os.Create(output)
+		if err != nil {
+			registry.Close()
+			log.Fatalf("Failed to create %s: %v", output, err)
+		}
+	}
+	if err := registry.Export(ctx, repo, reference, out); err != nil {
+		out.Close()
+		if output != "-" {
+			os.Remove(output)
+		}
+		registry.Close()
+		log.Fatalf("Export failed: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		registry.Close()
+		log.Fatalf("Failed to write %s: %v", output, err)
+	}
+	if output != "-" {
+		fmt.Fprintf(os.Stderr, "Exported %s to %s\n", args[0], output)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func getString(cmd *cobra.Command, name string) string {
+	v, err := cmd.Flags().GetString(name)
+	if err != nil {
+		log.Fatalf("Failed to get %s flag: %v", name, err)
+	}
+	return v
+}
+
+func getStringSlice(cmd *cobra.Command, name string) []string {
+	v, err := cmd.Flags().GetStringSlice(name)
+	if err != nil {
+		log.Fatalf("Failed to get %s flag: %v", name, err)
+	}
+	return v
+}
+
+func getStringArray(cmd *cobra.Command, name string) []string {
+	v, err := cmd.Flags().GetStringArray(name)
+	if err != nil {
+		log.Fatalf("Failed to get %s flag: %v", name, err)
+	}
+	return v
+}
+
+func getBool(cmd *cobra.Command, name string) bool {
+	v, err := cmd.Flags().GetBool(name)
+	if err != nil {
+		log.Fatalf("Failed to get %s flag: %v", name, err)
+	}
+	return v
+}
+
+func getInt(cmd *cobra.Command, name string) int {
+	v, err := cmd.Flags().GetInt(name)
+	if err != nil {
+		log.Fatalf("Failed to get %s flag: %v", name, err)
+	}
+	return v
+}
+
+func getDuration(cmd *cobra.Command, name string) time.Duration {
+	v, err := cmd.Flags().GetDuration(name)
+	if err != nil {
+		log.Fatalf("Failed to get %s flag: %v", name, err)
+	}
+	return v
+}
+
+// getSize parses a size flag such as 5MB or 64KiB into bytes.
+func getSize(cmd *cobra.Command, name string) int64 {
+	size, err := parseSize(getString(cmd, name))
+	if err != nil {
+		log.Fatalf("Invalid %s flag: %v", name, err)
+	}
+	return size
+}
+
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"B", 1},
+	}
+	number := strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(strings.ToUpper(number), strings.ToUpper(unit.suffix)) {
+			number = strings.TrimSpace(number[:len(number)-len(unit.suffix)])
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+func addNotationFlags(cmd *cobra.Command) {
+	cmd.Flags().String("notation-trust-policy", "", "Notation trustpolicy.json verifying notation signatures")
+	cmd.Flags().String("notation-trust-store", "", "Notation trust store directory holding x509/<type>/<name>/ certificates")
+}
+
+// notationOptions verifies notation signatures when a trust policy is given.
+func notationOptions(cmd *cobra.Command) []reg.Option {
+	policyPath := getString(cmd, "notation-trust-policy")
+	if policyPath == "" {
+		return nil
+	}
+	trustStore := getString(cmd, "notation-trust-store")
+	if trustStore == "" {
+		log.Fatalf("--notation-trust-policy requires --notation-trust-store")
+	}
+	verifier, err := reg.LoadNotationTrustPolicy(policyPath, trustStore)
+	if err != nil {
+		log.Fatalf("Failed to load notation trust policy: %v", err)
+	}
+	return []reg.Option{reg.WithNotationVerifier(verifier)}
+}
+
+func getStorageLayout(cmd *cobra.Command) reg.StorageLayout {
+	layout := reg.StorageLayout(getString(cmd, "storage-layout"))
+	if layout != reg.LayoutDistribution && layout != reg.LayoutOCI {
+		log.Fatalf("Invalid storage layout %q, expected distribution or oci", layout)
+	}
+	return layout
+}
+
+// parseEventFilter parses an --event-filter flag, "<sink>=<rules>". Sink names
+// may hold URLs with "=" in their query, so the rules start at the first "="
+// followed by a rule key.
+func parseEventFilter(value string) (string, reg.EventFilter) {
+	for i := strings.Index(value, "="); i >= 0; {
+		rules := value[i+1:]
+		for _, key := range []string{"repository:", "action:", "tag:", "media-type:"} {
+			if strings.HasPrefix(rules, key) {
+				filter, err := reg.ParseEventFilter(rules)
+				if err != nil {
+					log.Fatalf("Invalid event filter %q: %v", value, err)
+				}
+				return value[:i], filter
+			}
+		}
+		next := strings.Index(rules, "=")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	log.Fatalf("Invalid event filter %q, expected <sink>=<key>:<value>[;<key>:<value>...]", value)
+	return "", reg.EventFilter{}
+}
+
+// parseNetwork parses a CIDR, or a single address as the network of only it.
+func parseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		network, err := netip.ParsePrefix(s)
+		return network.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
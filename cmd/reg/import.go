@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newImportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <archive>",
+		Short: "Import images from an OCI layout or docker save archive",
+		Long: "Import images from an OCI image layout (directory or tarball) or a docker save tarball, gzipped or not.\n" +
+			"The repository and tag default to the names recorded in the archive.",
+		Args: cobra.ExactArgs(1),
+		Run:  runImport,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().String("repo", "", "Repository to import into")
+	cmd.Flags().String("tag", "", "Tag to apply, only valid for archives with a single image")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runImport(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	imported, err := registry.Import(ctx, args[0], reg.ImportOptions{
+		Repository: getString(cmd, "repo"),
+		Tag:        getString(cmd, "tag"),
+	})
+	for _, image := range imported {
+		if image.Tag != "" {
+			fmt.Printf("Imported %s:%s@%s\n", image.Repository, image.Tag, image.Digest)
+		} else {
+			fmt.Printf("Imported %s@%s\n", image.Repository, image.Digest)
+		}
+	}
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Import failed: %v", err)
+	}
+}
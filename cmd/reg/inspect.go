@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newInspectCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect <repo>:<tag>|<repo>@<digest>",
+		Short: "Show the manifest, config and size of an image without pulling it",
+		Args:  cobra.ExactArgs(1),
+		Run:   runInspect,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+	addNotationFlags(cmd)
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runInspect(cmd *cobra.Command, args []string) {
+	repo, reference, err := reg.ParseImageReference(args[0])
+	if err != nil {
+		log.Fatalf("Invalid image: %v", err)
+	}
+
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"), notationOptions(cmd)...)
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	info, err := registry.Inspect(ctx, repo, reference)
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Inspect failed: %v", err)
+	}
+
+	if getBool(cmd, "json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(info)
+		return
+	}
+	printImageInfo(os.Stdout, info, "")
+
+	var manifest bytes.Buffer
+	if err := json.Indent(&manifest, info.Manifest, "", "  "); err != nil {
+		manifest.Reset()
+		manifest.Write(info.Manifest)
+	}
+	fmt.Printf("\nManifest:\n%s\n", manifest.String())
+}
+
+func printImageInfo(out io.Writer, info *reg.ImageInfo, indent string) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if info.Reference != "" {
+		fmt.Fprintf(w, "%sName:\t%s:%s\n", indent, info.Repository, info.Reference)
+	}
+	fmt.Fprintf(w, "%sDigest:\t%s\n", indent, info.Digest)
+	fmt.Fprintf(w, "%sMedia type:\t%s\n", indent, info.MediaType)
+	if info.ArtifactType != "" {
+		fmt.Fprintf(w, "%sArtifact type:\t%s\n", indent, info.ArtifactType)
+	}
+	if info.Platform != nil {
+		fmt.Fprintf(w, "%sPlatform:\t%s\n", indent, formatPlatform(info))
+	}
+	if info.Created != nil {
+		fmt.Fprintf(w, "%sCreated:\t%s\n", indent, info.Created.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "%sTotal size:\t%s\n", indent, formatSize(info.Size))
+	if info.LastPushed != nil {
+		fmt.Fprintf(w, "%sLast pushed:\t%s\n", indent, formatTime(info.LastPushed))
+	}
+	if info.LastPulled != nil {
+		fmt.Fprintf(w, "%sLast pulled:\t%s\n", indent, formatTime(info.LastPulled))
+	}
+	w.Flush()
+
+	if len(info.Labels) > 0 {
+		fmt.Fprintf(out, "%sLabels:\n", indent)
+		keys := make([]string, 0, len(info.Labels))
+		for key := range info.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(out, "%s  %s=%s\n", indent, key, info.Labels[key])
+		}
+	}
+	if len(info.Layers) > 0 {
+		fmt.Fprintf(out, "%sLayers:\n", indent)
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, layer := range info.Layers {
+			fmt.Fprintf(w, "%s  %s\t%s\t%s\n", indent, layer.Digest, formatSize(layer.Size), layer.MediaType)
+		}
+		w.Flush()
+	}
+	if info.Signatures != nil {
+		fmt.Fprintf(out, "%sSignatures:\n", indent)
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, sig := range info.Signatures.Signatures {
+			result := "verified"
+			if !sig.Verified {
+				result = "unverified: " + sig.Error
+			}
+			fmt.Fprintf(w, "%s  %s\t%s\t%s\n", indent, sig.Digest, sig.Signer, result)
+		}
+		w.Flush()
+	}
+	if info.Scan != nil {
+		fmt.Fprintf(out, "%sScan:\t%s%s\n", indent, info.Scan.Status, formatScanSummary(info.Scan.Summary))
+	}
+	for i := range info.Manifests {
+		fmt.Fprintln(out)
+		printImageInfo(out, &info.Manifests[i], indent+"  ")
+	}
+}
+
+func formatScanSummary(summary map[string]int) string {
+	if len(summary) == 0 {
+		return ""
+	}
+	severities := make([]string, 0, len(summary))
+	for severity := range summary {
+		severities = append(severities, severity)
+	}
+	sort.Strings(severities)
+	parts := make([]string, len(severities))
+	for i, severity := range severities {
+		parts[i] = fmt.Sprintf("%s=%d", severity, summary[severity])
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// formatTime formats a time the registry may not have recorded, as "-" if not.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatPlatform(info *reg.ImageInfo) string {
+	parts := []string{info.Platform.OS, info.Platform.Architecture}
+	if info.Platform.Variant != "" {
+		parts = append(parts, info.Platform.Variant)
+	}
+	return strings.Join(parts, "/")
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/cobra"
+)
+
+// listen opens the server socket, accepting PROXY protocol v1 and v2 headers
+// when enabled so that handlers see the client address rather than the load
+// balancer's.
+func listen(cmd *cobra.Command, addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !getBool(cmd, "proxy-protocol") {
+		return ln, nil
+	}
+
+	var trusted []*net.IPNet
+	for _, cidr := range getStringSlice(cmd, "proxy-protocol-trusted") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %w", cidr, err)
+		}
+		trusted = append(trusted, ipNet)
+	}
+	// Trusting every peer would let any client spoof its address.
+	if len(trusted) == 0 {
+		ln.Close()
+		return nil, fmt.Errorf("--proxy-protocol needs the CIDRs of the load balancers in --proxy-protocol-trusted")
+	}
+	return &proxyproto.Listener{
+		Listener:          ln,
+		ReadHeaderTimeout: getDuration(cmd, "read-header-timeout"),
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			if tcpAddr, ok := opts.Upstream.(*net.TCPAddr); ok {
+				for _, ipNet := range trusted {
+					if ipNet.Contains(tcpAddr.IP) {
+						return proxyproto.USE, nil
+					}
+				}
+			}
+			// Untrusted peers may still connect directly, but cannot spoof
+			// their address with a header of their own.
+			return proxyproto.REJECT, nil
+		},
+	}, nil
+}
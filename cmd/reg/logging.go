@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+
+	"github.com/spf13/cobra"
+)
+
+// setupLogging installs the default slog logger from the --log-level and
+// --log-format flags, before any registry is created so that its startup is
+// logged the same way.
+func setupLogging(cmd *cobra.Command, w io.Writer) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getString(cmd, "log-level"))); err != nil {
+		log.Fatalf("Invalid log level %q, expected debug, info, warn or error", getString(cmd, "log-level"))
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := getString(cmd, "log-format"); format {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		log.Fatalf("Invalid log format %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+}
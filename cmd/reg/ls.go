@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newLsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls [repository]",
+		Short: "List repositories, or the tags of a repository, with counts and sizes",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runLs,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().Bool("s3", false, "Read from S3 instead of the local cache (repository sizes are not computed)")
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runLs(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	fromS3 := getBool(cmd, "s3")
+	var result any
+	if len(args) == 0 {
+		result, err = registry.RepositorySummaries(ctx, fromS3)
+	} else {
+		result, err = registry.TagSummaries(ctx, args[0], fromS3)
+	}
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Listing failed: %v", err)
+	}
+
+	if getBool(cmd, "json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	switch summaries := result.(type) {
+	case []reg.RepositorySummary:
+		fmt.Fprintln(w, "REPOSITORY\tTAGS\tSIZE")
+		for _, s := range summaries {
+			size := formatSize(s.Size)
+			if fromS3 {
+				size = "-"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\n", s.Repository, s.Tags, size)
+		}
+	case []reg.TagSummary:
+		fmt.Fprintln(w, "TAG\tDIGEST\tLAYERS\tSIZE\tPUSHED\tPULLED")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", s.Tag, s.Digest, s.Layers, formatSize(s.Size), formatTime(s.LastPushed), formatTime(s.LastPulled))
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newRmCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rm <repo>:<tag>|<repo>@<digest>...",
+		Short: "Delete tags, or manifests by digest together with the tags pointing at them",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runRm,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().BoolP("force", "f", false, "Do not ask for confirmation")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runRm(cmd *cobra.Command, args []string) {
+	type image struct{ repo, reference string }
+	images := make([]image, 0, len(args))
+	for _, arg := range args {
+		repo, reference, err := reg.ParseImageReference(arg)
+		if err != nil {
+			log.Fatalf("Invalid image: %v", err)
+		}
+		images = append(images, image{repo, reference})
+	}
+
+	if !getBool(cmd, "force") {
+		fmt.Printf("This will permanently delete:\n  %s\nContinue? [y/N] ", strings.Join(args, "\n  "))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Println("Aborted")
+			return
+		}
+	}
+
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	failed := false
+	for i, img := range images {
+		err := registry.Delete(ctx, img.repo, img.reference)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			fmt.Fprintf(os.Stderr, "%s: not found\n", args[i])
+			failed = true
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[i], err)
+			failed = true
+		default:
+			fmt.Printf("Deleted %s\n", args[i])
+		}
+	}
+	if failed {
+		registry.Close()
+		os.Exit(1)
+	}
+}
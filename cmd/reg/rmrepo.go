@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newRmRepoCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rm-repo <repository>...",
+		Short: "Delete whole repositories with all their tags, manifests and layer links",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runRmRepo,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().BoolP("force", "f", false, "Do not ask for confirmation")
+	cmd.Flags().Bool("gc", false, "Also delete blobs no other repository links to")
+	cmd.Flags().Duration("gc-grace-period", time.Hour, "Keep blobs written or referred to by a push this recently when collecting")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runRmRepo(cmd *cobra.Command, args []string) {
+	if !getBool(cmd, "force") {
+		fmt.Printf("This will permanently delete the repositories:\n  %s\nContinue? [y/N] ", strings.Join(args, "\n  "))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Println("Aborted")
+			return
+		}
+	}
+
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"), reg.WithGCGracePeriod(getDuration(cmd, "gc-grace-period")))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	failed := false
+	for _, repo := range args {
+		deletion, err := registry.DeleteRepository(ctx, repo)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			fmt.Fprintf(os.Stderr, "%s: not found\n", repo)
+			failed = true
+			continue
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", repo, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Deleted %s (%d tags, %d objects)\n", repo, deletion.Tags, deletion.Objects)
+
+		if getBool(cmd, "gc") {
+			collected, err := registry.CollectBlobs(ctx, deletion.Blobs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: failed to collect blobs: %v\n", repo, err)
+				failed = true
+			}
+			fmt.Printf("Deleted %d of %d blobs\n", collected, len(deletion.Blobs))
+		}
+	}
+	if failed {
+		registry.Close()
+		os.Exit(1)
+	}
+}
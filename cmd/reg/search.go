@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newSearchCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "search <query>...",
+		Short: "Search repositories, tags and image labels in the local cache",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   runSearch,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().IntP("limit", "n", 25, "Maximum number of results")
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runSearch(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	results, err := registry.Search(ctx, strings.Join(args, " "), getInt(cmd, "limit"), 0)
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Search failed: %v", err)
+	}
+
+	if getBool(cmd, "json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(results)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "REPOSITORY\tTAG\tARTIFACT TYPE\tLABELS")
+	for _, result := range results.Results {
+		labels := make([]string, 0, len(result.Labels))
+		for key, value := range result.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Repository, result.Tag, result.ArtifactType, strings.Join(labels, ","))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newStatsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show repository, tag, manifest, layer and upload counts from the local cache",
+		Args:  cobra.NoArgs,
+		Run:   runStats,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runStats(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	stats, err := registry.Stats(ctx)
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Failed to get stats: %v", err)
+	}
+
+	if getBool(cmd, "json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(stats)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "Repositories:\t%v\n", stats["repositories"])
+	fmt.Fprintf(w, "Tags:\t%v\n", stats["tags"])
+	fmt.Fprintf(w, "Manifests:\t%v\n", stats["manifests"])
+	fmt.Fprintf(w, "Layers:\t%v\n", stats["layers"])
+	if size, ok := stats["total_size_bytes"].(int64); ok {
+		fmt.Fprintf(w, "Total size:\t%s (%d bytes)\n", formatSize(size), size)
+	} else {
+		fmt.Fprintf(w, "Total size:\t%v bytes\n", stats["total_size_bytes"])
+	}
+	fmt.Fprintf(w, "Active uploads:\t%v\n", stats["active_uploads"])
+}
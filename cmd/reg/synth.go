@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/psarna/reg/pkg/plugin"
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newSynthCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "synth",
+		Short: "Plant a fake registry in the bucket, for benchmarking bootstrap, garbage collection and catalog listings at scale",
+		Long: `Plant a fake registry in the bucket, for benchmarking bootstrap, garbage
+collection and catalog listings at scale.
+
+Each repository gets --tags images, made of --base-layers layers picked from a
+pool of 16 shared by all repositories, a layer of --layer-size shared by the
+images of the repository, and a layer of --tag-layer-size of their own. Only
+the bucket is written; run "reg serve --bootstrap" against it to index it.`,
+		Args: cobra.NoArgs,
+		Run:  runSynth,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().Int("repos", 100, "Number of repositories")
+	cmd.Flags().Int("tags", 10, "Number of tags per repository")
+	cmd.Flags().String("layer-size", "5MB", "Size of the base and repository layers")
+	cmd.Flags().String("tag-layer-size", "64KB", "Size of the layer of each image")
+	cmd.Flags().Int("base-layers", 2, "Number of shared base layers per image, at most 16")
+	cmd.Flags().String("prefix", "synth", "Namespace of the repositories")
+	cmd.Flags().Int("concurrency", 16, "Number of repositories written concurrently")
+	cmd.Flags().String("storage-layout", string(reg.LayoutDistribution), "Layout of the bucket: distribution, or oci for an OCI image layout per repository")
+	cmd.Flags().String("storage-plugin", "", "Plugin binary storing the registry's objects in place of the S3 bucket")
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runSynth(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	opts := reg.SynthOptions{
+		Prefix:       getString(cmd, "prefix"),
+		Repos:        getInt(cmd, "repos"),
+		Tags:         getInt(cmd, "tags"),
+		BaseLayers:   getInt(cmd, "base-layers"),
+		LayerSize:    getSize(cmd, "layer-size"),
+		TagLayerSize: getSize(cmd, "tag-layer-size"),
+		Concurrency:  getInt(cmd, "concurrency"),
+	}
+
+	layout := getStorageLayout(cmd)
+	regOpts := []reg.Option{reg.WithStorageLayout(layout)}
+	if path := getString(cmd, "storage-plugin"); path != "" {
+		p, err := plugin.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to start storage plugin: %v", err)
+		}
+		defer p.Close()
+		storage, err := p.Storage()
+		if err != nil {
+			p.Close()
+			log.Fatalf("Failed to load storage plugin: %v", err)
+		}
+		regOpts = append(regOpts, reg.WithStoragePlugin(storage))
+	}
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"), regOpts...)
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	asJSON := getBool(cmd, "json")
+	if !asJSON {
+		fmt.Fprintf(os.Stderr, "Synthesizing %d repositories of %d tags, about %s of blobs\n",
+			opts.Repos, opts.Tags, formatSize(opts.EstimatedSize(layout)))
+	}
+	start := time.Now()
+	step := max(opts.Repos/20, 1)
+	result, err := registry.Synthesize(ctx, opts, func(p reg.SynthProgress) {
+		if !asJSON && (p.Repositories%step == 0 || p.Repositories == opts.Repos) {
+			fmt.Fprintf(os.Stderr, "%d/%d repositories, %d manifests, %s\n",
+				p.Repositories, opts.Repos, p.Manifests, formatSize(p.Bytes))
+		}
+	})
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Failed to synthesize registry: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			reg.SynthProgress
+			Seconds float64 `json:"seconds"`
+		}{result, elapsed.Seconds()})
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Repositories:\t%d\n", result.Repositories)
+	fmt.Fprintf(w, "Manifests:\t%d\n", result.Manifests)
+	fmt.Fprintf(w, "Blobs:\t%d\n", result.Blobs)
+	fmt.Fprintf(w, "Uploaded:\t%s (%d bytes)\n", formatSize(result.Bytes), result.Bytes)
+	fmt.Fprintf(w, "Elapsed:\t%s\n", elapsed.Round(time.Millisecond))
+	w.Flush()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/spf13/cobra"
+)
+
+func newVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify [repository...]",
+		Short: "Re-compute blob digests and report corrupt or missing blobs",
+		Long: "Download stored blobs and check their content against the digest in their key.\n" +
+			"Without repositories, every blob in the bucket is verified.",
+		Run: runVerify,
+	}
+	cmd.Flags().StringP("bucket", "b", "", "Bucket name (required)")
+	cmd.Flags().Int("concurrency", 8, "Number of blobs verified in parallel")
+	cmd.Flags().Bool("resume", false, "Skip blobs which passed a previous verification run")
+	cmd.Flags().Bool("json", false, "Print the result as JSON")
+	cmd.MarkFlagRequired("bucket")
+	return cmd
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	registry, err := reg.NewRegistry(ctx, getString(cmd, "bucket"))
+	if err != nil {
+		log.Fatalf("Failed to create registry: %v", err)
+	}
+	defer registry.Close()
+
+	result, err := registry.VerifyBlobs(ctx, reg.VerifyOptions{
+		Repositories: args,
+		Concurrency:  getInt(cmd, "concurrency"),
+		Resume:       getBool(cmd, "resume"),
+	})
+	if err != nil {
+		registry.Close()
+		log.Fatalf("Verification failed: %v", err)
+	}
+
+	if getBool(cmd, "json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	} else {
+		for _, m := range result.Mismatches {
+			fmt.Printf("%s\t%s\t%s\n", m.Digest, m.Key, m.Error)
+		}
+		fmt.Printf("verified: %d, skipped: %d, corrupt or missing: %d\n", result.Verified, result.Skipped, len(result.Mismatches))
+	}
+	if len(result.Mismatches) > 0 {
+		registry.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,308 @@
+//go:build e2e
+
+// Package e2e runs the registry against MinIO in a container, so that the S3
+// code paths the unit tests fake are exercised for real. It needs Docker:
+//
+//	go test -tags e2e ./e2e/
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/psarna/reg/pkg/reg"
+	"github.com/testcontainers/testcontainers-go/modules/minio"
+)
+
+const minioImage = "minio/minio:RELEASE.2025-04-22T22-12-26Z"
+
+var awsConfig aws.Config
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	container, err := minio.Run(ctx, minioImage)
+	if err != nil {
+		log.Fatalf("failed to start MinIO: %v", err)
+	}
+	endpoint, err := container.ConnectionString(ctx)
+	if err != nil {
+		log.Fatalf("failed to get MinIO endpoint: %v", err)
+	}
+	awsConfig = aws.Config{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider(container.Username, container.Password, ""),
+		BaseEndpoint: aws.String("http://" + endpoint),
+	}
+	code := m.Run()
+	if err := container.Terminate(ctx); err != nil {
+		log.Printf("failed to stop MinIO: %v", err)
+	}
+	os.Exit(code)
+}
+
+func s3Client() *s3.Client {
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = true
+	})
+}
+
+// newBucket creates a bucket of its own for the test.
+func newBucket(t *testing.T) string {
+	t.Helper()
+	bucket := strings.ToLower(strings.NewReplacer("/", "-", "_", "-").Replace(t.Name()))
+	bucket = fmt.Sprintf("%s-%d", bucket, time.Now().UnixNano())
+	if len(bucket) > 63 {
+		bucket = bucket[len(bucket)-63:]
+	}
+	bucket = strings.Trim(bucket, "-")
+	if _, err := s3Client().CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: &bucket}); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	return bucket
+}
+
+type server struct {
+	t        *testing.T
+	registry *reg.Registry
+	url      string
+}
+
+// startServer starts a registry on bucket with a database of its own.
+func startServer(t *testing.T, bucket string) *server {
+	t.Helper()
+	r, err := reg.New(context.Background(),
+		reg.WithBucket(bucket),
+		reg.WithAWSConfig(awsConfig),
+		reg.WithDatabase(filepath.Join(t.TempDir(), "registry.db")),
+	)
+	if err != nil {
+		t.Fatalf("failed to create registry: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	srv := httptest.NewServer(r.Handler())
+	t.Cleanup(srv.Close)
+	return &server{t: t, registry: r, url: srv.URL}
+}
+
+// do sends a request to the registry and, like a registry client, follows
+// redirects to the bucket.
+func (s *server) do(method string, path string, body []byte, header map[string]string) (*http.Response, []byte) {
+	s.t.Helper()
+	url := path
+	if strings.HasPrefix(path, "/") {
+		url = s.url + path
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatalf("failed to create request: %v", err)
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatalf("failed to read response of %s %s: %v", method, path, err)
+	}
+	return resp, data
+}
+
+func (s *server) expect(resp *http.Response, body []byte, status int, what string) {
+	s.t.Helper()
+	if resp.StatusCode != status {
+		s.t.Fatalf("%s: got %d, want %d: %s", what, resp.StatusCode, status, body)
+	}
+}
+
+func (s *server) location(resp *http.Response) string {
+	s.t.Helper()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		s.t.Fatalf("no Location in response to %s %s", resp.Request.Method, resp.Request.URL.Path)
+	}
+	return strings.TrimPrefix(location, s.url)
+}
+
+// pushBlob uploads data in chunks of chunkSize, in a single request when
+// chunkSize is 0.
+func (s *server) pushBlob(repo string, data []byte, chunkSize int) digest.Digest {
+	s.t.Helper()
+	dgst := digest.FromBytes(data)
+	resp, body := s.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repo), nil, nil)
+	s.expect(resp, body, http.StatusAccepted, "start upload")
+	location := s.location(resp)
+	rest := data
+	for chunkSize > 0 && len(rest) > chunkSize {
+		offset := len(data) - len(rest)
+		resp, body = s.do(http.MethodPatch, location, rest[:chunkSize], map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Content-Range": fmt.Sprintf("%d-%d", offset, offset+chunkSize-1),
+		})
+		s.expect(resp, body, http.StatusAccepted, "upload chunk")
+		location = s.location(resp)
+		rest = rest[chunkSize:]
+	}
+	sep := "?"
+	if strings.Contains(location, "?") {
+		sep = "&"
+	}
+	resp, body = s.do(http.MethodPut, location+sep+"digest="+dgst.String(), rest, map[string]string{"Content-Type": "application/octet-stream"})
+	s.expect(resp, body, http.StatusCreated, "complete upload")
+	return dgst
+}
+
+func (s *server) pushImage(repo string, tag string, layer []byte) digest.Digest {
+	s.t.Helper()
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	configDigest := s.pushBlob(repo, config, 0)
+	layerDigest := s.pushBlob(repo, layer, 0)
+	manifest := v1.Manifest{
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: configDigest, Size: int64(len(config))},
+		Layers:    []v1.Descriptor{{MediaType: v1.MediaTypeImageLayerGzip, Digest: layerDigest, Size: int64(len(layer))}},
+	}
+	manifest.SchemaVersion = 2
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		s.t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	resp, body := s.do(http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repo, tag), data,
+		map[string]string{"Content-Type": v1.MediaTypeImageManifest})
+	s.expect(resp, body, http.StatusCreated, "push manifest")
+	return digest.FromBytes(data)
+}
+
+func blobExists(t *testing.T, bucket string, dgst digest.Digest) bool {
+	t.Helper()
+	key := fmt.Sprintf("docker/registry/v2/blobs/%s/%s/%s/data", dgst.Algorithm(), dgst.Encoded()[:2], dgst.Encoded())
+	_, err := s3Client().HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+	return err == nil
+}
+
+func TestMultipartUpload(t *testing.T) {
+	s := startServer(t, newBucket(t))
+	// Two full parts and a short last one.
+	data := make([]byte, 10<<20+1234)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	dgst := s.pushBlob("e2e/multipart", data, 5<<20)
+
+	resp, body := s.do(http.MethodGet, fmt.Sprintf("/v2/e2e/multipart/blobs/%s", dgst), nil, nil)
+	s.expect(resp, body, http.StatusOK, "get blob")
+	if got := digest.FromBytes(body); got != dgst {
+		t.Fatalf("get blob: digest %s, want %s", got, dgst)
+	}
+}
+
+func TestPresignedRedirect(t *testing.T) {
+	bucket := newBucket(t)
+	s := startServer(t, bucket)
+	layer := []byte("presigned layer")
+	s.pushImage("e2e/presign", "v1", layer)
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirects.Get(fmt.Sprintf("%s/v2/e2e/presign/blobs/%s", s.url, digest.FromBytes(layer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		t.Fatalf("get blob: got %d, want a redirect", resp.StatusCode)
+	}
+	target := resp.Header.Get("Location")
+	if !strings.HasPrefix(target, *awsConfig.BaseEndpoint) || !strings.Contains(target, "X-Amz-Signature=") {
+		t.Fatalf("get blob: redirected to %s, want a presigned URL of the bucket", target)
+	}
+
+	resp, body := s.do(http.MethodGet, target, nil, nil)
+	s.expect(resp, body, http.StatusOK, "get presigned URL")
+	if !bytes.Equal(body, layer) {
+		t.Fatalf("get presigned URL: got %q, want %q", body, layer)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	bucket := newBucket(t)
+	s := startServer(t, bucket)
+	manifestDigest := s.pushImage("e2e/bootstrap", "v1", []byte("bootstrap layer"))
+	s.pushImage("e2e/bootstrap", "v2", []byte("another bootstrap layer"))
+
+	// A registry with an empty database learns the bucket's contents.
+	fresh := startServer(t, bucket)
+	if err := fresh.registry.Bootstrap(context.Background(), reg.BootstrapOptions{}); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	if status := fresh.registry.BootstrapStatus(); status.State != "completed" {
+		t.Fatalf("bootstrap: state %s", status.State)
+	}
+	resp, body := fresh.do(http.MethodGet, "/v2/e2e/bootstrap/tags/list", nil, nil)
+	fresh.expect(resp, body, http.StatusOK, "list tags")
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		t.Fatalf("list tags: %v: %s", err, body)
+	}
+	if strings.Join(list.Tags, ",") != "v1,v2" {
+		t.Fatalf("list tags: got %v, want v1 and v2", list.Tags)
+	}
+	resp, body = fresh.do(http.MethodHead, "/v2/e2e/bootstrap/manifests/v1", nil, map[string]string{"Accept": v1.MediaTypeImageManifest})
+	fresh.expect(resp, body, http.StatusOK, "head manifest")
+	if got := resp.Header.Get("Docker-Content-Digest"); got != manifestDigest.String() {
+		t.Fatalf("head manifest: digest %s, want %s", got, manifestDigest)
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	bucket := newBucket(t)
+	s := startServer(t, bucket)
+	shared := []byte("layer of both repositories")
+	own := []byte("layer of the deleted repository only")
+	s.pushImage("e2e/gc-keep", "v1", shared)
+	s.pushImage("e2e/gc-drop", "v1", shared)
+	s.pushImage("e2e/gc-drop", "v2", own)
+
+	ctx := context.Background()
+	deletion, err := s.registry.DeleteRepository(ctx, "e2e/gc-drop")
+	if err != nil {
+		t.Fatalf("delete repository: %v", err)
+	}
+	if deletion.Tags != 2 {
+		t.Fatalf("delete repository: deleted %d tags, want 2", deletion.Tags)
+	}
+	if _, err := s.registry.CollectBlobs(ctx, deletion.Blobs); err != nil {
+		t.Fatalf("collect blobs: %v", err)
+	}
+	if blobExists(t, bucket, digest.FromBytes(own)) {
+		t.Errorf("blob of the deleted repository only was not collected")
+	}
+	if !blobExists(t, bucket, digest.FromBytes(shared)) {
+		t.Errorf("blob still linked from another repository was collected")
+	}
+	resp, body := s.do(http.MethodGet, "/v2/e2e/gc-keep/manifests/v1", nil, map[string]string{"Accept": v1.MediaTypeImageManifest})
+	s.expect(resp, body, http.StatusOK, "get manifest of the kept repository")
+}
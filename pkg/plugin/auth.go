@@ -0,0 +1,70 @@
+package plugin
+
+import (
+	"context"
+
+	goplugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+)
+
+// AuthRequest is the part of a registry request an Auth driver sees.
+type AuthRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Empty for requests outside of a repository, like the catalog.
+	Repository string              `json:"repository,omitempty"`
+	Header     map[string][]string `json:"header"`
+	RemoteAddr string              `json:"remoteAddr"`
+}
+
+// Auth is an authentication provider, which tells who makes each registry
+// request. It returns an empty actor for anonymous requests it lets through,
+// ErrUnauthenticated to ask for credentials and ErrAccessDenied to deny the
+// request.
+type Auth interface {
+	Authenticate(ctx context.Context, req AuthRequest) (actor string, err error)
+}
+
+const authService = "reg.plugin.Auth"
+
+type authResponse struct {
+	Actor string `json:"actor,omitempty"`
+}
+
+var authServiceDesc = grpc.ServiceDesc{
+	ServiceName: authService,
+	HandlerType: (*Auth)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod(authService, "Authenticate", func(srv any, ctx context.Context, req *AuthRequest) (*authResponse, error) {
+			actor, err := srv.(Auth).Authenticate(ctx, *req)
+			return &authResponse{Actor: actor}, toStatus(err)
+		}),
+	},
+}
+
+type authClient struct {
+	conn *grpc.ClientConn
+}
+
+func (c *authClient) Authenticate(ctx context.Context, req AuthRequest) (string, error) {
+	resp, err := invoke[authResponse](ctx, c.conn, "/"+authService+"/Authenticate", &req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Actor, nil
+}
+
+// authPlugin plugs the auth service into go-plugin.
+type authPlugin struct {
+	goplugin.NetRPCUnsupportedPlugin
+	impl Auth
+}
+
+func (p *authPlugin) GRPCServer(broker *goplugin.GRPCBroker, s *grpc.Server) error {
+	s.RegisterService(&authServiceDesc, p.impl)
+	return nil
+}
+
+func (p *authPlugin) GRPCClient(ctx context.Context, broker *goplugin.GRPCBroker, conn *grpc.ClientConn) (any, error) {
+	return &authClient{conn: conn}, nil
+}
@@ -0,0 +1,224 @@
+// Package plugin lets storage backends and authentication providers ship as
+// separate binaries, which reg starts along with itself and talks to over
+// gRPC, so that the registry does not have to link every vendor SDK.
+//
+// A plugin is a program whose main function calls Serve with the drivers it
+// implements:
+//
+//	func main() {
+//		plugin.Serve(plugin.ServeConfig{Storage: newStorage()})
+//	}
+//
+// and which reg loads with --storage-plugin or --auth-plugin. Messages are
+// encoded as JSON rather than protobuf, so that plugins need nothing but
+// this package.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/hashicorp/go-hclog"
+	goplugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// Handshake is checked by both sides before reg talks to a plugin. The
+// protocol version is bumped on incompatible changes of the services.
+var Handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "REG_PLUGIN",
+	MagicCookieValue: "b3a7e0f2d95c4c1e8f6a2d7b0c9e4f15",
+}
+
+const (
+	storagePluginName = "storage"
+	authPluginName    = "auth"
+)
+
+var (
+	// ErrNotFound is returned for missing objects and uploads.
+	ErrNotFound = errors.New("not found")
+	// ErrPreconditionFailed is returned by Put when the object does not
+	// have the expected ETag.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrUnauthenticated is returned by Auth to ask the client for
+	// credentials.
+	ErrUnauthenticated = errors.New("authentication required")
+	// ErrAccessDenied is returned by Auth to deny an authenticated client.
+	ErrAccessDenied = errors.New("access denied")
+)
+
+// ServeConfig holds the drivers a plugin serves, either of which may be nil.
+type ServeConfig struct {
+	Storage Storage
+	Auth    Auth
+}
+
+// Serve serves the drivers to reg until it exits. It is meant to be called
+// from the plugin's main function.
+func Serve(config ServeConfig) {
+	plugins := goplugin.PluginSet{}
+	if config.Storage != nil {
+		plugins[storagePluginName] = &storagePlugin{impl: config.Storage}
+	}
+	if config.Auth != nil {
+		plugins[authPluginName] = &authPlugin{impl: config.Auth}
+	}
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         plugins,
+		GRPCServer:      goplugin.DefaultGRPCServer,
+	})
+}
+
+// Client is a running plugin.
+type Client struct {
+	client *goplugin.Client
+	rpc    goplugin.ClientProtocol
+}
+
+// Open starts the plugin binary at path with the given arguments.
+func Open(path string, args ...string) (*Client, error) {
+	client := goplugin.NewClient(&goplugin.ClientConfig{
+		HandshakeConfig: Handshake,
+		Plugins: goplugin.PluginSet{
+			storagePluginName: &storagePlugin{},
+			authPluginName:    &authPlugin{},
+		},
+		Cmd:              exec.Command(path, args...),
+		AllowedProtocols: []goplugin.Protocol{goplugin.ProtocolGRPC},
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Name:   "plugin",
+			Output: os.Stderr,
+			Level:  hclog.Info,
+		}),
+	})
+	rpc, err := client.Client()
+	if err != nil {
+		client.Kill()
+		return nil, fmt.Errorf("failed to start plugin %s: %w", path, err)
+	}
+	return &Client{client: client, rpc: rpc}, nil
+}
+
+// Storage returns the storage driver of the plugin.
+func (c *Client) Storage() (Storage, error) {
+	raw, err := c.rpc.Dispense(storagePluginName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load storage plugin: %w", err)
+	}
+	return raw.(Storage), nil
+}
+
+// Auth returns the authentication driver of the plugin.
+func (c *Client) Auth() (Auth, error) {
+	raw, err := c.rpc.Dispense(authPluginName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load auth plugin: %w", err)
+	}
+	return raw.(Auth), nil
+}
+
+// Close stops the plugin.
+func (c *Client) Close() {
+	c.client.Kill()
+}
+
+const codecName = "json"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return codecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// unaryMethod describes a method taking and returning a single message.
+func unaryMethod[Req, Resp any](service string, name string, handle func(srv any, ctx context.Context, req *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return handle(srv, ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + service + "/" + name}
+			return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+				return handle(srv, ctx, req.(*Req))
+			})
+		},
+	}
+}
+
+func invoke[Resp any](ctx context.Context, conn *grpc.ClientConn, method string, req any) (*Resp, error) {
+	resp := new(Resp)
+	if err := conn.Invoke(ctx, method, req, resp, grpc.CallContentSubtype(codecName)); err != nil {
+		return nil, fromStatus(err)
+	}
+	return resp, nil
+}
+
+var statusCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{ErrNotFound, codes.NotFound},
+	{ErrPreconditionFailed, codes.FailedPrecondition},
+	{ErrUnauthenticated, codes.Unauthenticated},
+	{ErrAccessDenied, codes.PermissionDenied},
+	{context.Canceled, codes.Canceled},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+}
+
+// toStatus carries the sentinel errors across the wire as status codes.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, s := range statusCodes {
+		if errors.Is(err, s.err) {
+			return status.Error(s.code, err.Error())
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// remoteError is an error returned by the plugin, wrapping the sentinel
+// error its status code stands for.
+type remoteError struct {
+	message string
+	err     error
+}
+
+func (e *remoteError) Error() string { return e.message }
+func (e *remoteError) Unwrap() error { return e.err }
+
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, s := range statusCodes {
+		if st.Code() == s.code {
+			return &remoteError{message: st.Message(), err: s.err}
+		}
+	}
+	return errors.New(st.Message())
+}
@@ -0,0 +1,437 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"time"
+
+	goplugin "github.com/hashicorp/go-plugin"
+	"google.golang.org/grpc"
+)
+
+// Object describes a stored object. ETags are opaque, but must change
+// whenever the object does.
+type Object struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// Part is a part of a multipart upload.
+type Part struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// ListResult is a page of keys sorted in lexical order. With a delimiter,
+// keys sharing a prefix up to the delimiter are rolled up into Prefixes.
+type ListResult struct {
+	Objects  []Object `json:"objects"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Passed back to List for the next page, empty on the last one.
+	NextToken string `json:"nextToken,omitempty"`
+}
+
+// Storage is a storage backend holding the registry's objects in place of an
+// S3 bucket. Keys are slash-separated paths. Missing objects and uploads are
+// reported with ErrNotFound, except by Delete which ignores them.
+type Storage interface {
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+	Stat(ctx context.Context, key string) (Object, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, Object, error)
+	// Put stores an object. A non-empty ifMatch makes the write fail with
+	// ErrPreconditionFailed unless the object exists with that ETag.
+	Put(ctx context.Context, key string, body io.Reader, ifMatch string) (Object, error)
+	Delete(ctx context.Context, keys ...string) error
+	List(ctx context.Context, prefix string, delimiter string, token string) (ListResult, error)
+	Copy(ctx context.Context, src string, dst string) (Object, error)
+
+	CreateUpload(ctx context.Context, key string) (uploadID string, err error)
+	UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.Reader) (etag string, err error)
+	ListParts(ctx context.Context, key string, uploadID string) ([]Part, error)
+	// CompleteUpload assembles the parts, in order, into the object.
+	CompleteUpload(ctx context.Context, key string, uploadID string, parts []Part) (Object, error)
+	AbortUpload(ctx context.Context, key string, uploadID string) error
+}
+
+const storageService = "reg.plugin.Storage"
+
+// Bodies are streamed in chunks well below the default gRPC message limit.
+const chunkSize = 1 << 20
+
+type keyRequest struct {
+	Key      string   `json:"key,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	UploadID string   `json:"uploadId,omitempty"`
+}
+
+type empty struct{}
+
+type listRequest struct {
+	Prefix    string `json:"prefix"`
+	Delimiter string `json:"delimiter,omitempty"`
+	Token     string `json:"token,omitempty"`
+}
+
+type copyRequest struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+type uploadResponse struct {
+	UploadID string `json:"uploadId,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+}
+
+type partsMessage struct {
+	Key      string `json:"key,omitempty"`
+	UploadID string `json:"uploadId,omitempty"`
+	Parts    []Part `json:"parts"`
+}
+
+// writeMessage opens the streams of Put and UploadPart, whose following
+// messages only carry data.
+type writeMessage struct {
+	Key        string `json:"key,omitempty"`
+	IfMatch    string `json:"ifMatch,omitempty"`
+	UploadID   string `json:"uploadId,omitempty"`
+	PartNumber int32  `json:"partNumber,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+}
+
+// readMessage opens the stream of Get with the object, the following ones
+// carry its data.
+type readMessage struct {
+	Object *Object `json:"object,omitempty"`
+	Data   []byte  `json:"data,omitempty"`
+}
+
+func storageMethod[Req, Resp any](name string, handle func(s Storage, ctx context.Context, req *Req) (*Resp, error)) grpc.MethodDesc {
+	return unaryMethod(storageService, name, func(srv any, ctx context.Context, req *Req) (*Resp, error) {
+		resp, err := handle(srv.(Storage), ctx, req)
+		return resp, toStatus(err)
+	})
+}
+
+var storageServiceDesc = grpc.ServiceDesc{
+	ServiceName: storageService,
+	HandlerType: (*Storage)(nil),
+	Methods: []grpc.MethodDesc{
+		storageMethod("Ping", func(s Storage, ctx context.Context, req *empty) (*empty, error) {
+			return &empty{}, s.Ping(ctx)
+		}),
+		storageMethod("Stat", func(s Storage, ctx context.Context, req *keyRequest) (*Object, error) {
+			obj, err := s.Stat(ctx, req.Key)
+			return &obj, err
+		}),
+		storageMethod("Delete", func(s Storage, ctx context.Context, req *keyRequest) (*empty, error) {
+			return &empty{}, s.Delete(ctx, req.Keys...)
+		}),
+		storageMethod("List", func(s Storage, ctx context.Context, req *listRequest) (*ListResult, error) {
+			result, err := s.List(ctx, req.Prefix, req.Delimiter, req.Token)
+			return &result, err
+		}),
+		storageMethod("Copy", func(s Storage, ctx context.Context, req *copyRequest) (*Object, error) {
+			obj, err := s.Copy(ctx, req.Src, req.Dst)
+			return &obj, err
+		}),
+		storageMethod("CreateUpload", func(s Storage, ctx context.Context, req *keyRequest) (*uploadResponse, error) {
+			uploadID, err := s.CreateUpload(ctx, req.Key)
+			return &uploadResponse{UploadID: uploadID}, err
+		}),
+		storageMethod("ListParts", func(s Storage, ctx context.Context, req *keyRequest) (*partsMessage, error) {
+			parts, err := s.ListParts(ctx, req.Key, req.UploadID)
+			return &partsMessage{Parts: parts}, err
+		}),
+		storageMethod("CompleteUpload", func(s Storage, ctx context.Context, req *partsMessage) (*Object, error) {
+			obj, err := s.CompleteUpload(ctx, req.Key, req.UploadID, req.Parts)
+			return &obj, err
+		}),
+		storageMethod("AbortUpload", func(s Storage, ctx context.Context, req *keyRequest) (*empty, error) {
+			return &empty{}, s.AbortUpload(ctx, req.Key, req.UploadID)
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Get", Handler: serveGet, ServerStreams: true},
+		{StreamName: "Put", Handler: serveWrite, ClientStreams: true},
+		{StreamName: "UploadPart", Handler: serveWrite, ClientStreams: true},
+	},
+}
+
+func serveGet(srv any, stream grpc.ServerStream) error {
+	var req keyRequest
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	body, obj, err := srv.(Storage).Get(stream.Context(), req.Key)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer body.Close()
+	if err := stream.SendMsg(&readMessage{Object: &obj}); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if err := stream.SendMsg(&readMessage{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return toStatus(err)
+		}
+	}
+}
+
+// serveWrite serves Put and UploadPart, handing the driver a reader of the
+// data as it arrives.
+func serveWrite(srv any, stream grpc.ServerStream) error {
+	var first writeMessage
+	if err := stream.RecvMsg(&first); err != nil {
+		return err
+	}
+	body, pw := io.Pipe()
+	go func() {
+		msg := first
+		for {
+			if len(msg.Data) > 0 {
+				if _, err := pw.Write(msg.Data); err != nil {
+					return
+				}
+			}
+			msg = writeMessage{}
+			if err := stream.RecvMsg(&msg); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	defer body.Close()
+
+	s := srv.(Storage)
+	ctx := stream.Context()
+	method, _ := grpc.Method(ctx)
+	var resp any
+	var err error
+	if method == "/"+storageService+"/UploadPart" {
+		var etag string
+		etag, err = s.UploadPart(ctx, first.Key, first.UploadID, first.PartNumber, body)
+		resp = &uploadResponse{ETag: etag}
+	} else {
+		var obj Object
+		obj, err = s.Put(ctx, first.Key, body, first.IfMatch)
+		resp = &obj
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+	return stream.SendMsg(resp)
+}
+
+// storageClient is the Storage reg talks to, forwarding calls to the plugin.
+type storageClient struct {
+	conn *grpc.ClientConn
+}
+
+func (c *storageClient) Ping(ctx context.Context) error {
+	_, err := invoke[empty](ctx, c.conn, "/"+storageService+"/Ping", &empty{})
+	return err
+}
+
+func (c *storageClient) Stat(ctx context.Context, key string) (Object, error) {
+	obj, err := invoke[Object](ctx, c.conn, "/"+storageService+"/Stat", &keyRequest{Key: key})
+	if err != nil {
+		return Object{}, err
+	}
+	return *obj, nil
+}
+
+func (c *storageClient) Get(ctx context.Context, key string) (io.ReadCloser, Object, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.conn.NewStream(ctx, &storageServiceDesc.Streams[0], "/"+storageService+"/Get", grpc.CallContentSubtype(codecName))
+	if err != nil {
+		cancel()
+		return nil, Object{}, fromStatus(err)
+	}
+	if err := stream.SendMsg(&keyRequest{Key: key}); err != nil {
+		cancel()
+		return nil, Object{}, fromStatus(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		cancel()
+		return nil, Object{}, fromStatus(err)
+	}
+	var first readMessage
+	if err := stream.RecvMsg(&first); err != nil || first.Object == nil {
+		cancel()
+		if err == nil || err == io.EOF {
+			return nil, Object{}, io.ErrUnexpectedEOF
+		}
+		return nil, Object{}, fromStatus(err)
+	}
+	return &streamReader{stream: stream, cancel: cancel}, *first.Object, nil
+}
+
+// streamReader reads the data messages of a Get stream.
+type streamReader struct {
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		var msg readMessage
+		if err := r.stream.RecvMsg(&msg); err != nil {
+			if err == io.EOF {
+				return 0, io.EOF
+			}
+			return 0, fromStatus(err)
+		}
+		r.buf = msg.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *streamReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// write streams body to Put or UploadPart, first is the opening message.
+func (c *storageClient) write(ctx context.Context, stream int, first *writeMessage, body io.Reader, resp any) error {
+	desc := &storageServiceDesc.Streams[stream]
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, err := c.conn.NewStream(ctx, desc, "/"+storageService+"/"+desc.StreamName, grpc.CallContentSubtype(codecName))
+	if err != nil {
+		return fromStatus(err)
+	}
+	if err := s.SendMsg(first); err != nil {
+		return c.sendError(s, err)
+	}
+	if body != nil {
+		buf := make([]byte, chunkSize)
+		for {
+			n, readErr := io.ReadFull(body, buf)
+			if n > 0 {
+				if err := s.SendMsg(&writeMessage{Data: buf[:n]}); err != nil {
+					return c.sendError(s, err)
+				}
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			}
+			if readErr != nil {
+				return readErr
+			}
+		}
+	}
+	if err := s.CloseSend(); err != nil {
+		return fromStatus(err)
+	}
+	return fromStatus(s.RecvMsg(resp))
+}
+
+// sendError returns the status of a stream the plugin ended early, which
+// SendMsg only reports as io.EOF.
+func (c *storageClient) sendError(s grpc.ClientStream, err error) error {
+	if err == io.EOF {
+		return fromStatus(s.RecvMsg(&empty{}))
+	}
+	return fromStatus(err)
+}
+
+func (c *storageClient) Put(ctx context.Context, key string, body io.Reader, ifMatch string) (Object, error) {
+	var obj Object
+	if err := c.write(ctx, 1, &writeMessage{Key: key, IfMatch: ifMatch}, body, &obj); err != nil {
+		return Object{}, err
+	}
+	return obj, nil
+}
+
+func (c *storageClient) UploadPart(ctx context.Context, key string, uploadID string, number int32, body io.Reader) (string, error) {
+	var resp uploadResponse
+	if err := c.write(ctx, 2, &writeMessage{Key: key, UploadID: uploadID, PartNumber: number}, body, &resp); err != nil {
+		return "", err
+	}
+	return resp.ETag, nil
+}
+
+func (c *storageClient) Delete(ctx context.Context, keys ...string) error {
+	_, err := invoke[empty](ctx, c.conn, "/"+storageService+"/Delete", &keyRequest{Keys: keys})
+	return err
+}
+
+func (c *storageClient) List(ctx context.Context, prefix string, delimiter string, token string) (ListResult, error) {
+	result, err := invoke[ListResult](ctx, c.conn, "/"+storageService+"/List", &listRequest{Prefix: prefix, Delimiter: delimiter, Token: token})
+	if err != nil {
+		return ListResult{}, err
+	}
+	return *result, nil
+}
+
+func (c *storageClient) Copy(ctx context.Context, src string, dst string) (Object, error) {
+	obj, err := invoke[Object](ctx, c.conn, "/"+storageService+"/Copy", &copyRequest{Src: src, Dst: dst})
+	if err != nil {
+		return Object{}, err
+	}
+	return *obj, nil
+}
+
+func (c *storageClient) CreateUpload(ctx context.Context, key string) (string, error) {
+	resp, err := invoke[uploadResponse](ctx, c.conn, "/"+storageService+"/CreateUpload", &keyRequest{Key: key})
+	if err != nil {
+		return "", err
+	}
+	return resp.UploadID, nil
+}
+
+func (c *storageClient) ListParts(ctx context.Context, key string, uploadID string) ([]Part, error) {
+	resp, err := invoke[partsMessage](ctx, c.conn, "/"+storageService+"/ListParts", &keyRequest{Key: key, UploadID: uploadID})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Parts, nil
+}
+
+func (c *storageClient) CompleteUpload(ctx context.Context, key string, uploadID string, parts []Part) (Object, error) {
+	obj, err := invoke[Object](ctx, c.conn, "/"+storageService+"/CompleteUpload", &partsMessage{Key: key, UploadID: uploadID, Parts: parts})
+	if err != nil {
+		return Object{}, err
+	}
+	return *obj, nil
+}
+
+func (c *storageClient) AbortUpload(ctx context.Context, key string, uploadID string) error {
+	_, err := invoke[empty](ctx, c.conn, "/"+storageService+"/AbortUpload", &keyRequest{Key: key, UploadID: uploadID})
+	return err
+}
+
+// storagePlugin plugs the storage service into go-plugin.
+type storagePlugin struct {
+	goplugin.NetRPCUnsupportedPlugin
+	impl Storage
+}
+
+func (p *storagePlugin) GRPCServer(broker *goplugin.GRPCBroker, s *grpc.Server) error {
+	s.RegisterService(&storageServiceDesc, p.impl)
+	return nil
+}
+
+func (p *storagePlugin) GRPCClient(ctx context.Context, broker *goplugin.GRPCBroker, conn *grpc.ClientConn) (any, error) {
+	return &storageClient{conn: conn}, nil
+}
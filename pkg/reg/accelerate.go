@@ -0,0 +1,34 @@
+package reg
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// transferEndpoint switches the requests carrying blob data, upload parts and
+// presigned downloads, to the Transfer Acceleration or dual-stack endpoints
+// when enabled. The other requests stay on the regional endpoint, which is
+// closer to the registry than the edge locations are.
+func (r *Registry) transferEndpoint(o *s3.Options) {
+	if r.s3Accelerate {
+		// Accelerate endpoints only serve virtual-hosted style requests.
+		o.UsePathStyle = false
+		o.UseAccelerate = true
+	}
+	if r.s3DualStack {
+		o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+	}
+}
+
+// checkTransferEndpoints disables the endpoint options S3 compatible stores
+// behind a custom endpoint do not have.
+func (r *Registry) checkTransferEndpoints() {
+	if !r.s3Accelerate && !r.s3DualStack {
+		return
+	}
+	if endpoint := r.s3Client.Options().BaseEndpoint; endpoint != nil {
+		r.logger.Warn("ignoring S3 accelerate and dual-stack endpoints, a custom endpoint is configured", "endpoint", *endpoint)
+		r.s3Accelerate = false
+		r.s3DualStack = false
+	}
+}
@@ -0,0 +1,656 @@
+package reg
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+)
+
+const eventStreamHeartbeat = 15 * time.Second
+
+func (h *Handler) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	repository := r.URL.Query().Get("repository")
+
+	events := h.registry.broadcaster.subscribe()
+	defer h.registry.broadcaster.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if repository != "" && event.Repository != repository {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				h.registry.logger.Error("error marshalling event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Action, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+type copyRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+func (h *Handler) copyImage(w http.ResponseWriter, r *http.Request) {
+	var req copyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid copy request: %v", err), http.StatusBadRequest)
+		return
+	}
+	srcRepo, srcRef, err := ParseImageReference(req.Source)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dstRepo, dstTag, err := ParseImageReference(req.Destination)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.registry.authorize(r.Context(), srcRepo, AccessPull)
+	if err == nil {
+		err = h.registry.authorize(r.Context(), dstRepo, AccessPush)
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error checking access", "error", err)
+		http.Error(w, fmt.Sprintf("error checking access: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	sha, err := h.registry.CopyImage(r.Context(), srcRepo, srcRef, dstRepo, dstTag)
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			writeError(w, http.StatusNotFound, errCodeManifestUnknown, err.Error())
+		case errors.Is(err, ErrTagImmutable), errors.Is(err, ErrPolicyDenied), errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrSignatureRequired):
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+		case errors.Is(err, ErrTagConflict), errors.Is(err, ErrTagLocked):
+			writeError(w, http.StatusConflict, errCodeDenied, err.Error())
+		case errors.Is(err, ErrProxyReadOnly):
+			writeError(w, http.StatusMethodNotAllowed, errCodeUnsupported, err.Error())
+		case errors.Is(err, ErrRepositoryNameReserved):
+			writeError(w, http.StatusBadRequest, errCodeNameInvalid, err.Error())
+		case errors.Is(err, ErrMediaTypeDenied), errors.Is(err, ErrForeignLayer):
+			writeError(w, http.StatusBadRequest, errCodeManifestInvalid, err.Error())
+		default:
+			h.registry.logger.Error("error copying image", "error", err)
+			http.Error(w, fmt.Sprintf("error copying image: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/manifests/%s", dstRepo, dstTag))
+	w.Header().Set("Docker-Content-Digest", sha.String())
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"repository": dstRepo, "tag": dstTag, "digest": sha.String()})
+}
+
+func (h *Handler) getBootstrapStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.registry.BootstrapStatus())
+}
+
+func (h *Handler) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.registry.Maintenance())
+}
+
+func (h *Handler) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceStatus
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid maintenance request: %v", err), http.StatusBadRequest)
+		return
+	}
+	h.registry.SetMaintenance(req.Enabled, time.Duration(req.RetryAfter)*time.Second)
+	h.registry.logger.Info("maintenance mode changed", "enabled", req.Enabled, "retryAfter", req.RetryAfter)
+	h.getMaintenance(w, r)
+}
+
+func (h *Handler) queryAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Repository: query.Get("repository"),
+		Actor:      query.Get("actor"),
+		Action:     AuditAction(query.Get("action")),
+	}
+	var err error
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(param); value != "" {
+			if *dst, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s, expected RFC 3339: %v", param, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if value := query.Get("last"); value != "" {
+		if filter.After, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid last: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("n"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid n: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := h.registry.QueryAudit(filter)
+	if err != nil {
+		h.registry.logger.Error("error querying audit log", "error", err)
+		http.Error(w, fmt.Sprintf("error querying audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (h *Handler) exportAudit(w http.ResponseWriter, r *http.Request) {
+	exported, err := h.registry.ExportAudit(r.Context())
+	if err != nil {
+		h.registry.logger.Error("error exporting audit log", "error", err)
+		http.Error(w, fmt.Sprintf("error exporting audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"exported": exported})
+}
+
+func (h *Handler) getAdminStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.registry.Stats(r.Context())
+	if err != nil {
+		h.registry.logger.Error("error getting registry stats", "error", err)
+		http.Error(w, fmt.Sprintf("error getting registry stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+	repositories, err := h.registry.RepositorySummaries(r.Context(), false)
+	if err != nil {
+		h.registry.logger.Error("error summarizing repositories", "error", err)
+		http.Error(w, fmt.Sprintf("error summarizing repositories: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if repositories == nil {
+		repositories = []RepositorySummary{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"registry":     stats,
+		"repositories": repositories,
+	})
+}
+
+func (h *Handler) getRepositoryStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	summary, err := h.registry.db.RepositorySummary(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, errCodeNameUnknown, fmt.Sprintf("repository %s not found", name))
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error summarizing repository", "error", err)
+		http.Error(w, fmt.Sprintf("error summarizing repository: %v", err), http.StatusInternalServerError)
+		return
+	}
+	tags, err := h.registry.TagSummaries(r.Context(), name, false)
+	if err != nil {
+		h.registry.logger.Error("error summarizing tags", "error", err)
+		http.Error(w, fmt.Sprintf("error summarizing tags: %v", err), http.StatusInternalServerError)
+		return
+	}
+	usage, err := h.registry.RepositoryUsage(name)
+	if err != nil {
+		h.registry.logger.Error("error getting repository usage", "error", err)
+		http.Error(w, fmt.Sprintf("error getting repository usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if usage == nil {
+		usage = []UsageSummary{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"repository": summary,
+		"tags":       tags,
+		"usage":      usage,
+	})
+}
+
+func (h *Handler) getCache(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	repo := query.Get("repository")
+	if repo == "" {
+		http.Error(w, "missing repository", http.StatusBadRequest)
+		return
+	}
+	cached, err := h.registry.CachedTags(repo, query.Get("tag"))
+	if err != nil {
+		h.registry.logger.Error("error inspecting cache", "error", err)
+		http.Error(w, fmt.Sprintf("error inspecting cache: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"repository": repo,
+		"cached":     len(cached) > 0,
+		"tags":       cached,
+	})
+}
+
+func (h *Handler) evictCache(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	tag := r.URL.Query().Get("tag")
+
+	if err := h.registry.Evict(name, tag); err != nil {
+		h.registry.logger.Error("error evicting cache", "error", err)
+		http.Error(w, fmt.Sprintf("error evicting cache: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.registry.logger.Info("cache evicted", "repository", name, "tag", tag)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) resyncCache(w http.ResponseWriter, r *http.Request) {
+	var opts ResyncOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, fmt.Sprintf("invalid resync request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	err := h.registry.Resync(opts)
+	if errors.Is(err, ErrBootstrapRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error starting resync", "error", err)
+		http.Error(w, fmt.Sprintf("error starting resync: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.registry.logger.Info("cache resync started", "prefix", opts.Prefix, "include", opts.Include, "exclude", opts.Exclude)
+	w.Header().Set("Location", h.absoluteURL(r, "/admin/bootstrap"))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) deleteRepository(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	gc := r.URL.Query().Get("gc") == "true"
+
+	deletion, err := h.registry.DeleteRepository(r.Context(), name)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, errCodeNameUnknown, fmt.Sprintf("repository %s not found", name))
+		return
+	}
+	if errors.Is(err, ErrPolicyDenied) {
+		writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error deleting repository", "error", err)
+		http.Error(w, fmt.Sprintf("error deleting repository: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.registry.logger.Info("repository deleted", "repository", name, "tags", deletion.Tags, "objects", deletion.Objects)
+
+	if gc {
+		go func() {
+			collected, err := h.registry.CollectBlobs(context.Background(), deletion.Blobs)
+			if err != nil {
+				h.registry.logger.Error("error collecting blobs", "repository", name, "error", err)
+			}
+			h.registry.logger.Info("blobs collected", "repository", name, "candidates", len(deletion.Blobs), "deleted", collected)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"repository":  deletion.Repository,
+		"tags":        deletion.Tags,
+		"objects":     deletion.Objects,
+		"uploads":     deletion.Uploads,
+		"gcScheduled": gc,
+	})
+}
+
+func (h *Handler) listNamespaces(w http.ResponseWriter, r *http.Request) {
+	namespaces, err := h.registry.Namespaces()
+	if err != nil {
+		h.registry.logger.Error("error listing namespaces", "error", err)
+		http.Error(w, fmt.Sprintf("error listing namespaces: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(namespaces)
+}
+
+func (h *Handler) getNamespace(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path := vars["path"]
+
+	ns, err := h.registry.Namespace(path)
+	switch {
+	case errors.Is(err, ErrInvalidNamespace):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, fmt.Sprintf("namespace %s has no settings", path), http.StatusNotFound)
+		return
+	case err != nil:
+		h.registry.logger.Error("error getting namespace", "error", err)
+		http.Error(w, fmt.Sprintf("error getting namespace: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ns)
+}
+
+func (h *Handler) putNamespace(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path := vars["path"]
+
+	var settings NamespaceSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, fmt.Sprintf("invalid namespace settings: %v", err), http.StatusBadRequest)
+		return
+	}
+	ns, err := h.registry.SetNamespace(path, settings)
+	if errors.Is(err, ErrInvalidNamespace) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error setting namespace", "error", err)
+		http.Error(w, fmt.Sprintf("error setting namespace: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.registry.logger.Info("namespace settings changed", "path", path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ns)
+}
+
+func (h *Handler) deleteNamespace(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path := vars["path"]
+
+	err := h.registry.DeleteNamespace(path)
+	switch {
+	case errors.Is(err, ErrInvalidNamespace):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, fmt.Sprintf("namespace %s has no settings", path), http.StatusNotFound)
+		return
+	case err != nil:
+		h.registry.logger.Error("error deleting namespace", "error", err)
+		http.Error(w, fmt.Sprintf("error deleting namespace: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.registry.logger.Info("namespace settings deleted", "path", path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getRepositorySettings(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	settings, err := h.registry.RepositorySettings(name)
+	if err != nil {
+		h.registry.logger.Error("error resolving repository settings", "error", err)
+		http.Error(w, fmt.Sprintf("error resolving repository settings: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *Handler) applyRetention(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	apply := h.registry.ApplyRetention
+	if dryRun {
+		apply = h.registry.PlanRetention
+	}
+	result, err := apply(r.Context())
+	if err != nil {
+		h.registry.logger.Error("error applying retention", "error", err)
+		http.Error(w, fmt.Sprintf("error applying retention: %v", err), http.StatusInternalServerError)
+		return
+	}
+	h.registry.logger.Info("retention applied", "repositories", result.Repositories, "deleted", len(result.Deleted), "expired", len(result.Expired), "dryRun", dryRun)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) getPopular(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := PopularityFilter{
+		Repository: query.Get("repository"),
+		OrderBy:    query.Get("by"),
+		Limit:      20,
+	}
+	if filter.OrderBy == "" {
+		filter.OrderBy = "pulls"
+	}
+	if filter.OrderBy != "pulls" && filter.OrderBy != "pushes" {
+		http.Error(w, "invalid by, expected pulls or pushes", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid since, expected RFC 3339: %v", err), http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if value := query.Get("n"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+
+	popular, err := h.registry.Popular(filter)
+	if err != nil {
+		h.registry.logger.Error("error ranking repositories", "error", err)
+		http.Error(w, fmt.Sprintf("error ranking repositories: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if popular == nil {
+		popular = []UsageSummary{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(popular)
+}
+
+func (h *Handler) getSignatureStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	reference := r.URL.Query().Get("reference")
+	if reference == "" {
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	}
+
+	status, err := h.registry.NotationStatus(r.Context(), name, reference)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("manifest not found: %s:%s", name, reference), http.StatusNotFound)
+			return
+		}
+		h.registry.logger.Error("error verifying signatures", "error", err)
+		http.Error(w, fmt.Sprintf("error verifying signatures: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *Handler) getScan(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	reference := r.URL.Query().Get("reference")
+	if reference == "" {
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.registry.ScanResult(r.Context(), name, reference)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("manifest not found: %s:%s", name, reference), http.StatusNotFound)
+			return
+		}
+		h.registry.logger.Error("error getting scan", "error", err)
+		http.Error(w, fmt.Sprintf("error getting scan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if result == nil {
+		http.Error(w, fmt.Sprintf("no scan for %s:%s", name, reference), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) rescan(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	reference := r.URL.Query().Get("reference")
+	if reference == "" {
+		http.Error(w, "reference is required", http.StatusBadRequest)
+		return
+	}
+	if h.registry.scans == nil {
+		http.Error(w, "no scanner configured", http.StatusConflict)
+		return
+	}
+
+	result, err := h.registry.Rescan(r.Context(), name, reference)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("manifest not found: %s:%s", name, reference), http.StatusNotFound)
+			return
+		}
+		h.registry.logger.Error("error queueing scan", "error", err)
+		http.Error(w, fmt.Sprintf("error queueing scan: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) getLayerUsage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	dgst, err := digest.Parse(vars["digest"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+
+	usage, err := h.registry.LayerUsage(dgst)
+	if err != nil {
+		if errors.Is(err, ErrLayerUnknown) {
+			writeError(w, http.StatusNotFound, errCodeBlobUnknown, err.Error())
+			return
+		}
+		h.registry.logger.Error("error getting layer usage", "error", err)
+		http.Error(w, fmt.Sprintf("error getting layer usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+func (h *Handler) getDedupReport(w http.ResponseWriter, r *http.Request) {
+	top := 10
+	if value := r.URL.Query().Get("n"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid n", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+
+	report, err := h.registry.DedupReport(top)
+	if err != nil {
+		h.registry.logger.Error("error computing dedup report", "error", err)
+		http.Error(w, fmt.Sprintf("error computing dedup report: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *Handler) getRepositoryStorage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	storage, err := h.registry.RepositoryStorage(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, errCodeNameUnknown, fmt.Sprintf("repository %s not found", name))
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error computing repository storage", "error", err)
+		http.Error(w, fmt.Sprintf("error computing repository storage: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(storage)
+}
@@ -0,0 +1,167 @@
+package reg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// imageArchive gives random access to the files of an image layout, either
+// unpacked in a directory or inside a (possibly gzipped) tarball.
+type imageArchive interface {
+	open(name string) (io.ReadCloser, int64, error)
+	Close() error
+}
+
+func openImageArchive(archivePath string) (imageArchive, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dirArchive{root: archivePath}, nil
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	magic, err := bufio.NewReader(file).Peek(2)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", archivePath, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return newTarArchive(file, "")
+	}
+
+	// Tar entries are read at arbitrary offsets, which needs the
+	// decompressed stream on disk.
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", archivePath, err)
+	}
+	tmp, err := os.CreateTemp("", "reg-import-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tmp, gz); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to decompress %s: %w", archivePath, err)
+	}
+	return newTarArchive(tmp, tmp.Name())
+}
+
+type dirArchive struct {
+	root string
+}
+
+func (a *dirArchive) open(name string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(filepath.Join(a.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (a *dirArchive) Close() error {
+	return nil
+}
+
+type tarEntry struct {
+	offset int64
+	size   int64
+	link   string
+}
+
+type tarArchive struct {
+	file    *os.File
+	temp    string
+	entries map[string]tarEntry
+}
+
+func newTarArchive(file *os.File, temp string) (*tarArchive, error) {
+	a := &tarArchive{file: file, temp: temp, entries: make(map[string]tarEntry)}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		a.Close()
+		return nil, err
+	}
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to read tar archive: %w", err)
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			offset, err := file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				a.Close()
+				return nil, err
+			}
+			a.entries[name] = tarEntry{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			a.entries[name] = tarEntry{link: path.Join(path.Dir(name), hdr.Linkname)}
+		case tar.TypeLink:
+			a.entries[name] = tarEntry{link: path.Clean(hdr.Linkname)}
+		}
+	}
+}
+
+func (a *tarArchive) open(name string) (io.ReadCloser, int64, error) {
+	name = path.Clean(name)
+	for range 16 {
+		entry, ok := a.entries[name]
+		if !ok {
+			return nil, 0, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		if entry.link == "" {
+			return io.NopCloser(io.NewSectionReader(a.file, entry.offset, entry.size)), entry.size, nil
+		}
+		name = entry.link
+	}
+	return nil, 0, fmt.Errorf("%s: too many links", name)
+}
+
+func (a *tarArchive) Close() error {
+	err := a.file.Close()
+	if a.temp != "" {
+		err = errors.Join(err, os.Remove(a.temp))
+	}
+	return err
+}
+
+func readArchiveFile(archive imageArchive, name string) ([]byte, error) {
+	body, _, err := archive.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
@@ -0,0 +1,179 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type AuditAction string
+
+const (
+	AuditManifestPush   AuditAction = "manifest.push"
+	AuditManifestDelete AuditAction = "manifest.delete"
+	AuditTagDelete      AuditAction = "tag.delete"
+	AuditImageCopy      AuditAction = "image.copy"
+	AuditUploadStart    AuditAction = "upload.start"
+	AuditUploadComplete AuditAction = "upload.complete"
+	AuditUploadCancel   AuditAction = "upload.cancel"
+	AuditRepoDelete     AuditAction = "repository.delete"
+	// The reference of a mount is the repository the blob was mounted from.
+	AuditBlobMount AuditAction = "blob.mount"
+)
+
+const (
+	auditExportPrefix    = "audit/"
+	auditExportBatchSize = 10000
+)
+
+type AuditEntry struct {
+	ID         int64       `db:"id" json:"id"`
+	Timestamp  time.Time   `db:"timestamp" json:"timestamp"`
+	Action     AuditAction `db:"action" json:"action"`
+	Actor      string      `db:"actor" json:"actor,omitempty"`
+	Addr       string      `db:"addr" json:"addr,omitempty"`
+	Repository string      `db:"repository" json:"repository"`
+	Reference  string      `db:"reference" json:"reference,omitempty"`
+	Digest     string      `db:"digest" json:"digest,omitempty"`
+}
+
+type AuditFilter struct {
+	Repository string
+	Actor      string
+	Action     AuditAction
+	Since      time.Time
+	Until      time.Time
+	// After is the ID of the last entry already seen, for pagination.
+	After int64
+	Limit int
+}
+
+// auditLog mirrors every audit entry as a JSON line to out, on top of the
+// audit_log table, and periodically exports the table to S3 when configured.
+type auditLog struct {
+	mu  sync.Mutex
+	out io.Writer
+
+	exportInterval time.Duration
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+}
+
+func (r *Registry) audit(ctx context.Context, action AuditAction, repo string, reference string, dgst string) {
+	info := requestInfoFrom(ctx)
+	entry := AuditEntry{
+		Timestamp:  time.Now().UTC(),
+		Action:     action,
+		Actor:      info.Actor,
+		Addr:       info.Addr,
+		Repository: repo,
+		Reference:  reference,
+		Digest:     dgst,
+	}
+	id, err := r.db.RecordAudit(entry)
+	if err != nil {
+		r.logger.Error("error recording audit entry", "action", action, "repository", repo, "error", err)
+	}
+	entry.ID = id
+
+	if r.auditLog.out == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		r.logger.Error("error marshalling audit entry", "error", err)
+		return
+	}
+	r.auditLog.mu.Lock()
+	defer r.auditLog.mu.Unlock()
+	if _, err := r.auditLog.out.Write(append(line, '\n')); err != nil {
+		r.logger.Error("error writing audit file", "error", err)
+	}
+}
+
+func (r *Registry) QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	return r.db.QueryAudit(filter)
+}
+
+// ExportAudit uploads audit entries not exported yet to the bucket as JSON
+// lines objects under audit/, returning how many entries were exported.
+func (r *Registry) ExportAudit(ctx context.Context) (int, error) {
+	exported := 0
+	for {
+		entries, err := r.db.UnexportedAudit(auditExportBatchSize)
+		if err != nil {
+			return exported, err
+		}
+		if len(entries) == 0 {
+			return exported, nil
+		}
+
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return exported, fmt.Errorf("failed to marshal audit entry: %w", err)
+			}
+		}
+		first, last := entries[0], entries[len(entries)-1]
+		key := fmt.Sprintf("%s%s/%020d-%020d.jsonl", auditExportPrefix, first.Timestamp.Format("2006-01-02"), first.ID, last.ID)
+		_, err = r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &r.bucket,
+			Key:    &key,
+			Body:   bytes.NewReader(buf.Bytes()),
+		}, forcePathStyle)
+		if err != nil {
+			return exported, fmt.Errorf("failed to upload audit export: %w", err)
+		}
+		if err := r.db.MarkAuditExported(first.ID, last.ID); err != nil {
+			return exported, err
+		}
+		exported += len(entries)
+	}
+}
+
+func (r *Registry) startAuditExport() {
+	interval := r.auditLog.exportInterval
+	if interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.auditLog.cancel = cancel
+	r.auditLog.wg.Add(1)
+	go func() {
+		defer r.auditLog.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !r.isLeader() {
+				continue
+			}
+			if n, err := r.ExportAudit(ctx); err != nil {
+				r.logger.Error("error exporting audit log", "error", err)
+			} else if n > 0 {
+				r.logger.Info("exported audit log", "entries", n)
+			}
+		}
+	}()
+}
+
+func (a *auditLog) stop() {
+	if a.cancel != nil {
+		a.cancel()
+		a.wg.Wait()
+	}
+}
@@ -0,0 +1,174 @@
+package reg
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd holds bcrypt credentials in the format written by
+// `htpasswd -B`.
+type Htpasswd struct {
+	users map[string][]byte
+
+	// bcrypt is slow by design and clients authenticate every request, so
+	// passwords which matched once are remembered by their SHA-256.
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open htpasswd file: %w", err)
+	}
+	defer f.Close()
+
+	h := &Htpasswd{users: make(map[string][]byte), verified: make(map[string][sha256.Size]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid htpasswd entry on line %d", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd entry for %s on line %d is not a bcrypt hash", user, line)
+		}
+		h.users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %w", err)
+	}
+	return h, nil
+}
+
+func (h *Htpasswd) Authenticate(user string, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(password))
+	h.mu.Lock()
+	known, cached := h.verified[user]
+	h.mu.Unlock()
+	if cached && subtle.ConstantTimeCompare(known[:], sum[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	h.mu.Lock()
+	h.verified[user] = sum
+	h.mu.Unlock()
+	return true
+}
+
+func (r *Registry) anonymousPullAllowed(repo string) bool {
+	for _, pattern := range r.anonymousPull {
+		if pattern.matchesRepo(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// htpasswdAuth is the AuthFunc of WithHtpasswd, which lets pulls from
+// repositories open to anonymous pulls through without credentials.
+func (r *Registry) htpasswdAuth(req *http.Request) (string, error) {
+	if user, password, ok := req.BasicAuth(); ok {
+		if !r.htpasswd.Authenticate(user, password) {
+			return "", fmt.Errorf("%w: invalid credentials", ErrUnauthenticated)
+		}
+		return user, nil
+	}
+	name := mux.Vars(req)["name"]
+	pull := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if name != "" && pull && r.anonymousPullAllowed(name) {
+		return "", nil
+	}
+	return "", ErrUnauthenticated
+}
+
+func writeAuthChallenge(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="reg"`)
+	writeError(w, http.StatusUnauthorized, errCodeUnauthorized, message)
+}
+
+// adminMiddleware lets authenticated actors, restricted to the admins when
+// any are set, use the admin API. Without an authenticator nobody can.
+func (h *Handler) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.registry.auth == nil {
+			writeError(w, http.StatusForbidden, errCodeDenied, "the admin API needs an authenticator")
+			return
+		}
+		actor := requestInfoFrom(r.Context()).Actor
+		switch {
+		case actor == "":
+			writeAuthChallenge(w, ErrUnauthenticated.Error())
+		case len(h.registry.admins) > 0 && !slices.Contains(h.registry.admins, actor):
+			writeError(w, http.StatusForbidden, errCodeDenied, fmt.Sprintf("%q is not an admin", actor))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// registryWideMiddleware keeps listings which span every repository, and so
+// cannot leave out those an actor may not pull, to admins once requests are
+// authenticated.
+func (h *Handler) registryWideMiddleware(next http.Handler) http.Handler {
+	admin := h.adminMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.registry.auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		admin.ServeHTTP(w, r)
+	})
+}
+
+// authMiddleware authenticates every registry request with the configured
+// AuthFunc, and records the actor it returns.
+func (h *Handler) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := h.registry.auth
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		actor, err := auth(r)
+		switch {
+		case errors.Is(err, ErrUnauthenticated):
+			writeAuthChallenge(w, err.Error())
+			return
+		case errors.Is(err, ErrAccessDenied):
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+			return
+		case err != nil:
+			h.registry.logger.Error("error authenticating request", "error", err)
+			http.Error(w, fmt.Sprintf("error authenticating request: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if actor != "" {
+			info := requestInfoFrom(r.Context())
+			info.Actor = actor
+			r = r.WithContext(withRequestInfo(r.Context(), info))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
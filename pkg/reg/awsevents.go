@@ -0,0 +1,104 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+type SNSSink struct {
+	client   *sns.Client
+	topicARN string
+	fifo     bool
+}
+
+func NewSNSSink(cfg aws.Config, topicARN string) *SNSSink {
+	return &SNSSink{
+		client:   sns.NewFromConfig(cfg),
+		topicARN: topicARN,
+		fifo:     strings.HasSuffix(topicARN, ".fifo"),
+	}
+}
+
+func (s *SNSSink) Name() string {
+	return "sns " + s.topicARN
+}
+
+func (s *SNSSink) Send(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	input := &sns.PublishInput{
+		TopicArn: &s.topicARN,
+		Message:  aws.String(string(data)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"action":     {DataType: aws.String("String"), StringValue: aws.String(string(event.Action))},
+			"repository": {DataType: aws.String("String"), StringValue: aws.String(event.Repository)},
+		},
+	}
+	if s.fifo {
+		input.MessageGroupId = aws.String(event.Repository)
+		input.MessageDeduplicationId = aws.String(event.ID)
+	}
+	if _, err := s.client.Publish(ctx, input); err != nil {
+		return fmt.Errorf("failed to publish event to SNS: %w", err)
+	}
+	return nil
+}
+
+func (s *SNSSink) Close() error {
+	return nil
+}
+
+type SQSSink struct {
+	client   *sqs.Client
+	queueURL string
+	fifo     bool
+}
+
+func NewSQSSink(cfg aws.Config, queueURL string) *SQSSink {
+	return &SQSSink{
+		client:   sqs.NewFromConfig(cfg),
+		queueURL: queueURL,
+		fifo:     strings.HasSuffix(queueURL, ".fifo"),
+	}
+}
+
+func (s *SQSSink) Name() string {
+	return "sqs " + s.queueURL
+}
+
+func (s *SQSSink) Send(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	input := &sqs.SendMessageInput{
+		QueueUrl:    &s.queueURL,
+		MessageBody: aws.String(string(data)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"action":     {DataType: aws.String("String"), StringValue: aws.String(string(event.Action))},
+			"repository": {DataType: aws.String("String"), StringValue: aws.String(event.Repository)},
+		},
+	}
+	if s.fifo {
+		input.MessageGroupId = aws.String(event.Repository)
+		input.MessageDeduplicationId = aws.String(event.ID)
+	}
+	if _, err := s.client.SendMessage(ctx, input); err != nil {
+		return fmt.Errorf("failed to send event to SQS: %w", err)
+	}
+	return nil
+}
+
+func (s *SQSSink) Close() error {
+	return nil
+}
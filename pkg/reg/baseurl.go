@@ -0,0 +1,66 @@
+package reg
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// absoluteURL builds a URL pointing back at the registry as the client sees
+// it: the configured public URL if there is one, otherwise the scheme and host
+// reported by a trusted fronting proxy, falling back to the request itself.
+func (h *Handler) absoluteURL(r *http.Request, format string, args ...any) string {
+	return h.baseURL(r) + fmt.Sprintf(format, args...)
+}
+
+func (h *Handler) baseURL(r *http.Request) string {
+	if public := h.registry.publicURL; public != nil {
+		return strings.TrimSuffix(public.String(), "/")
+	}
+	host := r.Host
+	if forwardedHost := h.registry.forwardedValue(r, "X-Forwarded-Host"); forwardedHost != "" {
+		host = forwardedHost
+	}
+	return h.registry.requestScheme(r) + "://" + host
+}
+
+// requestScheme returns the scheme the client used, which a trusted proxy
+// reports unless the registry serves the client itself.
+func (r *Registry) requestScheme(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	switch proto := strings.ToLower(r.forwardedValue(req, "X-Forwarded-Proto")); proto {
+	case "http", "https":
+		scheme = proto
+	}
+	return scheme
+}
+
+// forwardedValue returns a header set by a fronting proxy, only believed from
+// the proxies set with WithTrustedProxies, as any client may send it. Proxies
+// chained in front of each other append to the header, the first value is the
+// one the client used.
+func (r *Registry) forwardedValue(req *http.Request, header string) string {
+	if !r.fromTrustedProxy(req) {
+		return ""
+	}
+	value, _, _ := strings.Cut(req.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
+
+func (r *Registry) fromTrustedProxy(req *http.Request) bool {
+	addr, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := addr.Addr().Unmap()
+	for _, network := range r.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
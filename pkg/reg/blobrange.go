@@ -0,0 +1,89 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// setBlobHeaders sets the headers of a blob served by the registry itself,
+// before http.ServeContent answers Range requests for it. Blobs never change,
+// so their digest is the strong ETag If-Range is checked against.
+func setBlobHeaders(w http.ResponseWriter, r *http.Request, dgst string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst)
+	w.Header().Set("ETag", `"`+dgst+`"`)
+	setDigestFields(w, r, dgst)
+	// Content-Digest is of the bytes sent, which may only be part of the blob.
+	if r.Header.Get("Range") != "" {
+		w.Header().Del(headerContentDigest)
+	}
+}
+
+// blobRangeReader reads a blob from wherever it was last seeked to, with a
+// ranged GET, so that ranges of blobs are served without reading them whole.
+type blobRangeReader struct {
+	ctx      context.Context
+	registry *Registry
+	repo     string
+	digest   digest.Digest
+	size     int64
+
+	offset int64
+	body   io.ReadCloser
+	// The first error reading the blob, once headers are sent and it can
+	// only be logged.
+	err error
+}
+
+func (b *blobRangeReader) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		body, _, err := b.registry.openBlobFrom(b.ctx, b.repo, b.digest, b.offset)
+		if err != nil {
+			b.err = err
+			return 0, err
+		}
+		b.body = body
+	}
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *blobRangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != b.offset {
+		b.Close()
+		b.offset = offset
+	}
+	return offset, nil
+}
+
+func (b *blobRangeReader) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
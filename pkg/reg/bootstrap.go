@@ -0,0 +1,367 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+type BootstrapOptions struct {
+	// Prefix limits bootstrap to repositories whose name starts with it.
+	Prefix  string
+	Include []string
+	Exclude []string
+	// ListConcurrency is the number of top-level repository prefixes listed
+	// in parallel.
+	ListConcurrency int
+}
+
+const (
+	defaultBootstrapListConcurrency = 8
+	bootstrapBatchSize              = 256
+	bootstrapFlushInterval          = time.Second
+)
+
+// bootstrapper loads the manifest of every tag link it is handed into the
+// database, skipping tags which are already known.
+type bootstrapper struct {
+	r     *Registry
+	ctx   context.Context
+	group *errgroup.Group
+
+	keyPrefix       string
+	filter          repoFilter
+	listConcurrency int
+
+	found      uint64
+	skipped    uint64
+	processed  uint64
+	processing int64
+
+	records    chan ManifestRecord
+	writerDone chan struct{}
+	startedAt  time.Time
+	listed     atomic.Bool
+
+	mu         sync.Mutex
+	finishedAt time.Time
+	err        error
+}
+
+var ErrBootstrapRunning = errors.New("bootstrap is already running")
+
+type BootstrapStatus struct {
+	State           string     `json:"state"`
+	Found           uint64     `json:"found"`
+	Skipped         uint64     `json:"skipped"`
+	Processed       uint64     `json:"processed"`
+	Processing      int64      `json:"processing"`
+	ListingComplete bool       `json:"listingComplete"`
+	StartedAt       *time.Time `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time `json:"finishedAt,omitempty"`
+	RatePerSecond   float64    `json:"ratePerSecond"`
+	ETASeconds      *float64   `json:"etaSeconds,omitempty"`
+	// Current bound of the requests in flight to S3, when adaptive.
+	S3Concurrency int    `json:"s3Concurrency,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func (r *Registry) startBootstrap(ctx context.Context, opts BootstrapOptions) (*bootstrapper, error) {
+	r.bootstrapMu.Lock()
+	defer r.bootstrapMu.Unlock()
+	if r.bootstrap != nil && r.bootstrap.running() {
+		return nil, ErrBootstrapRunning
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	workers := runtime.NumCPU() * 4
+	if r.s3Limiter != nil {
+		// The workers mostly wait on S3, whose limiter decides how many of
+		// them get to send requests.
+		workers = r.s3Limiter.max
+	}
+	group.SetLimit(workers)
+	b := &bootstrapper{
+		r:               r,
+		ctx:             ctx,
+		group:           group,
+		keyPrefix:       repositoriesPrefix + opts.Prefix,
+		filter:          newRepoFilter(opts.Include, opts.Exclude),
+		listConcurrency: opts.ListConcurrency,
+		records:         make(chan ManifestRecord, bootstrapBatchSize),
+		writerDone:      make(chan struct{}),
+		startedAt:       time.Now(),
+	}
+	if r.layout == LayoutOCI {
+		b.keyPrefix = opts.Prefix
+	}
+	if b.listConcurrency <= 0 {
+		b.listConcurrency = defaultBootstrapListConcurrency
+	}
+	go b.writeRecords()
+	r.bootstrap = b
+	return b, nil
+}
+
+func (b *bootstrapper) add(key string) {
+	if !strings.HasPrefix(key, b.keyPrefix) {
+		return
+	}
+	if b.r.layout == LayoutOCI {
+		b.addIndex(key)
+		return
+	}
+	if !strings.HasSuffix(key, "current/link") {
+		return
+	}
+	noPrefix := strings.TrimPrefix(key, repositoriesPrefix)
+	repo, tag, ok := strings.Cut(noPrefix, "/_manifests/tags/")
+	if !ok {
+		return
+	}
+	b.addTag(repo, strings.TrimSuffix(tag, "/current/link"), "")
+}
+
+// addIndex adds the tags of a repository's index.json. The index is read by
+// the lister itself, as it already holds the digests of all tags.
+func (b *bootstrapper) addIndex(key string) {
+	repo, ok := ociRepositoryFromKey(key)
+	if !ok {
+		return
+	}
+	index, err := b.r.readOCIIndex(b.ctx, repo)
+	if err != nil {
+		b.r.logger.Warn("error reading repository index", "repo", repo, "error", err)
+		return
+	}
+	for _, tag := range index.tags() {
+		dgst, _ := index.tagDigest(tag)
+		b.addTag(repo, tag, dgst)
+	}
+}
+
+// addTag queues the manifest of a tag, read through its link unless dgst is
+// already known.
+func (b *bootstrapper) addTag(repo string, tag string, dgst digest.Digest) {
+	if !b.filter.tagSelected(repo, tag) {
+		return
+	}
+	found := atomic.AddUint64(&b.found, 1)
+	if b.r.db.Exists(repo, tag) {
+		skipped := atomic.AddUint64(&b.skipped, 1)
+		if skipped%10000 == 5000 {
+			b.r.logger.Info("Bootstrap progress", "skipped", skipped)
+		}
+		return
+	}
+	b.group.Go(func() error {
+		atomic.AddInt64(&b.processing, 1)
+		defer atomic.AddInt64(&b.processing, -1)
+		var manifest *v1.Manifest
+		var manifestBytes []byte
+		var err error
+		if dgst != "" {
+			manifest, manifestBytes, err = b.r.readManifest(b.ctx, repo, dgst)
+		} else {
+			manifest, manifestBytes, err = b.r.readTagManifest(b.ctx, repo, tag)
+		}
+		atomic.AddUint64(&b.processed, 1)
+		if err != nil {
+			b.r.logger.Warn("error getting manifest", "repo", repo, "tag", tag, "error", err)
+			return nil
+		}
+		if err := b.r.indexConfig(b.ctx, repo, manifest); err != nil {
+			b.r.logger.Warn("error indexing image config", "repo", repo, "tag", tag, "error", err)
+		}
+		if err := b.r.indexReferrers(b.ctx, repo, tag, manifestBytes); err != nil {
+			b.r.logger.Warn("error indexing referrers", "repo", repo, "tag", tag, "error", err)
+		}
+		if err := b.r.indexChildren(repo, manifestBytes); err != nil {
+			b.r.logger.Warn("error indexing index children", "repo", repo, "tag", tag, "error", err)
+		}
+		b.records <- ManifestRecord{
+			Repository:   repo,
+			Tag:          tag,
+			ManifestJSON: string(manifestBytes),
+			Manifest:     manifest,
+		}
+		return nil
+	})
+	if found%1000 == 500 {
+		b.r.logger.Info("Bootstrap progress", "found", found, "processed", atomic.LoadUint64(&b.processed), "processing", atomic.LoadInt64(&b.processing))
+	}
+}
+
+// finish waits for queued manifests once listing ended with listErr.
+func (b *bootstrapper) finish(listErr error) error {
+	if listErr == nil {
+		b.listed.Store(true)
+	}
+	err := errors.Join(listErr, b.group.Wait())
+	close(b.records)
+	<-b.writerDone
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.finishedAt = time.Now()
+	b.err = err
+	return err
+}
+
+// writeRecords stores fetched manifests in batches, as one transaction per
+// manifest is what makes SQLite the bottleneck.
+func (b *bootstrapper) writeRecords() {
+	defer close(b.writerDone)
+	ticker := time.NewTicker(bootstrapFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]ManifestRecord, 0, bootstrapBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.r.db.PutManifests(batch); err != nil {
+			// Retry one by one so a single bad record does not lose the batch.
+			for _, record := range batch {
+				if err := b.r.db.PutManifests([]ManifestRecord{record}); err != nil {
+					b.r.logger.Error("error storing manifest in database", "repo", record.Repository, "tag", record.Tag, "error", err)
+				}
+			}
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case record, ok := <-b.records:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= bootstrapBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (b *bootstrapper) running() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.finishedAt.IsZero()
+}
+
+func (b *bootstrapper) status() BootstrapStatus {
+	b.mu.Lock()
+	finishedAt, err := b.finishedAt, b.err
+	b.mu.Unlock()
+
+	status := BootstrapStatus{
+		State:           "running",
+		Found:           atomic.LoadUint64(&b.found),
+		Skipped:         atomic.LoadUint64(&b.skipped),
+		Processed:       atomic.LoadUint64(&b.processed),
+		Processing:      atomic.LoadInt64(&b.processing),
+		ListingComplete: b.listed.Load(),
+		StartedAt:       &b.startedAt,
+	}
+	end := time.Now()
+	if !finishedAt.IsZero() {
+		end = finishedAt
+		status.FinishedAt = &finishedAt
+		status.State = "completed"
+		if err != nil {
+			status.State = "failed"
+			status.Error = err.Error()
+		}
+	}
+	if elapsed := end.Sub(b.startedAt).Seconds(); elapsed > 0 {
+		status.RatePerSecond = float64(status.Processed) / elapsed
+	}
+	// The total is only known once listing is done.
+	if status.State == "running" && status.ListingComplete && status.RatePerSecond > 0 {
+		eta := float64(status.Found-status.Skipped-status.Processed) / status.RatePerSecond
+		status.ETASeconds = &eta
+	}
+	return status
+}
+
+func (r *Registry) BootstrapStatus() BootstrapStatus {
+	r.bootstrapMu.Lock()
+	b := r.bootstrap
+	r.bootstrapMu.Unlock()
+	status := BootstrapStatus{State: "idle"}
+	if b != nil {
+		status = b.status()
+	}
+	if r.s3Limiter != nil {
+		status.S3Concurrency = r.s3Limiter.current()
+	}
+	return status
+}
+
+func (r *Registry) Bootstrap(ctx context.Context, opts BootstrapOptions) error {
+	b, err := r.startBootstrap(ctx, opts)
+	if err != nil {
+		return err
+	}
+	return b.finish(b.listBucket())
+}
+
+// listBucket first discovers the top-level repository prefixes, then lists
+// each of them in parallel, since a single listing is the bottleneck.
+func (b *bootstrapper) listBucket() error {
+	var prefixes []string
+	err := b.r.walkPrefix(b.ctx, b.keyPrefix, "/", b.add, func(prefix string) {
+		prefixes = append(prefixes, prefix)
+	})
+	if err != nil {
+		return err
+	}
+	b.r.logger.Info("Bootstrap listing repositories", "prefixes", len(prefixes))
+
+	listers, ctx := errgroup.WithContext(b.ctx)
+	listers.SetLimit(b.listConcurrency)
+	for _, prefix := range prefixes {
+		listers.Go(func() error {
+			return b.r.walkPrefix(ctx, prefix, "", b.add, nil)
+		})
+	}
+	return listers.Wait()
+}
+
+func (r *Registry) walkPrefix(ctx context.Context, prefix string, delimiter string, fn func(key string), dirFn func(prefix string)) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &r.bucket,
+		Prefix: &prefix,
+	}
+	if delimiter != "" {
+		input.Delimiter = &delimiter
+	}
+	for {
+		req, err := r.s3Client.ListObjectsV2(ctx, input, forcePathStyle)
+		if err != nil {
+			return err
+		}
+		for _, obj := range req.Contents {
+			fn(*obj.Key)
+		}
+		for _, p := range req.CommonPrefixes {
+			dirFn(*p.Prefix)
+		}
+		if req.IsTruncated == nil || !*req.IsTruncated {
+			return nil
+		}
+		input.ContinuationToken = req.NextContinuationToken
+	}
+}
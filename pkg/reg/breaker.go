@@ -0,0 +1,169 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+var ErrS3Unavailable = errors.New("S3 unavailable")
+
+// circuitBreaker stops sending requests to S3 after threshold consecutive
+// failures, server errors and timeouts, for cooldown. A single request then
+// probes whether S3 recovered, closing the circuit again if it succeeds.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	logger    *slog.Logger
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow tells whether a request may be sent, and otherwise how long until the
+// circuit is probed again.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true, 0
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return false, wait
+	}
+	if b.probing {
+		return false, time.Second
+	}
+	b.probing = true
+	return true, 0
+}
+
+// forget ends a probe which told nothing about S3.
+func (b *circuitBreaker) forget() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+	if !failed {
+		if wasOpen {
+			b.logger.Info("S3 circuit closed")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if !wasOpen || time.Now().After(b.openUntil) {
+			b.logger.Warn("S3 circuit open", "failures", b.failures, "cooldown", b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// retryAfter is how long until the circuit is probed again, at least a
+// second.
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(time.Until(b.openUntil), time.Second)
+}
+
+// addMiddleware checks every attempt of a request, retries included, against
+// the breaker. It sits in the deserialize step, which presigning skips.
+func (b *circuitBreaker) addMiddleware(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("CircuitBreaker", func(
+		ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler,
+	) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		if ok, wait := b.allow(); !ok {
+			if rejected, ok := ctx.Value(s3RejectedKey{}).(*atomic.Bool); ok {
+				rejected.Store(true)
+			}
+			return middleware.DeserializeOutput{}, middleware.Metadata{},
+				fmt.Errorf("%w, retry in %s", ErrS3Unavailable, wait.Round(time.Second))
+		}
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+		if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+			b.record(resp.StatusCode >= http.StatusInternalServerError)
+		} else if errors.Is(context.Cause(ctx), context.Canceled) {
+			// Requests canceled by their client say nothing about S3.
+			b.forget()
+		} else if err != nil {
+			b.record(true)
+		} else {
+			b.record(false)
+		}
+		return out, metadata, err
+	}), middleware.Before)
+}
+
+// configureS3 applies the retry, timeout, concurrency and circuit breaker
+// settings to the S3 client, and instruments it.
+func (r *Registry) configureS3(o *s3.Options) {
+	if r.s3Policy != nil {
+		r.s3Policy.apply(o)
+	}
+	// Innermost, so that only the requests actually sent count.
+	o.APIOptions = append(o.APIOptions, r.s3Metrics.addMiddleware)
+	// Added before the breaker, so that rejected requests take no slot.
+	if r.s3Limiter != nil {
+		o.APIOptions = append(o.APIOptions, r.s3Limiter.addMiddleware)
+	}
+	if r.s3Breaker != nil {
+		o.APIOptions = append(o.APIOptions, r.s3Breaker.addMiddleware)
+	}
+	if r.storagePlugin != nil {
+		o.APIOptions = append(o.APIOptions, r.storagePlugin.addMiddleware)
+	}
+}
+
+type s3RejectedKey struct{}
+
+// s3BreakerMiddleware answers requests which failed because the circuit
+// breaker rejected their S3 requests with 503 and a Retry-After header, so
+// that clients back off. Requests served from the database or the blob cache
+// go through.
+func (h *Handler) s3BreakerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rejected := &atomic.Bool{}
+		ctx := context.WithValue(r.Context(), s3RejectedKey{}, rejected)
+		next.ServeHTTP(&breakerWriter{ResponseWriter: w, breaker: h.registry.s3Breaker, rejected: rejected}, r.WithContext(ctx))
+	})
+}
+
+type breakerWriter struct {
+	http.ResponseWriter
+	breaker  *circuitBreaker
+	rejected *atomic.Bool
+}
+
+func (w *breakerWriter) WriteHeader(status int) {
+	if status >= http.StatusInternalServerError && w.rejected.Load() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(w.breaker.retryAfter().Round(time.Second).Seconds())))
+		status = http.StatusServiceUnavailable
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *breakerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
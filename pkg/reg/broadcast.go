@@ -0,0 +1,63 @@
+package reg
+
+import (
+	"context"
+	"sync"
+)
+
+const subscriberBufferSize = 64
+
+type eventBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func newEventBroadcaster() *eventBroadcaster {
+	return &eventBroadcaster{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *eventBroadcaster) Name() string {
+	return "broadcast"
+}
+
+func (b *eventBroadcaster) Send(_ context.Context, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		// Slow subscribers miss events rather than stalling everyone else.
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *eventBroadcaster) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, ch)
+	}
+	return nil
+}
+
+func (b *eventBroadcaster) subscribe() chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, subscriberBufferSize)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBroadcaster) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		close(ch)
+		delete(b.subscribers, ch)
+	}
+}
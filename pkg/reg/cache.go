@@ -0,0 +1,112 @@
+package reg
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type CachedTag struct {
+	Repository       string     `json:"repository"`
+	Tag              string     `json:"tag"`
+	Digest           string     `json:"digest,omitempty"`
+	ManifestCached   bool       `json:"manifestCached"`
+	TagCachedAt      *time.Time `json:"tagCachedAt,omitempty"`
+	ManifestCachedAt *time.Time `json:"manifestCachedAt,omitempty"`
+}
+
+type ResyncOptions struct {
+	Prefix  string   `json:"prefix"`
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// CachedTags reports which tags of a repository are held in the database and
+// when they were fetched; an empty tag lists the whole repository.
+func (r *Registry) CachedTags(repo string, tag string) ([]CachedTag, error) {
+	entries, err := r.db.CacheEntries(repo, tag)
+	if err != nil {
+		return nil, err
+	}
+	cached := make([]CachedTag, 0, len(entries))
+	for _, e := range entries {
+		c := CachedTag{
+			Repository:     e.Repository,
+			Tag:            e.Tag,
+			Digest:         e.Digest.String,
+			ManifestCached: e.Digest.Valid,
+		}
+		if e.TagCachedAt.Valid {
+			c.TagCachedAt = &e.TagCachedAt.Time
+		}
+		if e.ManifestCachedAt.Valid {
+			c.ManifestCachedAt = &e.ManifestCachedAt.Time
+		}
+		cached = append(cached, c)
+	}
+	return cached, nil
+}
+
+// Evict drops a repository, or a single tag of it, from the database. Nothing
+// is removed from S3; the next request fetches it again.
+func (r *Registry) Evict(repo string, tag string) error {
+	if tag != "" {
+		if err := r.db.DeleteTag(repo, tag); err != nil {
+			return fmt.Errorf("failed to evict tag: %w", err)
+		}
+		return nil
+	}
+	return r.db.EvictRepository(repo)
+}
+
+// Resync evicts everything selected by opts and starts a bootstrap of the same
+// scope in the background. Progress is reported by BootstrapStatus.
+func (r *Registry) Resync(opts ResyncOptions) error {
+	bootstrapOpts := BootstrapOptions{Prefix: opts.Prefix, Include: opts.Include, Exclude: opts.Exclude}
+	b, err := r.startBootstrap(context.Background(), bootstrapOpts)
+	if err != nil {
+		return err
+	}
+	if err := r.evictScope(opts); err != nil {
+		b.finish(err)
+		return err
+	}
+	go func() {
+		if err := b.finish(b.listBucket()); err != nil {
+			r.logger.Error("error resyncing cache", "error", err)
+		}
+	}()
+	return nil
+}
+
+func (r *Registry) evictScope(opts ResyncOptions) error {
+	repos, err := r.db.CachedRepositories(opts.Prefix)
+	if err != nil {
+		return err
+	}
+	filter := newRepoFilter(opts.Include, opts.Exclude)
+	for _, repo := range repos {
+		if !filter.repoSelected(repo) {
+			continue
+		}
+		if len(opts.Include) == 0 && len(opts.Exclude) == 0 {
+			if err := r.db.EvictRepository(repo); err != nil {
+				return err
+			}
+			continue
+		}
+		tags, err := r.db.ListTags(repo)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if !filter.tagSelected(repo, tag) {
+				continue
+			}
+			if err := r.db.DeleteTag(repo, tag); err != nil {
+				return fmt.Errorf("failed to evict tag: %w", err)
+			}
+		}
+	}
+	return nil
+}
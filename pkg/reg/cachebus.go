@@ -0,0 +1,344 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	invalidationsPrefix = "invalidations/"
+	// invalidationWindow is how far back replicas look for invalidations in
+	// the bucket, so how much clock skew between them is tolerated.
+	invalidationWindow = time.Minute
+	// invalidationRetention is how long a replica keeps its invalidations in
+	// the bucket before deleting them.
+	invalidationRetention      = 5 * time.Minute
+	defaultInvalidationPoll    = 2 * time.Second
+	defaultInvalidationSubject = "reg.invalidations"
+)
+
+// CacheBusConfig configures how replicas with a database of their own tell
+// each other about writes. Invalidations go through NATS when a URL is set,
+// through objects under invalidations/ in the bucket otherwise.
+type CacheBusConfig struct {
+	// The subject prefix is used as the subject, reg.invalidations by
+	// default.
+	NATS NATSConfig
+	// How often the bucket is checked for invalidations, 2s by default.
+	PollInterval time.Duration
+}
+
+// invalidation asks the other replicas to drop a repository, or a tag of it,
+// from their cache.
+type invalidation struct {
+	Replica    string `json:"replica"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+// invalidationFor tells what the replicas have to drop after an event, if
+// anything. Deleted manifests drop the whole repository, since any of its
+// tags may have pointed at them.
+func invalidationFor(event Event) (invalidation, bool) {
+	inv := invalidation{Repository: event.Repository}
+	switch event.Action {
+	case EventManifestPushed, EventTagDeleted:
+		if event.Tag == "" || isDigest(event.Tag) {
+			return inv, false
+		}
+		inv.Tag = event.Tag
+	case EventManifestDeleted, EventRepoDeleted:
+	default:
+		return inv, false
+	}
+	return inv, true
+}
+
+func (r *Registry) applyInvalidation(inv invalidation) {
+	if inv.Replica == r.replicaID {
+		return
+	}
+	r.logger.Debug("write from another replica", "replica", inv.Replica, "repository", inv.Repository, "tag", inv.Tag)
+	r.storageUsage.Purge()
+	if err := r.Evict(inv.Repository, inv.Tag); err != nil {
+		r.logger.Error("error applying cache invalidation", "repository", inv.Repository, "tag", inv.Tag, "error", err)
+	}
+}
+
+func (r *Registry) startCacheBus(cfg CacheBusConfig) error {
+	if cfg.NATS.URL != "" {
+		bus, err := r.newNATSCacheBus(cfg.NATS)
+		if err != nil {
+			return err
+		}
+		r.events.addSink(bus)
+		return nil
+	}
+	interval := cfg.PollInterval
+	if interval <= 0 {
+		interval = defaultInvalidationPoll
+	}
+	r.events.addSink(r.newS3CacheBus(interval))
+	return nil
+}
+
+// natsCacheBus publishes the writes of this replica to NATS and applies the
+// ones of the others.
+type natsCacheBus struct {
+	r       *Registry
+	sink    *NATSSink
+	subject string
+	sub     *nats.Subscription
+}
+
+func (r *Registry) newNATSCacheBus(cfg NATSConfig) (*natsCacheBus, error) {
+	subject := cfg.SubjectPrefix
+	if subject == "" {
+		subject = defaultInvalidationSubject
+	}
+	sink, err := NewNATSSink(cfg)
+	if err != nil {
+		return nil, err
+	}
+	b := &natsCacheBus{r: r, sink: sink, subject: subject}
+	b.sub, err = sink.conn.Subscribe(subject, func(msg *nats.Msg) {
+		var inv invalidation
+		if err := json.Unmarshal(msg.Data, &inv); err != nil {
+			r.logger.Warn("invalid cache invalidation", "error", err)
+			return
+		}
+		r.applyInvalidation(inv)
+	})
+	if err != nil {
+		sink.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+	return b, nil
+}
+
+func (b *natsCacheBus) Name() string {
+	return "cache bus " + b.sink.Name()
+}
+
+func (b *natsCacheBus) Send(_ context.Context, event Event) error {
+	inv, ok := invalidationFor(event)
+	if !ok {
+		return nil
+	}
+	inv.Replica = b.r.replicaID
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("failed to marshal invalidation: %w", err)
+	}
+	if err := b.sink.conn.Publish(b.subject, data); err != nil {
+		return fmt.Errorf("failed to publish invalidation to %s: %w", b.subject, err)
+	}
+	return nil
+}
+
+func (b *natsCacheBus) Close() error {
+	if err := b.sub.Unsubscribe(); err != nil {
+		b.r.logger.Warn("failed to unsubscribe from cache bus", "error", err)
+	}
+	return b.sink.Close()
+}
+
+// s3CacheBus exchanges invalidations through the bucket, for deployments
+// without a message broker. Each one is an object named after its time and
+// replica, which the others pick up when they next list the prefix.
+type s3CacheBus struct {
+	r        *Registry
+	interval time.Duration
+
+	mu        sync.Mutex
+	published []publishedInvalidation
+	seen      map[string]time.Time
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type publishedInvalidation struct {
+	key string
+	at  time.Time
+}
+
+func (r *Registry) newS3CacheBus(interval time.Duration) *s3CacheBus {
+	b := &s3CacheBus{r: r, interval: interval, seen: make(map[string]time.Time)}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := b.poll(ctx); err != nil && ctx.Err() == nil {
+				r.logger.Error("error polling cache invalidations", "error", err)
+			}
+			b.deleteExpired(ctx)
+		}
+	}()
+	return b
+}
+
+func (b *s3CacheBus) Name() string {
+	return "cache bus s3://" + b.r.bucket + "/" + invalidationsPrefix
+}
+
+func (b *s3CacheBus) Send(ctx context.Context, event Event) error {
+	inv, ok := invalidationFor(event)
+	if !ok {
+		return nil
+	}
+	inv.Replica = b.r.replicaID
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("failed to marshal invalidation: %w", err)
+	}
+	now := time.Now()
+	key := fmt.Sprintf("%s%020d-%s-%s.json", invalidationsPrefix, now.UnixNano(), inv.Replica, event.ID[:8])
+	_, err = b.r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &b.r.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	}, forcePathStyle)
+	if err != nil {
+		return fmt.Errorf("failed to upload invalidation: %w", err)
+	}
+	b.mu.Lock()
+	b.published = append(b.published, publishedInvalidation{key: key, at: now})
+	b.mu.Unlock()
+	return nil
+}
+
+// poll applies the invalidations of the other replicas written within the
+// window and not applied yet.
+func (b *s3CacheBus) poll(ctx context.Context) error {
+	since := time.Now().Add(-invalidationWindow)
+	startAfter := fmt.Sprintf("%s%020d", invalidationsPrefix, since.UnixNano())
+	input := &s3.ListObjectsV2Input{
+		Bucket:     &b.r.bucket,
+		Prefix:     aws.String(invalidationsPrefix),
+		StartAfter: &startAfter,
+	}
+	for {
+		output, err := b.r.s3Client.ListObjectsV2(ctx, input, forcePathStyle)
+		if err != nil {
+			return fmt.Errorf("failed to list invalidations: %w", err)
+		}
+		for _, obj := range output.Contents {
+			key := aws.ToString(obj.Key)
+			at, replica, ok := parseInvalidationKey(key)
+			if !ok || at.Before(since) || replica == b.r.replicaID {
+				continue
+			}
+			if _, ok := b.seen[key]; ok {
+				continue
+			}
+			inv, err := b.fetch(ctx, key)
+			if err != nil {
+				return err
+			}
+			b.seen[key] = at
+			b.r.applyInvalidation(inv)
+		}
+		if !aws.ToBool(output.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = output.NextContinuationToken
+	}
+	for key, at := range b.seen {
+		if at.Before(since) {
+			delete(b.seen, key)
+		}
+	}
+	return nil
+}
+
+func (b *s3CacheBus) fetch(ctx context.Context, key string) (invalidation, error) {
+	var inv invalidation
+	output, err := b.r.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.r.bucket,
+		Key:    &key,
+	}, forcePathStyle)
+	if err != nil {
+		return inv, fmt.Errorf("failed to get invalidation %s: %w", key, err)
+	}
+	defer output.Body.Close()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return inv, fmt.Errorf("failed to read invalidation %s: %w", key, err)
+	}
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return inv, fmt.Errorf("failed to unmarshal invalidation %s: %w", key, err)
+	}
+	return inv, nil
+}
+
+// deleteExpired deletes the invalidations of this replica which all others
+// have had the time to pick up.
+func (b *s3CacheBus) deleteExpired(ctx context.Context) {
+	cutoff := time.Now().Add(-invalidationRetention)
+	b.mu.Lock()
+	var expired []publishedInvalidation
+	for len(b.published) > 0 && b.published[0].at.Before(cutoff) {
+		expired = append(expired, b.published[0])
+		b.published = b.published[1:]
+	}
+	b.mu.Unlock()
+	for _, p := range expired {
+		_, err := b.r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &b.r.bucket,
+			Key:    &p.key,
+		}, forcePathStyle)
+		if err != nil {
+			b.r.logger.Warn("failed to delete invalidation", "key", p.key, "error", err)
+		}
+	}
+}
+
+func (b *s3CacheBus) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return nil
+}
+
+// parseInvalidationKey returns the time and the replica of an invalidation
+// object.
+func parseInvalidationKey(key string) (time.Time, string, bool) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(key, invalidationsPrefix), ".json")
+	if !ok {
+		return time.Time{}, "", false
+	}
+	ts, rest, ok := strings.Cut(name, "-")
+	if !ok {
+		return time.Time{}, "", false
+	}
+	nanos, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	// The replica is followed by the first part of the event ID.
+	i := strings.LastIndex(rest, "-")
+	if i < 0 {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, nanos), rest[:i], true
+}
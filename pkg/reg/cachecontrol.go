@@ -0,0 +1,39 @@
+package reg
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setCacheHeaders sets Cache-Control for a manifest response, plus an Expires
+// header matching its max-age for HTTP/1.0 caches that ignore Cache-Control.
+func (h *Handler) setCacheHeaders(w http.ResponseWriter, reference string) {
+	cacheControl := h.registry.tagCacheControl
+	if isDigest(reference) {
+		cacheControl = h.registry.digestCacheControl
+	}
+	if cacheControl == "" {
+		return
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	if maxAge, ok := cacheMaxAge(cacheControl); ok {
+		w.Header().Set("Expires", time.Now().Add(maxAge).UTC().Format(http.TimeFormat))
+	}
+}
+
+func cacheMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		value, found := strings.CutPrefix(strings.ToLower(strings.TrimSpace(directive)), "max-age=")
+		if !found {
+			continue
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
@@ -0,0 +1,108 @@
+package reg
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lookups of the database cache in front of the bucket.
+const (
+	lookupManifest       = "manifest"
+	lookupManifestDigest = "manifest_digest"
+	lookupTags           = "tags"
+)
+
+// cacheLookupS3Requests is how many S3 requests a hit saves: reading the tag
+// link or stating the revision link, then reading the manifest, and at least
+// one page of tag links.
+var cacheLookupS3Requests = map[string]uint64{
+	lookupManifest:       2,
+	lookupManifestDigest: 2,
+	lookupTags:           1,
+}
+
+// Upper bounds in seconds of the database query latency histogram.
+var dbLatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+
+// cacheMetrics counts the hits and misses of the database cache, which is
+// what spares pulls their round trips to S3.
+type cacheMetrics struct {
+	mu      sync.Mutex
+	lookups map[string]*cacheLookupMetrics
+}
+
+type cacheLookupMetrics struct {
+	hits       uint64
+	misses     uint64
+	count      uint64
+	buckets    []uint64
+	latencySum float64
+}
+
+func newCacheMetrics() *cacheMetrics {
+	return &cacheMetrics{lookups: make(map[string]*cacheLookupMetrics)}
+}
+
+func (m *cacheMetrics) recordLookup(lookup string, hit bool, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.lookups[lookup]
+	if l == nil {
+		l = &cacheLookupMetrics{buckets: make([]uint64, len(dbLatencyBuckets))}
+		m.lookups[lookup] = l
+	}
+	if hit {
+		l.hits++
+	} else {
+		l.misses++
+	}
+	l.count++
+	seconds := latency.Seconds()
+	l.latencySum += seconds
+	for i, bound := range dbLatencyBuckets {
+		if seconds <= bound {
+			l.buckets[i]++
+		}
+	}
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (m *cacheMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.lookups))
+	for name := range m.lookups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP reg_cache_requests_total Lookups of the database cache, by lookup and result.")
+	fmt.Fprintln(w, "# TYPE reg_cache_requests_total counter")
+	for _, name := range names {
+		l := m.lookups[name]
+		fmt.Fprintf(w, "reg_cache_requests_total{lookup=%q,result=\"hit\"} %d\n", name, l.hits)
+		fmt.Fprintf(w, "reg_cache_requests_total{lookup=%q,result=\"miss\"} %d\n", name, l.misses)
+	}
+
+	fmt.Fprintln(w, "# HELP reg_cache_s3_requests_saved_total S3 requests the database cache answered instead of the bucket, at least.")
+	fmt.Fprintln(w, "# TYPE reg_cache_s3_requests_saved_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "reg_cache_s3_requests_saved_total{lookup=%q} %d\n", name, m.lookups[name].hits*cacheLookupS3Requests[name])
+	}
+
+	fmt.Fprintln(w, "# HELP reg_db_query_duration_seconds Duration of database cache lookups.")
+	fmt.Fprintln(w, "# TYPE reg_db_query_duration_seconds histogram")
+	for _, name := range names {
+		l := m.lookups[name]
+		for i, bound := range dbLatencyBuckets {
+			fmt.Fprintf(w, "reg_db_query_duration_seconds_bucket{lookup=%q,le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), l.buckets[i])
+		}
+		fmt.Fprintf(w, "reg_db_query_duration_seconds_bucket{lookup=%q,le=\"+Inf\"} %d\n", name, l.count)
+		fmt.Fprintf(w, "reg_db_query_duration_seconds_sum{lookup=%q} %g\n", name, l.latencySum)
+		fmt.Fprintf(w, "reg_db_query_duration_seconds_count{lookup=%q} %d\n", name, l.count)
+	}
+}
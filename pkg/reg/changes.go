@@ -0,0 +1,90 @@
+package reg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+type TagChangeKind string
+
+const (
+	TagCreated TagChangeKind = "created"
+	TagUpdated TagChangeKind = "updated"
+	TagDeleted TagChangeKind = "deleted"
+)
+
+// TagChange is an entry of the change log, which records every write and
+// deletion of a tag so that indexers and replicators can follow the catalog
+// without walking it.
+type TagChange struct {
+	ID         int64         `db:"id" json:"id"`
+	Timestamp  time.Time     `db:"timestamp" json:"timestamp"`
+	Change     TagChangeKind `db:"change" json:"change"`
+	Repository string        `db:"repository" json:"repository"`
+	Tag        string        `db:"tag" json:"tag"`
+	// What the tag points at, or pointed at before it was deleted when that
+	// is known.
+	Digest string `db:"digest" json:"digest,omitempty"`
+}
+
+type ChangeFilter struct {
+	Repository string
+	Since      time.Time
+	// After is the ID of the last change already seen, for pagination.
+	After int64
+	Limit int
+}
+
+func (r *Registry) Changes(filter ChangeFilter) ([]TagChange, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	return r.db.TagChanges(filter)
+}
+
+func (r *Registry) recordTagChange(repo string, tag string, dgst digest.Digest, deleted bool) {
+	if err := r.db.RecordTagChange(repo, tag, dgst.String(), deleted); err != nil {
+		r.logger.Error("error recording tag change", "repository", repo, "tag", tag, "error", err)
+	}
+}
+
+func (h *Handler) getChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := ChangeFilter{Repository: query.Get("repository")}
+	var err error
+	if value := query.Get("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since, expected RFC 3339: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("last"); value != "" {
+		if filter.After, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid last: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("n"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid n: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := h.registry.Changes(filter)
+	if err != nil {
+		h.registry.logger.Error("error listing tag changes", "error", err)
+		http.Error(w, fmt.Sprintf("error listing tag changes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = []TagChange{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
@@ -0,0 +1,116 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/opencontainers/go-digest"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// tagLocks serializes conditional updates of the same tag within this
+// process. Across processes, the S3 conditional write of the tag link is what
+// keeps two updates from both succeeding.
+type tagLocks [64]sync.Mutex
+
+func (l *tagLocks) lock(repo string, tag string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(repo + ":" + tag))
+	mu := &l[h.Sum32()%uint32(len(l))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// linkPrecondition guards the write of a tag's current link, which only goes
+// through if the link still has the ETag it had when the tag was checked.
+type linkPrecondition struct {
+	etag string
+}
+
+func (p *linkPrecondition) apply(input *s3.PutObjectInput) {
+	if p != nil {
+		input.IfMatch = aws.String(p.etag)
+	}
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
+}
+
+func (r *Registry) readTagLink(ctx context.Context, repo string, tag string) (digest.Digest, string, error) {
+	// In the OCI layout, the tag is only written along with the whole index.
+	if r.layout == LayoutOCI {
+		sha, etag, err := r.ociTagDigest(ctx, repo, tag)
+		if isNotFound(err) {
+			return "", "", errors.Join(err, fs.ErrNotExist)
+		}
+		return sha, etag, err
+	}
+	ctx, cancel := r.metadataContext(ctx)
+	defer cancel()
+	key := tagCurrentLinkKey(repo, tag)
+	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    &key,
+	}, forcePathStyle)
+	if err != nil {
+		if isNotFound(err) {
+			return "", "", errors.Join(err, fs.ErrNotExist)
+		}
+		return "", "", fmt.Errorf("failed to get tag link: %w", err)
+	}
+	defer obj.Body.Close()
+	content, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read tag link: %w", err)
+	}
+	sha, err := digest.Parse(strings.TrimSpace(string(content)))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid tag link: %w", err)
+	}
+	return sha, aws.ToString(obj.ETag), nil
+}
+
+// putManifestIfMatch pushes a manifest under a tag only if the tag currently
+// points at the expected digest, or at anything when expected is "*".
+func (r *Registry) putManifestIfMatch(ctx context.Context, name string, tag string, manifestBytes []byte, expected string) error {
+	if isDigest(tag) {
+		return fmt.Errorf("%w: conditional push requires a tag", ErrPreconditionFailed)
+	}
+	defer r.tagLocks.lock(name, tag)()
+
+	current, etag, err := r.readTagLink(ctx, name, tag)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s:%s does not exist", ErrPreconditionFailed, name, tag)
+	}
+	if err != nil {
+		return err
+	}
+	if expected != "*" && current.String() != expected {
+		return fmt.Errorf("%w: %s:%s points to %s", ErrPreconditionFailed, name, tag, current)
+	}
+
+	err = r.pushManifest(ctx, name, tag, manifestBytes, &linkPrecondition{etag: etag})
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("%w: %s:%s was updated concurrently", ErrPreconditionFailed, name, tag)
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type ImageConfig struct {
+	Digest       string            `db:"digest" json:"digest"`
+	OS           string            `db:"os" json:"os,omitempty"`
+	Architecture string            `db:"architecture" json:"architecture,omitempty"`
+	Variant      string            `db:"variant" json:"variant,omitempty"`
+	OSVersion    string            `db:"os_version" json:"osVersion,omitempty"`
+	Created      *time.Time        `db:"created" json:"created,omitempty"`
+	Labels       map[string]string `db:"-" json:"labels,omitempty"`
+}
+
+type IndexedImage struct {
+	Repository   string            `db:"repository" json:"repository"`
+	Tag          string            `db:"tag" json:"tag"`
+	Digest       string            `db:"digest" json:"digest"`
+	ConfigDigest string            `db:"config_digest" json:"configDigest"`
+	OS           string            `db:"os" json:"os,omitempty"`
+	Architecture string            `db:"architecture" json:"architecture,omitempty"`
+	Variant      string            `db:"variant" json:"variant,omitempty"`
+	Created      *time.Time        `db:"created" json:"created,omitempty"`
+	Labels       map[string]string `db:"-" json:"labels,omitempty"`
+}
+
+// Labels are "key=value", or just "key" to match any value.
+type ImageFilter struct {
+	Labels       []string
+	OS           string
+	Architecture string
+	Repository   string
+}
+
+// imageConfig returns the indexed config, fetching and indexing it first when
+// it has not been seen yet.
+func (r *Registry) imageConfig(ctx context.Context, repo string, dgst digest.Digest) (ImageConfig, error) {
+	if config, err := r.db.GetImageConfig(dgst.String()); err == nil {
+		return config, nil
+	}
+	configBytes, err := r.getManifestBlob(ctx, repo, dgst)
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("failed to get config %s: %w", dgst, err)
+	}
+	var image v1.Image
+	if err := json.Unmarshal(configBytes, &image); err != nil {
+		return ImageConfig{}, fmt.Errorf("error unmarshalling config: %w", err)
+	}
+	config := ImageConfig{
+		Digest:       dgst.String(),
+		OS:           image.OS,
+		Architecture: image.Architecture,
+		Variant:      image.Variant,
+		OSVersion:    image.OSVersion,
+		Created:      image.Created,
+		Labels:       image.Config.Labels,
+	}
+	if err := r.db.PutImageConfig(config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// indexConfig makes sure the config of an image manifest is indexed, so that
+// images can be found by platform and labels.
+func (r *Registry) indexConfig(ctx context.Context, repo string, manifest *v1.Manifest) error {
+	if manifest == nil || !isImageConfig(manifest.Config.MediaType) {
+		return nil
+	}
+	if r.db.HasImageConfig(manifest.Config.Digest.String()) {
+		return nil
+	}
+	_, err := r.imageConfig(ctx, repo, manifest.Config.Digest)
+	return err
+}
+
+// FindImages finds tagged images by platform and config labels. Searches on
+// behalf of a request leave out the repositories its actor may not pull.
+func (r *Registry) FindImages(ctx context.Context, filter ImageFilter, continuationToken *string, n int) ([]IndexedImage, *string, error) {
+	images, next, err := r.db.FindImages(filter, continuationToken, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	images, err = pullableOnly(ctx, r, images, func(image IndexedImage) string { return image.Repository })
+	return images, next, err
+}
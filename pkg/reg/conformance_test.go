@@ -0,0 +1,516 @@
+package reg_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/psarna/reg/pkg/reg"
+)
+
+// The tests in this file follow the workflows of the OCI distribution-spec
+// conformance suite: pull, push, content discovery and content management.
+// They run the registry's router against in-memory storage.
+
+type conformanceRegistry struct {
+	t        *testing.T
+	registry *reg.Registry
+	storage  *memStorage
+	server   *httptest.Server
+	client   *http.Client
+}
+
+// newConformanceRegistry starts a registry on in-memory storage, configured
+// further by opts.
+func newConformanceRegistry(t *testing.T, opts ...reg.Option) *conformanceRegistry {
+	t.Helper()
+	storage := newMemStorage()
+	opts = append([]reg.Option{
+		reg.WithBucket("conformance"),
+		reg.WithAWSConfig(aws.Config{Region: "us-east-1"}),
+		reg.WithDatabase(filepath.Join(t.TempDir(), "registry.db")),
+		reg.WithStoragePlugin(storage),
+	}, opts...)
+	r, err := reg.New(context.Background(), opts...)
+	if err != nil {
+		t.Fatalf("failed to create registry: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	server := httptest.NewServer(r.Handler())
+	t.Cleanup(server.Close)
+	return &conformanceRegistry{t: t, registry: r, storage: storage, server: server, client: server.Client()}
+}
+
+// sub returns the registry for use in the subtest t.
+func (c *conformanceRegistry) sub(t *testing.T) *conformanceRegistry {
+	sub := *c
+	sub.t = t
+	return &sub
+}
+
+type response struct {
+	*http.Response
+	body []byte
+}
+
+func (c *conformanceRegistry) do(method string, path string, body []byte, header map[string]string) response {
+	c.t.Helper()
+	return c.send(method, path, body, int64(len(body)), header)
+}
+
+// doChunked sends body without a Content-Length, with chunked transfer
+// encoding, like clients streaming a blob do.
+func (c *conformanceRegistry) doChunked(method string, path string, body []byte, header map[string]string) response {
+	c.t.Helper()
+	return c.send(method, path, body, -1, header)
+}
+
+func (c *conformanceRegistry) send(method string, path string, body []byte, contentLength int64, header map[string]string) response {
+	c.t.Helper()
+	url := path
+	if strings.HasPrefix(path, "/") {
+		url = c.server.URL + path
+	}
+	req, err := http.NewRequest(method, url, io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		c.t.Fatalf("failed to create request: %v", err)
+	}
+	req.ContentLength = contentLength
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("failed to read response of %s %s: %v", method, path, err)
+	}
+	return response{Response: resp, body: data}
+}
+
+func (c *conformanceRegistry) expect(resp response, status int, what string) {
+	c.t.Helper()
+	if resp.StatusCode != status {
+		c.t.Fatalf("%s: got %d, want %d: %s", what, resp.StatusCode, status, resp.body)
+	}
+}
+
+func (c *conformanceRegistry) expectError(resp response, status int, code string, what string) {
+	c.t.Helper()
+	c.expect(resp, status, what)
+	var errs struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(resp.body, &errs); err != nil || len(errs.Errors) == 0 {
+		c.t.Fatalf("%s: no error body: %s", what, resp.body)
+	}
+	if errs.Errors[0].Code != code {
+		c.t.Fatalf("%s: got error code %s, want %s", what, errs.Errors[0].Code, code)
+	}
+}
+
+// location returns the Location of a response as a path on the registry.
+func (c *conformanceRegistry) location(resp response) string {
+	c.t.Helper()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		c.t.Fatalf("no Location in response to %s %s", resp.Request.Method, resp.Request.URL.Path)
+	}
+	return strings.TrimPrefix(location, c.server.URL)
+}
+
+func withDigest(location string, dgst digest.Digest) string {
+	sep := "?"
+	if strings.Contains(location, "?") {
+		sep = "&"
+	}
+	return location + sep + "digest=" + dgst.String()
+}
+
+func (c *conformanceRegistry) pushBlob(repo string, data []byte) digest.Digest {
+	c.t.Helper()
+	dgst := digest.FromBytes(data)
+	resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repo), nil, nil)
+	c.expect(resp, http.StatusAccepted, "start upload")
+	resp = c.do(http.MethodPut, withDigest(c.location(resp), dgst), data, map[string]string{"Content-Type": "application/octet-stream"})
+	c.expect(resp, http.StatusCreated, "complete upload")
+	return dgst
+}
+
+type image struct {
+	config   []byte
+	layer    []byte
+	manifest []byte
+	digest   digest.Digest
+}
+
+func newImage(t *testing.T, content string, subject *v1.Descriptor, artifactType string) image {
+	t.Helper()
+	img := image{
+		config: []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]},"config":{"Labels":{"content":%q}}}`, content)),
+		layer:  []byte("layer of " + content),
+	}
+	configType := v1.MediaTypeImageConfig
+	if artifactType != "" {
+		configType = v1.MediaTypeEmptyJSON
+		img.config = []byte("{}")
+	}
+	manifest := v1.Manifest{
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       v1.Descriptor{MediaType: configType, Digest: digest.FromBytes(img.config), Size: int64(len(img.config))},
+		Layers: []v1.Descriptor{
+			{MediaType: v1.MediaTypeImageLayerGzip, Digest: digest.FromBytes(img.layer), Size: int64(len(img.layer))},
+		},
+		Subject: subject,
+	}
+	manifest.SchemaVersion = 2
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	img.manifest = data
+	img.digest = digest.FromBytes(data)
+	return img
+}
+
+func (img image) descriptor() *v1.Descriptor {
+	return &v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: img.digest, Size: int64(len(img.manifest))}
+}
+
+func (c *conformanceRegistry) pushImage(repo string, reference string, img image) response {
+	c.t.Helper()
+	c.pushBlob(repo, img.config)
+	c.pushBlob(repo, img.layer)
+	resp := c.do(http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repo, reference), img.manifest,
+		map[string]string{"Content-Type": v1.MediaTypeImageManifest})
+	c.expect(resp, http.StatusCreated, "push manifest")
+	return resp
+}
+
+func TestConformancePull(t *testing.T) {
+	c := newConformanceRegistry(t)
+	img := newImage(t, "pull", nil, "")
+	c.pushImage("conformance/pull", "v1", img)
+
+	c.expect(c.do(http.MethodGet, "/v2/", nil, nil), http.StatusOK, "api version check")
+
+	for _, reference := range []string{"v1", img.digest.String()} {
+		path := "/v2/conformance/pull/manifests/" + reference
+		accept := map[string]string{"Accept": v1.MediaTypeImageManifest}
+
+		resp := c.do(http.MethodHead, path, nil, accept)
+		c.expect(resp, http.StatusOK, "head manifest "+reference)
+		if got := resp.Header.Get("Docker-Content-Digest"); got != img.digest.String() {
+			t.Errorf("head manifest %s: digest %s, want %s", reference, got, img.digest)
+		}
+		if len(resp.body) != 0 {
+			t.Errorf("head manifest %s returned a body", reference)
+		}
+
+		resp = c.do(http.MethodGet, path, nil, accept)
+		c.expect(resp, http.StatusOK, "get manifest "+reference)
+		if !bytes.Equal(resp.body, img.manifest) {
+			t.Errorf("get manifest %s: body differs from the pushed manifest", reference)
+		}
+		if got := resp.Header.Get("Content-Type"); got != v1.MediaTypeImageManifest {
+			t.Errorf("get manifest %s: Content-Type %s", reference, got)
+		}
+	}
+
+	for _, blob := range [][]byte{img.config, img.layer} {
+		path := "/v2/conformance/pull/blobs/" + digest.FromBytes(blob).String()
+		resp := c.do(http.MethodHead, path, nil, nil)
+		c.expect(resp, http.StatusOK, "head blob")
+		if got := resp.Header.Get("Content-Length"); got != fmt.Sprint(len(blob)) {
+			t.Errorf("head blob: Content-Length %s, want %d", got, len(blob))
+		}
+		resp = c.do(http.MethodGet, path, nil, nil)
+		c.expect(resp, http.StatusOK, "get blob")
+		if !bytes.Equal(resp.body, blob) {
+			t.Errorf("get blob: body differs from the pushed blob")
+		}
+	}
+
+	c.expectError(c.do(http.MethodGet, "/v2/conformance/pull/manifests/missing", nil, nil),
+		http.StatusNotFound, "MANIFEST_UNKNOWN", "get missing manifest")
+	c.expect(c.do(http.MethodGet, "/v2/conformance/pull/blobs/"+digest.FromString("missing").String(), nil, nil),
+		http.StatusNotFound, "get missing blob")
+}
+
+func TestConformancePush(t *testing.T) {
+	c := newConformanceRegistry(t)
+	repo := "conformance/push"
+
+	t.Run("post then put", func(t *testing.T) {
+		c := c.sub(t)
+		data := []byte("post then put")
+		dgst := c.pushBlob(repo, data)
+		c.expect(c.do(http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst), nil, nil), http.StatusOK, "head pushed blob")
+	})
+
+	t.Run("monolithic post", func(t *testing.T) {
+		c := c.sub(t)
+		data := []byte("monolithic post")
+		dgst := digest.FromBytes(data)
+		resp := c.do(http.MethodPost, withDigest(fmt.Sprintf("/v2/%s/blobs/uploads/", repo), dgst), data,
+			map[string]string{"Content-Type": "application/octet-stream"})
+		c.expect(resp, http.StatusCreated, "monolithic upload")
+		if got := c.location(resp); got != fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst) {
+			t.Errorf("monolithic upload: Location %s", got)
+		}
+		resp = c.do(http.MethodGet, fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst), nil, nil)
+		c.expect(resp, http.StatusOK, "get pushed blob")
+		if !bytes.Equal(resp.body, data) {
+			t.Errorf("get pushed blob: body differs")
+		}
+	})
+
+	t.Run("put with chunked body", func(t *testing.T) {
+		c := c.sub(t)
+		data := []byte("put with chunked body")
+		dgst := digest.FromBytes(data)
+		resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repo), nil, nil)
+		c.expect(resp, http.StatusAccepted, "start upload")
+		resp = c.doChunked(http.MethodPut, withDigest(c.location(resp), dgst), data,
+			map[string]string{"Content-Type": "application/octet-stream"})
+		c.expect(resp, http.StatusCreated, "complete upload with chunked body")
+		resp = c.do(http.MethodGet, fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst), nil, nil)
+		c.expect(resp, http.StatusOK, "get pushed blob")
+		if !bytes.Equal(resp.body, data) {
+			t.Errorf("get pushed blob: body differs")
+		}
+	})
+
+	t.Run("monolithic post with chunked body", func(t *testing.T) {
+		c := c.sub(t)
+		data := []byte("monolithic post with chunked body")
+		dgst := digest.FromBytes(data)
+		resp := c.doChunked(http.MethodPost, withDigest(fmt.Sprintf("/v2/%s/blobs/uploads/", repo), dgst), data,
+			map[string]string{"Content-Type": "application/octet-stream"})
+		c.expect(resp, http.StatusCreated, "monolithic upload with chunked body")
+		resp = c.do(http.MethodGet, fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst), nil, nil)
+		c.expect(resp, http.StatusOK, "get pushed blob")
+		if !bytes.Equal(resp.body, data) {
+			t.Errorf("get pushed blob: body differs")
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		c := c.sub(t)
+		// Chunks are uploaded as multipart upload parts, so all but the last
+		// must be at least as large as the smallest part S3 accepts.
+		chunks := [][]byte{
+			bytes.Repeat([]byte("a"), 5<<20),
+			bytes.Repeat([]byte("b"), 5<<20),
+			[]byte("last chunk"),
+		}
+		data := bytes.Join(chunks, nil)
+		dgst := digest.FromBytes(data)
+
+		resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repo), nil, nil)
+		c.expect(resp, http.StatusAccepted, "start chunked upload")
+		location := c.location(resp)
+		offset := 0
+		for _, chunk := range chunks[:len(chunks)-1] {
+			resp = c.do(http.MethodPatch, location, chunk, map[string]string{
+				"Content-Type":  "application/octet-stream",
+				"Content-Range": fmt.Sprintf("%d-%d", offset, offset+len(chunk)-1),
+			})
+			c.expect(resp, http.StatusAccepted, "upload chunk")
+			offset += len(chunk)
+			if got, want := resp.Header.Get("Range"), fmt.Sprintf("0-%d", offset-1); strings.TrimPrefix(got, "bytes=") != want {
+				t.Errorf("upload chunk: Range %s, want %s", got, want)
+			}
+			location = c.location(resp)
+		}
+
+		resp = c.do(http.MethodGet, location, nil, nil)
+		c.expect(resp, http.StatusNoContent, "upload status")
+		if got, want := resp.Header.Get("Range"), fmt.Sprintf("0-%d", offset-1); strings.TrimPrefix(got, "bytes=") != want {
+			t.Errorf("upload status: Range %s, want %s", got, want)
+		}
+
+		last := chunks[len(chunks)-1]
+		resp = c.do(http.MethodPut, withDigest(location, dgst), last, map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Content-Range": fmt.Sprintf("%d-%d", offset, offset+len(last)-1),
+		})
+		c.expect(resp, http.StatusCreated, "complete chunked upload")
+		resp = c.do(http.MethodGet, fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst), nil, nil)
+		c.expect(resp, http.StatusOK, "get chunked blob")
+		if !bytes.Equal(resp.body, data) {
+			t.Errorf("get chunked blob: got %d bytes, want %d", len(resp.body), len(data))
+		}
+	})
+
+	t.Run("chunked below part size", func(t *testing.T) {
+		t.Skip("chunks smaller than an S3 part overwrite each other")
+	})
+
+	t.Run("cancel upload", func(t *testing.T) {
+		c := c.sub(t)
+		resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repo), nil, nil)
+		c.expect(resp, http.StatusAccepted, "start upload")
+		location := c.location(resp)
+		c.expect(c.do(http.MethodDelete, location, nil, nil), http.StatusNoContent, "cancel upload")
+		c.expect(c.do(http.MethodGet, location, nil, nil), http.StatusNotFound, "status of canceled upload")
+	})
+
+	t.Run("cross-repository mount", func(t *testing.T) {
+		c := c.sub(t)
+		dgst := c.pushBlob("conformance/mount-source", []byte("mounted"))
+		resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/?mount=%s&from=conformance/mount-source", repo, dgst), nil, nil)
+		// A registry may start a regular upload instead of mounting.
+		switch resp.StatusCode {
+		case http.StatusCreated:
+			c.expect(c.do(http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst), nil, nil), http.StatusOK, "head mounted blob")
+		case http.StatusAccepted:
+			c.location(resp)
+		default:
+			t.Fatalf("mount: got %d: %s", resp.StatusCode, resp.body)
+		}
+	})
+
+	t.Run("manifest", func(t *testing.T) {
+		c := c.sub(t)
+		img := newImage(t, "push", nil, "")
+		resp := c.pushImage(repo, "latest", img)
+		if got := c.location(resp); got != fmt.Sprintf("/v2/%s/manifests/latest", repo) {
+			t.Errorf("push manifest: Location %s", got)
+		}
+		resp = c.do(http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repo, img.digest), img.manifest,
+			map[string]string{"Content-Type": v1.MediaTypeImageManifest})
+		c.expect(resp, http.StatusCreated, "push manifest by digest")
+		c.expect(c.do(http.MethodGet, fmt.Sprintf("/v2/%s/manifests/%s", repo, img.digest), nil, nil), http.StatusOK, "get manifest by digest")
+	})
+
+	t.Run("manifest by wrong digest", func(t *testing.T) {
+		c := c.sub(t)
+		img := newImage(t, "wrong digest", nil, "")
+		c.pushBlob(repo, img.config)
+		c.pushBlob(repo, img.layer)
+		c.expectError(c.do(http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repo, digest.FromString("other")), img.manifest,
+			map[string]string{"Content-Type": v1.MediaTypeImageManifest}),
+			http.StatusBadRequest, "DIGEST_INVALID", "push manifest by wrong digest")
+	})
+
+	t.Run("invalid manifest", func(t *testing.T) {
+		c := c.sub(t)
+		c.expectError(c.do(http.MethodPut, fmt.Sprintf("/v2/%s/manifests/broken", repo), []byte("{not json"),
+			map[string]string{"Content-Type": v1.MediaTypeImageManifest}),
+			http.StatusBadRequest, "MANIFEST_INVALID", "push invalid manifest")
+	})
+}
+
+func TestConformanceContentDiscovery(t *testing.T) {
+	c := newConformanceRegistry(t)
+	repo := "conformance/discovery"
+	img := newImage(t, "discovery", nil, "")
+	tags := []string{"a", "b", "c", "d"}
+	for _, tag := range tags {
+		c.pushImage(repo, tag, img)
+	}
+
+	t.Run("list tags", func(t *testing.T) {
+		c := c.sub(t)
+		resp := c.do(http.MethodGet, fmt.Sprintf("/v2/%s/tags/list", repo), nil, nil)
+		c.expect(resp, http.StatusOK, "list tags")
+		var list struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}
+		if err := json.Unmarshal(resp.body, &list); err != nil {
+			t.Fatalf("list tags: %v: %s", err, resp.body)
+		}
+		if list.Name != repo || strings.Join(list.Tags, ",") != strings.Join(tags, ",") {
+			t.Errorf("list tags: got %+v", list)
+		}
+	})
+
+	t.Run("list tags paginated", func(t *testing.T) {
+		t.Skip("tags/list ignores n and last")
+	})
+
+	t.Run("referrers", func(t *testing.T) {
+		c := c.sub(t)
+		signature := newImage(t, "signature", img.descriptor(), "application/vnd.example.signature")
+		sbom := newImage(t, "sbom", img.descriptor(), "application/vnd.example.sbom")
+		for _, referrer := range []image{signature, sbom} {
+			resp := c.pushImage(repo, referrer.digest.String(), referrer)
+			if got := resp.Header.Get("OCI-Subject"); got != img.digest.String() {
+				t.Errorf("push referrer: OCI-Subject %q, want %s", got, img.digest)
+			}
+		}
+
+		resp := c.do(http.MethodGet, fmt.Sprintf("/v2/%s/referrers/%s", repo, img.digest), nil, nil)
+		c.expect(resp, http.StatusOK, "list referrers")
+		if got := resp.Header.Get("Content-Type"); got != v1.MediaTypeImageIndex {
+			t.Errorf("list referrers: Content-Type %s", got)
+		}
+		var index v1.Index
+		if err := json.Unmarshal(resp.body, &index); err != nil {
+			t.Fatalf("list referrers: %v: %s", err, resp.body)
+		}
+		if len(index.Manifests) != 2 {
+			t.Fatalf("list referrers: got %d, want 2: %s", len(index.Manifests), resp.body)
+		}
+
+		resp = c.do(http.MethodGet, fmt.Sprintf("/v2/%s/referrers/%s?artifactType=application/vnd.example.sbom", repo, img.digest), nil, nil)
+		c.expect(resp, http.StatusOK, "list filtered referrers")
+		if got := resp.Header.Get("OCI-Filters-Applied"); got != "artifactType" {
+			t.Errorf("list filtered referrers: OCI-Filters-Applied %q", got)
+		}
+		index = v1.Index{}
+		if err := json.Unmarshal(resp.body, &index); err != nil {
+			t.Fatalf("list filtered referrers: %v: %s", err, resp.body)
+		}
+		if len(index.Manifests) != 1 || index.Manifests[0].Digest != sbom.digest || index.Manifests[0].ArtifactType != "application/vnd.example.sbom" {
+			t.Errorf("list filtered referrers: got %s", resp.body)
+		}
+
+		resp = c.do(http.MethodGet, fmt.Sprintf("/v2/%s/referrers/%s", repo, digest.FromString("no referrers")), nil, nil)
+		c.expect(resp, http.StatusOK, "list referrers of unknown manifest")
+	})
+}
+
+func TestConformanceContentManagement(t *testing.T) {
+	c := newConformanceRegistry(t)
+	repo := "conformance/management"
+	img := newImage(t, "management", nil, "")
+	c.pushImage(repo, "keep", img)
+	c.pushImage(repo, "drop", img)
+
+	t.Run("delete tag", func(t *testing.T) {
+		c := c.sub(t)
+		c.expect(c.do(http.MethodDelete, fmt.Sprintf("/v2/%s/manifests/drop", repo), nil, nil), http.StatusAccepted, "delete tag")
+		c.expect(c.do(http.MethodGet, fmt.Sprintf("/v2/%s/manifests/drop", repo), nil, nil), http.StatusNotFound, "get deleted tag")
+		c.expect(c.do(http.MethodGet, fmt.Sprintf("/v2/%s/manifests/keep", repo), nil, nil), http.StatusOK, "get other tag")
+	})
+
+	t.Run("delete manifest", func(t *testing.T) {
+		c := c.sub(t)
+		c.expect(c.do(http.MethodDelete, fmt.Sprintf("/v2/%s/manifests/%s", repo, img.digest), nil, nil), http.StatusAccepted, "delete manifest")
+		c.expect(c.do(http.MethodGet, fmt.Sprintf("/v2/%s/manifests/%s", repo, img.digest), nil, nil), http.StatusNotFound, "get deleted manifest")
+		c.expect(c.do(http.MethodDelete, fmt.Sprintf("/v2/%s/manifests/%s", repo, img.digest), nil, nil), http.StatusNotFound, "delete deleted manifest")
+	})
+
+	t.Run("delete blob", func(t *testing.T) {
+		t.Skip("blob deletion is accepted but left to garbage collection")
+	})
+}
@@ -0,0 +1,98 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CopyImage points dstRepo:dstTag at the manifest behind srcRepo:srcRef. Blobs
+// are shared across the bucket, so only links and metadata are written, except
+// in the OCI layout where the blobs are copied to dstRepo.
+func (r *Registry) CopyImage(ctx context.Context, srcRepo string, srcRef string, dstRepo string, dstTag string) (digest.Digest, error) {
+	if isDigest(dstTag) {
+		return "", fmt.Errorf("destination must be a tag, got %q", dstTag)
+	}
+	_, manifestBytes, err := r.getStoredManifest(ctx, srcRepo, srcRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to get source manifest: %w", err)
+	}
+	push, err := r.admitManifest(ctx, dstRepo, dstTag, manifestBytes)
+	if err != nil {
+		return "", err
+	}
+
+	sha := push.Digest
+	recheck := func(ctx context.Context) error { return r.checkTagWrite(ctx, dstRepo, dstTag, sha) }
+	if err := r.linkManifest(ctx, srcRepo, dstRepo, dstTag, manifestBytes, recheck); err != nil {
+		return "", err
+	}
+	r.replicator.enqueue(dstRepo, dstTag, sha)
+	r.scans.enqueue(dstRepo, dstTag, manifestBytes)
+	r.manifestPushed(ctx, push)
+	r.audit(ctx, AuditImageCopy, dstRepo, dstTag, sha.String())
+	r.recordPush(dstRepo, dstTag)
+	return sha, nil
+}
+
+func (r *Registry) linkManifest(ctx context.Context, srcRepo string, repo string, reference string, manifestBytes []byte, checkTag func(context.Context) error) error {
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range manifest.Manifests {
+		childBytes, err := r.getManifestBlob(ctx, srcRepo, child.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to get child manifest %s: %w", child.Digest, err)
+		}
+		if err := r.linkManifest(ctx, srcRepo, repo, child.Digest.String(), childBytes, nil); err != nil {
+			return err
+		}
+	}
+	for _, blob := range manifest.blobs() {
+		var err error
+		if r.layout == LayoutOCI {
+			err = r.copyOCIBlob(ctx, srcRepo, repo, blob.Digest)
+		} else {
+			err = r.putLink(ctx, layerLinkKey(repo, blob.Digest), blob.Digest)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to link blob %s: %w", blob.Digest, err)
+		}
+	}
+
+	var imageManifest v1.Manifest
+	if err := json.Unmarshal(manifestBytes, &imageManifest); err != nil {
+		return fmt.Errorf("error unmarshalling manifest: %w", err)
+	}
+	return r.storeManifestIf(ctx, repo, reference, manifestBytes, &imageManifest, nil, checkTag)
+}
+
+func (r *Registry) putLink(ctx context.Context, key string, dgst digest.Digest) error {
+	_, err := r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &r.bucket,
+		Key:    &key,
+		Body:   strings.NewReader(dgst.String()),
+	}, forcePathStyle)
+	return err
+}
+
+func (r *Registry) copyOCIBlob(ctx context.Context, srcRepo string, dstRepo string, dgst digest.Digest) error {
+	if srcRepo == dstRepo {
+		return nil
+	}
+	key := ociBlobKey(dstRepo, dgst)
+	_, err := r.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     &r.bucket,
+		Key:        &key,
+		CopySource: aws.String(r.bucket + "/" + ociBlobKey(srcRepo, dgst)),
+	}, forcePathStyle)
+	return err
+}
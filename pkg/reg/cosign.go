@@ -0,0 +1,553 @@
+package reg
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var ErrSignatureRequired = errors.New("no trusted signature")
+
+const (
+	cosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	cosignSimpleSigningType     = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertAnnotation        = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+
+	maxSignaturePayloadSize = 1 << 20
+)
+
+var (
+	// Fulcio certificate extensions naming the OIDC issuer, the first one
+	// being deprecated in favour of the second.
+	oidFulcioIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// SignaturePolicyConfig is the JSON trust configuration loaded with
+// LoadSignaturePolicies. The first policy matching a repository applies.
+type SignaturePolicyConfig struct {
+	// PEM file with the Fulcio root and intermediate certificates that
+	// keyless signing certificates must chain to.
+	FulcioRoots string `json:"fulcioRoots,omitempty"`
+	// PEM public key of the Rekor transparency log, inline or as a file path.
+	RekorPublicKey string `json:"rekorPublicKey,omitempty"`
+	// Rekor server that inclusion proofs are fetched from. Without it, only
+	// the log's signed promise of inclusion in the signature is checked.
+	RekorURL string            `json:"rekorUrl,omitempty"`
+	Policies []SignaturePolicy `json:"policies"`
+}
+
+type SignaturePolicy struct {
+	// Repository globs, as for --anonymous-pull.
+	Repositories []string `json:"repositories"`
+	// "push" requires a signature on the digest a tag is pushed to, "pull" on
+	// every manifest served.
+	Enforce []string `json:"enforce"`
+	// PEM public keys, inline or as file paths relative to the configuration.
+	Keys    []string          `json:"keys,omitempty"`
+	Keyless []KeylessIdentity `json:"keyless,omitempty"`
+	// Require signatures to be recorded in the Rekor transparency log.
+	TransparencyLog bool `json:"transparencyLog,omitempty"`
+}
+
+// KeylessIdentity is a signer identity from a Fulcio certificate, the OIDC
+// issuer and the subject (email or URI), each either exact or a pattern.
+type KeylessIdentity struct {
+	Issuer        string `json:"issuer,omitempty"`
+	IssuerRegexp  string `json:"issuerRegexp,omitempty"`
+	Subject       string `json:"subject,omitempty"`
+	SubjectRegexp string `json:"subjectRegexp,omitempty"`
+}
+
+// SignatureVerifier checks cosign signatures, attached either through the
+// referrers API or as "sha256-<digest>.sig" tags, against the policies.
+//
+// Keyless certificates are checked against the Fulcio roots as of their
+// issuance, and their signatures must have been logged in Rekor meanwhile.
+// Policies may also require the Rekor entries of signatures by keys.
+type SignatureVerifier struct {
+	policies   []*signaturePolicy
+	roots      *x509.CertPool
+	fulcioPool []*x509.Certificate
+	rekor      *rekorLog
+	verified   *expirable.LRU[string, struct{}]
+}
+
+type signaturePolicy struct {
+	repositories []repoTagPattern
+	push         bool
+	pull         bool
+	keys         []crypto.PublicKey
+	identities   []keylessIdentity
+	// Require an entry in the transparency log.
+	transparencyLog bool
+}
+
+type keylessIdentity struct {
+	issuer        string
+	issuerPattern *regexp.Regexp
+	subject       string
+	pattern       *regexp.Regexp
+}
+
+func LoadSignaturePolicies(path string) (*SignatureVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature policies: %w", err)
+	}
+	var config SignaturePolicyConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse signature policies: %w", err)
+	}
+	return NewSignatureVerifier(config, filepath.Dir(path))
+}
+
+// NewSignatureVerifier resolves relative file paths in config against dir.
+func NewSignatureVerifier(config SignaturePolicyConfig, dir string) (*SignatureVerifier, error) {
+	v := &SignatureVerifier{
+		verified: expirable.NewLRU[string, struct{}](4096, nil, time.Minute),
+	}
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	if config.FulcioRoots != "" {
+		data, err := os.ReadFile(resolve(config.FulcioRoots))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Fulcio roots: %w", err)
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Fulcio roots: %w", err)
+		}
+		v.roots = x509.NewCertPool()
+		for _, cert := range certs {
+			if isSelfSigned(cert) {
+				v.roots.AddCert(cert)
+			} else {
+				v.fulcioPool = append(v.fulcioPool, cert)
+			}
+		}
+	}
+
+	if config.RekorPublicKey != "" {
+		data := []byte(config.RekorPublicKey)
+		if !strings.HasPrefix(strings.TrimSpace(config.RekorPublicKey), "-----BEGIN") {
+			var err error
+			if data, err = os.ReadFile(resolve(config.RekorPublicKey)); err != nil {
+				return nil, fmt.Errorf("failed to read Rekor public key: %w", err)
+			}
+		}
+		rekor, err := newRekorLog(data, config.RekorURL)
+		if err != nil {
+			return nil, err
+		}
+		v.rekor = rekor
+	} else if config.RekorURL != "" {
+		return nil, errors.New("rekorUrl needs rekorPublicKey")
+	}
+
+	for i, p := range config.Policies {
+		policy := &signaturePolicy{transparencyLog: p.TransparencyLog}
+		for _, pattern := range p.Repositories {
+			policy.repositories = append(policy.repositories, parseRepoPattern(pattern))
+		}
+		for _, enforce := range p.Enforce {
+			switch enforce {
+			case "push":
+				policy.push = true
+			case "pull":
+				policy.pull = true
+			default:
+				return nil, fmt.Errorf("policy %d: invalid enforce %q, expected push or pull", i, enforce)
+			}
+		}
+		for _, key := range p.Keys {
+			data := []byte(key)
+			if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+				var err error
+				if data, err = os.ReadFile(resolve(key)); err != nil {
+					return nil, fmt.Errorf("policy %d: failed to read key: %w", i, err)
+				}
+			}
+			pub, err := parsePublicKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("policy %d: %w", i, err)
+			}
+			policy.keys = append(policy.keys, pub)
+		}
+		for _, id := range p.Keyless {
+			if (id.Issuer == "") == (id.IssuerRegexp == "") || (id.Subject == "") == (id.SubjectRegexp == "") {
+				return nil, fmt.Errorf("policy %d: keyless identities need either issuer or issuerRegexp, and either subject or subjectRegexp", i)
+			}
+			identity := keylessIdentity{issuer: id.Issuer, subject: id.Subject}
+			if id.IssuerRegexp != "" {
+				pattern, err := regexp.Compile("^(?:" + id.IssuerRegexp + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("policy %d: invalid issuerRegexp: %w", i, err)
+				}
+				identity.issuerPattern = pattern
+			}
+			if id.SubjectRegexp != "" {
+				pattern, err := regexp.Compile("^(?:" + id.SubjectRegexp + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("policy %d: invalid subjectRegexp: %w", i, err)
+				}
+				identity.pattern = pattern
+			}
+			policy.identities = append(policy.identities, identity)
+		}
+		if len(p.Keyless) > 0 && v.roots == nil {
+			return nil, fmt.Errorf("policy %d: keyless identities need fulcioRoots", i)
+		}
+		// Only the log vouches that a short-lived certificate was used while
+		// valid, rather than by whoever got its key later.
+		if len(p.Keyless) > 0 && !policy.transparencyLog {
+			return nil, fmt.Errorf("policy %d: keyless identities need transparencyLog", i)
+		}
+		if policy.transparencyLog && v.rekor == nil {
+			return nil, fmt.Errorf("policy %d: transparencyLog needs rekorPublicKey", i)
+		}
+		if len(policy.keys) == 0 && len(policy.identities) == 0 {
+			return nil, fmt.Errorf("policy %d: no keys or keyless identities to trust", i)
+		}
+		v.policies = append(v.policies, policy)
+	}
+	return v, nil
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM public key found")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return pub, nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return certs, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return cert.CheckSignatureFrom(cert) == nil
+}
+
+func (v *SignatureVerifier) policyFor(repo string) *signaturePolicy {
+	for _, policy := range v.policies {
+		for _, pattern := range policy.repositories {
+			if pattern.matchesRepo(repo) {
+				return policy
+			}
+		}
+	}
+	return nil
+}
+
+// verifyPayload checks a cosign signature over payload against the policy's
+// keys, or against its keyless identities if a certificate is attached, and
+// then against its Rekor bundle if the policy requires one.
+func (v *SignatureVerifier) verifyPayload(ctx context.Context, policy *signaturePolicy, payload []byte, sig []byte, certPEM string, chainPEM string, bundle string) error {
+	cert, err := v.verifySigner(policy, payload, sig, certPEM, chainPEM)
+	if err != nil {
+		return err
+	}
+	if policy.transparencyLog {
+		return v.rekor.verify(ctx, bundle, payload, sig, cert)
+	}
+	return nil
+}
+
+// verifySigner returns the signing certificate of keyless signatures.
+func (v *SignatureVerifier) verifySigner(policy *signaturePolicy, payload []byte, sig []byte, certPEM string, chainPEM string) (*x509.Certificate, error) {
+	if certPEM == "" {
+		for _, key := range policy.keys {
+			if verifySignature(key, payload, sig) {
+				return nil, nil
+			}
+		}
+		return nil, errors.New("signature does not match any trusted key")
+	}
+
+	if len(policy.identities) == 0 {
+		return nil, errors.New("keyless signatures are not trusted")
+	}
+	certs, err := parseCertificates([]byte(certPEM))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing certificate: %w", err)
+	}
+	cert := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range v.fulcioPool {
+		intermediates.AddCert(c)
+	}
+	if chainPEM != "" {
+		chain, err := parseCertificates([]byte(chainPEM))
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate chain: %w", err)
+		}
+		for _, c := range chain {
+			if !isSelfSigned(c) {
+				intermediates.AddCert(c)
+			}
+		}
+	}
+	// Fulcio certificates only live for minutes, so they are checked as of
+	// when they were issued.
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   cert.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("untrusted signing certificate: %w", err)
+	}
+	if !matchesIdentity(cert, policy.identities) {
+		return nil, errors.New("signing certificate identity is not trusted")
+	}
+	if !verifySignature(cert.PublicKey, payload, sig) {
+		return nil, errors.New("signature does not match its certificate")
+	}
+	return cert, nil
+}
+
+func matchesIdentity(cert *x509.Certificate, identities []keylessIdentity) bool {
+	issuer := certIssuer(cert)
+	var subjects []string
+	subjects = append(subjects, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	for _, id := range identities {
+		if id.issuerPattern != nil {
+			if !id.issuerPattern.MatchString(issuer) {
+				continue
+			}
+		} else if id.issuer != issuer {
+			continue
+		}
+		for _, subject := range subjects {
+			if subject == id.subject || (id.pattern != nil && id.pattern.MatchString(subject)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func certIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidFulcioIssuerV2):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+				return issuer
+			}
+		case ext.Id.Equal(oidFulcioIssuerV1):
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+func verifySignature(pub crypto.PublicKey, payload []byte, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil ||
+			rsa.VerifyPSS(key, crypto.SHA256, hash[:], sig, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, payload, sig)
+	}
+	return false
+}
+
+// simpleSigningPayload is the part of cosign's signed payload that binds a
+// signature to a manifest.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// attachedArtifactTypes are the artifact and config media types of
+// signatures and attestations.
+var attachedArtifactTypes = []string{
+	cosignSignatureArtifactType,
+	notationSignatureArtifactType,
+	"application/vnd.dsse.envelope.v1+json",
+	"application/vnd.in-toto+json",
+	"application/vnd.dev.sigstore.bundle.v0.3+json",
+}
+
+// isAttachedArtifact tells whether a manifest is a signature or attestation
+// attached to an image, which is never itself verified. Its config must be
+// one of a signature, or empty with the artifact type of one: anyone may give
+// an image a subject, a tag, or an artifact type that looks like one of a
+// signature, but an image needs its config.
+func isAttachedArtifact(m *anyManifest) bool {
+	if m.Config == nil {
+		return false
+	}
+	if m.Config.MediaType == v1.MediaTypeEmptyJSON {
+		return slices.Contains(attachedArtifactTypes, m.ArtifactType)
+	}
+	return slices.Contains(attachedArtifactTypes, m.Config.MediaType)
+}
+
+// requireSignature returns ErrSignatureRequired unless a manifest in a
+// repository protected for the given operation has a trusted signature.
+func (r *Registry) requireSignature(ctx context.Context, name string, reference string, manifestBytes []byte, operation string) error {
+	if r.signatures == nil {
+		return nil
+	}
+	policy := r.signatures.policyFor(name)
+	if policy == nil || (operation == "push" && !policy.push) || (operation == "pull" && !policy.pull) {
+		return nil
+	}
+	m, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	if isAttachedArtifact(m) {
+		return nil
+	}
+
+	dgst := digest.FromBytes(manifestBytes)
+	key := name + "@" + dgst.String()
+	if _, ok := r.signatures.verified.Get(key); ok {
+		return nil
+	}
+	reason, err := r.verifySignatures(ctx, name, dgst, policy)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return fmt.Errorf("%w for %s@%s: %s", ErrSignatureRequired, name, dgst, reason)
+	}
+	r.signatures.verified.Add(key, struct{}{})
+	return nil
+}
+
+// verifySignatures returns why none of the signatures of dgst is trusted, or
+// nothing if one is.
+func (r *Registry) verifySignatures(ctx context.Context, name string, dgst digest.Digest, policy *signaturePolicy) (string, error) {
+	var manifests [][]byte
+	if _, sigBytes, err := r.getStoredManifest(ctx, name, referrersTag(dgst)+".sig"); err == nil {
+		manifests = append(manifests, sigBytes)
+	}
+	referrers, err := r.Referrers(ctx, name, dgst, cosignSignatureArtifactType)
+	if err != nil {
+		return "", err
+	}
+	for _, desc := range referrers {
+		_, sigBytes, err := r.getManifestByDigest(ctx, name, desc.Digest)
+		if err != nil {
+			r.logger.Warn("error reading signature", "repository", name, "digest", desc.Digest, "error", err)
+			continue
+		}
+		manifests = append(manifests, sigBytes)
+	}
+	if len(manifests) == 0 {
+		return "no signatures found", nil
+	}
+
+	reason := "no cosign signatures found"
+	for _, sigBytes := range manifests {
+		m, err := parseAnyManifest(sigBytes)
+		if err != nil {
+			continue
+		}
+		for _, layer := range m.Layers {
+			if err := r.verifyCosignLayer(ctx, name, dgst, layer, policy); err != nil {
+				reason = err.Error()
+				continue
+			}
+			return "", nil
+		}
+	}
+	return reason, nil
+}
+
+func (r *Registry) verifyCosignLayer(ctx context.Context, name string, dgst digest.Digest, layer v1.Descriptor, policy *signaturePolicy) error {
+	encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+	if !ok || layer.MediaType != cosignSimpleSigningType {
+		return errors.New("no cosign signatures found")
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if layer.Size > maxSignaturePayloadSize {
+		return errors.New("signature payload too large")
+	}
+	payload, err := r.getManifestBlob(ctx, name, layer.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to read signature payload: %w", err)
+	}
+	if digest.FromBytes(payload) != layer.Digest {
+		return errors.New("signature payload does not match its digest")
+	}
+	var signed simpleSigningPayload
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return fmt.Errorf("invalid signature payload: %w", err)
+	}
+	if signed.Critical.Image.DockerManifestDigest != dgst.String() {
+		return errors.New("signature is for another manifest")
+	}
+	return r.signatures.verifyPayload(ctx, policy, payload, sig, layer.Annotations[cosignCertAnnotation], layer.Annotations[cosignChainAnnotation], layer.Annotations[cosignBundleAnnotation])
+}
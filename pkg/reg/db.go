@@ -2,19 +2,31 @@ package reg
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	_ "github.com/tursodatabase/libsql-client-go/libsql"
 )
 
 type RegistryDB struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	logger *slog.Logger
+	// Whether the search index is an FTS5 table, which needs SQLite built
+	// with the sqlite_fts5 tag.
+	fts bool
+	// Set when the search index is an FTS5 table but FTS5 is not available.
+	searchDisabled bool
 }
 
-func initSQLite(path string) (*RegistryDB, error) {
+func initSQLite(path string, logger *slog.Logger) (*RegistryDB, error) {
 	db, err := sqlx.Open("sqlite3", path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
@@ -23,6 +35,25 @@ func initSQLite(path string) (*RegistryDB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to set journal mode: %w", err)
 	}
+	return initSchema(db, logger)
+}
+
+// initLibSQL opens a database on a libsql server, like sqld or Turso, which
+// several registries share. It speaks the same SQL as SQLite.
+func initLibSQL(url string, logger *slog.Logger) (*RegistryDB, error) {
+	db, err := sqlx.Open("libsql", url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return initSchema(db, logger)
+}
+
+func initSchema(db *sqlx.DB, logger *slog.Logger) (*RegistryDB, error) {
+	var err error
 
 	tables := []string{
 		`CREATE TABLE IF NOT EXISTS tags (
@@ -46,6 +77,36 @@ func initSQLite(path string) (*RegistryDB, error) {
 			media_type TEXT NOT NULL,
 			size INTEGER NOT NULL
 		);`,
+		`CREATE TABLE IF NOT EXISTS replication_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			target TEXT NOT NULL,
+			repository TEXT NOT NULL,
+			reference TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			next_attempt DATETIME DEFAULT CURRENT_TIMESTAMP,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			action TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			next_attempt DATETIME DEFAULT CURRENT_TIMESTAMP,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			delivered_at DATETIME
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status ON webhook_deliveries(status, next_attempt);`,
+		`CREATE TABLE IF NOT EXISTS blob_verifications (
+			digest TEXT PRIMARY KEY,
+			error TEXT,
+			verified_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
 		`CREATE TABLE IF NOT EXISTS upload_sessions (
 			upload_id TEXT PRIMARY KEY,
 			repository TEXT NOT NULL,
@@ -57,19 +118,360 @@ func initSQLite(path string) (*RegistryDB, error) {
 			total_size INTEGER,
 			uploaded_size INTEGER DEFAULT 0
 		);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL DEFAULT '',
+			addr TEXT NOT NULL DEFAULT '',
+			repository TEXT NOT NULL,
+			reference TEXT NOT NULL DEFAULT '',
+			digest TEXT NOT NULL DEFAULT '',
+			exported_at DATETIME
+		);`,
+		`CREATE INDEX IF NOT EXISTS audit_log_repository ON audit_log(repository, id);`,
+		`CREATE TABLE IF NOT EXISTS tag_changes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			change TEXT NOT NULL,
+			repository TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			digest TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS tag_changes_tag ON tag_changes(repository, tag, id);`,
+		`CREATE INDEX IF NOT EXISTS tag_changes_timestamp ON tag_changes(timestamp);`,
+		`CREATE TABLE IF NOT EXISTS usage_counters (
+			repository TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			pulls INTEGER NOT NULL DEFAULT 0,
+			pushes INTEGER NOT NULL DEFAULT 0,
+			last_pulled DATETIME,
+			last_pushed DATETIME,
+			PRIMARY KEY(repository, tag)
+		);`,
+		`CREATE TABLE IF NOT EXISTS image_configs (
+			digest TEXT PRIMARY KEY,
+			os TEXT NOT NULL DEFAULT '',
+			architecture TEXT NOT NULL DEFAULT '',
+			variant TEXT NOT NULL DEFAULT '',
+			os_version TEXT NOT NULL DEFAULT '',
+			created DATETIME
+		);`,
+		`CREATE TABLE IF NOT EXISTS image_labels (
+			config_digest TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY(config_digest, key)
+		);`,
+		`CREATE INDEX IF NOT EXISTS image_labels_key_value ON image_labels(key, value);`,
+		`CREATE TABLE IF NOT EXISTS referrers (
+			repository TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			media_type TEXT NOT NULL,
+			artifact_type TEXT NOT NULL DEFAULT '',
+			size INTEGER NOT NULL,
+			annotations TEXT,
+			PRIMARY KEY(repository, subject, digest)
+		);`,
+		`CREATE INDEX IF NOT EXISTS referrers_digest ON referrers(repository, digest);`,
+		`CREATE TABLE IF NOT EXISTS namespaces (
+			path TEXT PRIMARY KEY,
+			settings TEXT NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS scans (
+			repository TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			status TEXT NOT NULL,
+			summary TEXT,
+			vulnerabilities TEXT,
+			error TEXT,
+			queued BOOLEAN NOT NULL DEFAULT 1,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt DATETIME DEFAULT CURRENT_TIMESTAMP,
+			requested_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			scanned_at DATETIME,
+			PRIMARY KEY(repository, digest)
+		);`,
+		`CREATE INDEX IF NOT EXISTS scans_queued ON scans(queued, next_attempt);`,
+		`CREATE TABLE IF NOT EXISTS index_children (
+			repository TEXT NOT NULL,
+			index_digest TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			digest TEXT NOT NULL,
+			media_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			os TEXT NOT NULL DEFAULT '',
+			architecture TEXT NOT NULL DEFAULT '',
+			variant TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY(repository, index_digest, position)
+		);`,
+		`CREATE INDEX IF NOT EXISTS index_children_digest ON index_children(repository, digest);`,
+		`CREATE TABLE IF NOT EXISTS helm_charts (
+			digest TEXT PRIMARY KEY,
+			metadata TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS leases (
+			name TEXT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS blob_restores (
+			digest TEXT PRIMARY KEY,
+			storage_class TEXT NOT NULL,
+			status TEXT NOT NULL,
+			requested_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			restored_at DATETIME,
+			expires_at DATETIME
+		);`,
+		`CREATE TABLE IF NOT EXISTS blob_generations (
+			digest TEXT PRIMARY KEY,
+			generation INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS manifest_expiry (
+			repository TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			PRIMARY KEY(repository, digest)
+		);`,
+		`CREATE INDEX IF NOT EXISTS manifest_expiry_expires_at ON manifest_expiry(expires_at);`,
+		`CREATE TABLE IF NOT EXISTS proxy_tags (
+			repository TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			fetched_at DATETIME NOT NULL,
+			PRIMARY KEY(repository, tag)
+		);`,
 	}
 
 	for _, table := range tables {
-		slog.Debug("Creating table", "table", table)
+		logger.Debug("Creating table", "table", table)
 		_, err = db.Exec(table)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create table: %w", err)
 		}
 	}
 
-	return &RegistryDB{db: db}, nil
+	rdb := &RegistryDB{db: db, logger: logger}
+	if err := rdb.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return rdb, nil
+}
+
+func (r *RegistryDB) addColumn(table string, column string, definition string) error {
+	var exists int
+	query := `SELECT COUNT(*) FROM pragma_table_xinfo(?) WHERE name = ?`
+	if err := r.db.Get(&exists, query, table, column); err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	if exists > 0 {
+		return nil
+	}
+	r.logger.Debug("Adding column", "table", table, "column", column)
+	_, err := r.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) migrate() error {
+	if err := r.addColumn("manifests", "digest", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := r.db.Exec(`CREATE INDEX IF NOT EXISTS manifests_digest ON manifests(digest)`); err != nil {
+		return fmt.Errorf("failed to create manifests digest index: %w", err)
+	}
+	if _, err := r.db.Exec(`CREATE INDEX IF NOT EXISTS manifests_config_digest ON manifests(json_extract(manifest_json, '$.config.digest'))`); err != nil {
+		return fmt.Errorf("failed to create manifests config digest index: %w", err)
+	}
+	if err := r.addColumn("tags", "cached_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := r.addColumn("manifests", "artifact_type", "TEXT GENERATED ALWAYS AS ("+artifactTypeExpr+") VIRTUAL"); err != nil {
+		return err
+	}
+	if _, err := r.db.Exec(`CREATE INDEX IF NOT EXISTS manifests_artifact_type ON manifests(artifact_type)`); err != nil {
+		return fmt.Errorf("failed to create manifests artifact type index: %w", err)
+	}
+	if err := r.addColumn("manifests", "cached_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := r.addColumn("upload_sessions", "parts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := r.addColumn("webhook_deliveries", "content_type", "TEXT NOT NULL DEFAULT 'application/json'"); err != nil {
+		return err
+	}
+
+	var pending []struct {
+		RowID        int64  `db:"id"`
+		ManifestJSON string `db:"manifest_json"`
+	}
+	if err := r.db.Select(&pending, `SELECT rowid AS id, manifest_json FROM manifests WHERE digest IS NULL`); err != nil {
+		return fmt.Errorf("failed to find manifests without digest: %w", err)
+	}
+	for _, m := range pending {
+		_, err := r.db.Exec(`UPDATE manifests SET digest = ? WHERE rowid = ?`, digest.FromString(m.ManifestJSON).String(), m.RowID)
+		if err != nil {
+			return fmt.Errorf("failed to backfill manifest digest: %w", err)
+		}
+	}
+	return r.createSearchIndex()
+}
+
+const searchLabelsQuery = `SELECT COALESCE(group_concat(l.key || '=' || l.value, char(10)), '') FROM image_labels l
+	WHERE l.config_digest = (SELECT json_extract(m.manifest_json, '$.config.digest') FROM manifests m WHERE m.tag_rowid = %s)`
+
+// createSearchIndex sets up search_index with one row per tag, sharing the
+// tag's rowid, and triggers keeping it in sync with tags, manifests and
+// labels. Without FTS5 it is a plain table searched with LIKE. An FTS5 index
+// created by a build with FTS5 cannot be written without it, so such a build
+// drops the triggers and leaves search off, and the next build with FTS5
+// refills the index.
+func (r *RegistryDB) createSearchIndex() error {
+	var sourceID string
+	ftsAvailable := r.db.Get(&sourceID, `SELECT fts5_source_id()`) == nil
+
+	var exists int
+	if err := r.db.Get(&exists, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'search_index'`); err != nil {
+		return fmt.Errorf("failed to check search index: %w", err)
+	}
+	fill := exists == 0
+	if exists == 0 {
+		var err error
+		if ftsAvailable {
+			_, err = r.db.Exec(`CREATE VIRTUAL TABLE search_index USING fts5(repository, tag, labels)`)
+		} else {
+			r.logger.Warn("FTS5 is not available, search falls back to substring matching")
+			_, err = r.db.Exec(`CREATE TABLE search_index (id INTEGER PRIMARY KEY, repository TEXT NOT NULL, tag TEXT NOT NULL, labels TEXT NOT NULL)`)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create search index: %w", err)
+		}
+	}
+	var sqlText string
+	if err := r.db.Get(&sqlText, `SELECT sql FROM sqlite_master WHERE name = 'search_index'`); err != nil {
+		return fmt.Errorf("failed to check search index: %w", err)
+	}
+	r.fts = strings.Contains(strings.ToLower(sqlText), "using fts5")
+
+	if r.fts && !ftsAvailable {
+		r.logger.Warn("The search index needs FTS5, which is not available, search is disabled")
+		r.searchDisabled = true
+		for _, trigger := range searchTriggers {
+			if _, err := r.db.Exec(`DROP TRIGGER IF EXISTS ` + trigger); err != nil {
+				return fmt.Errorf("failed to drop search trigger: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if !fill {
+		var triggers int
+		query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'search\_%' ESCAPE '\'`
+		if err := r.db.Get(&triggers, query); err != nil {
+			return fmt.Errorf("failed to check search triggers: %w", err)
+		}
+		// The index missed the writes made while the triggers were dropped.
+		if triggers < len(searchTriggers) {
+			if _, err := r.db.Exec(`DELETE FROM search_index`); err != nil {
+				return fmt.Errorf("failed to clear search index: %w", err)
+			}
+			fill = true
+		}
+	}
+	if fill {
+		_, err := r.db.Exec(`INSERT INTO search_index (rowid, repository, tag, labels)
+			SELECT t.rowid, t.repository, t.name, (` + fmt.Sprintf(searchLabelsQuery, "t.rowid") + `) FROM tags t`)
+		if err != nil {
+			return fmt.Errorf("failed to fill search index: %w", err)
+		}
+	}
+
+	triggers := []string{
+		`CREATE TRIGGER IF NOT EXISTS search_tag_insert AFTER INSERT ON tags BEGIN
+			INSERT INTO search_index (rowid, repository, tag, labels) VALUES (new.rowid, new.repository, new.name, '');
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS search_tag_delete AFTER DELETE ON tags BEGIN
+			DELETE FROM search_index WHERE rowid = old.rowid;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS search_manifest_insert AFTER INSERT ON manifests BEGIN
+			UPDATE search_index SET labels = (` + fmt.Sprintf(searchLabelsQuery, "new.tag_rowid") + `) WHERE rowid = new.tag_rowid;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS search_manifest_update AFTER UPDATE OF manifest_json ON manifests BEGIN
+			UPDATE search_index SET labels = (` + fmt.Sprintf(searchLabelsQuery, "new.tag_rowid") + `) WHERE rowid = new.tag_rowid;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS search_label_insert AFTER INSERT ON image_labels BEGIN
+			UPDATE search_index SET labels = (` + fmt.Sprintf(searchLabelsQuery, "search_index.rowid") + `)
+			WHERE rowid IN (SELECT m.tag_rowid FROM manifests m WHERE json_extract(m.manifest_json, '$.config.digest') = new.config_digest);
+		END`,
+	}
+	for _, trigger := range triggers {
+		if _, err := r.db.Exec(trigger); err != nil {
+			return fmt.Errorf("failed to create search trigger: %w", err)
+		}
+	}
+	return nil
+}
+
+var searchTriggers = []string{
+	"search_tag_insert",
+	"search_tag_delete",
+	"search_manifest_insert",
+	"search_manifest_update",
+	"search_label_insert",
+}
+
+// ErrSearchUnavailable is returned by searches of an FTS5 index in a build
+// without FTS5.
+var ErrSearchUnavailable = errors.New("search needs FTS5, which this build lacks")
+
+// Search ranks tags by how well their repository, tag and labels match every
+// term of the query, and also returns the repositories whose name matches.
+func (r *RegistryDB) Search(terms []string, n int, offset int) ([]SearchResult, error) {
+	if r.searchDisabled {
+		return nil, ErrSearchUnavailable
+	}
+	var query string
+	var args []any
+	if r.fts {
+		quoted := make([]string, 0, len(terms))
+		for _, term := range terms {
+			quoted = append(quoted, `"`+strings.ReplaceAll(term, `"`, `""`)+`"*`)
+		}
+		query = `SELECT repository, tag, labels, ` + searchArtifactTypeColumn + `, -bm25(search_index, 10.0, 5.0, 1.0) AS score FROM search_index
+			WHERE search_index MATCH ? ORDER BY score DESC, repository, tag LIMIT ? OFFSET ?`
+		args = append(args, strings.Join(quoted, " "))
+	} else {
+		query = `SELECT repository, tag, labels, ` + searchArtifactTypeColumn + `, 0.0 AS score FROM search_index WHERE 1 = 1`
+		for _, term := range terms {
+			query += ` AND (repository || ' ' || tag || ' ' || labels) LIKE ? ESCAPE '\'`
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		}
+		query += ` ORDER BY repository, tag LIMIT ? OFFSET ?`
+	}
+	args = append(args, n, offset)
+
+	var results []SearchResult
+	if err := r.db.Select(&results, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+	return results, nil
 }
 
+// artifactTypeExpr mirrors anyManifest.artifactType: the artifactType field,
+// or else a config media type other than an image config or the empty config.
+var artifactTypeExpr = fmt.Sprintf(`COALESCE(json_extract(manifest_json, '$.artifactType'),
+	CASE WHEN json_extract(manifest_json, '$.config.mediaType') NOT IN ('%s', '%s', '%s')
+	THEN json_extract(manifest_json, '$.config.mediaType') END)`,
+	v1.MediaTypeImageConfig, mediaTypeDockerConfig, v1.MediaTypeEmptyJSON)
+
+const searchArtifactTypeColumn = `COALESCE((SELECT m.artifact_type FROM manifests m WHERE m.tag_rowid = search_index.rowid), '') AS artifact_type`
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 func (r *RegistryDB) GetManifest(repo string, tag string) (string, error) {
 	query := `SELECT manifest_json FROM manifests 
 		JOIN tags ON tags.rowid = manifests.tag_rowid
@@ -78,7 +480,7 @@ func (r *RegistryDB) GetManifest(repo string, tag string) (string, error) {
 	var manifestJSON string
 	err := r.db.Get(&manifestJSON, query, repo, tag)
 
-	slog.Debug("Retrieved manifest", "repo", repo, "tag", tag)
+	r.logger.Debug("Retrieved manifest", "repo", repo, "tag", tag)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return "", fmt.Errorf("manifest not found for repository %s and tag %s", repo, tag)
@@ -89,7 +491,25 @@ func (r *RegistryDB) GetManifest(repo string, tag string) (string, error) {
 	return manifestJSON, nil
 }
 
+type ManifestRecord struct {
+	Repository   string
+	Tag          string
+	ManifestJSON string
+	Manifest     *v1.Manifest
+}
+
 func (r *RegistryDB) PutManifest(repo string, tag string, manifestBytes string, manifest *v1.Manifest) error {
+	return r.PutManifests([]ManifestRecord{{
+		Repository:   repo,
+		Tag:          tag,
+		ManifestJSON: manifestBytes,
+		Manifest:     manifest,
+	}})
+}
+
+// PutManifests stores all records in a single transaction, which is much
+// cheaper than one transaction per manifest for bulk ingestion.
+func (r *RegistryDB) PutManifests(records []ManifestRecord) error {
 	tx, err := r.db.Beginx()
 	if err != nil {
 		return fmt.Errorf("failed to start transaction: %w", err)
@@ -100,59 +520,177 @@ func (r *RegistryDB) PutManifest(repo string, tag string, manifestBytes string,
 		}
 	}()
 
-	query := `INSERT INTO tags (repository, name) VALUES (?, ?) ON CONFLICT(repository, name) DO NOTHING`
-	_, err = tx.Exec(query, repo, tag)
+	stmts, err := prepareManifestStatements(tx)
+	if err != nil {
+		return err
+	}
+	defer stmts.close()
+
+	for _, record := range records {
+		if err = stmts.put(record); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+type manifestStatements struct {
+	insertTag      *sqlx.Stmt
+	selectTag      *sqlx.Stmt
+	upsertManifest *sqlx.Stmt
+	upsertLayer    *sqlx.Stmt
+	purgeLayers    *sqlx.Stmt
+	selectManifest *sqlx.Stmt
+	insertLayer    *sqlx.Stmt
+}
+
+func prepareManifestStatements(tx *sqlx.Tx) (*manifestStatements, error) {
+	stmts := &manifestStatements{}
+	queries := []struct {
+		stmt  **sqlx.Stmt
+		query string
+	}{
+		{&stmts.insertTag, `INSERT INTO tags (repository, name, cached_at) VALUES (?, ?, CURRENT_TIMESTAMP) ON CONFLICT(repository, name) DO NOTHING`},
+		{&stmts.selectTag, `SELECT rowid FROM tags WHERE repository = ? AND name = ?`},
+		{&stmts.upsertManifest, `INSERT INTO manifests (tag_rowid, manifest_json, digest, cached_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP) 
+			ON CONFLICT(tag_rowid) DO UPDATE SET manifest_json = ?, digest = ?, cached_at = CURRENT_TIMESTAMP`},
+		{&stmts.upsertLayer, `INSERT INTO layers (digest, media_type, size) VALUES (?, ?, ?) 
+			ON CONFLICT(digest) DO UPDATE SET media_type = ?, size = ?`},
+		{&stmts.purgeLayers, `DELETE FROM manifest_layers WHERE manifest_rowid = (SELECT rowid FROM manifests WHERE tag_rowid = ?)`},
+		{&stmts.selectManifest, `SELECT rowid FROM manifests WHERE tag_rowid = ?`},
+		{&stmts.insertLayer, `INSERT INTO manifest_layers (manifest_rowid, layer_digest, layer_index) VALUES (?, ?, ?)`},
+	}
+	for _, q := range queries {
+		stmt, err := tx.Preparex(q.query)
+		if err != nil {
+			stmts.close()
+			return nil, fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		*q.stmt = stmt
+	}
+	return stmts, nil
+}
+
+func (s *manifestStatements) close() {
+	for _, stmt := range []*sqlx.Stmt{s.insertTag, s.selectTag, s.upsertManifest, s.upsertLayer, s.purgeLayers, s.selectManifest, s.insertLayer} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+func (s *manifestStatements) put(record ManifestRecord) error {
+	_, err := s.insertTag.Exec(record.Repository, record.Tag)
 	if err != nil {
 		return fmt.Errorf("failed to register tag: %w", err)
 	}
 
 	var tagRowID int64
-	query = `SELECT rowid FROM tags WHERE repository = ? AND name = ?`
-	err = tx.Get(&tagRowID, query, repo, tag)
+	err = s.selectTag.Get(&tagRowID, record.Repository, record.Tag)
 	if err != nil {
 		return fmt.Errorf("failed to get tag rowid: %w", err)
 	}
 
-	query = `INSERT INTO manifests (tag_rowid, manifest_json) VALUES (?, ?) 
-		ON CONFLICT(tag_rowid) DO UPDATE SET manifest_json = ?`
-	_, err = tx.Exec(query, tagRowID, manifestBytes, manifestBytes)
+	manifestDigest := digest.FromString(record.ManifestJSON).String()
+	_, err = s.upsertManifest.Exec(tagRowID, record.ManifestJSON, manifestDigest, record.ManifestJSON, manifestDigest)
 	if err != nil {
 		return fmt.Errorf("failed to store manifest: %w", err)
 	}
 
-	query = `INSERT INTO layers (digest, media_type, size) VALUES (?, ?, ?) 
-		ON CONFLICT(digest) DO UPDATE SET media_type = ?, size = ?`
-	for _, layer := range manifest.Layers {
-		_, err = tx.Exec(query, layer.Digest.String(), layer.MediaType, layer.Size, layer.MediaType, layer.Size)
+	for _, layer := range record.Manifest.Layers {
+		_, err = s.upsertLayer.Exec(layer.Digest.String(), layer.MediaType, layer.Size, layer.MediaType, layer.Size)
 		if err != nil {
 			return fmt.Errorf("failed to store layer: %w", err)
 		}
 	}
 
-	purgeLayersQuery := `DELETE FROM manifest_layers WHERE manifest_rowid = (SELECT rowid FROM manifests WHERE tag_rowid = ?)`
-	_, err = tx.Exec(purgeLayersQuery, tagRowID)
+	_, err = s.purgeLayers.Exec(tagRowID)
 	if err != nil {
 		return fmt.Errorf("failed to delete existing manifest layers: %w", err)
 	}
 
 	var manifestRowID int64
-	query = `SELECT rowid FROM manifests WHERE tag_rowid = ?`
-	err = tx.Get(&manifestRowID, query, tagRowID)
+	err = s.selectManifest.Get(&manifestRowID, tagRowID)
 	if err != nil {
 		return fmt.Errorf("failed to get manifest rowid: %w", err)
 	}
 
-	for i, layer := range manifest.Layers {
-		_, err = tx.Exec(
-			`INSERT INTO manifest_layers (manifest_rowid, layer_digest, layer_index) VALUES (?, ?, ?)`,
-			manifestRowID,
-			layer.Digest.String(),
-			i,
-		)
+	for i, layer := range record.Manifest.Layers {
+		_, err = s.insertLayer.Exec(manifestRowID, layer.Digest.String(), i)
 		if err != nil {
 			return fmt.Errorf("failed to store manifest layer: %w", err)
 		}
 	}
+	return nil
+}
+
+func (r *RegistryDB) GetManifestByDigest(repo string, dgst string) (string, error) {
+	query := `SELECT manifest_json FROM manifests 
+		JOIN tags ON tags.rowid = manifests.tag_rowid
+		WHERE tags.repository = ? AND manifests.digest = ? LIMIT 1`
+
+	var manifestJSON string
+	err := r.db.Get(&manifestJSON, query, repo, dgst)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("manifest not found for repository %s and digest %s", repo, dgst)
+		}
+		return "", fmt.Errorf("failed to get manifest: %w", err)
+	}
+
+	return manifestJSON, nil
+}
+
+func (r *RegistryDB) ListTagsByDigest(repo string, dgst string) ([]string, error) {
+	var tags []string
+	query := `SELECT tags.name FROM tags 
+		JOIN manifests ON tags.rowid = manifests.tag_rowid
+		WHERE tags.repository = ? AND manifests.digest = ?`
+
+	err := r.db.Select(&tags, query, repo, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags by digest: %w", err)
+	}
+
+	return tags, nil
+}
+
+func (r *RegistryDB) DeleteTag(repo string, tag string) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	query := `DELETE FROM manifest_layers WHERE manifest_rowid IN (
+		SELECT manifests.rowid FROM manifests
+		JOIN tags ON tags.rowid = manifests.tag_rowid
+		WHERE tags.repository = ? AND tags.name = ?)`
+	_, err = tx.Exec(query, repo, tag)
+	if err != nil {
+		return fmt.Errorf("failed to delete manifest layers: %w", err)
+	}
+
+	query = `DELETE FROM manifests WHERE tag_rowid IN (SELECT rowid FROM tags WHERE repository = ? AND name = ?)`
+	_, err = tx.Exec(query, repo, tag)
+	if err != nil {
+		return fmt.Errorf("failed to delete manifest: %w", err)
+	}
+
+	query = `DELETE FROM tags WHERE repository = ? AND name = ?`
+	_, err = tx.Exec(query, repo, tag)
+	if err != nil {
+		return fmt.Errorf("failed to delete tag: %w", err)
+	}
 
 	if err = tx.Commit(); err != nil {
 		return fmt.Errorf("failed to commit transaction: %w", err)
@@ -184,9 +722,13 @@ func (r *RegistryDB) PutTags(repo string, tags []string) error {
 		}
 	}()
 
-	query := `INSERT INTO tags (repository, name) VALUES (?, ?) ON CONFLICT(repository, name) DO NOTHING`
+	stmt, err := tx.Preparex(`INSERT INTO tags (repository, name, cached_at) VALUES (?, ?, CURRENT_TIMESTAMP) ON CONFLICT(repository, name) DO NOTHING`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
 	for _, tag := range tags {
-		_, err := tx.Exec(query, repo, tag)
+		_, err = stmt.Exec(repo, tag)
 		if err != nil {
 			return fmt.Errorf("failed to register tag: %w", err)
 		}
@@ -199,12 +741,81 @@ func (r *RegistryDB) PutTags(repo string, tags []string) error {
 	return nil
 }
 
+type CacheEntry struct {
+	Repository       string         `db:"repository" json:"repository"`
+	Tag              string         `db:"tag" json:"tag"`
+	Digest           sql.NullString `db:"digest" json:"-"`
+	TagCachedAt      sql.NullTime   `db:"tag_cached_at" json:"-"`
+	ManifestCachedAt sql.NullTime   `db:"manifest_cached_at" json:"-"`
+}
+
+// CacheEntries lists what the database holds for a repository, or for a single
+// tag of it when tag is not empty. Tags cached before cached_at was tracked
+// have no timestamps.
+func (r *RegistryDB) CacheEntries(repo string, tag string) ([]CacheEntry, error) {
+	query := `SELECT t.repository AS repository, t.name AS tag, m.digest AS digest,
+		t.cached_at AS tag_cached_at, m.cached_at AS manifest_cached_at
+		FROM tags t LEFT JOIN manifests m ON m.tag_rowid = t.rowid
+		WHERE t.repository = ?`
+	args := []any{repo}
+	if tag != "" {
+		query += ` AND t.name = ?`
+		args = append(args, tag)
+	}
+	query += ` ORDER BY t.name`
+	var entries []CacheEntry
+	if err := r.db.Select(&entries, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to list cache entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (r *RegistryDB) CachedRepositories(prefix string) ([]string, error) {
+	var repos []string
+	query := `SELECT DISTINCT repository FROM tags WHERE substr(repository, 1, ?) = ? ORDER BY repository`
+	if err := r.db.Select(&repos, query, len(prefix), prefix); err != nil {
+		return nil, fmt.Errorf("failed to list cached repositories: %w", err)
+	}
+	return repos, nil
+}
+
+func (r *RegistryDB) EvictRepository(repo string) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	queries := []string{
+		`DELETE FROM manifest_layers WHERE manifest_rowid IN (
+			SELECT manifests.rowid FROM manifests
+			JOIN tags ON tags.rowid = manifests.tag_rowid
+			WHERE tags.repository = ?)`,
+		`DELETE FROM manifests WHERE tag_rowid IN (SELECT rowid FROM tags WHERE repository = ?)`,
+		`DELETE FROM tags WHERE repository = ?`,
+	}
+	for _, query := range queries {
+		if _, err = tx.Exec(query, repo); err != nil {
+			return fmt.Errorf("failed to evict repository: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
 func (r *RegistryDB) ListRepositories(continuationToken *string, n int) ([]string, *string, error) {
 	if continuationToken == nil {
 		token := ""
 		continuationToken = &token
 	}
-	query := `SELECT repository FROM tags WHERE repository > ? LIMIT ?`
+	query := `SELECT DISTINCT repository FROM tags WHERE repository > ? ORDER BY repository LIMIT ?`
 	var repos []string
 	err := r.db.Select(&repos, query, continuationToken, n)
 	if err != nil {
@@ -218,67 +829,494 @@ func (r *RegistryDB) ListRepositories(continuationToken *string, n int) ([]strin
 	return repos, &repos[len(repos)-1], nil
 }
 
-func (r *RegistryDB) Exists(repo string, tag string) bool {
-	query := `SELECT 1 FROM tags WHERE repository = ? AND name = ?`
-	var dummy int
-	return r.db.Get(&dummy, query, repo, tag) == nil
+type RepositorySummary struct {
+	Repository string `db:"repository" json:"repository"`
+	Tags       int    `db:"tags" json:"tags"`
+	Manifests  int    `db:"manifests" json:"manifests"`
+	Size       int64  `db:"size" json:"size"`
+}
+
+type TagSummary struct {
+	Tag        string     `db:"tag" json:"tag"`
+	Digest     string     `db:"digest" json:"digest"`
+	Layers     int        `db:"layers" json:"layers"`
+	Size       int64      `db:"size" json:"size"`
+	LastPushed *time.Time `db:"last_pushed" json:"lastPushed,omitempty"`
+	LastPulled *time.Time `db:"last_pulled" json:"lastPulled,omitempty"`
 }
 
-func (r *RegistryDB) CreateUploadSession(uploadID, repository, s3Key string) error {
-	query := `INSERT INTO upload_sessions (upload_id, repository, s3_key) VALUES (?, ?, ?)`
-	_, err := r.db.Exec(query, uploadID, repository, s3Key)
+// Repository sizes count every distinct layer once, even when shared between tags.
+const repositorySummaryQuery = `SELECT t.repository AS repository, COUNT(*) AS tags,
+		(SELECT COUNT(DISTINCT m.digest) FROM manifests m
+			JOIN tags t2 ON t2.rowid = m.tag_rowid
+			WHERE t2.repository = t.repository) AS manifests,
+		(SELECT COALESCE(SUM(l.size), 0) FROM layers l WHERE l.digest IN (
+			SELECT ml.layer_digest FROM manifest_layers ml
+			JOIN manifests m ON m.rowid = ml.manifest_rowid
+			JOIN tags t2 ON t2.rowid = m.tag_rowid
+			WHERE t2.repository = t.repository)) AS size
+		FROM tags t`
+
+func (r *RegistryDB) RepositorySummaries() ([]RepositorySummary, error) {
+	var summaries []RepositorySummary
+	err := r.db.Select(&summaries, repositorySummaryQuery+` GROUP BY t.repository ORDER BY t.repository`)
 	if err != nil {
-		return fmt.Errorf("failed to create upload session: %w", err)
+		return nil, fmt.Errorf("failed to summarize repositories: %w", err)
 	}
-	return nil
+	return summaries, nil
 }
 
-func (r *RegistryDB) UpdateUploadSession(uploadID, s3UploadID string, uploadedSize int64) error {
-	query := `UPDATE upload_sessions SET s3_upload_id = ?, uploaded_size = ?, last_activity = CURRENT_TIMESTAMP WHERE upload_id = ?`
-	_, err := r.db.Exec(query, s3UploadID, uploadedSize, uploadID)
+func (r *RegistryDB) RepositorySummary(repo string) (RepositorySummary, error) {
+	var summary RepositorySummary
+	err := r.db.Get(&summary, repositorySummaryQuery+` WHERE t.repository = ? GROUP BY t.repository`, repo)
 	if err != nil {
-		return fmt.Errorf("failed to update upload session: %w", err)
+		return summary, fmt.Errorf("failed to summarize repository: %w", err)
 	}
-	return nil
+	return summary, nil
 }
 
-func (r *RegistryDB) GetUploadSession(uploadID string) (string, string, int64, error) {
-	query := `SELECT COALESCE(s3_upload_id, ''), COALESCE(s3_key, ''), uploaded_size FROM upload_sessions WHERE upload_id = ?`
-	var s3UploadID, s3Key string
-	var uploadedSize int64
-	err := r.db.QueryRow(query, uploadID).Scan(&s3UploadID, &s3Key, &uploadedSize)
+func (r *RegistryDB) TagSummaries(repo string) ([]TagSummary, error) {
+	var summaries []TagSummary
+	query := `SELECT t.name AS tag, COALESCE(m.digest, '') AS digest,
+		COUNT(ml.layer_digest) AS layers, COALESCE(SUM(l.size), 0) AS size,
+		u.last_pushed AS last_pushed, u.last_pulled AS last_pulled
+		FROM tags t
+		LEFT JOIN manifests m ON m.tag_rowid = t.rowid
+		LEFT JOIN manifest_layers ml ON ml.manifest_rowid = m.rowid
+		LEFT JOIN layers l ON l.digest = ml.layer_digest
+		LEFT JOIN usage_counters u ON u.repository = t.repository AND u.tag = t.name
+		WHERE t.repository = ? GROUP BY t.rowid ORDER BY t.name`
+	err := r.db.Select(&summaries, query, repo)
 	if err != nil {
-		return "", "", 0, fmt.Errorf("failed to get upload session: %w", err)
+		return nil, fmt.Errorf("failed to summarize tags: %w", err)
 	}
-	return s3UploadID, s3Key, uploadedSize, nil
+	return summaries, nil
 }
 
-func (r *RegistryDB) DeleteUploadSession(uploadID string) error {
-	query := `DELETE FROM upload_sessions WHERE upload_id = ?`
-	_, err := r.db.Exec(query, uploadID)
-	if err != nil {
-		return fmt.Errorf("failed to delete upload session: %w", err)
+type namespaceRow struct {
+	Path      string    `db:"path"`
+	Settings  string    `db:"settings"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (r *RegistryDB) PutNamespace(path string, settings string) error {
+	query := `INSERT INTO namespaces (path, settings) VALUES (?, ?)
+		ON CONFLICT(path) DO UPDATE SET settings = excluded.settings, updated_at = CURRENT_TIMESTAMP`
+	if _, err := r.db.Exec(query, path, settings); err != nil {
+		return fmt.Errorf("failed to store namespace: %w", err)
 	}
 	return nil
 }
 
-func (r *RegistryDB) GetStaleUploadSessions(maxAge string) ([]string, error) {
-	query := `SELECT upload_id FROM upload_sessions WHERE last_activity < datetime('now', ?)`
-	var uploadIDs []string
-	err := r.db.Select(&uploadIDs, query, maxAge)
+func (r *RegistryDB) DeleteNamespace(path string) error {
+	res, err := r.db.Exec(`DELETE FROM namespaces WHERE path = ?`, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get stale upload sessions: %w", err)
+		return fmt.Errorf("failed to delete namespace: %w", err)
 	}
-	return uploadIDs, nil
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
-func (r *RegistryDB) ListAllTags(continuationToken *string, n int) ([]map[string]string, *string, error) {
-	if continuationToken == nil {
-		token := ""
-		continuationToken = &token
+// Namespaces returns the given namespaces that have settings, or all of them
+// when no path is given.
+func (r *RegistryDB) Namespaces(paths ...string) ([]namespaceRow, error) {
+	query := `SELECT path, settings, updated_at FROM namespaces ORDER BY path`
+	var args []any
+	if len(paths) > 0 {
+		var err error
+		query, args, err = sqlx.In(`SELECT path, settings, updated_at FROM namespaces WHERE path IN (?) ORDER BY path`, paths)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build namespace query: %w", err)
+		}
+	}
+	var rows []namespaceRow
+	if err := r.db.Select(&rows, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get namespaces: %w", err)
+	}
+	return rows, nil
+}
+
+// NamespaceUsage sums the distinct layers referenced by repositories under
+// prefix, and reports which of layers are among them already.
+func (r *RegistryDB) NamespaceUsage(prefix string, layers []string) (int64, []string, error) {
+	const namespaceLayers = `SELECT ml.layer_digest FROM manifest_layers ml
+		JOIN manifests m ON m.rowid = ml.manifest_rowid
+		JOIN tags t ON t.rowid = m.tag_rowid
+		WHERE substr(t.repository, 1, ?) = ?`
+	var usage int64
+	query := `SELECT COALESCE(SUM(size), 0) FROM layers WHERE digest IN (` + namespaceLayers + `)`
+	if err := r.db.Get(&usage, query, len(prefix), prefix); err != nil {
+		return 0, nil, fmt.Errorf("failed to get namespace usage: %w", err)
+	}
+	if len(layers) == 0 {
+		return usage, nil, nil
+	}
+	query, args, err := sqlx.In(`SELECT DISTINCT layer_digest FROM (`+namespaceLayers+`) WHERE layer_digest IN (?)`, len(prefix), prefix, layers)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to build namespace usage query: %w", err)
+	}
+	var present []string
+	if err := r.db.Select(&present, query, args...); err != nil {
+		return 0, nil, fmt.Errorf("failed to get namespace layers: %w", err)
+	}
+	return usage, present, nil
+}
+
+// AddUsage adds pending counts to both the tag's row and the repository's
+// total, which is kept under the empty tag.
+func (r *RegistryDB) AddUsage(pending map[usageKey]*usageDelta) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.Preparex(`INSERT INTO usage_counters (repository, tag, pulls, pushes, last_pulled, last_pushed)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(repository, tag) DO UPDATE SET
+			pulls = pulls + excluded.pulls,
+			pushes = pushes + excluded.pushes,
+			last_pulled = COALESCE(excluded.last_pulled, last_pulled),
+			last_pushed = COALESCE(excluded.last_pushed, last_pushed)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	nullTime := func(t time.Time) sql.NullTime {
+		return sql.NullTime{Time: t, Valid: !t.IsZero()}
+	}
+	for key, d := range pending {
+		for _, tag := range []string{key.tag, ""} {
+			_, err = stmt.Exec(key.repository, tag, d.Pulls, d.Pushes, nullTime(d.LastPulled), nullTime(d.LastPushed))
+			if err != nil {
+				return fmt.Errorf("failed to add usage: %w", err)
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) Popular(filter PopularityFilter) ([]UsageSummary, error) {
+	query := `SELECT repository, tag, pulls, pushes, last_pulled, last_pushed FROM usage_counters`
+	var args []any
+	if filter.Repository != "" {
+		query += ` WHERE repository = ? AND tag != ''`
+		args = append(args, filter.Repository)
+	} else {
+		query += ` WHERE tag = ''`
+	}
+	column, last := "pulls", "last_pulled"
+	if filter.OrderBy == "pushes" {
+		column, last = "pushes", "last_pushed"
+	}
+	if !filter.Since.IsZero() {
+		query += ` AND ` + last + ` >= ?`
+		args = append(args, filter.Since.UTC())
+	}
+	query += ` ORDER BY ` + column + ` DESC, repository, tag`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	var summaries []UsageSummary
+	if err := r.db.Select(&summaries, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	return summaries, nil
+}
+
+// TagUsage returns the usage of a tag, or nil if it was never pulled or
+// pushed.
+func (r *RegistryDB) TagUsage(repo string, tag string) (*UsageSummary, error) {
+	var summary UsageSummary
+	query := `SELECT repository, tag, pulls, pushes, last_pulled, last_pushed FROM usage_counters WHERE repository = ? AND tag = ?`
+	err := r.db.Get(&summary, query, repo, tag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tag usage: %w", err)
+	}
+	return &summary, nil
+}
+
+func (r *RegistryDB) HasImageConfig(dgst string) bool {
+	var dummy int
+	return r.db.Get(&dummy, `SELECT 1 FROM image_configs WHERE digest = ?`, dgst) == nil
+}
+
+func (r *RegistryDB) PutImageConfig(config ImageConfig) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec(`INSERT INTO image_configs (digest, os, architecture, variant, os_version, created) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(digest) DO NOTHING`, config.Digest, config.OS, config.Architecture, config.Variant, config.OSVersion, config.Created)
+	if err != nil {
+		return fmt.Errorf("failed to insert image config: %w", err)
+	}
+	for key, value := range config.Labels {
+		_, err = tx.Exec(`INSERT INTO image_labels (config_digest, key, value) VALUES (?, ?, ?)
+			ON CONFLICT(config_digest, key) DO NOTHING`, config.Digest, key, value)
+		if err != nil {
+			return fmt.Errorf("failed to insert image label: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) GetImageConfig(dgst string) (ImageConfig, error) {
+	var config ImageConfig
+	err := r.db.Get(&config, `SELECT digest, os, architecture, variant, os_version, created FROM image_configs WHERE digest = ?`, dgst)
+	if err != nil {
+		return config, fmt.Errorf("failed to get image config: %w", err)
+	}
+	labels, err := r.imageLabels([]string{dgst})
+	if err != nil {
+		return config, err
+	}
+	config.Labels = labels[dgst]
+	return config, nil
+}
+
+func (r *RegistryDB) imageLabels(configDigests []string) (map[string]map[string]string, error) {
+	labels := make(map[string]map[string]string)
+	if len(configDigests) == 0 {
+		return labels, nil
+	}
+	query, args, err := sqlx.In(`SELECT config_digest, key, value FROM image_labels WHERE config_digest IN (?)`, configDigests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build label query: %w", err)
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image labels: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dgst, key, value string
+		if err := rows.Scan(&dgst, &key, &value); err != nil {
+			return nil, fmt.Errorf("failed to scan label row: %w", err)
+		}
+		if labels[dgst] == nil {
+			labels[dgst] = make(map[string]string)
+		}
+		labels[dgst][key] = value
+	}
+	return labels, rows.Err()
+}
+
+// FindImages lists tagged images whose indexed config matches the filter,
+// paginated by "repository:tag" like ListAllTags.
+func (r *RegistryDB) FindImages(filter ImageFilter, continuationToken *string, n int) ([]IndexedImage, *string, error) {
+	query := `SELECT t.repository AS repository, t.name AS tag, m.digest AS digest, c.digest AS config_digest,
+		c.os AS os, c.architecture AS architecture, c.variant AS variant, c.created AS created
+		FROM image_configs c
+		JOIN manifests m ON json_extract(m.manifest_json, '$.config.digest') = c.digest
+		JOIN tags t ON t.rowid = m.tag_rowid
+		WHERE t.repository || ':' || t.name > ?`
+	args := []any{""}
+	if continuationToken != nil {
+		args[0] = *continuationToken
+	}
+	for _, label := range filter.Labels {
+		key, value, hasValue := strings.Cut(label, "=")
+		if hasValue {
+			query += ` AND EXISTS (SELECT 1 FROM image_labels l WHERE l.config_digest = c.digest AND l.key = ? AND l.value = ?)`
+			args = append(args, key, value)
+		} else {
+			query += ` AND EXISTS (SELECT 1 FROM image_labels l WHERE l.config_digest = c.digest AND l.key = ?)`
+			args = append(args, key)
+		}
+	}
+	if filter.OS != "" {
+		query += ` AND c.os = ?`
+		args = append(args, filter.OS)
+	}
+	if filter.Architecture != "" {
+		query += ` AND c.architecture = ?`
+		args = append(args, filter.Architecture)
+	}
+	if filter.Repository != "" {
+		query += ` AND t.repository = ?`
+		args = append(args, filter.Repository)
+	}
+	query += ` ORDER BY t.repository, t.name LIMIT ?`
+	args = append(args, n)
+
+	var images []IndexedImage
+	if err := r.db.Select(&images, query, args...); err != nil {
+		return nil, nil, fmt.Errorf("failed to find images: %w", err)
+	}
+	if len(images) == 0 {
+		return nil, nil, nil
+	}
+	configDigests := make([]string, 0, len(images))
+	for _, image := range images {
+		configDigests = append(configDigests, image.ConfigDigest)
+	}
+	labels, err := r.imageLabels(configDigests)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range images {
+		images[i].Labels = labels[images[i].ConfigDigest]
+	}
+	last := images[len(images)-1]
+	nextToken := last.Repository + ":" + last.Tag
+	return images, &nextToken, nil
+}
+
+func (r *RegistryDB) Exists(repo string, tag string) bool {
+	query := `SELECT 1 FROM tags WHERE repository = ? AND name = ?`
+	var dummy int
+	return r.db.Get(&dummy, query, repo, tag) == nil
+}
+
+// CreateUploadSession records a new upload, of totalSize bytes if known.
+func (r *RegistryDB) CreateUploadSession(uploadID, repository, s3Key string, totalSize int64) error {
+	query := `INSERT INTO upload_sessions (upload_id, repository, s3_key, total_size) VALUES (?, ?, ?, ?)`
+	_, err := r.db.Exec(query, uploadID, repository, s3Key, sql.NullInt64{Int64: totalSize, Valid: totalSize > 0})
+	if err != nil {
+		return fmt.Errorf("failed to create upload session: %w", err)
+	}
+	return nil
+}
+
+// UpdateUploadSession records a chunk which brought the upload to
+// uploadedSize bytes in parts more parts.
+func (r *RegistryDB) UpdateUploadSession(uploadID, s3UploadID string, uploadedSize int64, parts int) error {
+	query := `UPDATE upload_sessions SET s3_upload_id = ?, uploaded_size = ?, parts = parts + ?, last_activity = CURRENT_TIMESTAMP WHERE upload_id = ?`
+	_, err := r.db.Exec(query, s3UploadID, uploadedSize, parts, uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to update upload session: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) GetUploadSession(uploadID string) (string, string, int64, error) {
+	query := `SELECT COALESCE(s3_upload_id, ''), COALESCE(s3_key, ''), uploaded_size FROM upload_sessions WHERE upload_id = ?`
+	var s3UploadID, s3Key string
+	var uploadedSize int64
+	err := r.db.QueryRow(query, uploadID).Scan(&s3UploadID, &s3Key, &uploadedSize)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to get upload session: %w", err)
+	}
+	return s3UploadID, s3Key, uploadedSize, nil
+}
+
+// UploadProgress is how far an upload got, for clients showing progress.
+type UploadProgress struct {
+	Uploaded int64 `json:"uploaded"`
+	// Size of the blob, when the request starting the upload announced it.
+	Total          int64     `json:"total,omitempty"`
+	Parts          int       `json:"parts"`
+	StartedAt      time.Time `json:"startedAt"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+}
+
+func (r *RegistryDB) GetUploadProgress(uploadID string) (*UploadProgress, error) {
+	var row struct {
+		Uploaded  int64         `db:"uploaded_size"`
+		Total     sql.NullInt64 `db:"total_size"`
+		Parts     int           `db:"parts"`
+		StartedAt time.Time     `db:"created_at"`
+	}
+	query := `SELECT uploaded_size, total_size, parts, created_at FROM upload_sessions WHERE upload_id = ?`
+	if err := r.db.Get(&row, query, uploadID); err != nil {
+		return nil, fmt.Errorf("failed to get upload session: %w", err)
+	}
+	return &UploadProgress{
+		Uploaded:       row.Uploaded,
+		Total:          row.Total.Int64,
+		Parts:          row.Parts,
+		StartedAt:      row.StartedAt,
+		ElapsedSeconds: time.Since(row.StartedAt).Seconds(),
+	}, nil
+}
+
+func (r *RegistryDB) DeleteUploadSession(uploadID string) error {
+	query := `DELETE FROM upload_sessions WHERE upload_id = ?`
+	_, err := r.db.Exec(query, uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) RepositoryUploadSessions(repo string) ([]string, error) {
+	var uploadIDs []string
+	err := r.db.Select(&uploadIDs, `SELECT upload_id FROM upload_sessions WHERE repository = ?`, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository upload sessions: %w", err)
+	}
+	return uploadIDs, nil
+}
+
+func (r *RegistryDB) DeleteLayer(dgst string) error {
+	if _, err := r.db.Exec(`DELETE FROM layers WHERE digest = ?`, dgst); err != nil {
+		return fmt.Errorf("failed to delete layer: %w", err)
+	}
+	return nil
+}
+
+// OldestActiveUpload returns when the oldest upload with activity within
+// maxAge started, or the zero time if there is none.
+func (r *RegistryDB) OldestActiveUpload(maxAge string) (time.Time, error) {
+	query := `SELECT created_at FROM upload_sessions WHERE last_activity >= datetime('now', ?) ORDER BY created_at LIMIT 1`
+	var startedAt time.Time
+	err := r.db.Get(&startedAt, query, maxAge)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get active upload sessions: %w", err)
+	}
+	return startedAt, nil
+}
+
+func (r *RegistryDB) GetStaleUploadSessions(maxAge string) ([]string, error) {
+	query := `SELECT upload_id FROM upload_sessions WHERE last_activity < datetime('now', ?)`
+	var uploadIDs []string
+	err := r.db.Select(&uploadIDs, query, maxAge)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stale upload sessions: %w", err)
+	}
+	return uploadIDs, nil
+}
+
+func (r *RegistryDB) ListAllTags(continuationToken *string, n int) ([]map[string]string, *string, error) {
+	if continuationToken == nil {
+		token := ""
+		continuationToken = &token
 	}
 
-	query := `SELECT repository, name FROM tags WHERE repository || ':' || name > ? ORDER BY repository, name LIMIT ?`
+	query := `SELECT t.repository, t.name, COALESCE(c.os, ''), COALESCE(c.architecture, ''), c.created, COALESCE(m.artifact_type, '') FROM tags t
+		LEFT JOIN manifests m ON m.tag_rowid = t.rowid
+		LEFT JOIN image_configs c ON c.digest = json_extract(m.manifest_json, '$.config.digest')
+		WHERE t.repository || ':' || t.name > ? ORDER BY t.repository, t.name LIMIT ?`
 	var result []map[string]string
 	rows, err := r.db.Query(query, *continuationToken, n)
 	if err != nil {
@@ -287,11 +1325,23 @@ func (r *RegistryDB) ListAllTags(continuationToken *string, n int) ([]map[string
 	defer rows.Close()
 
 	for rows.Next() {
-		var repo, tag string
-		if err := rows.Scan(&repo, &tag); err != nil {
+		var repo, tag, os, arch, artifactType string
+		var created sql.NullTime
+		if err := rows.Scan(&repo, &tag, &os, &arch, &created, &artifactType); err != nil {
 			return nil, nil, fmt.Errorf("failed to scan tag row: %w", err)
 		}
-		result = append(result, map[string]string{"repository": repo, "tag": tag})
+		entry := map[string]string{"repository": repo, "tag": tag}
+		if os != "" {
+			entry["os"] = os
+			entry["architecture"] = arch
+		}
+		if created.Valid {
+			entry["created"] = created.Time.Format(time.RFC3339)
+		}
+		if artifactType != "" {
+			entry["artifactType"] = artifactType
+		}
+		result = append(result, entry)
 	}
 
 	if len(result) == 0 {
@@ -460,12 +1510,1040 @@ func (r *RegistryDB) GetRegistryStats() (map[string]any, error) {
 	}
 	stats["active_uploads"] = activeUploads
 
+	var indexCount int
+	if err := r.db.Get(&indexCount, "SELECT COUNT(*) FROM (SELECT DISTINCT repository, index_digest FROM index_children)"); err != nil {
+		return nil, fmt.Errorf("failed to count indexes: %w", err)
+	}
+	stats["indexes"] = indexCount
+
 	return stats, nil
 }
 
-func (r *RegistryDB) Close() error {
-	if err := r.db.Close(); err != nil {
-		return fmt.Errorf("failed to close database: %w", err)
+func (r *RegistryDB) RecordBlobVerification(dgst string, verifyErr string) error {
+	query := `INSERT INTO blob_verifications (digest, error) VALUES (?, NULLIF(?, ''))
+		ON CONFLICT(digest) DO UPDATE SET error = excluded.error, verified_at = CURRENT_TIMESTAMP`
+	_, err := r.db.Exec(query, dgst, verifyErr)
+	if err != nil {
+		return fmt.Errorf("failed to record blob verification: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) IsBlobVerified(dgst string) bool {
+	query := `SELECT 1 FROM blob_verifications WHERE digest = ? AND error IS NULL`
+	var dummy int
+	return r.db.Get(&dummy, query, dgst) == nil
+}
+
+func (r *RegistryDB) DeleteBlobVerification(dgst string) error {
+	if _, err := r.db.Exec(`DELETE FROM blob_verifications WHERE digest = ?`, dgst); err != nil {
+		return fmt.Errorf("failed to delete blob verification: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) CountFailedBlobVerifications() (int, error) {
+	var count int
+	if err := r.db.Get(&count, `SELECT COUNT(*) FROM blob_verifications WHERE error IS NOT NULL`); err != nil {
+		return 0, fmt.Errorf("failed to count failed blob verifications: %w", err)
+	}
+	return count, nil
+}
+
+func (r *RegistryDB) GetBlobSize(dgst string) (int64, error) {
+	var size int64
+	if err := r.db.Get(&size, `SELECT size FROM layers WHERE digest = ?`, dgst); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+type ReplicationTask struct {
+	ID         int64          `db:"id"`
+	Target     string         `db:"target"`
+	Repository string         `db:"repository"`
+	Reference  string         `db:"reference"`
+	Digest     string         `db:"digest"`
+	Attempts   int            `db:"attempts"`
+	LastError  sql.NullString `db:"last_error"`
+}
+
+func (r *RegistryDB) EnqueueReplication(target string, repo string, reference string, dgst string) error {
+	query := `INSERT INTO replication_queue (target, repository, reference, digest) VALUES (?, ?, ?, ?)`
+	_, err := r.db.Exec(query, target, repo, reference, dgst)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue replication: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) DueReplications(n int) ([]ReplicationTask, error) {
+	var tasks []ReplicationTask
+	query := `SELECT id, target, repository, reference, digest, attempts, last_error FROM replication_queue
+		WHERE next_attempt <= CURRENT_TIMESTAMP ORDER BY id LIMIT ?`
+	err := r.db.Select(&tasks, query, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due replications: %w", err)
+	}
+	return tasks, nil
+}
+
+func (r *RegistryDB) RetryReplication(id int64, lastError string, backoff time.Duration) error {
+	query := `UPDATE replication_queue SET attempts = attempts + 1, last_error = ?,
+		next_attempt = datetime('now', ?) WHERE id = ?`
+	_, err := r.db.Exec(query, lastError, fmt.Sprintf("+%d seconds", int(backoff.Seconds())), id)
+	if err != nil {
+		return fmt.Errorf("failed to reschedule replication: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) DeleteReplication(id int64) error {
+	_, err := r.db.Exec(`DELETE FROM replication_queue WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete replication: %w", err)
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `id, url, event_id, action, content_type, payload, status, attempts, last_error, next_attempt, created_at, delivered_at`
+
+func (r *RegistryDB) EnqueueWebhookDelivery(url string, eventID string, action string, contentType string, payload []byte) (int64, error) {
+	query := `INSERT INTO webhook_deliveries (url, event_id, action, content_type, payload) VALUES (?, ?, ?, ?, ?)`
+	res, err := r.db.Exec(query, url, eventID, action, contentType, string(payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to enqueue webhook delivery: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+func (r *RegistryDB) DueWebhookDeliveries(n int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt <= CURRENT_TIMESTAMP ORDER BY id LIMIT ?`
+	if err := r.db.Select(&deliveries, query, n); err != nil {
+		return nil, fmt.Errorf("failed to get due webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (r *RegistryDB) GetWebhookDelivery(id int64) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = ?`
+	err := r.db.Get(&delivery, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook delivery: %w", err)
+	}
+	return &delivery, nil
+}
+
+func (r *RegistryDB) WebhookDeliveries(filter DeliveryFilter) ([]WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id > ?`
+	args := []any{filter.After}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+	if filter.URL != "" {
+		query += ` AND url = ?`
+		args = append(args, filter.URL)
+	}
+	query += ` ORDER BY id LIMIT ?`
+	args = append(args, filter.Limit)
+
+	var deliveries []WebhookDelivery
+	if err := r.db.Select(&deliveries, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+func (r *RegistryDB) CompleteWebhookDelivery(id int64) error {
+	query := `UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1,
+		last_error = NULL, delivered_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if _, err := r.db.Exec(query, id); err != nil {
+		return fmt.Errorf("failed to complete webhook delivery: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) RetryWebhookDelivery(id int64, lastError string, backoff time.Duration) error {
+	query := `UPDATE webhook_deliveries SET attempts = attempts + 1, last_error = ?,
+		next_attempt = datetime('now', ?) WHERE id = ?`
+	_, err := r.db.Exec(query, lastError, fmt.Sprintf("+%d seconds", int(backoff.Seconds())), id)
+	if err != nil {
+		return fmt.Errorf("failed to reschedule webhook delivery: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) FailWebhookDelivery(id int64, lastError string) error {
+	query := `UPDATE webhook_deliveries SET status = 'failed', attempts = attempts + 1, last_error = ? WHERE id = ?`
+	if _, err := r.db.Exec(query, lastError, id); err != nil {
+		return fmt.Errorf("failed to mark webhook delivery failed: %w", err)
+	}
+	return nil
+}
+
+// PruneWebhookDeliveries deletes finished deliveries created before maxAge, a
+// SQLite datetime modifier like "-7 days".
+func (r *RegistryDB) PruneWebhookDeliveries(maxAge string) error {
+	query := `DELETE FROM webhook_deliveries WHERE status != 'pending' AND created_at < datetime('now', ?)`
+	if _, err := r.db.Exec(query, maxAge); err != nil {
+		return fmt.Errorf("failed to prune webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) RecordAudit(entry AuditEntry) (int64, error) {
+	query := `INSERT INTO audit_log (timestamp, action, actor, addr, repository, reference, digest) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := r.db.Exec(query, entry.Timestamp, entry.Action, entry.Actor, entry.Addr, entry.Repository, entry.Reference, entry.Digest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+func (r *RegistryDB) QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	query := `SELECT id, timestamp, action, actor, addr, repository, reference, digest FROM audit_log WHERE id > ?`
+	args := []any{filter.After}
+	if filter.Repository != "" {
+		query += ` AND repository = ?`
+		args = append(args, filter.Repository)
+	}
+	if filter.Actor != "" {
+		query += ` AND actor = ?`
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		query += ` AND action = ?`
+		args = append(args, filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query += ` AND timestamp < ?`
+		args = append(args, filter.Until.UTC())
+	}
+	query += ` ORDER BY id LIMIT ?`
+	args = append(args, filter.Limit)
+
+	var entries []AuditEntry
+	if err := r.db.Select(&entries, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	return entries, nil
+}
+
+func (r *RegistryDB) UnexportedAudit(n int) ([]AuditEntry, error) {
+	query := `SELECT id, timestamp, action, actor, addr, repository, reference, digest FROM audit_log
+		WHERE exported_at IS NULL ORDER BY id LIMIT ?`
+	var entries []AuditEntry
+	if err := r.db.Select(&entries, query, n); err != nil {
+		return nil, fmt.Errorf("failed to get unexported audit entries: %w", err)
+	}
+	return entries, nil
+}
+
+func (r *RegistryDB) MarkAuditExported(firstID int64, lastID int64) error {
+	query := `UPDATE audit_log SET exported_at = CURRENT_TIMESTAMP WHERE id BETWEEN ? AND ? AND exported_at IS NULL`
+	if _, err := r.db.Exec(query, firstID, lastID); err != nil {
+		return fmt.Errorf("failed to mark audit entries exported: %w", err)
+	}
+	return nil
+}
+
+// RecordTagChange appends a change of a tag to the change log: its deletion,
+// or a write pointing it at dgst, recorded as created or updated depending on
+// whether the tag was current. Changes which leave the tag as it was are not
+// recorded.
+func (r *RegistryDB) RecordTagChange(repo string, tag string, dgst string, deleted bool) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var last struct {
+		Change TagChangeKind `db:"change"`
+		Digest string        `db:"digest"`
+	}
+	found := true
+	err = tx.Get(&last, `SELECT change, digest FROM tag_changes WHERE repository = ? AND tag = ? ORDER BY id DESC LIMIT 1`, repo, tag)
+	if errors.Is(err, sql.ErrNoRows) {
+		found, err = false, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get last tag change: %w", err)
+	}
+	current := found && last.Change != TagDeleted
+	var change TagChangeKind
+	switch {
+	case !deleted && !current:
+		change = TagCreated
+	case !deleted && last.Digest != dgst:
+		change = TagUpdated
+	case deleted && (current || !found):
+		// Tags pushed before there was a change log have no changes.
+		change = TagDeleted
+	default:
+		return tx.Rollback()
+	}
+
+	query := `INSERT INTO tag_changes (timestamp, change, repository, tag, digest) VALUES (?, ?, ?, ?, ?)`
+	if _, err = tx.Exec(query, time.Now().UTC(), change, repo, tag, dgst); err != nil {
+		return fmt.Errorf("failed to record tag change: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) TagChanges(filter ChangeFilter) ([]TagChange, error) {
+	query := `SELECT id, timestamp, change, repository, tag, digest FROM tag_changes WHERE id > ?`
+	args := []any{filter.After}
+	if filter.Repository != "" {
+		query += ` AND repository = ?`
+		args = append(args, filter.Repository)
+	}
+	if !filter.Since.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, filter.Since.UTC())
+	}
+	query += ` ORDER BY id LIMIT ?`
+	args = append(args, filter.Limit)
+
+	var changes []TagChange
+	if err := r.db.Select(&changes, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query tag changes: %w", err)
+	}
+	return changes, nil
+}
+
+func (r *RegistryDB) Close() error {
+	if err := r.db.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+	return nil
+}
+
+type referrerRow struct {
+	Digest       string         `db:"digest"`
+	MediaType    string         `db:"media_type"`
+	ArtifactType string         `db:"artifact_type"`
+	Size         int64          `db:"size"`
+	Annotations  sql.NullString `db:"annotations"`
+}
+
+func (r *RegistryDB) PutReferrers(repo string, subject string, descriptors []v1.Descriptor) error {
+	if len(descriptors) == 0 {
+		return nil
+	}
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, desc := range descriptors {
+		var annotations sql.NullString
+		if len(desc.Annotations) > 0 {
+			var data []byte
+			data, err = json.Marshal(desc.Annotations)
+			if err != nil {
+				return fmt.Errorf("failed to marshal annotations: %w", err)
+			}
+			annotations = sql.NullString{String: string(data), Valid: true}
+		}
+		_, err = tx.Exec(`INSERT INTO referrers (repository, subject, digest, media_type, artifact_type, size, annotations) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(repository, subject, digest) DO NOTHING`,
+			repo, subject, desc.Digest.String(), desc.MediaType, desc.ArtifactType, desc.Size, annotations)
+		if err != nil {
+			return fmt.Errorf("failed to insert referrer: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Referrers returns the manifests referring to subject in the order they
+// were indexed, only those of artifactType if it is set.
+func (r *RegistryDB) Referrers(repo string, subject string, artifactType string) ([]v1.Descriptor, error) {
+	query := `SELECT digest, media_type, artifact_type, size, annotations FROM referrers WHERE repository = ? AND subject = ?`
+	args := []any{repo, subject}
+	if artifactType != "" {
+		query += ` AND artifact_type = ?`
+		args = append(args, artifactType)
+	}
+	query += ` ORDER BY rowid`
+	var rows []referrerRow
+	if err := r.db.Select(&rows, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to query referrers: %w", err)
+	}
+	descriptors := make([]v1.Descriptor, 0, len(rows))
+	for _, row := range rows {
+		desc := v1.Descriptor{
+			MediaType:    row.MediaType,
+			ArtifactType: row.ArtifactType,
+			Digest:       digest.Digest(row.Digest),
+			Size:         row.Size,
+		}
+		if row.Annotations.Valid {
+			if err := json.Unmarshal([]byte(row.Annotations.String), &desc.Annotations); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal annotations: %w", err)
+			}
+		}
+		descriptors = append(descriptors, desc)
+	}
+	return descriptors, nil
+}
+
+// DeleteReferrer removes a manifest from the referrers index and returns the
+// subjects it referred to.
+func (r *RegistryDB) DeleteReferrer(repo string, dgst string) ([]string, error) {
+	var subjects []string
+	if err := r.db.Select(&subjects, `DELETE FROM referrers WHERE repository = ? AND digest = ? RETURNING subject`, repo, dgst); err != nil {
+		return nil, fmt.Errorf("failed to delete referrer: %w", err)
+	}
+	return subjects, nil
+}
+
+func (r *RegistryDB) DeleteReferrersOf(repo string, subject string) error {
+	if _, err := r.db.Exec(`DELETE FROM referrers WHERE repository = ? AND subject = ?`, repo, subject); err != nil {
+		return fmt.Errorf("failed to delete referrers: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) DeleteRepositoryReferrers(repo string) error {
+	if _, err := r.db.Exec(`DELETE FROM referrers WHERE repository = ?`, repo); err != nil {
+		return fmt.Errorf("failed to delete referrers: %w", err)
+	}
+	return nil
+}
+
+type ScanTask struct {
+	Repository string `db:"repository"`
+	Digest     string `db:"digest"`
+	Attempts   int    `db:"attempts"`
+}
+
+type scanRow struct {
+	Repository      string         `db:"repository"`
+	Digest          string         `db:"digest"`
+	Status          string         `db:"status"`
+	Summary         sql.NullString `db:"summary"`
+	Vulnerabilities sql.NullString `db:"vulnerabilities"`
+	Error           sql.NullString `db:"error"`
+	Queued          bool           `db:"queued"`
+	RequestedAt     time.Time      `db:"requested_at"`
+	ScannedAt       *time.Time     `db:"scanned_at"`
+}
+
+// EnqueueScan queues a scan of a manifest. Unless rescan is set, manifests
+// which already have a scan are left alone. A rescan keeps the previous
+// status until the new result is in.
+func (r *RegistryDB) EnqueueScan(repo string, dgst string, rescan bool) error {
+	query := `INSERT INTO scans (repository, digest, status) VALUES (?, ?, ?)
+		ON CONFLICT(repository, digest) DO NOTHING`
+	if rescan {
+		query = `INSERT INTO scans (repository, digest, status) VALUES (?, ?, ?)
+			ON CONFLICT(repository, digest) DO UPDATE SET queued = 1, attempts = 0,
+			next_attempt = CURRENT_TIMESTAMP, requested_at = CURRENT_TIMESTAMP`
+	}
+	if _, err := r.db.Exec(query, repo, dgst, ScanPending); err != nil {
+		return fmt.Errorf("failed to enqueue scan: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) DueScans(n int) ([]ScanTask, error) {
+	var tasks []ScanTask
+	query := `SELECT repository, digest, attempts FROM scans
+		WHERE queued = 1 AND next_attempt <= CURRENT_TIMESTAMP ORDER BY requested_at LIMIT ?`
+	if err := r.db.Select(&tasks, query, n); err != nil {
+		return nil, fmt.Errorf("failed to get due scans: %w", err)
+	}
+	return tasks, nil
+}
+
+func (r *RegistryDB) CompleteScan(repo string, dgst string, status string, summary map[string]int, vulnerabilities []Vulnerability, scanErr string) error {
+	summaryJSON, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scan summary: %w", err)
+	}
+	vulnerabilitiesJSON, err := json.Marshal(vulnerabilities)
+	if err != nil {
+		return fmt.Errorf("failed to marshal vulnerabilities: %w", err)
+	}
+	query := `UPDATE scans SET status = ?, summary = ?, vulnerabilities = ?, error = NULLIF(?, ''),
+		queued = 0, attempts = 0, scanned_at = CURRENT_TIMESTAMP WHERE repository = ? AND digest = ?`
+	_, err = r.db.Exec(query, status, string(summaryJSON), string(vulnerabilitiesJSON), scanErr, repo, dgst)
+	if err != nil {
+		return fmt.Errorf("failed to record scan: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) RetryScan(repo string, dgst string, lastError string, backoff time.Duration) error {
+	query := `UPDATE scans SET attempts = attempts + 1, error = ?,
+		next_attempt = datetime('now', ?) WHERE repository = ? AND digest = ?`
+	_, err := r.db.Exec(query, lastError, fmt.Sprintf("+%d seconds", int(backoff.Seconds())), repo, dgst)
+	if err != nil {
+		return fmt.Errorf("failed to reschedule scan: %w", err)
+	}
+	return nil
+}
+
+// GetScan returns the scan of a manifest, or nil if it was never queued.
+func (r *RegistryDB) GetScan(repo string, dgst string) (*ScanResult, error) {
+	var row scanRow
+	query := `SELECT repository, digest, status, summary, vulnerabilities, error, queued, requested_at, scanned_at
+		FROM scans WHERE repository = ? AND digest = ?`
+	if err := r.db.Get(&row, query, repo, dgst); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get scan: %w", err)
+	}
+	result := &ScanResult{
+		Repository:  row.Repository,
+		Digest:      row.Digest,
+		Status:      row.Status,
+		Error:       row.Error.String,
+		Queued:      row.Queued,
+		RequestedAt: row.RequestedAt,
+		ScannedAt:   row.ScannedAt,
+	}
+	if row.Summary.Valid {
+		if err := json.Unmarshal([]byte(row.Summary.String), &result.Summary); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal scan summary: %w", err)
+		}
+	}
+	if row.Vulnerabilities.Valid {
+		if err := json.Unmarshal([]byte(row.Vulnerabilities.String), &result.Vulnerabilities); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal vulnerabilities: %w", err)
+		}
+	}
+	return result, nil
+}
+
+func (r *RegistryDB) DeleteScan(repo string, dgst string) error {
+	if _, err := r.db.Exec(`DELETE FROM scans WHERE repository = ? AND digest = ?`, repo, dgst); err != nil {
+		return fmt.Errorf("failed to delete scan: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) DeleteRepositoryScans(repo string) error {
+	if _, err := r.db.Exec(`DELETE FROM scans WHERE repository = ?`, repo); err != nil {
+		return fmt.Errorf("failed to delete scans: %w", err)
+	}
+	return nil
+}
+
+type HelmManifest struct {
+	Repository   string `db:"repository"`
+	Tag          string `db:"tag"`
+	ManifestJSON string `db:"manifest_json"`
+}
+
+// ListHelmManifests returns the tagged helm chart manifests of repositories
+// directly under namespace, or of top-level repositories if it is empty.
+func (r *RegistryDB) ListHelmManifests(namespace string) ([]HelmManifest, error) {
+	query := `SELECT t.repository, t.name AS tag, m.manifest_json FROM manifests m
+		JOIN tags t ON t.rowid = m.tag_rowid
+		WHERE json_extract(m.manifest_json, '$.config.mediaType') = ?`
+	args := []any{helmConfigMediaType}
+	if namespace != "" {
+		query += ` AND t.repository LIKE ? ESCAPE '\'`
+		args = append(args, likeEscaper.Replace(namespace)+"/%")
+	}
+	query += ` ORDER BY t.repository, t.name`
+
+	var all []HelmManifest
+	if err := r.db.Select(&all, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to list helm charts: %w", err)
+	}
+	manifests := all[:0]
+	for _, m := range all {
+		chart := m.Repository
+		if namespace != "" {
+			chart = strings.TrimPrefix(chart, namespace+"/")
+		}
+		if !strings.Contains(chart, "/") {
+			manifests = append(manifests, m)
+		}
+	}
+	return manifests, nil
+}
+
+func (r *RegistryDB) GetHelmChart(dgst string) (map[string]any, error) {
+	var metadata string
+	if err := r.db.Get(&metadata, `SELECT metadata FROM helm_charts WHERE digest = ?`, dgst); err != nil {
+		return nil, fmt.Errorf("failed to get helm chart: %w", err)
+	}
+	var chart map[string]any
+	if err := json.Unmarshal([]byte(metadata), &chart); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal helm chart: %w", err)
+	}
+	return chart, nil
+}
+
+func (r *RegistryDB) PutHelmChart(dgst string, metadata []byte) error {
+	_, err := r.db.Exec(`INSERT INTO helm_charts (digest, metadata) VALUES (?, ?) ON CONFLICT(digest) DO NOTHING`, dgst, string(metadata))
+	if err != nil {
+		return fmt.Errorf("failed to store helm chart: %w", err)
+	}
+	return nil
+}
+
+// IndexChild is a manifest listed by an index, in the order of the index.
+type IndexChild struct {
+	IndexDigest  string `db:"index_digest" json:"index"`
+	Position     int    `db:"position" json:"position"`
+	Digest       string `db:"digest" json:"digest"`
+	MediaType    string `db:"media_type" json:"mediaType"`
+	Size         int64  `db:"size" json:"size"`
+	OS           string `db:"os" json:"os,omitempty"`
+	Architecture string `db:"architecture" json:"architecture,omitempty"`
+	Variant      string `db:"variant" json:"variant,omitempty"`
+}
+
+func (c IndexChild) descriptor() v1.Descriptor {
+	desc := v1.Descriptor{
+		MediaType: c.MediaType,
+		Digest:    digest.Digest(c.Digest),
+		Size:      c.Size,
+	}
+	if c.OS != "" || c.Architecture != "" {
+		desc.Platform = &v1.Platform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}
+	}
+	return desc
+}
+
+func (r *RegistryDB) PutIndexChildren(repo string, index string, children []v1.Descriptor) error {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// Indexes are immutable, so a known one need not be written again.
+	var known int
+	if err = tx.Get(&known, `SELECT COUNT(*) FROM index_children WHERE repository = ? AND index_digest = ?`, repo, index); err != nil {
+		return fmt.Errorf("failed to look up index children: %w", err)
+	}
+	if known > 0 {
+		return tx.Commit()
+	}
+	for i, child := range children {
+		var platform v1.Platform
+		if child.Platform != nil {
+			platform = *child.Platform
+		}
+		_, err = tx.Exec(`INSERT INTO index_children (repository, index_digest, position, digest, media_type, size, os, architecture, variant)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			repo, index, i, child.Digest.String(), child.MediaType, child.Size, platform.OS, platform.Architecture, platform.Variant)
+		if err != nil {
+			return fmt.Errorf("failed to store index child: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// IndexChildren returns the manifests listed by an index, none if the index
+// is not known.
+func (r *RegistryDB) IndexChildren(repo string, index string) ([]IndexChild, error) {
+	var children []IndexChild
+	query := `SELECT index_digest, position, digest, media_type, size, os, architecture, variant FROM index_children
+		WHERE repository = ? AND index_digest = ? ORDER BY position`
+	if err := r.db.Select(&children, query, repo, index); err != nil {
+		return nil, fmt.Errorf("failed to get index children: %w", err)
+	}
+	return children, nil
+}
+
+// IndexesOf returns the digests of the indexes of a repository listing dgst.
+func (r *RegistryDB) IndexesOf(repo string, dgst string) ([]string, error) {
+	var indexes []string
+	query := `SELECT DISTINCT index_digest FROM index_children WHERE repository = ? AND digest = ? ORDER BY index_digest`
+	if err := r.db.Select(&indexes, query, repo, dgst); err != nil {
+		return nil, fmt.Errorf("failed to get indexes: %w", err)
+	}
+	return indexes, nil
+}
+
+func (r *RegistryDB) DeleteIndexChildren(repo string, index string) error {
+	if _, err := r.db.Exec(`DELETE FROM index_children WHERE repository = ? AND index_digest = ?`, repo, index); err != nil {
+		return fmt.Errorf("failed to delete index children: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) DeleteRepositoryIndexChildren(repo string) error {
+	if _, err := r.db.Exec(`DELETE FROM index_children WHERE repository = ?`, repo); err != nil {
+		return fmt.Errorf("failed to delete index children: %w", err)
+	}
+	return nil
+}
+
+type ManifestExpiry struct {
+	Repository string    `db:"repository"`
+	Digest     string    `db:"digest"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+// PutManifestExpiry records when a manifest expires, keeping the expiry
+// recorded at its first push.
+func (r *RegistryDB) PutManifestExpiry(repo string, dgst string, expiresAt time.Time) error {
+	query := `INSERT INTO manifest_expiry (repository, digest, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(repository, digest) DO NOTHING`
+	if _, err := r.db.Exec(query, repo, dgst, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("failed to put manifest expiry: %w", err)
+	}
+	return nil
+}
+
+// ExpiredManifests returns the manifests which expired by now, the oldest
+// expiry first.
+func (r *RegistryDB) ExpiredManifests(now time.Time) ([]ManifestExpiry, error) {
+	var expired []ManifestExpiry
+	query := `SELECT repository, digest, expires_at FROM manifest_expiry WHERE expires_at <= ? ORDER BY expires_at`
+	if err := r.db.Select(&expired, query, now.UTC()); err != nil {
+		return nil, fmt.Errorf("failed to get expired manifests: %w", err)
+	}
+	return expired, nil
+}
+
+func (r *RegistryDB) DeleteManifestExpiry(repo string, dgst string) error {
+	if _, err := r.db.Exec(`DELETE FROM manifest_expiry WHERE repository = ? AND digest = ?`, repo, dgst); err != nil {
+		return fmt.Errorf("failed to delete manifest expiry: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) DeleteRepositoryManifestExpiry(repo string) error {
+	if _, err := r.db.Exec(`DELETE FROM manifest_expiry WHERE repository = ?`, repo); err != nil {
+		return fmt.Errorf("failed to delete manifest expiry: %w", err)
+	}
+	return nil
+}
+
+// PutProxyTag records when a tag of a pull-through cache was last fetched
+// from, or confirmed by, its upstream.
+func (r *RegistryDB) PutProxyTag(repo string, tag string, fetchedAt time.Time) error {
+	query := `INSERT INTO proxy_tags (repository, tag, fetched_at) VALUES (?, ?, ?)
+		ON CONFLICT(repository, tag) DO UPDATE SET fetched_at = excluded.fetched_at`
+	if _, err := r.db.Exec(query, repo, tag, fetchedAt.UTC()); err != nil {
+		return fmt.Errorf("failed to put proxy tag: %w", err)
+	}
+	return nil
+}
+
+// ProxyTagFetchedAt returns when a tag of a pull-through cache was last
+// fetched, the zero time if never.
+func (r *RegistryDB) ProxyTagFetchedAt(repo string, tag string) (time.Time, error) {
+	var fetchedAt time.Time
+	err := r.db.Get(&fetchedAt, `SELECT fetched_at FROM proxy_tags WHERE repository = ? AND tag = ?`, repo, tag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get proxy tag: %w", err)
+	}
+	return fetchedAt, nil
+}
+
+// RepositoryReferencesBlob tells whether a tagged manifest of a repository is,
+// or references as config or layer, a blob.
+func (r *RegistryDB) RepositoryReferencesBlob(repo string, dgst string) (bool, error) {
+	query := `SELECT EXISTS (
+			SELECT 1 FROM manifest_layers ml
+			JOIN manifests m ON m.rowid = ml.manifest_rowid
+			JOIN tags t ON t.rowid = m.tag_rowid
+			WHERE t.repository = ? AND ml.layer_digest = ?
+		) OR EXISTS (
+			SELECT 1 FROM manifests m
+			JOIN tags t ON t.rowid = m.tag_rowid
+			WHERE t.repository = ? AND (m.digest = ? OR json_extract(m.manifest_json, '$.config.digest') = ?)
+		)`
+	var referenced bool
+	if err := r.db.Get(&referenced, query, repo, dgst, repo, dgst, dgst); err != nil {
+		return false, fmt.Errorf("failed to check blob references: %w", err)
+	}
+	return referenced, nil
+}
+
+// LayerUsage returns the tags referencing a layer, nil if the layer is not
+// known.
+func (r *RegistryDB) LayerUsage(dgst string) (*LayerUsage, error) {
+	usage := &LayerUsage{Digest: dgst, References: []LayerReference{}}
+	err := r.db.QueryRow(`SELECT media_type, size FROM layers WHERE digest = ?`, dgst).Scan(&usage.MediaType, &usage.Size)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get layer: %w", err)
+	}
+
+	query := `WITH direct AS (
+			SELECT t.repository, t.name AS tag, m.digest FROM manifest_layers ml
+			JOIN manifests m ON m.rowid = ml.manifest_rowid
+			JOIN tags t ON t.rowid = m.tag_rowid
+			WHERE ml.layer_digest = ?
+		)
+		SELECT DISTINCT repository, tag, digest, '' AS child FROM direct
+		UNION
+		SELECT DISTINCT t.repository, t.name, m.digest, c.digest FROM index_children c
+		JOIN direct d ON d.repository = c.repository AND d.digest = c.digest
+		JOIN manifests m ON m.digest = c.index_digest
+		JOIN tags t ON t.rowid = m.tag_rowid AND t.repository = c.repository
+		ORDER BY repository, tag`
+	if err := r.db.Select(&usage.References, query, dgst); err != nil {
+		return nil, fmt.Errorf("failed to get layer usage: %w", err)
+	}
+	return usage, nil
+}
+
+// dedupRefs lists the layers of every distinct manifest of every repository,
+// however many tags point at it.
+const dedupRefs = `WITH refs AS (
+		SELECT DISTINCT t.repository, m.digest, ml.layer_digest FROM manifest_layers ml
+		JOIN manifests m ON m.rowid = ml.manifest_rowid
+		JOIN tags t ON t.rowid = m.tag_rowid
+	)`
+
+// DedupReport sums layer sizes per manifest and per distinct layer, listing
+// the top layers shared by the most manifests.
+func (r *RegistryDB) DedupReport(top int) (*DedupReport, error) {
+	report := &DedupReport{SharedLayers: []SharedLayer{}, Repositories: []RepositoryDedup{}}
+	query := dedupRefs + `SELECT
+		(SELECT COALESCE(SUM(l.size), 0) FROM refs JOIN layers l ON l.digest = refs.layer_digest),
+		(SELECT COALESCE(SUM(size), 0) FROM layers WHERE digest IN (SELECT layer_digest FROM refs))`
+	if err := r.db.QueryRow(query).Scan(&report.LogicalSize, &report.PhysicalSize); err != nil {
+		return nil, fmt.Errorf("failed to sum layer sizes: %w", err)
+	}
+
+	query = dedupRefs + `SELECT refs.layer_digest AS digest, l.media_type, l.size,
+		COUNT(DISTINCT refs.repository) AS repositories, COUNT(*) AS manifests,
+		(COUNT(*) - 1) * l.size AS saved_size
+		FROM refs JOIN layers l ON l.digest = refs.layer_digest
+		GROUP BY refs.layer_digest HAVING COUNT(*) > 1
+		ORDER BY saved_size DESC, digest LIMIT ?`
+	if err := r.db.Select(&report.SharedLayers, query, top); err != nil {
+		return nil, fmt.Errorf("failed to list shared layers: %w", err)
+	}
+
+	query = dedupRefs + `SELECT refs.repository, COUNT(DISTINCT refs.digest) AS manifests,
+		COALESCE(SUM(l.size), 0) AS logical_size,
+		(SELECT COALESCE(SUM(size), 0) FROM layers WHERE digest IN (
+			SELECT layer_digest FROM refs r2 WHERE r2.repository = refs.repository)) AS physical_size
+		FROM refs JOIN layers l ON l.digest = refs.layer_digest
+		GROUP BY refs.repository ORDER BY refs.repository`
+	if err := r.db.Select(&report.Repositories, query); err != nil {
+		return nil, fmt.Errorf("failed to summarize repository layers: %w", err)
+	}
+	return report, nil
+}
+
+// RepositoryStorage splits the size of the layers of a repository between
+// those no other repository uses and those shared with at least one.
+func (r *RegistryDB) RepositoryStorage(repo string) (*RepositoryStorage, error) {
+	storage := &RepositoryStorage{Repository: repo}
+	query := `WITH repo_layers AS (
+			SELECT DISTINCT ml.layer_digest FROM manifest_layers ml
+			JOIN manifests m ON m.rowid = ml.manifest_rowid
+			JOIN tags t ON t.rowid = m.tag_rowid
+			WHERE t.repository = ?
+		), shared AS (
+			SELECT DISTINCT ml.layer_digest FROM manifest_layers ml
+			JOIN manifests m ON m.rowid = ml.manifest_rowid
+			JOIN tags t ON t.rowid = m.tag_rowid
+			WHERE t.repository != ? AND ml.layer_digest IN (SELECT layer_digest FROM repo_layers)
+		)
+		SELECT
+			COALESCE(SUM(CASE WHEN l.digest IN (SELECT layer_digest FROM shared) THEN 0 ELSE l.size END), 0),
+			COALESCE(SUM(CASE WHEN l.digest IN (SELECT layer_digest FROM shared) THEN l.size ELSE 0 END), 0)
+		FROM layers l WHERE l.digest IN (SELECT layer_digest FROM repo_layers)`
+	if err := r.db.QueryRow(query, repo, repo).Scan(&storage.UniqueSize, &storage.SharedSize); err != nil {
+		return nil, fmt.Errorf("failed to sum repository layers: %w", err)
+	}
+
+	var lastPushed sql.NullTime
+	err := r.db.Get(&lastPushed, `SELECT last_pushed FROM usage_counters WHERE repository = ? AND tag = ''`, repo)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get last push: %w", err)
+	}
+	if lastPushed.Valid {
+		storage.LastPushed = &lastPushed.Time
+	}
+	return storage, nil
+}
+
+func (r *RegistryDB) GetBlobRestore(dgst string) (*BlobRestore, error) {
+	var restore BlobRestore
+	query := `SELECT digest, storage_class, status, requested_at, restored_at, expires_at FROM blob_restores WHERE digest = ?`
+	if err := r.db.Get(&restore, query, dgst); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get blob restore: %w", err)
+	}
+	return &restore, nil
+}
+
+// StartBlobRestore records a restore in progress, keeping the time of the
+// request which started it.
+func (r *RegistryDB) StartBlobRestore(dgst string, storageClass string) error {
+	query := `INSERT INTO blob_restores (digest, storage_class, status) VALUES (?, ?, ?)
+		ON CONFLICT(digest) DO UPDATE SET storage_class = excluded.storage_class, status = excluded.status,
+			requested_at = CASE WHEN status = excluded.status THEN requested_at ELSE CURRENT_TIMESTAMP END,
+			restored_at = NULL, expires_at = NULL`
+	if _, err := r.db.Exec(query, dgst, storageClass, RestoreInProgress); err != nil {
+		return fmt.Errorf("failed to record blob restore: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) CompleteBlobRestore(dgst string, storageClass string, expiresAt *time.Time) error {
+	query := `INSERT INTO blob_restores (digest, storage_class, status, restored_at, expires_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+		ON CONFLICT(digest) DO UPDATE SET storage_class = excluded.storage_class, status = excluded.status,
+			restored_at = CASE WHEN status = excluded.status THEN restored_at ELSE CURRENT_TIMESTAMP END,
+			expires_at = excluded.expires_at`
+	if _, err := r.db.Exec(query, dgst, storageClass, RestoreCompleted, expiresAt); err != nil {
+		return fmt.Errorf("failed to record blob restore: %w", err)
+	}
+	return nil
+}
+
+func (r *RegistryDB) ListBlobRestores() ([]BlobRestore, error) {
+	var restores []BlobRestore
+	query := `SELECT digest, storage_class, status, requested_at, restored_at, expires_at FROM blob_restores ORDER BY requested_at DESC`
+	if err := r.db.Select(&restores, query); err != nil {
+		return nil, fmt.Errorf("failed to list blob restores: %w", err)
+	}
+	return restores, nil
+}
+
+func (r *RegistryDB) DeleteBlobRestore(dgst string) error {
+	if _, err := r.db.Exec(`DELETE FROM blob_restores WHERE digest = ?`, dgst); err != nil {
+		return fmt.Errorf("failed to delete blob restore: %w", err)
+	}
+	return nil
+}
+
+// ClaimBlobs records generation as the latest generation of the given blobs,
+// which a push wrote or refers to. Blobs whose collection lease is held are
+// left alone and returned, for the claim to be retried once it is released.
+func (r *RegistryDB) ClaimBlobs(dgsts []string, generation time.Time) ([]string, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.Preparex(`INSERT INTO blob_generations (digest, generation)
+		SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM leases WHERE name = ? AND expires_at >= ?)
+		ON CONFLICT(digest) DO UPDATE SET generation = MAX(generation, excluded.generation)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	var busy []string
+	now := time.Now().UnixMilli()
+	for _, dgst := range dgsts {
+		var res sql.Result
+		res, err = stmt.Exec(dgst, generation.UnixMilli(), blobCollectionLease(dgst), now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record blob generation: %w", err)
+		}
+		var n int64
+		if n, err = res.RowsAffected(); err != nil {
+			return nil, fmt.Errorf("failed to record blob generation: %w", err)
+		}
+		if n == 0 {
+			busy = append(busy, dgst)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return busy, nil
+}
+
+// BlobGeneration returns the latest generation recorded for a blob, or the
+// zero time if none was.
+func (r *RegistryDB) BlobGeneration(dgst string) (time.Time, error) {
+	var generation int64
+	err := r.db.Get(&generation, `SELECT generation FROM blob_generations WHERE digest = ?`, dgst)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get blob generation: %w", err)
+	}
+	return time.UnixMilli(generation), nil
+}
+
+func (r *RegistryDB) DeleteBlobGeneration(dgst string) error {
+	if _, err := r.db.Exec(`DELETE FROM blob_generations WHERE digest = ?`, dgst); err != nil {
+		return fmt.Errorf("failed to delete blob generation: %w", err)
+	}
+	return nil
+}
+
+// AcquireLease takes the named lease for ttl if it is free or expired, or
+// renews it if holder already has it, and tells whether holder has it now.
+func (r *RegistryDB) AcquireLease(name string, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	query := `INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at < ?`
+	res, err := r.db.Exec(query, name, holder, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lease: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lease: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (r *RegistryDB) ReleaseLease(name string, holder string) error {
+	if _, err := r.db.Exec(`DELETE FROM leases WHERE name = ? AND holder = ?`, name, holder); err != nil {
+		return fmt.Errorf("failed to release lease: %w", err)
 	}
 	return nil
 }
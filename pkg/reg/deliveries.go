@@ -0,0 +1,318 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	webhookPollInterval = 5 * time.Second
+	webhookMaxBackoff   = time.Hour
+	webhookBatchSize    = 32
+	// webhookDeliveryRetention is how long finished deliveries are listed.
+	webhookDeliveryRetention = "-7 days"
+)
+
+var ErrWebhookNotConfigured = errors.New("webhook is not configured")
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// Deliveries fail once their retries are used up, and stay failed until
+	// redelivered.
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+// WebhookDelivery is an event queued for a webhook. Deliveries are kept in the
+// database, so that events are delivered across restarts and failed ones can
+// be looked at and redelivered.
+type WebhookDelivery struct {
+	ID          int64           `db:"id" json:"id"`
+	URL         string          `db:"url" json:"url"`
+	EventID     string          `db:"event_id" json:"eventId"`
+	Action      string          `db:"action" json:"action"`
+	ContentType string          `db:"content_type" json:"contentType"`
+	Payload     string          `db:"payload" json:"-"`
+	Event       json.RawMessage `db:"-" json:"event"`
+	Status      DeliveryStatus  `db:"status" json:"status"`
+	Attempts    int             `db:"attempts" json:"attempts"`
+	LastError   *string         `db:"last_error" json:"lastError,omitempty"`
+	NextAttempt time.Time       `db:"next_attempt" json:"nextAttempt"`
+	CreatedAt   time.Time       `db:"created_at" json:"createdAt"`
+	DeliveredAt *time.Time      `db:"delivered_at" json:"deliveredAt,omitempty"`
+}
+
+type DeliveryFilter struct {
+	Status DeliveryStatus
+	URL    string
+	// After is the ID of the last delivery already seen, for pagination.
+	After int64
+	Limit int
+}
+
+// webhookQueue holds the webhooks added with WithWebhook. Events are written
+// to the delivery queue as they happen, so that none is lost to a full event
+// queue, and the leader works through it.
+type webhookQueue struct {
+	registry *Registry
+	webhooks map[string]*WebhookSink
+	wake     chan struct{}
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (r *Registry) addWebhook(sink *WebhookSink) {
+	if r.webhooks == nil {
+		r.webhooks = &webhookQueue{
+			registry: r,
+			webhooks: make(map[string]*WebhookSink),
+			wake:     make(chan struct{}, 1),
+		}
+	}
+	r.webhooks.webhooks[sink.url] = sink
+}
+
+// enqueue writes a delivery of the event for every webhook whose filters
+// accept it.
+func (q *webhookQueue) enqueue(event Event) {
+	if q == nil {
+		return
+	}
+	// Docker distribution notifications have no action for corrupted blobs.
+	if event.Action == EventBlobCorrupted && q.registry.webhookFormat == WebhookFormatDistribution {
+		return
+	}
+	payload, contentType, err := q.registry.webhookPayload(event)
+	if err != nil {
+		q.registry.logger.Error("failed to encode webhook payload", "action", event.Action, "id", event.ID, "error", err)
+		return
+	}
+	for url, sink := range q.webhooks {
+		if !q.registry.events.accepts(sink.Name(), event) {
+			continue
+		}
+		if _, err := q.registry.db.EnqueueWebhookDelivery(url, event.ID, string(event.Action), contentType, payload); err != nil {
+			q.registry.logger.Error("failed to enqueue webhook delivery", "url", url, "id", event.ID, "error", err)
+		}
+	}
+	q.notify()
+}
+
+func (q *webhookQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *webhookQueue) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.run(ctx)
+	}()
+}
+
+func (q *webhookQueue) stop() {
+	if q == nil || q.cancel == nil {
+		return
+	}
+	q.cancel()
+	q.wg.Wait()
+	for _, sink := range q.webhooks {
+		sink.Close()
+	}
+}
+
+func (q *webhookQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		q.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *webhookQueue) processDue(ctx context.Context) {
+	if !q.registry.isLeader() {
+		return
+	}
+	if err := q.registry.db.PruneWebhookDeliveries(webhookDeliveryRetention); err != nil {
+		q.registry.logger.Error("failed to prune webhook deliveries", "error", err)
+	}
+	for {
+		deliveries, err := q.registry.db.DueWebhookDeliveries(webhookBatchSize)
+		if err != nil {
+			q.registry.logger.Error("failed to load webhook delivery queue", "error", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		for _, delivery := range deliveries {
+			if ctx.Err() != nil {
+				return
+			}
+			q.deliver(ctx, delivery)
+		}
+	}
+}
+
+func (q *webhookQueue) deliver(ctx context.Context, delivery WebhookDelivery) {
+	db := q.registry.db
+	sink, ok := q.webhooks[delivery.URL]
+	if !ok {
+		q.registry.logger.Warn("failing delivery to unknown webhook", "url", delivery.URL, "id", delivery.ID)
+		if err := db.FailWebhookDelivery(delivery.ID, ErrWebhookNotConfigured.Error()); err != nil {
+			q.registry.logger.Error("failed to update webhook delivery", "id", delivery.ID, "error", err)
+		}
+		return
+	}
+
+	err := sink.post(ctx, []byte(delivery.Payload), delivery.ContentType)
+	if err == nil {
+		if err := db.CompleteWebhookDelivery(delivery.ID); err != nil {
+			q.registry.logger.Error("failed to update webhook delivery", "id", delivery.ID, "error", err)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down, the attempt is made again on start.
+		return
+	}
+
+	if delivery.Attempts >= sink.maxRetries {
+		q.registry.logger.Error("webhook delivery failed", "url", delivery.URL, "id", delivery.ID, "attempts", delivery.Attempts+1, "error", err)
+		if err := db.FailWebhookDelivery(delivery.ID, err.Error()); err != nil {
+			q.registry.logger.Error("failed to update webhook delivery", "id", delivery.ID, "error", err)
+		}
+		return
+	}
+	backoff := min(time.Duration(1<<min(delivery.Attempts, 12))*time.Second, webhookMaxBackoff)
+	q.registry.logger.Warn("webhook delivery failed", "url", delivery.URL, "id", delivery.ID, "attempt", delivery.Attempts+1, "retryIn", backoff, "error", err)
+	if err := db.RetryWebhookDelivery(delivery.ID, err.Error(), backoff); err != nil {
+		q.registry.logger.Error("failed to reschedule webhook delivery", "id", delivery.ID, "error", err)
+	}
+}
+
+func (r *Registry) WebhookDeliveries(filter DeliveryFilter) ([]WebhookDelivery, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	deliveries, err := r.db.WebhookDeliveries(filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range deliveries {
+		deliveries[i].Event = json.RawMessage(deliveries[i].Payload)
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhook queues the event of a delivery again, as a new delivery,
+// and returns it. The delivery itself is left as it was.
+func (r *Registry) RedeliverWebhook(id int64) (*WebhookDelivery, error) {
+	delivery, err := r.db.GetWebhookDelivery(id)
+	if err != nil {
+		return nil, err
+	}
+	if delivery == nil {
+		return nil, nil
+	}
+	if r.webhooks == nil || r.webhooks.webhooks[delivery.URL] == nil {
+		return nil, fmt.Errorf("%w: %s", ErrWebhookNotConfigured, delivery.URL)
+	}
+	newID, err := r.db.EnqueueWebhookDelivery(delivery.URL, delivery.EventID, delivery.Action, delivery.ContentType, []byte(delivery.Payload))
+	if err != nil {
+		return nil, err
+	}
+	r.webhooks.notify()
+	redelivery, err := r.db.GetWebhookDelivery(newID)
+	if err != nil {
+		return nil, err
+	}
+	if redelivery == nil {
+		return nil, fmt.Errorf("webhook delivery %d vanished", newID)
+	}
+	redelivery.Event = json.RawMessage(redelivery.Payload)
+	return redelivery, nil
+}
+
+func (h *Handler) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := DeliveryFilter{Status: DeliveryStatus(query.Get("status")), URL: query.Get("url")}
+	switch filter.Status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+	default:
+		http.Error(w, fmt.Sprintf("invalid status %q, expected pending, delivered or failed", filter.Status), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if value := query.Get("last"); value != "" {
+		if filter.After, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid last: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("n"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil {
+			http.Error(w, fmt.Sprintf("invalid n: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	deliveries, err := h.registry.WebhookDeliveries(filter)
+	if err != nil {
+		h.registry.logger.Error("error listing webhook deliveries", "error", err)
+		http.Error(w, fmt.Sprintf("error listing webhook deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []WebhookDelivery{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func (h *Handler) redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid delivery id: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := h.registry.RedeliverWebhook(id)
+	if err != nil {
+		if errors.Is(err, ErrWebhookNotConfigured) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		h.registry.logger.Error("error redelivering webhook", "error", err)
+		http.Error(w, fmt.Sprintf("error redelivering webhook: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if delivery == nil {
+		http.Error(w, fmt.Sprintf("delivery %d not found", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
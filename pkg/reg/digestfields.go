@@ -0,0 +1,194 @@
+package reg
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// The RFC 9530 digest fields carry the digests the registry already sends as
+// Docker-Content-Digest, in a form generic HTTP tooling and CDNs understand:
+// Repr-Digest is of the whole blob or manifest, Content-Digest of the bytes
+// actually sent.
+const (
+	headerContentDigest = "Content-Digest"
+	headerReprDigest    = "Repr-Digest"
+)
+
+// digestFieldAlgorithms maps the algorithm names of the RFC 9530 registry to
+// those of OCI digests.
+var digestFieldAlgorithms = map[string]digest.Algorithm{
+	"sha-256": digest.SHA256,
+	"sha-512": digest.SHA512,
+}
+
+var errContentDigestMismatch = errors.New("content does not match Content-Digest")
+
+// digestField formats dgst as a digest field value, or returns "" for
+// algorithms the RFC has no name for.
+func digestField(dgst digest.Digest) string {
+	for name, alg := range digestFieldAlgorithms {
+		if alg != dgst.Algorithm() {
+			continue
+		}
+		raw, err := hex.DecodeString(dgst.Encoded())
+		if err != nil {
+			return ""
+		}
+		return name + "=:" + base64.StdEncoding.EncodeToString(raw) + ":"
+	}
+	return ""
+}
+
+// setDigestFields sets the digest fields of a response serving the whole
+// blob or manifest dgst. Content-Digest is left out of HEAD responses, which
+// have no content.
+func setDigestFields(w http.ResponseWriter, r *http.Request, dgst string) {
+	parsed, err := digest.Parse(dgst)
+	if err != nil {
+		return
+	}
+	value := digestField(parsed)
+	if value == "" {
+		return
+	}
+	w.Header().Set(headerReprDigest, value)
+	if r.Method != http.MethodHead {
+		w.Header().Set(headerContentDigest, value)
+	}
+}
+
+// parseDigestField parses a Content-Digest or Repr-Digest value, a structured
+// field dictionary of byte sequences keyed by algorithm. Algorithms the
+// registry does not support are skipped, as the RFC asks.
+func parseDigestField(value string) ([]digest.Digest, error) {
+	var digests []digest.Digest
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		name, encoded, found := strings.Cut(member, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid digest field member %q", member)
+		}
+		alg, ok := digestFieldAlgorithms[name]
+		if !ok || !alg.Available() {
+			continue
+		}
+		// Parameters carry nothing the registry needs.
+		encoded, _, _ = strings.Cut(encoded, ";")
+		if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			return nil, fmt.Errorf("invalid %s digest field value", name)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+		if err != nil || len(raw) != alg.Size() {
+			return nil, fmt.Errorf("invalid %s digest field value", name)
+		}
+		digests = append(digests, digest.NewDigestFromEncoded(alg, hex.EncodeToString(raw)))
+	}
+	return digests, nil
+}
+
+// verifyContentDigest makes the body of a request with a Content-Digest fail
+// its final read when it does not match, so that an upload corrupted on the
+// way is rejected before it is stored.
+func verifyContentDigest(r *http.Request) error {
+	value := r.Header.Get(headerContentDigest)
+	// The content of an encoded body is not what is stored.
+	if value == "" || r.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	digests, err := parseDigestField(value)
+	if err != nil {
+		return err
+	}
+	if len(digests) > 0 {
+		r.Body = &contentDigestReader{ReadCloser: r.Body, digests: digests, verifiers: verifiersOf(digests)}
+	}
+	return nil
+}
+
+// checkReprDigest checks the Repr-Digest of a request against the digest of
+// what it uploads. Only digests of the same algorithm can be compared.
+func checkReprDigest(r *http.Request, dgst string) error {
+	value := r.Header.Get(headerReprDigest)
+	if value == "" {
+		return nil
+	}
+	digests, err := parseDigestField(value)
+	if err != nil {
+		return err
+	}
+	for _, expected := range digests {
+		if expected.Algorithm() == digest.Digest(dgst).Algorithm() && expected.String() != dgst {
+			return fmt.Errorf("digest %s of Repr-Digest does not match %s", expected, dgst)
+		}
+	}
+	return nil
+}
+
+// checkUploadDigestFields checks the digest fields of a blob upload request
+// carrying the digest of the blob, and verifies its body as it is read.
+func checkUploadDigestFields(r *http.Request, dgst string) error {
+	if err := checkReprDigest(r, dgst); err != nil {
+		return err
+	}
+	return verifyContentDigest(r)
+}
+
+// checkDigestFields checks both digest fields of a request against its body,
+// read already, which is the whole representation.
+func checkDigestFields(r *http.Request, body []byte) error {
+	for _, field := range []string{headerContentDigest, headerReprDigest} {
+		value := r.Header.Get(field)
+		if value == "" || (field == headerContentDigest && r.Header.Get("Content-Encoding") != "") {
+			continue
+		}
+		digests, err := parseDigestField(value)
+		if err != nil {
+			return err
+		}
+		for _, expected := range digests {
+			if expected.Algorithm().FromBytes(body) != expected {
+				return fmt.Errorf("digest %s of %s does not match the body", expected, field)
+			}
+		}
+	}
+	return nil
+}
+
+func verifiersOf(digests []digest.Digest) []digest.Verifier {
+	verifiers := make([]digest.Verifier, len(digests))
+	for i, dgst := range digests {
+		verifiers[i] = dgst.Verifier()
+	}
+	return verifiers
+}
+
+type contentDigestReader struct {
+	io.ReadCloser
+	digests   []digest.Digest
+	verifiers []digest.Verifier
+}
+
+func (c *contentDigestReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	for _, verifier := range c.verifiers {
+		verifier.Write(p[:n])
+	}
+	if err == io.EOF {
+		for i, verifier := range c.verifiers {
+			if !verifier.Verified() {
+				return n, fmt.Errorf("%w %s", errContentDigestMismatch, c.digests[i])
+			}
+		}
+	}
+	return n, err
+}
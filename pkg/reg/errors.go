@@ -0,0 +1,46 @@
+package reg
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Error codes from the distribution spec, see
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#error-codes
+const (
+	errCodeBlobUnknown       = "BLOB_UNKNOWN"
+	errCodeBlobUploadUnknown = "BLOB_UPLOAD_UNKNOWN"
+	errCodeDigestInvalid     = "DIGEST_INVALID"
+	errCodeManifestInvalid   = "MANIFEST_INVALID"
+	errCodeManifestUnknown   = "MANIFEST_UNKNOWN"
+	errCodeNameInvalid       = "NAME_INVALID"
+	errCodeNameUnknown       = "NAME_UNKNOWN"
+	errCodeUnauthorized      = "UNAUTHORIZED"
+	errCodeDenied            = "DENIED"
+	errCodeUnsupported       = "UNSUPPORTED"
+	// Not in the spec, the code Docker distribution answers 503s with.
+	errCodeUnavailable = "UNAVAILABLE"
+)
+
+type ociError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  any    `json:"detail,omitempty"`
+}
+
+type ociErrors struct {
+	Errors []ociError `json:"errors"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	body, err := json.Marshal(ociErrors{Errors: []ociError{{Code: code, Message: message}}})
+	if err != nil {
+		slog.Error("error marshalling error response", "error", err)
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,152 @@
+package reg
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// EventFilter narrows the events an event sink receives. Every criterion set
+// must match: repositories and media types are path.Match globs, and the tag
+// regular expression matches anywhere in the tag. Events without a tag, like
+// uploads and deletions of repositories, do not match a tag filter, and
+// events without a media type do not match a media type filter.
+type EventFilter struct {
+	Repositories []string
+	Actions      []EventAction
+	Tags         *regexp.Regexp
+	MediaTypes   []string
+}
+
+// ParseEventFilter parses a filter written as ";"-separated rules of the
+// form "<key>:<value>", where the key is repository, action, tag or
+// media-type. Repeated keys are alternatives, e.g.
+// "repository:team/*;action:manifest.pushed;action:tag.deleted".
+func ParseEventFilter(rules string) (EventFilter, error) {
+	var filter EventFilter
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		key, value, found := strings.Cut(rule, ":")
+		if !found || value == "" {
+			return EventFilter{}, fmt.Errorf("invalid event filter rule %q, expected <key>:<value>", rule)
+		}
+		switch key {
+		case "repository":
+			if _, err := path.Match(value, ""); err != nil {
+				return EventFilter{}, fmt.Errorf("invalid repository glob %q: %w", value, err)
+			}
+			filter.Repositories = append(filter.Repositories, value)
+		case "action":
+			action := EventAction(value)
+			switch action {
+			case EventManifestPushed, EventManifestDeleted, EventTagDeleted, EventBlobUploaded, EventRepoDeleted, EventBlobCorrupted:
+			default:
+				return EventFilter{}, fmt.Errorf("unknown event action %q", value)
+			}
+			filter.Actions = append(filter.Actions, action)
+		case "tag":
+			if filter.Tags != nil {
+				return EventFilter{}, fmt.Errorf("event filter has more than one tag rule, use an alternation instead")
+			}
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return EventFilter{}, fmt.Errorf("invalid tag regexp %q: %w", value, err)
+			}
+			filter.Tags = re
+		case "media-type":
+			if _, err := path.Match(value, ""); err != nil {
+				return EventFilter{}, fmt.Errorf("invalid media type glob %q: %w", value, err)
+			}
+			filter.MediaTypes = append(filter.MediaTypes, value)
+		default:
+			return EventFilter{}, fmt.Errorf("unknown event filter key %q, expected repository, action, tag or media-type", key)
+		}
+	}
+	return filter, nil
+}
+
+func (f EventFilter) matches(event Event) bool {
+	if len(f.Repositories) > 0 && !matchesAnyGlob(f.Repositories, event.Repository) {
+		return false
+	}
+	if len(f.Actions) > 0 {
+		found := false
+		for _, action := range f.Actions {
+			if action == event.Action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Tags != nil && (event.Tag == "" || !f.Tags.MatchString(event.Tag)) {
+		return false
+	}
+	if len(f.MediaTypes) > 0 && (event.MediaType == "" || !matchesAnyGlob(f.MediaTypes, event.MediaType)) {
+		return false
+	}
+	return true
+}
+
+func matchesAnyGlob(globs []string, name string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sinkFilter is an event filter of the sinks named sink, or whose name starts
+// with sink and a space, so that "nats" covers "nats nats://host:4222".
+type sinkFilter struct {
+	sink   string
+	filter EventFilter
+}
+
+func (f sinkFilter) covers(name string) bool {
+	return name == f.sink || strings.HasPrefix(name, f.sink+" ")
+}
+
+// checkEventFilters rejects filters covering no sink, most likely a typo that
+// would leave the sink receiving every event.
+func (r *Registry) checkEventFilters() error {
+	var names []string
+	for _, w := range r.events.workers {
+		names = append(names, w.sink.Name())
+	}
+	if r.webhooks != nil {
+		for _, sink := range r.webhooks.webhooks {
+			names = append(names, sink.Name())
+		}
+	}
+	for _, f := range r.events.filters {
+		if !slices.ContainsFunc(names, f.covers) {
+			return fmt.Errorf("event filter for unknown sink %q", f.sink)
+		}
+	}
+	return nil
+}
+
+// acceptsEvent tells whether the sink named name is to receive event: when
+// no filter covers it, or when any of those that do matches.
+func acceptsEvent(filters []sinkFilter, name string, event Event) bool {
+	covered := false
+	for _, f := range filters {
+		if !f.covers(name) {
+			continue
+		}
+		if f.filter.matches(event) {
+			return true
+		}
+		covered = true
+	}
+	return !covered
+}
@@ -0,0 +1,226 @@
+package reg
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type EventAction string
+
+const (
+	EventManifestPushed  EventAction = "manifest.pushed"
+	EventManifestDeleted EventAction = "manifest.deleted"
+	EventTagDeleted      EventAction = "tag.deleted"
+	EventBlobUploaded    EventAction = "blob.uploaded"
+	EventRepoDeleted     EventAction = "repository.deleted"
+	EventBlobCorrupted   EventAction = "blob.corrupted"
+)
+
+type Event struct {
+	ID         string      `json:"id"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Action     EventAction `json:"action"`
+	Repository string      `json:"repository"`
+	Tag        string      `json:"tag,omitempty"`
+	Digest     string      `json:"digest,omitempty"`
+	MediaType  string      `json:"mediaType,omitempty"`
+	Size       int64       `json:"size,omitempty"`
+	Actor      string      `json:"actor,omitempty"`
+	Addr       string      `json:"addr,omitempty"`
+	Error      string      `json:"error,omitempty"`
+
+	request requestInfo
+}
+
+type EventSink interface {
+	Name() string
+	Send(ctx context.Context, event Event) error
+	Close() error
+}
+
+type requestInfo struct {
+	Actor     string
+	Addr      string
+	Method    string
+	Scheme    string
+	Host      string
+	UserAgent string
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// onBehalfOfRequest tells whether ctx is that of a request, rather than of a
+// call by the program embedding the registry.
+func onBehalfOfRequest(ctx context.Context) bool {
+	_, ok := ctx.Value(requestInfoKey{}).(requestInfo)
+	return ok
+}
+
+func requestInfoFrom(ctx context.Context) requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info
+}
+
+// newRequestInfo leaves the actor to authMiddleware, which sets it once the
+// AuthFunc verified the credentials.
+func (r *Registry) newRequestInfo(req *http.Request) requestInfo {
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		addr = req.RemoteAddr
+	}
+	return requestInfo{
+		Addr:      addr,
+		Method:    req.Method,
+		Scheme:    r.requestScheme(req),
+		Host:      req.Host,
+		UserAgent: req.UserAgent(),
+	}
+}
+
+const eventQueueSize = 1024
+
+type sinkWorker struct {
+	sink   EventSink
+	events *eventDispatcher
+	queue  chan Event
+	done   chan struct{}
+}
+
+func (w *sinkWorker) run() {
+	defer close(w.done)
+	for event := range w.queue {
+		if err := w.sink.Send(context.Background(), event); err != nil {
+			w.events.logger.Warn("failed to deliver event", "sink", w.sink.Name(), "action", event.Action, "id", event.ID, "error", err)
+		}
+	}
+}
+
+type eventDispatcher struct {
+	logger  *slog.Logger
+	mu      sync.RWMutex
+	workers []*sinkWorker
+	filters []sinkFilter
+	closed  bool
+}
+
+func (d *eventDispatcher) addSink(sink EventSink) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w := &sinkWorker{
+		sink:   sink,
+		events: d,
+		queue:  make(chan Event, eventQueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	d.workers = append(d.workers, w)
+}
+
+func (d *eventDispatcher) addFilter(sink string, filter EventFilter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.filters = append(d.filters, sinkFilter{sink: sink, filter: filter})
+}
+
+func (d *eventDispatcher) accepts(name string, event Event) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return acceptsEvent(d.filters, name, event)
+}
+
+func (d *eventDispatcher) dispatch(event Event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, w := range d.workers {
+		if !acceptsEvent(d.filters, w.sink.Name(), event) {
+			continue
+		}
+		select {
+		case w.queue <- event:
+		default:
+			d.logger.Warn("event queue full, dropping event", "sink", w.sink.Name(), "action", event.Action, "id", event.ID)
+		}
+	}
+}
+
+func (d *eventDispatcher) close() {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	workers := d.workers
+	d.mu.Unlock()
+
+	for _, w := range workers {
+		close(w.queue)
+		<-w.done
+		if err := w.sink.Close(); err != nil {
+			d.logger.Warn("failed to close event sink", "sink", w.sink.Name(), "error", err)
+		}
+	}
+}
+
+func (r *Registry) notify(ctx context.Context, event Event) {
+	info := requestInfoFrom(ctx)
+	event.ID = uuid.New().String()
+	event.Timestamp = time.Now().UTC()
+	event.Actor = info.Actor
+	event.Addr = info.Addr
+	event.request = info
+	r.webhooks.enqueue(event)
+	r.events.dispatch(event)
+}
+
+// eventHooks turns pushes, uploads and deletions into events for the sinks.
+func (r *Registry) eventHooks() Hooks {
+	return Hooks{
+		OnManifestPush: func(ctx context.Context, push ManifestPush) {
+			r.notify(ctx, Event{
+				Action:     EventManifestPushed,
+				Repository: push.Repository,
+				Tag:        push.Tag,
+				Digest:     push.Digest.String(),
+				MediaType:  push.MediaType,
+				Size:       int64(len(push.Manifest)),
+			})
+		},
+		OnBlobUploadComplete: func(ctx context.Context, upload BlobUpload) {
+			r.notify(ctx, Event{
+				Action:     EventBlobUploaded,
+				Repository: upload.Repository,
+				Digest:     upload.Digest.String(),
+				Size:       upload.Size,
+			})
+		},
+		OnDelete: func(ctx context.Context, deletion Deletion) {
+			event := Event{
+				Action:     EventRepoDeleted,
+				Repository: deletion.Repository,
+				Tag:        deletion.Tag,
+				Digest:     deletion.Digest.String(),
+			}
+			switch {
+			case deletion.Tag != "":
+				event.Action = EventTagDeleted
+			case deletion.Digest != "":
+				event.Action = EventManifestDeleted
+			}
+			r.notify(ctx, event)
+		},
+	}
+}
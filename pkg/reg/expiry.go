@@ -0,0 +1,134 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Annotations making a manifest expire: at an RFC 3339 time, or a duration
+// like "12h" or "7d" after it is first pushed.
+const (
+	expiresAtAnnotation    = "reg.expires-at"
+	expiresAfterAnnotation = "reg.expires-after"
+)
+
+// manifestExpiry returns when a manifest pushed at pushed expires according
+// to its annotations, nil if it never does.
+func manifestExpiry(annotations map[string]string, pushed time.Time) (*time.Time, error) {
+	if value, ok := annotations[expiresAtAnnotation]; ok {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", expiresAtAnnotation, err)
+		}
+		return &t, nil
+	}
+	if value, ok := annotations[expiresAfterAnnotation]; ok {
+		d, err := parseExpiryDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", expiresAfterAnnotation, err)
+		}
+		t := pushed.Add(d)
+		return &t, nil
+	}
+	return nil, nil
+}
+
+// parseExpiryDuration parses Go durations, along with whole days ("7d") and
+// weeks ("2w").
+func parseExpiryDuration(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count <= 0 {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+func (r *Registry) indexExpiry(name string, manifestBytes []byte) error {
+	m, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	expiresAt, err := manifestExpiry(m.Annotations, time.Now())
+	if err != nil || expiresAt == nil {
+		return err
+	}
+	return r.db.PutManifestExpiry(name, digest.FromBytes(manifestBytes).String(), *expiresAt)
+}
+
+// expireManifests deletes the manifests whose expiry annotation has passed,
+// along with their tags, unless one of those tags is immutable. A dry run
+// only reports what would be deleted.
+func (r *Registry) expireManifests(ctx context.Context, dryRun bool) ([]string, error) {
+	expired, err := r.db.ExpiredManifests(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, m := range expired {
+		dgst := digest.Digest(m.Digest)
+		tags, err := r.manifestTags(ctx, m.Repository, dgst)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := r.db.DeleteManifestExpiry(m.Repository, m.Digest); err != nil {
+				return deleted, err
+			}
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("failed to get tags of %s@%s: %w", m.Repository, dgst, err)
+		}
+		immutable, err := r.hasImmutableTag(ctx, m.Repository, dgst, tags)
+		if err != nil {
+			return deleted, err
+		}
+		if immutable {
+			r.logger.Debug("not expiring manifest with an immutable tag", "repository", m.Repository, "digest", dgst)
+			continue
+		}
+		if !dryRun {
+			if err := r.deleteManifest(ctx, m.Repository, dgst); err != nil {
+				return deleted, fmt.Errorf("failed to delete %s@%s: %w", m.Repository, dgst, err)
+			}
+		}
+		deleted = append(deleted, m.Repository+"@"+m.Digest)
+	}
+	return deleted, nil
+}
+
+// hasImmutableTag tells whether any of the tags currently pointing at a
+// manifest is immutable.
+func (r *Registry) hasImmutableTag(ctx context.Context, repo string, dgst digest.Digest, tags []string) (bool, error) {
+	settings, err := r.RepositorySettings(repo)
+	if err != nil {
+		return false, err
+	}
+	immutable := settings.Settings.Immutable != nil && *settings.Settings.Immutable
+	for _, tag := range tags {
+		current, err := r.getManifestSHA(ctx, repo, tag)
+		if err != nil || current != dgst {
+			continue
+		}
+		if immutable || r.isTagImmutable(repo, tag) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,166 @@
+package reg
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const annotationContainerdImageName = "io.containerd.image.name"
+
+// dockerArchiveManifest is an entry of manifest.json in a docker save tarball.
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+func ociBlobPath(dgst digest.Digest) string {
+	return path.Join(v1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// Export writes repo:reference as an OCI image layout tarball. Image manifests
+// also get a docker save style manifest.json, so the same archive works with
+// docker load.
+func (r *Registry) Export(ctx context.Context, repo string, reference string, w io.Writer) error {
+	_, manifestBytes, err := r.getStoredManifest(ctx, repo, reference)
+	if err != nil {
+		return fmt.Errorf("failed to get manifest: %w", err)
+	}
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, v1.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+
+	written := make(map[digest.Digest]bool)
+	if err := r.exportManifest(ctx, tw, repo, manifestBytes, written); err != nil {
+		return err
+	}
+
+	sha := digest.FromBytes(manifestBytes)
+	annotations := map[string]string{annotationContainerdImageName: repo + "@" + sha.String()}
+	if !isDigest(reference) {
+		annotations[v1.AnnotationRefName] = reference
+		annotations[annotationContainerdImageName] = repo + ":" + reference
+	}
+	index, err := json.Marshal(v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{{
+			MediaType:   manifest.mediaType(),
+			Digest:      sha,
+			Size:        int64(len(manifestBytes)),
+			Annotations: annotations,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, v1.ImageIndexFile, index); err != nil {
+		return err
+	}
+
+	if !manifest.isIndex() && manifest.Config != nil {
+		entry := dockerArchiveManifest{Config: ociBlobPath(manifest.Config.Digest)}
+		if !isDigest(reference) {
+			entry.RepoTags = []string{repo + ":" + reference}
+		}
+		for _, layer := range manifest.Layers {
+			entry.Layers = append(entry.Layers, ociBlobPath(layer.Digest))
+		}
+		dockerManifest, err := json.Marshal([]dockerArchiveManifest{entry})
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, "manifest.json", dockerManifest); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (r *Registry) exportManifest(ctx context.Context, tw *tar.Writer, repo string, manifestBytes []byte, written map[digest.Digest]bool) error {
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	for _, child := range manifest.Manifests {
+		if written[child.Digest] {
+			continue
+		}
+		childBytes, err := r.getManifestBlob(ctx, repo, child.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to get child manifest %s: %w", child.Digest, err)
+		}
+		if err := r.exportManifest(ctx, tw, repo, childBytes, written); err != nil {
+			return err
+		}
+	}
+	for _, blob := range manifest.blobs() {
+		if written[blob.Digest] || len(blob.URLs) > 0 {
+			continue
+		}
+		if err := r.exportBlob(ctx, tw, repo, blob); err != nil {
+			return err
+		}
+		written[blob.Digest] = true
+	}
+
+	sha := digest.FromBytes(manifestBytes)
+	if written[sha] {
+		return nil
+	}
+	written[sha] = true
+	return writeTarFile(tw, ociBlobPath(sha), manifestBytes)
+}
+
+func (r *Registry) exportBlob(ctx context.Context, tw *tar.Writer, repo string, blob v1.Descriptor) error {
+	body, size, err := r.openBlob(ctx, repo, blob.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %w", blob.Digest, err)
+	}
+	defer body.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    ociBlobPath(blob.Digest),
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, body, size); err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", blob.Digest, err)
+	}
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
@@ -0,0 +1,183 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+)
+
+// fallbackWindow is how long after a failed read of the primary bucket
+// redirects point at the fallback bucket, unless a read succeeds meanwhile.
+const fallbackWindow = 30 * time.Second
+
+// fallbackProbeInterval is how often the primary bucket is checked, since
+// pulls served from the database and the presigned URL cache never reach it.
+const fallbackProbeInterval = 10 * time.Second
+
+// fallbackBucket is a replica of the bucket, typically replicated to another
+// region, which blob and link reads turn to when the primary bucket fails.
+// Writes always go to the primary bucket.
+type fallbackBucket struct {
+	bucket string
+	region string
+	client *s3.Client
+	logger *slog.Logger
+
+	// Unix nanoseconds of the last failed read of the primary bucket, zero
+	// once reads succeed again.
+	primaryFailedAt atomic.Int64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// configure points the fallback client at the fallback region, with the same
+// retries and timeouts as the primary one. The circuit breaker and the
+// concurrency limit only guard the primary bucket.
+func (f *fallbackBucket) configure(policy *S3Policy) func(o *s3.Options) {
+	return func(o *s3.Options) {
+		if f.region != "" {
+			o.Region = f.region
+		}
+		if policy != nil {
+			policy.apply(o)
+		}
+	}
+}
+
+// active tells whether the primary bucket failed recently.
+func (f *fallbackBucket) active() bool {
+	failedAt := f.primaryFailedAt.Load()
+	return failedAt != 0 && time.Since(time.Unix(0, failedAt)) < fallbackWindow
+}
+
+func (f *fallbackBucket) primaryFailed(err error) {
+	if f.primaryFailedAt.Swap(time.Now().UnixNano()) == 0 {
+		f.logger.Warn("primary bucket failing, reading from fallback bucket", "bucket", f.bucket, "error", err)
+	}
+}
+
+func (f *fallbackBucket) primaryRecovered() {
+	if f.primaryFailedAt.Swap(0) != 0 {
+		f.logger.Info("primary bucket recovered")
+	}
+}
+
+func (r *Registry) startFallbackProbe() {
+	f := r.fallback
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		ticker := time.NewTicker(fallbackProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				probeCtx, cancel := context.WithTimeout(ctx, fallbackProbeInterval/2)
+				_, err := r.s3Client.HeadBucket(probeCtx, &s3.HeadBucketInput{Bucket: &r.bucket}, forcePathStyle)
+				cancel()
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					f.primaryFailed(err)
+				} else {
+					f.primaryRecovered()
+				}
+			}
+		}
+	}()
+}
+
+func (f *fallbackBucket) stop() {
+	if f != nil && f.cancel != nil {
+		f.cancel()
+		f.wg.Wait()
+	}
+}
+
+// withFallback runs a read against the primary bucket holding the key read
+// and, if it fails for any other reason than a missing key or the client
+// going away, against the fallback bucket. Should the fallback fail too, the
+// primary error is returned.
+func withFallback[T any](ctx context.Context, r *Registry, bucket string, read func(client *s3.Client, bucket string) (T, error)) (T, error) {
+	out, err := read(r.s3Client, bucket)
+	f := r.fallback
+	if f == nil {
+		return out, err
+	}
+	if err == nil || isNotFound(err) {
+		f.primaryRecovered()
+		return out, err
+	}
+	if ctx.Err() != nil {
+		return out, err
+	}
+	f.primaryFailed(err)
+	fallbackOut, fallbackErr := read(f.client, f.bucket)
+	if fallbackErr != nil {
+		if !isNotFound(fallbackErr) {
+			r.logger.Error("error reading from fallback bucket", "error", fallbackErr)
+		}
+		return out, err
+	}
+	return fallbackOut, nil
+}
+
+func (r *Registry) getObject(ctx context.Context, key string) (*s3.GetObjectOutput, error) {
+	return r.getObjectFrom(ctx, key, 0)
+}
+
+// getObjectFrom gets an object from offset on, with a ranged GET unless the
+// offset is 0.
+func (r *Registry) getObjectFrom(ctx context.Context, key string, offset int64) (*s3.GetObjectOutput, error) {
+	return withFallback(ctx, r, r.bucketFor(key), func(client *s3.Client, bucket string) (*s3.GetObjectOutput, error) {
+		input := &s3.GetObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		}
+		if offset > 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+		}
+		return client.GetObject(ctx, input, forcePathStyle)
+	})
+}
+
+func (r *Registry) headObject(ctx context.Context, key string) (*s3.HeadObjectOutput, error) {
+	return withFallback(ctx, r, r.bucketFor(key), func(client *s3.Client, bucket string) (*s3.HeadObjectOutput, error) {
+		return client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		}, forcePathStyle)
+	})
+}
+
+// presignFallback signs a URL for a blob in the fallback bucket. These are
+// not cached, so that redirects point back at the primary bucket as soon as
+// it recovers.
+func (r *Registry) presignFallback(ctx context.Context, dgst digest.Digest, method string) (string, error) {
+	key := blobKey(dgst)
+	if _, err := r.fallback.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &r.fallback.bucket,
+		Key:    &key,
+	}, forcePathStyle); err != nil {
+		if isNotFound(err) {
+			return "", errors.Join(err, fs.ErrNotExist)
+		}
+		return "", fmt.Errorf("failed to stat blob in fallback bucket: %w", err)
+	}
+	return r.presign(ctx, r.fallback.client, r.fallback.bucket, key, method)
+}
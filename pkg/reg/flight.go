@@ -0,0 +1,34 @@
+package reg
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// sharedCallTimeout bounds a shared call, which runs detached from the
+// callers so that the first one going away does not fail the others, and
+// which may reach an upstream registry.
+const sharedCallTimeout = time.Minute
+
+// shared runs fn once for all concurrent callers asking for the same key, so
+// a burst of identical cache misses turns into a single S3 round trip. Each
+// caller stops waiting once its own ctx is done.
+func shared[T any](ctx context.Context, group *singleflight.Group, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	ch := group.DoChan(key, func() (any, error) {
+		callCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedCallTimeout)
+		defer cancel()
+		return fn(callCtx)
+	})
+	var zero T
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case result := <-ch:
+		if result.Err != nil {
+			return zero, result.Err
+		}
+		return result.Val.(T), nil
+	}
+}
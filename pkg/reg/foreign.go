@@ -0,0 +1,56 @@
+package reg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+var ErrForeignLayer = errors.New("manifest has foreign layers")
+
+type ForeignLayerPolicy string
+
+const (
+	// Manifests with foreign layers are accepted as pushed.
+	ForeignLayersAllow ForeignLayerPolicy = "allow"
+	// Manifests with foreign layers are accepted, and their push logged.
+	ForeignLayersWarn ForeignLayerPolicy = "warn"
+	// Manifests with foreign layers are rejected.
+	ForeignLayersReject ForeignLayerPolicy = "reject"
+)
+
+// foreignLayer reports whether a layer is meant to be pulled from elsewhere,
+// like Windows base layers, so that it need not be in the bucket.
+func foreignLayer(layer v1.Descriptor) bool {
+	if len(layer.URLs) > 0 || layer.MediaType == mediaTypeDockerForeignLayer {
+		return true
+	}
+	return strings.HasPrefix(layer.MediaType, "application/vnd.oci.image.layer.nondistributable.")
+}
+
+// checkForeignLayers applies the foreign layer policy to a manifest pushed to
+// repo. Pulls of such manifests break wherever the layers' URLs cannot be
+// reached, which is why they may be kept out of the registry.
+func (r *Registry) checkForeignLayers(repo string, reference string, manifest *anyManifest) error {
+	if r.foreignLayers == ForeignLayersAllow {
+		return nil
+	}
+	var foreign []string
+	for _, layer := range manifest.Layers {
+		if foreignLayer(layer) {
+			foreign = append(foreign, layer.Digest.String())
+		}
+	}
+	if len(foreign) == 0 {
+		return nil
+	}
+	if r.foreignLayers == ForeignLayersReject {
+		return fmt.Errorf("%w: %s", ErrForeignLayer, strings.Join(foreign, ", "))
+	}
+	r.logger.Warn("manifest has foreign layers", "repository", repo, "reference", reference, "layers", foreign)
+	return nil
+}
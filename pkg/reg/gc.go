@@ -0,0 +1,165 @@
+package reg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+const defaultGCGracePeriod = time.Hour
+
+// staleUploadAge is how long an upload may go without activity before it is
+// aborted as abandoned.
+const staleUploadAge = "-24 hours"
+
+const (
+	// blobCollectionTTL bounds how long a collection holds the lease of a
+	// blob while it checks and deletes it.
+	blobCollectionTTL = time.Minute
+	// blobClaimWait is how long a claim waits for collections of its blobs.
+	blobClaimWait = 30 * time.Second
+)
+
+// blobCollectionLease names the lease a collection holds on a blob, in the
+// database the replicas share.
+func blobCollectionLease(dgst string) string {
+	return "gc:blob:" + dgst
+}
+
+// claimBlobs records a new generation of blobs a push wrote, mounted or
+// refers to. A collection keeps blobs of generations within its grace period,
+// so that it does not delete the layers of an image whose manifest is still
+// being pushed.
+func (r *Registry) claimBlobs(ctx context.Context, dgsts []digest.Digest) error {
+	if len(dgsts) == 0 {
+		return nil
+	}
+	keys := make([]string, len(dgsts))
+	for i, dgst := range dgsts {
+		keys[i] = dgst.String()
+	}
+	// Claims skip the blobs a collection holds the lease of, and wait for
+	// it, so a blob is either claimed before it is checked or deleted before
+	// it is claimed, whichever replica collects it.
+	ctx, cancel := context.WithTimeout(ctx, blobClaimWait)
+	defer cancel()
+	backoff := 25 * time.Millisecond
+	for {
+		busy, err := r.db.ClaimBlobs(keys, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to claim blobs: %w", err)
+		}
+		if len(busy) == 0 {
+			return nil
+		}
+		keys = busy
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to claim blobs: %d still being collected", len(busy))
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 500*time.Millisecond)
+	}
+}
+
+// claimManifestBlobs claims a manifest and the blobs it refers to.
+func (r *Registry) claimManifestBlobs(ctx context.Context, manifestBytes []byte) error {
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	dgsts := []digest.Digest{digest.FromBytes(manifestBytes)}
+	for _, blob := range manifest.blobs() {
+		dgsts = append(dgsts, blob.Digest)
+	}
+	for _, child := range manifest.Manifests {
+		dgsts = append(dgsts, child.Digest)
+	}
+	return r.claimBlobs(ctx, dgsts)
+}
+
+// collectionCutoff returns the generation blobs must be older than to be
+// collected by a collection starting now: older than the grace period, and
+// than the oldest upload not abandoned yet, whose image may refer to blobs
+// pushed since it started.
+func (r *Registry) collectionCutoff() (time.Time, error) {
+	cutoff := time.Now().Add(-r.gcGracePeriod)
+	oldest, err := r.db.OldestActiveUpload(staleUploadAge)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !oldest.IsZero() && oldest.Before(cutoff) {
+		cutoff = oldest
+	}
+	return cutoff, nil
+}
+
+// collectBlob deletes an unreferenced blob unless it was written or claimed
+// after cutoff, and tells whether it did.
+func (r *Registry) collectBlob(ctx context.Context, dgst digest.Digest, cutoff time.Time) (bool, error) {
+	lease := blobCollectionLease(dgst.String())
+	holder := r.replicaID + "-" + uuid.NewString()[:8]
+	held, err := r.db.AcquireLease(lease, holder, blobCollectionTTL)
+	if err != nil {
+		return false, err
+	}
+	if !held {
+		// Another collection is at it.
+		return false, nil
+	}
+	defer func() {
+		if err := r.db.ReleaseLease(lease, holder); err != nil {
+			r.logger.Warn("failed to release blob lease", "digest", dgst, "error", err)
+		}
+	}()
+
+	generation, err := r.db.BlobGeneration(dgst.String())
+	if err != nil {
+		return false, err
+	}
+	key := blobKey(dgst)
+	// Blobs written by imports, mirrors or replication were never claimed,
+	// the time they were written at is their generation.
+	obj, err := r.headObject(ctx, key)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat blob %s: %w", dgst, err)
+	}
+	if written := aws.ToTime(obj.LastModified); written.After(generation) {
+		generation = written
+	}
+	// Both may be truncated to the second, a blob of the same second is kept.
+	if !generation.Before(cutoff) {
+		r.logger.Debug("keeping blob within grace period", "digest", dgst, "generation", generation)
+		return false, nil
+	}
+
+	_, err = r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(r.bucketFor(key)),
+		Key:    &key,
+	}, forcePathStyle)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete blob %s: %w", dgst, err)
+	}
+	if err := r.db.DeleteLayer(dgst.String()); err != nil {
+		r.logger.Error("error deleting layer from database", "error", err)
+	}
+	if err := r.db.DeleteBlobRestore(dgst.String()); err != nil {
+		r.logger.Error("error deleting blob restore", "error", err)
+	}
+	if err := r.db.DeleteBlobGeneration(dgst.String()); err != nil {
+		r.logger.Error("error deleting blob generation", "error", err)
+	}
+	if err := r.db.DeleteBlobVerification(dgst.String()); err != nil {
+		r.logger.Error("error deleting blob verification", "error", err)
+	}
+	r.presigned.forget(dgst)
+	return true, nil
+}
@@ -8,19 +8,41 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type Handler struct {
 	registry  *Registry
 	blobCache *lru.Cache[string, []byte]
+	spec      []byte
+}
+
+// Handler serves the registry's HTTP API, for embedding the registry into
+// another server. NewRouter builds a separate router instead.
+func (r *Registry) Handler() http.Handler {
+	r.handlerOnce.Do(func() {
+		router, err := NewRouter(context.Background(), r)
+		if err != nil {
+			r.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, fmt.Sprintf("error creating router: %v", err), http.StatusInternalServerError)
+			})
+			return
+		}
+		r.handler = router
+	})
+	return r.handler
 }
 
 func NewRouter(ctx context.Context, registry *Registry) (*mux.Router, error) {
@@ -35,19 +57,39 @@ func NewRouter(ctx context.Context, registry *Registry) (*mux.Router, error) {
 	}
 
 	r := mux.NewRouter()
+	r.Use(h.requestInfoMiddleware)
+	if registry.s3Breaker != nil {
+		r.Use(h.s3BreakerMiddleware)
+	}
+	if registry.compressMinSize > 0 {
+		r.Use(compressionMiddleware(registry.compressMinSize))
+	}
+	// Prometheus metrics of the S3 client, the cache, the OCI endpoints and blob
+	// scrubbing
+	r.Handle("/metrics", http.HandlerFunc(h.getMetrics)).Methods("GET")
+
 	apiRouter := r.PathPrefix("/v2").Subrouter()
+	apiRouter.Use(h.httpMetricsMiddleware)
+	apiRouter.Use(h.maintenanceMiddleware)
+	apiRouter.Use(h.authMiddleware)
+	apiRouter.Use(h.aclMiddleware)
 
 	// end-1: Check API support
 	apiRouter.Handle("/", http.HandlerFunc(h.checkAPISupport)).Methods("GET")
 
 	// end-2: Get blob
-	apiRouter.Handle("/{name:.*}/blobs/{digest}", http.HandlerFunc(h.getBlob)).Methods("GET", "HEAD")
+	apiRouter.Handle("/{name:.*}/blobs/{digest}", h.longRunning(http.HandlerFunc(h.getBlob))).Methods("GET", "HEAD")
 
-	// end-3: Get manifest
+	// end-3b: Get the manifest of one platform of a multi-arch image
+	apiRouter.Handle("/{name:.*}/manifests/{reference}", http.HandlerFunc(h.getManifestForPlatform)).
+		Methods("GET", "HEAD").
+		Queries("platform", "{platform}")
+
+	// end-3a: Get manifest
 	apiRouter.Handle("/{name:.*}/manifests/{reference}", http.HandlerFunc(h.getManifest)).Methods("GET", "HEAD")
 
 	// end-4b: Start upload with digest
-	apiRouter.Handle("/{name:.*}/blobs/uploads/", http.HandlerFunc(h.startUploadWithDigest)).
+	apiRouter.Handle("/{name:.*}/blobs/uploads/", h.longRunning(http.HandlerFunc(h.startUploadWithDigest))).
 		Methods("POST").
 		Queries("digest", "{digest}")
 
@@ -55,12 +97,12 @@ func NewRouter(ctx context.Context, registry *Registry) (*mux.Router, error) {
 	apiRouter.Handle("/{name:.*}/blobs/uploads/", http.HandlerFunc(h.startUpload)).Methods("POST")
 
 	// end-6: Complete upload
-	apiRouter.Handle("/{name:.*}/blobs/uploads/{reference}", http.HandlerFunc(h.completeUpload)).
+	apiRouter.Handle("/{name:.*}/blobs/uploads/{reference}", h.longRunning(http.HandlerFunc(h.completeUpload))).
 		Methods("PUT", "PATCH").
 		Queries("digest", "{digest}")
 
 	// end-5: Upload chunk
-	apiRouter.Handle("/{name:.*}/blobs/uploads/{reference}", http.HandlerFunc(h.uploadChunk)).Methods("PUT", "PATCH")
+	apiRouter.Handle("/{name:.*}/blobs/uploads/{reference}", h.longRunning(http.HandlerFunc(h.uploadChunk))).Methods("PUT", "PATCH")
 
 	// end-7: Put manifest
 	apiRouter.Handle("/{name:.*}/manifests/{reference}", http.HandlerFunc(h.putManifest)).Methods("PUT")
@@ -84,14 +126,14 @@ func NewRouter(ctx context.Context, registry *Registry) (*mux.Router, error) {
 		Methods("POST").
 		Queries("mount", "{digest}", "from", "{other_name}")
 
-	// end-12a: Get referrers
-	apiRouter.Handle("/{name:.*}/referrers/{digest}", http.HandlerFunc(h.getReferrers)).Methods("GET")
-
 	// end-12b: Get referrers filtered by artifact type
 	apiRouter.Handle("/{name:.*}/referrers/{digest}", http.HandlerFunc(h.getReferrersFiltered)).
 		Methods("GET").
 		Queries("artifactType", "{artifactType}")
 
+	// end-12a: Get referrers
+	apiRouter.Handle("/{name:.*}/referrers/{digest}", http.HandlerFunc(h.getReferrers)).Methods("GET")
+
 	// end-13: Get upload status
 	apiRouter.Handle("/{name:.*}/blobs/uploads/{reference}", http.HandlerFunc(h.getUploadStatus)).Methods("GET")
 
@@ -106,7 +148,7 @@ func NewRouter(ctx context.Context, registry *Registry) (*mux.Router, error) {
 	apiRouter.Handle("/tags", http.HandlerFunc(h.listAllTags)).Methods("GET")
 
 	// custom endpoint 3: list all layers
-	apiRouter.Handle("/layers", http.HandlerFunc(h.listLayers)).Methods("GET")
+	apiRouter.Handle("/layers", h.registryWideMiddleware(http.HandlerFunc(h.listLayers))).Methods("GET")
 
 	// custom endpoint 4: list all manifests
 	apiRouter.Handle("/manifests", http.HandlerFunc(h.listManifests)).Methods("GET")
@@ -115,73 +157,220 @@ func NewRouter(ctx context.Context, registry *Registry) (*mux.Router, error) {
 	apiRouter.Handle("/upload-sessions", http.HandlerFunc(h.listUploadSessions)).Methods("GET")
 
 	// custom endpoint 6: get registry stats
-	apiRouter.Handle("/stats", http.HandlerFunc(h.getRegistryStats)).Methods("GET")
+	apiRouter.Handle("/stats", h.registryWideMiddleware(http.HandlerFunc(h.getRegistryStats))).Methods("GET")
+
+	// custom endpoint 7: find images by platform and config labels
+	apiRouter.Handle("/images", http.HandlerFunc(h.findImages)).Methods("GET")
+
+	// custom endpoint 8: search repositories, tags and labels
+	apiRouter.Handle("/_search", http.HandlerFunc(h.search)).Methods("GET")
+
+	// custom endpoint 9: OpenAPI description of all endpoints
+	apiRouter.Handle("/_spec", http.HandlerFunc(h.getSpec)).Methods("GET")
+
+	if registry.helmRepository {
+		helmRouter := r.PathPrefix("/helm").Subrouter()
+		helmRouter.Use(h.maintenanceMiddleware)
+		helmRouter.Use(h.authMiddleware)
+
+		// helm endpoint 1: classic chart repository index of a namespace
+		helmRouter.Handle("/index.yaml", http.HandlerFunc(h.getHelmIndex)).Methods("GET", "HEAD")
+		helmRouter.Handle("/{namespace:.*}/index.yaml", http.HandlerFunc(h.getHelmIndex)).Methods("GET", "HEAD")
+
+		// helm endpoint 2: chart archives referenced by the index
+		helmRouter.Handle("/charts/{file}", h.longRunning(http.HandlerFunc(h.getHelmChart))).Methods("GET", "HEAD")
+		helmRouter.Handle("/{namespace:.*}/charts/{file}", h.longRunning(http.HandlerFunc(h.getHelmChart))).Methods("GET", "HEAD")
+	}
+
+	adminRouter := r.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(h.authMiddleware)
+	adminRouter.Use(h.adminMiddleware)
+
+	// admin endpoint 1: stream registry events
+	adminRouter.Handle("/events", h.longRunning(http.HandlerFunc(h.streamEvents))).Methods("GET")
+
+	// admin endpoint 2: copy or retag an image without re-uploading blobs
+	adminRouter.Handle("/copy", http.HandlerFunc(h.copyImage)).Methods("POST")
+
+	// admin endpoint 3: bootstrap progress
+	adminRouter.Handle("/bootstrap", http.HandlerFunc(h.getBootstrapStatus)).Methods("GET")
+
+	// admin endpoint 4: toggle maintenance mode
+	adminRouter.Handle("/maintenance", http.HandlerFunc(h.getMaintenance)).Methods("GET")
+	adminRouter.Handle("/maintenance", http.HandlerFunc(h.setMaintenance)).Methods("PUT")
+
+	// admin endpoint 5: query and export the audit log
+	adminRouter.Handle("/audit", http.HandlerFunc(h.queryAudit)).Methods("GET")
+	adminRouter.Handle("/audit/export", http.HandlerFunc(h.exportAudit)).Methods("POST")
+
+	// admin endpoint 6: registry stats with per-repository breakdowns
+	adminRouter.Handle("/stats", http.HandlerFunc(h.getAdminStats)).Methods("GET")
+	adminRouter.Handle("/stats/{name:.*}", http.HandlerFunc(h.getRepositoryStats)).Methods("GET")
+
+	// admin endpoint 7: inspect, evict and resync the database cache
+	adminRouter.Handle("/cache", http.HandlerFunc(h.getCache)).Methods("GET")
+	adminRouter.Handle("/cache/resync", http.HandlerFunc(h.resyncCache)).Methods("POST")
+	adminRouter.Handle("/cache/{name:.*}", http.HandlerFunc(h.evictCache)).Methods("DELETE")
+
+	// admin endpoint 8: delete a whole repository
+	adminRouter.Handle("/repositories/{name:.*}", http.HandlerFunc(h.deleteRepository)).Methods("DELETE")
+
+	// admin endpoint 9: org and project settings inherited by repositories
+	adminRouter.Handle("/namespaces", http.HandlerFunc(h.listNamespaces)).Methods("GET")
+	adminRouter.Handle("/namespaces/{path:.*}", http.HandlerFunc(h.getNamespace)).Methods("GET")
+	adminRouter.Handle("/namespaces/{path:.*}", http.HandlerFunc(h.putNamespace)).Methods("PUT")
+	adminRouter.Handle("/namespaces/{path:.*}", http.HandlerFunc(h.deleteNamespace)).Methods("DELETE")
+	adminRouter.Handle("/settings/{name:.*}", http.HandlerFunc(h.getRepositorySettings)).Methods("GET")
+
+	// admin endpoint 10: delete tags outside their namespace's retention
+	adminRouter.Handle("/retention", http.HandlerFunc(h.applyRetention)).Methods("POST")
+
+	// admin endpoint 11: most pulled or pushed repositories and tags
+	adminRouter.Handle("/popular", http.HandlerFunc(h.getPopular)).Methods("GET")
+
+	// admin endpoint 12: notation signature verification status
+	adminRouter.Handle("/signatures/{name:.*}", http.HandlerFunc(h.getSignatureStatus)).Methods("GET")
+
+	// admin endpoint 13: vulnerability scan results and rescans
+	adminRouter.Handle("/scans/{name:.*}", http.HandlerFunc(h.getScan)).Methods("GET")
+	adminRouter.Handle("/scans/{name:.*}", http.HandlerFunc(h.rescan)).Methods("POST")
+
+	// admin endpoint 14: images using a layer
+	adminRouter.Handle("/layers/{digest}/usage", http.HandlerFunc(h.getLayerUsage)).Methods("GET")
+
+	// admin endpoint 15: storage saved by layer deduplication
+	adminRouter.Handle("/dedup", http.HandlerFunc(h.getDedupReport)).Methods("GET")
+
+	// admin endpoint 16: storage used by a repository
+	adminRouter.Handle("/repositories/{name:.*}/usage", http.HandlerFunc(h.getRepositoryStorage)).Methods("GET")
+
+	// admin endpoint 17: restores of archived blobs
+	adminRouter.Handle("/restores", http.HandlerFunc(h.listRestores)).Methods("GET")
+	adminRouter.Handle("/restores/{digest}", http.HandlerFunc(h.restoreBlob)).Methods("POST")
+
+	// admin endpoint 18: regions of an active/active deployment
+	adminRouter.Handle("/regions", http.HandlerFunc(h.getRegionStatus)).Methods("GET")
+	adminRouter.Handle("/regions/events", http.HandlerFunc(h.receiveRegionEvent)).Methods("POST")
+
+	// admin endpoint 19: leadership of replicas sharing a database
+	adminRouter.Handle("/replica", http.HandlerFunc(h.getReplicaStatus)).Methods("GET")
+
+	// admin endpoint 20: tags created, updated and deleted since a point
+	adminRouter.Handle("/changes", http.HandlerFunc(h.getChanges)).Methods("GET")
+
+	// admin endpoint 21: deliveries of webhook events
+	adminRouter.Handle("/webhooks/deliveries", http.HandlerFunc(h.listWebhookDeliveries)).Methods("GET")
+	adminRouter.Handle("/webhooks/deliveries/{id}/redeliver", http.HandlerFunc(h.redeliverWebhook)).Methods("POST")
+
+	h.spec, err = buildOpenAPI(r)
+	if err != nil {
+		return nil, err
+	}
 
 	return r, nil
 }
 
+func (h *Handler) requestInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withRequestInfo(r.Context(), h.registry.newRequestInfo(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func (h *Handler) checkAPISupport(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// blobCacheKey is the digest, qualified by the repository in the OCI layout
+// where each repository holds its own blobs.
+func (h *Handler) blobCacheKey(name string, digest string) string {
+	if h.registry.layout == LayoutOCI {
+		return name + "@" + digest
+	}
+	return digest
+}
+
 func (h *Handler) getBlob(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 	digest := vars["digest"]
 
-	if h.blobCache != nil {
-		if blobData, ok := h.blobCache.Get(digest); ok {
-			slog.Debug("blob cache hit", "digest", digest)
-			w.Header().Set("Content-Type", "application/octet-stream")
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blobData)))
-			w.Header().Set("Docker-Content-Digest", digest)
-
-			if r.Method == "HEAD" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-
-			_, err := w.Write(blobData)
-			if err != nil {
-				slog.Error("error writing blob from cache", "error", err)
-				http.Error(w, fmt.Sprintf("error writing blob: %v", err), http.StatusInternalServerError)
-				return
-			}
+	if err := h.registry.ensureBlob(r.Context(), name, digest); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, errCodeBlobUnknown, fmt.Sprintf("blob not found: %v", err))
 			return
 		}
+		h.registry.logger.Error("error fetching blob from upstream", "error", err)
+		http.Error(w, fmt.Sprintf("error fetching blob from upstream: %v", err), http.StatusBadGateway)
+		return
 	}
-
-	presignedURL, err := h.registry.getBlobRedirect(r.Context(), name, digest, r.Method)
-	if err != nil {
+	if err := h.registry.checkBlobLinked(r.Context(), name, digest); err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
-			http.Error(w, fmt.Sprintf("blob not found: %v", err), http.StatusNotFound)
+			writeError(w, http.StatusNotFound, errCodeBlobUnknown, "blob not found")
 			return
 		}
-		slog.Error("error getting blob redirect", "error", err)
-		http.Error(w, fmt.Sprintf("error getting blob redirect: %v", err), http.StatusInternalServerError)
+		h.registry.logger.Error("error checking blob link", "error", err)
+		http.Error(w, fmt.Sprintf("error checking blob: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	if r.Method == "HEAD" {
-		exists, err := h.registry.hasBlob(r.Context(), digest)
-		if err != nil {
-			slog.Error("error checking blob existence", "error", err)
-			http.Error(w, fmt.Sprintf("error checking blob: %v", err), http.StatusInternalServerError)
+	if h.blobCache != nil {
+		if blobData, ok := h.blobCache.Get(h.blobCacheKey(name, digest)); ok {
+			h.registry.logger.Debug("blob cache hit", "digest", digest)
+			setBlobHeaders(w, r, digest)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blobData))
 			return
 		}
+	}
 
-		if !exists {
-			http.Error(w, "blob not found", http.StatusNotFound)
+	if r.Method == "HEAD" && !h.registry.redirectHead {
+		size, err := h.registry.blobSize(r.Context(), name, digest)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				writeError(w, http.StatusNotFound, errCodeBlobUnknown, "blob not found")
+				return
+			}
+			h.registry.logger.Error("error checking blob existence", "error", err)
+			http.Error(w, fmt.Sprintf("error checking blob: %v", err), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 		w.Header().Set("Docker-Content-Digest", digest)
+		setDigestFields(w, r, digest)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	http.Redirect(w, r, presignedURL, http.StatusFound)
+	if h.registry.storagePlugin != nil {
+		h.streamBlob(w, r, name, digest)
+		return
+	}
+
+	if r.Method == "GET" {
+		if peerURL, ok := h.registry.peerRedirect(r, name, digest); ok {
+			http.Redirect(w, r, peerURL, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	presignedURL, err := h.registry.getBlobRedirect(r.Context(), name, digest, r.Method)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, errCodeBlobUnknown, "blob not found")
+			return
+		}
+		if errors.Is(err, ErrBlobArchived) {
+			h.writeArchived(w, err)
+			return
+		}
+		h.registry.logger.Error("error getting blob redirect", "error", err)
+		http.Error(w, fmt.Sprintf("error getting blob redirect: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, presignedURL, h.registry.redirectStatus)
 }
 
 func (h *Handler) getManifest(w http.ResponseWriter, r *http.Request) {
@@ -189,46 +378,125 @@ func (h *Handler) getManifest(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 	reference := vars["reference"]
 
-	manifest, manifestBytes, err := h.registry.getManifest(r.Context(), name, reference)
+	_, manifestBytes, err := h.registry.getManifest(r.Context(), name, reference)
 	if err != nil {
-		slog.Error("error getting manifest", "error", err)
+		h.registry.logger.Error("error getting manifest", "error", err)
 		if errors.Is(err, fs.ErrNotExist) {
-			http.Error(w, fmt.Sprintf("manifest not found: %v", err), http.StatusNotFound)
+			writeError(w, http.StatusNotFound, errCodeManifestUnknown, fmt.Sprintf("manifest not found: %v", err))
 			return
 		}
 		http.Error(w, fmt.Sprintf("error getting manifest: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", manifest.MediaType)
+	if err := h.registry.requireSignature(r.Context(), name, reference, manifestBytes, "pull"); err != nil {
+		if errors.Is(err, ErrSignatureRequired) {
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+			return
+		}
+		h.registry.logger.Error("error verifying signatures", "error", err)
+		http.Error(w, fmt.Sprintf("error verifying signatures: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := h.registry.checkQuarantine(r.Context(), name, reference, manifestBytes); err != nil {
+		if errors.Is(err, ErrQuarantined) {
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+			return
+		}
+		h.registry.logger.Error("error checking quarantine", "error", err)
+		http.Error(w, fmt.Sprintf("error checking quarantine: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		h.registry.recordPull(name, reference)
+	}
+	h.writeManifest(w, r, reference, manifestBytes)
+}
+
+func (h *Handler) writeManifest(w http.ResponseWriter, r *http.Request, reference string, manifestBytes []byte) {
+	manifestDigest := digest.FromBytes(manifestBytes).String()
+	etag := `"` + manifestDigest + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Docker-Content-Digest", manifestDigest)
+	h.setCacheHeaders(w, reference)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// The mediaType field is optional, e.g. in artifacts pushed by ORAS.
+	mediaType := v1.MediaTypeImageManifest
+	if m, err := parseAnyManifest(manifestBytes); err == nil {
+		mediaType = m.mediaType()
+	}
+	w.Header().Set("Content-Type", mediaType)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifestBytes)))
-	_, err = w.Write(manifestBytes)
+	setDigestFields(w, r, manifestDigest)
+	_, err := w.Write(manifestBytes)
 	if err != nil {
-		slog.Error("error writing manifest response", "error", err)
+		h.registry.logger.Error("error writing manifest response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing manifest response: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
+// etagMatches reports whether an If-None-Match header value lists the given
+// entity tag, using the weak comparison RFC 9110 asks for.
+func etagMatches(header string, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIfMatch accepts "*" or a single strong ETag as served by getManifest,
+// returning the digest it names.
+func parseIfMatch(header string) (string, bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return header, true
+	}
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return "", false
+	}
+	dgst, err := digest.Parse(header[1 : len(header)-1])
+	if err != nil {
+		return "", false
+	}
+	return dgst.String(), true
+}
+
 func (h *Handler) startUpload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 	uploadId := uuid.New().String()
 
-	err := h.registry.startUpload(r.Context(), name, uploadId)
+	err := h.registry.startUpload(r.Context(), name, uploadId, r.ContentLength)
+	if errors.Is(err, ErrRepositoryNameReserved) {
+		writeError(w, http.StatusBadRequest, errCodeNameInvalid, err.Error())
+		return
+	}
 	if err != nil {
-		slog.Error("error starting upload", "error", err)
+		h.registry.logger.Error("error starting upload", "error", err)
 		http.Error(w, fmt.Sprintf("error starting upload: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("v2/%s/blobs/uploads/%s", name, uploadId))
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/blobs/uploads/%s", name, uploadId))
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func parseContentRange(fRange string) (int64, int64, error) {
 	var startOffset, endOffset int64
-	_, err := fmt.Sscanf(fRange, "bytes=%d-%d", &startOffset, &endOffset)
+	// The spec sends the bare range, some clients prefix it with the unit.
+	_, err := fmt.Sscanf(strings.TrimPrefix(fRange, "bytes="), "%d-%d", &startOffset, &endOffset)
 	if err != nil {
 		return 0, int64(1<<63 - 1), nil
 	}
@@ -241,59 +509,79 @@ func parseContentRange(fRange string) (int64, int64, error) {
 func (h *Handler) startUploadWithDigest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
+	sha, err := digest.Parse(vars["digest"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
 	digest := vars["digest"]
 	uploadId := uuid.New().String()
 
-	err := h.registry.startUpload(r.Context(), name, uploadId)
+	if err := checkUploadDigestFields(r, digest); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+	err = h.registry.startUpload(r.Context(), name, uploadId, r.ContentLength)
+	if errors.Is(err, ErrRepositoryNameReserved) {
+		writeError(w, http.StatusBadRequest, errCodeNameInvalid, err.Error())
+		return
+	}
 	if err != nil {
-		slog.Error("error starting upload", "error", err)
+		h.registry.logger.Error("error starting upload", "error", err)
 		http.Error(w, fmt.Sprintf("error starting upload: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	if len(r.Header.Get("Content-Length")) > 0 && r.Header.Get("Content-Length") != "0" {
-		contentLength, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
-		if err != nil {
-			slog.Error("error parsing content length", "error", err)
-			http.Error(w, fmt.Sprintf("error parsing content length: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		var blobReader io.ReadCloser = r.Body
-		if contentLength <= 8192 {
-			var blobData []byte
-			blobData, err = io.ReadAll(r.Body)
+	// A body of unknown length, sent with chunked transfer encoding, has a
+	// ContentLength of -1.
+	if r.ContentLength != 0 {
+		// The blob is only completed, and cached, once its content turned
+		// out to match the digest it is pushed as.
+		blobReader := newVerifyingReader(r.Body, sha)
+		var blobData []byte
+		if r.ContentLength > 0 && r.ContentLength <= 8192 {
+			blobData, err = io.ReadAll(blobReader)
+			if errors.Is(err, errContentDigestMismatch) || errors.Is(err, errBlobDigestMismatch) {
+				_ = h.registry.abortUpload(r.Context(), uploadId)
+				writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+				return
+			}
 			if err != nil {
-				slog.Error("error reading blob data", "error", err)
+				h.registry.logger.Error("error reading blob data", "error", err)
 				http.Error(w, fmt.Sprintf("error reading blob data: %v", err), http.StatusInternalServerError)
 				return
 			}
-			if h.blobCache != nil {
-				h.blobCache.Add(digest, blobData)
-			}
 			blobReader = io.NopCloser(bytes.NewReader(blobData))
 		}
 
 		_, err = h.registry.uploadChunk(r.Context(), uploadId, 0, blobReader)
+		if errors.Is(err, errContentDigestMismatch) || errors.Is(err, errBlobDigestMismatch) {
+			_ = h.registry.abortUpload(r.Context(), uploadId)
+			writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+			return
+		}
 		if err != nil {
-			slog.Error("error uploading chunk", "error", err)
+			h.registry.logger.Error("error uploading chunk", "error", err)
 			http.Error(w, fmt.Sprintf("error uploading chunk: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		err = h.registry.completeUpload(r.Context(), uploadId, digest)
+		err = h.registry.completeUpload(r.Context(), name, uploadId, digest, true)
 		if err != nil {
-			slog.Error("error completing upload", "error", err)
+			h.registry.logger.Error("error completing upload", "error", err)
 			http.Error(w, fmt.Sprintf("error completing upload: %v", err), http.StatusInternalServerError)
 			return
 		}
+		if h.blobCache != nil && blobData != nil {
+			h.blobCache.Add(h.blobCacheKey(name, digest), blobData)
+		}
 
-		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+		w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/blobs/%s", name, digest))
 		w.WriteHeader(http.StatusCreated)
 		return
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("v2/%s/blobs/uploads/%s", name, uploadId))
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/blobs/uploads/%s", name, uploadId))
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -305,21 +593,29 @@ func (h *Handler) uploadChunk(w http.ResponseWriter, r *http.Request) {
 	fRange := r.Header.Get("Content-Range")
 	startOffset, endOffset, err := parseContentRange(fRange)
 	if err != nil {
-		slog.Error("error parsing content range", "error", err)
+		h.registry.logger.Error("error parsing content range", "error", err)
 		http.Error(w, fmt.Sprintf("error parsing content range: %v", err), http.StatusBadRequest)
 		return
 	}
-	slog.Debug("uploadChunk", "ref", reference, "range", fRange, "start", startOffset, "end", endOffset)
+	h.registry.logger.Debug("uploadChunk", "ref", reference, "range", fRange, "start", startOffset, "end", endOffset)
 
+	if err := verifyContentDigest(r); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
 	n, err := h.registry.uploadChunk(r.Context(), reference, startOffset, r.Body)
+	if errors.Is(err, errContentDigestMismatch) {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
 	if err != nil {
-		slog.Error("error uploading chunk", "error", err)
+		h.registry.logger.Error("error uploading chunk", "error", err)
 		http.Error(w, fmt.Sprintf("error uploading chunk: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, reference))
-	w.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", startOffset, startOffset+n-1))
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/blobs/uploads/%s", name, reference))
+	w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", startOffset+n-1))
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -329,14 +625,42 @@ func (h *Handler) completeUpload(w http.ResponseWriter, r *http.Request) {
 	reference := vars["reference"]
 	digest := vars["digest"]
 
-	err := h.registry.completeUpload(r.Context(), reference, digest)
+	if err := checkUploadDigestFields(r, digest); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+	// A monolithic upload, or the final chunk, may arrive together with the
+	// digest, possibly with chunked transfer encoding and so no length.
+	if r.ContentLength != 0 {
+		_, _, uploadedSize, err := h.registry.getUploadSession(reference)
+		if err != nil {
+			h.registry.logger.Error("error getting upload session", "error", err)
+			writeError(w, http.StatusNotFound, errCodeBlobUploadUnknown, fmt.Sprintf("upload session not found: %v", err))
+			return
+		}
+		if _, err := h.registry.uploadChunk(r.Context(), reference, uploadedSize, r.Body); err != nil {
+			if errors.Is(err, errContentDigestMismatch) {
+				writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+				return
+			}
+			h.registry.logger.Error("error uploading final chunk", "error", err)
+			http.Error(w, fmt.Sprintf("error uploading chunk: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := h.registry.completeUpload(r.Context(), name, reference, digest, false)
+	if errors.Is(err, errBlobDigestMismatch) {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
 	if err != nil {
-		slog.Error("error completing upload", "error", err)
+		h.registry.logger.Error("error completing upload", "error", err)
 		http.Error(w, fmt.Sprintf("error completing upload: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/blobs/%s", name, digest))
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -344,23 +668,83 @@ func (h *Handler) putManifest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
 	reference := vars["reference"]
-	slog.Warn("putManifest", "name", name, "reference", reference)
+	h.registry.logger.Warn("putManifest", "name", name, "reference", reference)
 
 	manifestBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		slog.Error("error reading manifest body", "error", err)
+		h.registry.logger.Error("error reading manifest body", "error", err)
 		http.Error(w, fmt.Sprintf("error reading manifest body: %v", err), http.StatusInternalServerError)
 		return
 	}
-	err = h.registry.putManifest(r.Context(), name, reference, manifestBytes)
+	if err := checkDigestFields(r, manifestBytes); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+	m, err := parseAnyManifest(manifestBytes)
 	if err != nil {
-		slog.Error("error putting manifest", "error", err)
+		writeError(w, http.StatusBadRequest, errCodeManifestInvalid, err.Error())
+		return
+	}
+	if contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && m.MediaType != "" && contentType != m.MediaType {
+		writeError(w, http.StatusBadRequest, errCodeManifestInvalid,
+			fmt.Sprintf("manifest media type %s does not match Content-Type %s", m.MediaType, contentType))
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		expected, ok := parseIfMatch(ifMatch)
+		if !ok {
+			writeError(w, http.StatusBadRequest, errCodeUnsupported, "If-Match must be * or a single manifest digest ETag")
+			return
+		}
+		err = h.registry.putManifestIfMatch(r.Context(), name, reference, manifestBytes, expected)
+	} else {
+		err = h.registry.putManifest(r.Context(), name, reference, manifestBytes)
+	}
+	if err != nil {
+		if errors.Is(err, ErrPolicyDenied) {
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+			return
+		}
+		if errors.Is(err, ErrPreconditionFailed) {
+			writeError(w, http.StatusPreconditionFailed, errCodeDenied, err.Error())
+			return
+		}
+		if errors.Is(err, ErrTagConflict) || errors.Is(err, ErrTagLocked) {
+			writeError(w, http.StatusConflict, errCodeDenied, err.Error())
+			return
+		}
+		if errors.Is(err, ErrTagImmutable) || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrSignatureRequired) {
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+			return
+		}
+		if errors.Is(err, ErrManifestDigestMismatch) {
+			writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+			return
+		}
+		if errors.Is(err, ErrProxyReadOnly) {
+			writeError(w, http.StatusMethodNotAllowed, errCodeUnsupported, err.Error())
+			return
+		}
+		if errors.Is(err, ErrRepositoryNameReserved) {
+			writeError(w, http.StatusBadRequest, errCodeNameInvalid, err.Error())
+			return
+		}
+		if errors.Is(err, ErrMediaTypeDenied) || errors.Is(err, ErrForeignLayer) {
+			writeError(w, http.StatusBadRequest, errCodeManifestInvalid, err.Error())
+			return
+		}
+		h.registry.logger.Error("error putting manifest", "error", err)
 		http.Error(w, fmt.Sprintf("error putting manifest: %v", err), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, reference))
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/manifests/%s", name, reference))
+	// Tells the client that the subject was indexed, so it need not maintain
+	// a referrers tag itself.
+	if m.Subject != nil {
+		w.Header().Set("OCI-Subject", m.Subject.Digest.String())
+	}
 	w.WriteHeader(http.StatusCreated)
-	fmt.Printf("Put manifest for %s with reference %s\n", name, reference)
+	h.registry.logger.Debug("put manifest", "name", name, "reference", reference)
 }
 
 type tags struct {
@@ -374,7 +758,7 @@ func (h *Handler) listTags(w http.ResponseWriter, r *http.Request) {
 
 	repoTags, err := h.registry.listTags(r.Context(), name)
 	if err != nil {
-		slog.Error("error listing tags", "error", err)
+		h.registry.logger.Error("error listing tags", "error", err)
 		http.Error(w, fmt.Sprintf("error listing tags: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -384,14 +768,14 @@ func (h *Handler) listTags(w http.ResponseWriter, r *http.Request) {
 		Tags: repoTags,
 	})
 	if err != nil {
-		slog.Error("error marshalling tags", "error", err)
+		h.registry.logger.Error("error marshalling tags", "error", err)
 		http.Error(w, fmt.Sprintf("error marshalling tags: %v", err), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(marshaledTags)
 	if err != nil {
-		slog.Error("error writing tags response", "error", err)
+		h.registry.logger.Error("error writing tags response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing tags response: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -403,8 +787,8 @@ func (h *Handler) listTagsPaginated(w http.ResponseWriter, r *http.Request) {
 	n := vars["n"]
 	last := vars["last"]
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Printf(`{"name":"%s", "tags":["tag4", "tag5"], "n":%s, "last":"%s"}`, name, n, last)
+	h.registry.logger.Debug("listing tags page", "name", name, "n", n, "last", last)
+	h.listTags(w, r)
 }
 
 func (h *Handler) deleteManifest(w http.ResponseWriter, r *http.Request) {
@@ -412,8 +796,26 @@ func (h *Handler) deleteManifest(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 	reference := vars["reference"]
 
+	err := h.registry.Delete(r.Context(), name, reference)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, errCodeManifestUnknown, fmt.Sprintf("manifest not found: %s:%s", name, reference))
+			return
+		}
+		if errors.Is(err, ErrPolicyDenied) || errors.Is(err, ErrTagImmutable) {
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+			return
+		}
+		if errors.Is(err, ErrTagLocked) {
+			writeError(w, http.StatusConflict, errCodeDenied, err.Error())
+			return
+		}
+		h.registry.logger.Error("error deleting manifest", "error", err)
+		http.Error(w, fmt.Sprintf("error deleting manifest: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusAccepted)
-	fmt.Printf("Deleting manifest for %s with reference %s", name, reference)
 }
 
 func (h *Handler) deleteBlob(w http.ResponseWriter, r *http.Request) {
@@ -422,7 +824,7 @@ func (h *Handler) deleteBlob(w http.ResponseWriter, r *http.Request) {
 	digest := vars["digest"]
 
 	w.WriteHeader(http.StatusAccepted)
-	fmt.Printf("Deleting blob for %s with digest %s", name, digest)
+	h.registry.logger.Debug("ignoring blob deletion", "name", name, "digest", digest)
 }
 
 func (h *Handler) mountBlob(w http.ResponseWriter, r *http.Request) {
@@ -431,28 +833,76 @@ func (h *Handler) mountBlob(w http.ResponseWriter, r *http.Request) {
 	digest := vars["digest"]
 	otherName := vars["other_name"]
 
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	err := h.registry.authorize(r.Context(), otherName, AccessPull)
+	if errors.Is(err, ErrAccessDenied) {
+		writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error checking access", "error", err)
+		http.Error(w, fmt.Sprintf("error checking access: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	mounted, err := h.registry.mountBlob(r.Context(), otherName, name, digest)
+	if err != nil {
+		h.registry.logger.Error("error mounting blob", "error", err)
+		http.Error(w, fmt.Sprintf("error mounting blob: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// The spec lets a registry answer a mount it cannot do with a regular upload.
+	if !mounted {
+		h.startUpload(w, r)
+		return
+	}
+
+	h.registry.audit(r.Context(), AuditBlobMount, name, otherName, digest)
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/blobs/%s", name, digest))
 	w.WriteHeader(http.StatusCreated)
-	fmt.Printf("Mounted blob from %s to %s with digest %s", otherName, name, digest)
+	h.registry.logger.Debug("mounted blob", "from", otherName, "name", name, "digest", digest)
 }
 
 func (h *Handler) getReferrers(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-	digest := vars["digest"]
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Printf(`{"name":"%s", "digest":"%s", "referrers":[{"mediaType":"application/example", "digest":"sha256:abc"}]}`, name, digest)
+	h.writeReferrers(w, r, "")
 }
 
 func (h *Handler) getReferrersFiltered(w http.ResponseWriter, r *http.Request) {
+	h.writeReferrers(w, r, mux.Vars(r)["artifactType"])
+}
+
+func (h *Handler) writeReferrers(w http.ResponseWriter, r *http.Request, artifactType string) {
 	vars := mux.Vars(r)
 	name := vars["name"]
-	digest := vars["digest"]
-	artifactType := vars["artifactType"]
+	subject, err := digest.Parse(vars["digest"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
 
+	descriptors, err := h.registry.Referrers(r.Context(), name, subject, artifactType)
+	if err != nil {
+		h.registry.logger.Error("error listing referrers", "error", err)
+		http.Error(w, fmt.Sprintf("error listing referrers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: descriptors,
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		h.registry.logger.Error("error marshalling referrers", "error", err)
+		http.Error(w, fmt.Sprintf("error marshalling referrers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
 	w.WriteHeader(http.StatusOK)
-	fmt.Printf(`{"name":"%s", "digest":"%s", "artifactType":"%s", "referrers":[{"mediaType":"application/example", "digest":"sha256:def"}]}`, name, digest, artifactType)
+	w.Write(data)
 }
 
 func (h *Handler) getUploadStatus(w http.ResponseWriter, r *http.Request) {
@@ -460,30 +910,51 @@ func (h *Handler) getUploadStatus(w http.ResponseWriter, r *http.Request) {
 	name := vars["name"]
 	reference := vars["reference"]
 
-	_, _, uploadedSize, err := h.registry.getUploadSession(reference)
+	progress, err := h.registry.getUploadProgress(reference)
 	if err != nil {
-		slog.Error("error getting upload status", "error", err)
+		h.registry.logger.Error("error getting upload status", "error", err)
 		http.Error(w, fmt.Sprintf("error getting upload status: %v", err), http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, reference))
-	if uploadedSize > 0 {
-		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", uploadedSize-1))
+	w.Header().Set("Location", h.absoluteURL(r, "/v2/%s/blobs/uploads/%s", name, reference))
+	if progress.Uploaded > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", progress.Uploaded-1))
 	}
-	w.WriteHeader(http.StatusNoContent)
+	// The spec answers with the headers alone; progress dashboards ask for
+	// the details as JSON.
+	if !acceptsJSON(r) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
+func acceptsJSON(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, accepted := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(accepted)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (h *Handler) cancelUpload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	name := vars["name"]
 	reference := vars["reference"]
 
 	err := h.registry.abortUpload(r.Context(), reference)
 	if err != nil {
-		slog.Error("error canceling upload", "error", err)
+		h.registry.logger.Error("error canceling upload", "error", err)
 		http.Error(w, fmt.Sprintf("error canceling upload: %v", err), http.StatusInternalServerError)
 		return
 	}
+	h.registry.audit(r.Context(), AuditUploadCancel, name, reference, "")
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -500,14 +971,14 @@ func (h *Handler) listRepositories(w http.ResponseWriter, r *http.Request) {
 	}
 	repositories, continuationToken, err := h.registry.listRepositories(r.Context(), continuationToken, n)
 	if err != nil {
-		slog.Error("error listing repositories", "error", err)
+		h.registry.logger.Error("error listing repositories", "error", err)
 		http.Error(w, fmt.Sprintf("error listing repositories: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	marshaledRepos, err := json.Marshal(repositories)
 	if err != nil {
-		slog.Error("error marshalling repositories", "error", err)
+		h.registry.logger.Error("error marshalling repositories", "error", err)
 		http.Error(w, fmt.Sprintf("error marshalling repositories: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -517,7 +988,7 @@ func (h *Handler) listRepositories(w http.ResponseWriter, r *http.Request) {
 			"Link",
 			fmt.Sprintf(
 				"<%s/v2/repositories?continuationToken=%s&n=%d>; rel=\"next\"",
-				r.URL.Scheme+"://"+r.URL.Host,
+				h.baseURL(r),
 				url.QueryEscape(*continuationToken),
 				n,
 			),
@@ -525,7 +996,7 @@ func (h *Handler) listRepositories(w http.ResponseWriter, r *http.Request) {
 	}
 	_, err = w.Write(marshaledRepos)
 	if err != nil {
-		slog.Error("error writing repositories response", "error", err)
+		h.registry.logger.Error("error writing repositories response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing repositories response: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -543,14 +1014,14 @@ func (h *Handler) listAllTags(w http.ResponseWriter, r *http.Request) {
 	}
 	tags, continuationToken, err := h.registry.listAllTags(r.Context(), continuationToken, n)
 	if err != nil {
-		slog.Error("error listing tags", "error", err)
+		h.registry.logger.Error("error listing tags", "error", err)
 		http.Error(w, fmt.Sprintf("error listing tags: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	marshaledTags, err := json.Marshal(tags)
 	if err != nil {
-		slog.Error("error marshalling tags", "error", err)
+		h.registry.logger.Error("error marshalling tags", "error", err)
 		http.Error(w, fmt.Sprintf("error marshalling tags: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -560,7 +1031,7 @@ func (h *Handler) listAllTags(w http.ResponseWriter, r *http.Request) {
 			"Link",
 			fmt.Sprintf(
 				"<%s/v2/tags?continuationToken=%s&n=%d>; rel=\"next\"",
-				r.URL.Scheme+"://"+r.URL.Host,
+				h.baseURL(r),
 				url.QueryEscape(*continuationToken),
 				n,
 			),
@@ -568,7 +1039,7 @@ func (h *Handler) listAllTags(w http.ResponseWriter, r *http.Request) {
 	}
 	_, err = w.Write(marshaledTags)
 	if err != nil {
-		slog.Error("error writing tags response", "error", err)
+		h.registry.logger.Error("error writing tags response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing tags response: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -586,14 +1057,14 @@ func (h *Handler) listLayers(w http.ResponseWriter, r *http.Request) {
 	}
 	layers, continuationToken, err := h.registry.listLayers(r.Context(), continuationToken, n)
 	if err != nil {
-		slog.Error("error listing layers", "error", err)
+		h.registry.logger.Error("error listing layers", "error", err)
 		http.Error(w, fmt.Sprintf("error listing layers: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	marshaledLayers, err := json.Marshal(layers)
 	if err != nil {
-		slog.Error("error marshalling layers", "error", err)
+		h.registry.logger.Error("error marshalling layers", "error", err)
 		http.Error(w, fmt.Sprintf("error marshalling layers: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -603,7 +1074,7 @@ func (h *Handler) listLayers(w http.ResponseWriter, r *http.Request) {
 			"Link",
 			fmt.Sprintf(
 				"<%s/v2/layers?continuationToken=%s&n=%d>; rel=\"next\"",
-				r.URL.Scheme+"://"+r.URL.Host,
+				h.baseURL(r),
 				url.QueryEscape(*continuationToken),
 				n,
 			),
@@ -611,7 +1082,7 @@ func (h *Handler) listLayers(w http.ResponseWriter, r *http.Request) {
 	}
 	_, err = w.Write(marshaledLayers)
 	if err != nil {
-		slog.Error("error writing layers response", "error", err)
+		h.registry.logger.Error("error writing layers response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing layers response: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -629,14 +1100,14 @@ func (h *Handler) listManifests(w http.ResponseWriter, r *http.Request) {
 	}
 	manifests, continuationToken, err := h.registry.listManifests(r.Context(), continuationToken, n)
 	if err != nil {
-		slog.Error("error listing manifests", "error", err)
+		h.registry.logger.Error("error listing manifests", "error", err)
 		http.Error(w, fmt.Sprintf("error listing manifests: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	marshaledManifests, err := json.Marshal(manifests)
 	if err != nil {
-		slog.Error("error marshalling manifests", "error", err)
+		h.registry.logger.Error("error marshalling manifests", "error", err)
 		http.Error(w, fmt.Sprintf("error marshalling manifests: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -646,7 +1117,7 @@ func (h *Handler) listManifests(w http.ResponseWriter, r *http.Request) {
 			"Link",
 			fmt.Sprintf(
 				"<%s/v2/manifests?continuationToken=%s&n=%d>; rel=\"next\"",
-				r.URL.Scheme+"://"+r.URL.Host,
+				h.baseURL(r),
 				url.QueryEscape(*continuationToken),
 				n,
 			),
@@ -654,7 +1125,7 @@ func (h *Handler) listManifests(w http.ResponseWriter, r *http.Request) {
 	}
 	_, err = w.Write(marshaledManifests)
 	if err != nil {
-		slog.Error("error writing manifests response", "error", err)
+		h.registry.logger.Error("error writing manifests response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing manifests response: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -663,45 +1134,117 @@ func (h *Handler) listManifests(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) listUploadSessions(w http.ResponseWriter, r *http.Request) {
 	sessions, err := h.registry.listUploadSessions(r.Context())
 	if err != nil {
-		slog.Error("error listing upload sessions", "error", err)
+		h.registry.logger.Error("error listing upload sessions", "error", err)
 		http.Error(w, fmt.Sprintf("error listing upload sessions: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	marshaledSessions, err := json.Marshal(sessions)
 	if err != nil {
-		slog.Error("error marshalling upload sessions", "error", err)
+		h.registry.logger.Error("error marshalling upload sessions", "error", err)
 		http.Error(w, fmt.Sprintf("error marshalling upload sessions: %v", err), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(marshaledSessions)
 	if err != nil {
-		slog.Error("error writing upload sessions response", "error", err)
+		h.registry.logger.Error("error writing upload sessions response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing upload sessions response: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
 func (h *Handler) getRegistryStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := h.registry.getRegistryStats(r.Context())
+	stats, err := h.registry.Stats(r.Context())
 	if err != nil {
-		slog.Error("error getting registry stats", "error", err)
+		h.registry.logger.Error("error getting registry stats", "error", err)
 		http.Error(w, fmt.Sprintf("error getting registry stats: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	marshaledStats, err := json.Marshal(stats)
 	if err != nil {
-		slog.Error("error marshalling registry stats", "error", err)
+		h.registry.logger.Error("error marshalling registry stats", "error", err)
 		http.Error(w, fmt.Sprintf("error marshalling registry stats: %v", err), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(marshaledStats)
 	if err != nil {
-		slog.Error("error writing registry stats response", "error", err)
+		h.registry.logger.Error("error writing registry stats response", "error", err)
 		http.Error(w, fmt.Sprintf("error writing registry stats response: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
+
+func (h *Handler) findImages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var continuationToken *string
+	if token := query.Get("continuationToken"); token != "" {
+		continuationToken = &token
+	}
+	n, err := strconv.Atoi(query.Get("n"))
+	if err != nil {
+		n = 64
+	}
+	filter := ImageFilter{
+		Labels:       query["label"],
+		OS:           query.Get("os"),
+		Architecture: query.Get("architecture"),
+		Repository:   query.Get("repository"),
+	}
+
+	images, continuationToken, err := h.registry.FindImages(r.Context(), filter, continuationToken, n)
+	if err != nil {
+		h.registry.logger.Error("error finding images", "error", err)
+		http.Error(w, fmt.Sprintf("error finding images: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if images == nil {
+		images = []IndexedImage{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if continuationToken != nil {
+		next := url.Values{}
+		for key, values := range query {
+			next[key] = values
+		}
+		next.Set("continuationToken", *continuationToken)
+		next.Set("n", strconv.Itoa(n))
+		w.Header().Set("Link", fmt.Sprintf("<%s/v2/images?%s>; rel=\"next\"", h.baseURL(r), next.Encode()))
+	}
+	json.NewEncoder(w).Encode(images)
+}
+
+func (h *Handler) search(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	n, err := strconv.Atoi(query.Get("n"))
+	if err != nil || n <= 0 {
+		n = 25
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	results, err := h.registry.Search(r.Context(), query.Get("q"), n, offset)
+	if errors.Is(err, ErrSearchUnavailable) {
+		writeError(w, http.StatusNotImplemented, errCodeUnsupported, err.Error())
+		return
+	}
+	if err != nil {
+		h.registry.logger.Error("error searching", "error", err)
+		http.Error(w, fmt.Sprintf("error searching: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(results.Results) == n {
+		w.Header().Set(
+			"Link",
+			fmt.Sprintf("<%s/v2/_search?q=%s&n=%d&offset=%d>; rel=\"next\"", h.baseURL(r), url.QueryEscape(results.Query), n, results.next),
+		)
+	}
+	json.NewEncoder(w).Encode(results)
+}
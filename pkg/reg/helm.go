@@ -0,0 +1,209 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType  = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// HelmChart is a chart version pushed as an OCI artifact.
+type HelmChart struct {
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+	// The Chart.yaml fields, as helm stores them in the config.
+	Metadata map[string]any
+	Content  v1.Descriptor
+	Created  string
+	manifest []byte
+}
+
+func (c *HelmChart) name() string {
+	name, _ := c.Metadata["name"].(string)
+	return name
+}
+
+func (c *HelmChart) version() string {
+	version, _ := c.Metadata["version"].(string)
+	return version
+}
+
+// fileName is the name of the chart archive in a classic chart repository.
+func (c *HelmChart) fileName() string {
+	return fmt.Sprintf("%s-%s.tgz", c.name(), c.version())
+}
+
+// HelmCharts lists the chart versions stored in the repositories directly
+// under namespace that the actor of ctx may pull.
+func (r *Registry) HelmCharts(ctx context.Context, namespace string) ([]HelmChart, error) {
+	manifests, err := r.db.ListHelmManifests(namespace)
+	if err != nil {
+		return nil, err
+	}
+	var charts []HelmChart
+	seen := make(map[string]bool)
+	for _, m := range manifests {
+		if err := r.authorize(ctx, m.Repository, AccessPull); err != nil {
+			if errors.Is(err, ErrAccessDenied) {
+				continue
+			}
+			return nil, err
+		}
+		var manifest v1.Manifest
+		if err := json.Unmarshal([]byte(m.ManifestJSON), &manifest); err != nil {
+			r.logger.Warn("skipping invalid helm chart manifest", "repository", m.Repository, "tag", m.Tag, "error", err)
+			continue
+		}
+		chart := HelmChart{
+			Repository: m.Repository,
+			Tag:        m.Tag,
+			Digest:     digest.FromString(m.ManifestJSON),
+			Created:    manifest.Annotations[v1.AnnotationCreated],
+			manifest:   []byte(m.ManifestJSON),
+		}
+		for _, layer := range manifest.Layers {
+			if layer.MediaType == helmChartMediaType {
+				chart.Content = layer
+			}
+		}
+		if chart.Content.Digest == "" {
+			continue
+		}
+		chart.Metadata, err = r.helmChartMetadata(ctx, m.Repository, manifest.Config.Digest)
+		if err != nil {
+			r.logger.Warn("skipping helm chart", "repository", m.Repository, "tag", m.Tag, "error", err)
+			continue
+		}
+		// Several tags may point at one chart version, e.g. "latest".
+		key := chart.name() + "\x00" + chart.version()
+		if chart.name() == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		charts = append(charts, chart)
+	}
+	return charts, nil
+}
+
+// helmChartMetadata returns the Chart.yaml fields of a chart config, fetching
+// and caching them in the database the first time.
+func (r *Registry) helmChartMetadata(ctx context.Context, repo string, dgst digest.Digest) (map[string]any, error) {
+	if metadata, err := r.db.GetHelmChart(dgst.String()); err == nil {
+		return metadata, nil
+	}
+	configBytes, err := r.getManifestBlob(ctx, repo, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chart config %s: %w", dgst, err)
+	}
+	var metadata map[string]any
+	if err := json.Unmarshal(configBytes, &metadata); err != nil {
+		return nil, fmt.Errorf("error unmarshalling chart config: %w", err)
+	}
+	if err := r.db.PutHelmChart(dgst.String(), configBytes); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// HelmIndex renders the charts under namespace as the index.yaml of a classic
+// chart repository, whose archives are served relative to it under charts/.
+func (r *Registry) HelmIndex(ctx context.Context, namespace string) ([]byte, error) {
+	charts, err := r.HelmCharts(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string][]map[string]any)
+	for _, chart := range charts {
+		entry := make(map[string]any, len(chart.Metadata)+3)
+		for k, v := range chart.Metadata {
+			entry[k] = v
+		}
+		if chart.Created != "" {
+			entry["created"] = chart.Created
+		}
+		entry["digest"] = chart.Content.Digest.Encoded()
+		entry["urls"] = []string{"charts/" + url.PathEscape(chart.fileName())}
+		entries[chart.name()] = append(entries[chart.name()], entry)
+	}
+	return yaml.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"entries":    entries,
+		"generated":  time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func (h *Handler) getHelmIndex(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+
+	index, err := h.registry.HelmIndex(r.Context(), namespace)
+	if err != nil {
+		h.registry.logger.Error("error generating helm index", "error", err)
+		http.Error(w, fmt.Sprintf("error generating helm index: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Header().Set("Content-Length", fmt.Sprint(len(index)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(index)
+	}
+}
+
+func (h *Handler) getHelmChart(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	file := vars["file"]
+
+	charts, err := h.registry.HelmCharts(r.Context(), namespace)
+	if err != nil {
+		h.registry.logger.Error("error listing helm charts", "error", err)
+		http.Error(w, fmt.Sprintf("error listing helm charts: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, chart := range charts {
+		if chart.fileName() != file {
+			continue
+		}
+		if err := h.registry.checkPull(r.Context(), chart.Repository, chart.Tag, chart.manifest); err != nil {
+			if errors.Is(err, ErrSignatureRequired) || errors.Is(err, ErrQuarantined) {
+				writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+				return
+			}
+			h.registry.logger.Error("error checking chart pull", "error", err)
+			http.Error(w, fmt.Sprintf("error checking chart pull: %v", err), http.StatusInternalServerError)
+			return
+		}
+		h.registry.recordPull(chart.Repository, chart.Tag)
+		// Served like any other blob, redirects to presigned URLs included.
+		r = mux.SetURLVars(r, map[string]string{
+			"name":   chart.Repository,
+			"digest": chart.Content.Digest.String(),
+		})
+		h.getBlob(w, r)
+		return
+	}
+	http.Error(w, fmt.Sprintf("chart not found: %s", file), http.StatusNotFound)
+}
+
+// checkPull applies the signature and quarantine checks of manifest pulls.
+func (r *Registry) checkPull(ctx context.Context, name string, reference string, manifestBytes []byte) error {
+	if err := r.requireSignature(ctx, name, reference, manifestBytes, "pull"); err != nil {
+		return err
+	}
+	return r.checkQuarantine(ctx, name, reference, manifestBytes)
+}
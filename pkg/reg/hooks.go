@@ -0,0 +1,131 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrUnauthenticated is returned by an AuthFunc to answer a request with an
+// authentication challenge.
+var ErrUnauthenticated = errors.New("authentication required")
+
+// AuthFunc authenticates a request to the registry API and returns the actor
+// making it, empty for anonymous requests. Errors wrapping ErrUnauthenticated
+// are answered with 401 and a challenge, errors wrapping ErrAccessDenied with
+// 403.
+type AuthFunc func(r *http.Request) (actor string, err error)
+
+// ManifestPush is a manifest pushed, or copied, to a repository.
+type ManifestPush struct {
+	Repository string
+	// Empty for pushes by digest.
+	Tag       string
+	Digest    digest.Digest
+	MediaType string
+	Manifest  []byte
+}
+
+// BlobUpload is a completed blob upload.
+type BlobUpload struct {
+	Repository string
+	Digest     digest.Digest
+	Size       int64
+}
+
+// Deletion is a tag, a manifest or a whole repository being deleted. Tag is
+// set for tags, along with the digest they point at, Digest alone for
+// manifests, and neither for repositories.
+type Deletion struct {
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+// Hooks are called around registry operations, so that embedders can add
+// validation and side effects of their own. Any of them may be nil. They run
+// synchronously within the request, so slow side effects belong in a
+// goroutine. Errors returned by the Before hooks reject the operation with
+// ErrPolicyDenied.
+type Hooks struct {
+	// Replaces the authentication of registry requests, last one wins.
+	Auth AuthFunc
+	// Called before a manifest is stored.
+	BeforeManifestPush func(ctx context.Context, push ManifestPush) error
+	// Called once a manifest was stored.
+	OnManifestPush func(ctx context.Context, push ManifestPush)
+	// Called once an upload was moved to its final location.
+	OnBlobUploadComplete func(ctx context.Context, upload BlobUpload)
+	// Called before a client deletes a tag, a manifest or a repository.
+	// Deletions by retention and referrer cleanup do not ask.
+	BeforeDelete func(ctx context.Context, deletion Deletion) error
+	// Called once a tag, a manifest or a repository was deleted, including
+	// the tags deleted along with a manifest.
+	OnDelete func(ctx context.Context, deletion Deletion)
+}
+
+func (r *Registry) beforeManifestPush(ctx context.Context, push ManifestPush) error {
+	for _, hooks := range r.hooks {
+		if hooks.BeforeManifestPush == nil {
+			continue
+		}
+		if err := hooks.BeforeManifestPush(ctx, push); err != nil {
+			return fmt.Errorf("%w: %v", ErrPolicyDenied, err)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) manifestPushed(ctx context.Context, push ManifestPush) {
+	for _, hooks := range r.hooks {
+		if hooks.OnManifestPush != nil {
+			hooks.OnManifestPush(ctx, push)
+		}
+	}
+}
+
+func (r *Registry) blobUploaded(ctx context.Context, upload BlobUpload) {
+	for _, hooks := range r.hooks {
+		if hooks.OnBlobUploadComplete != nil {
+			hooks.OnBlobUploadComplete(ctx, upload)
+		}
+	}
+}
+
+func (r *Registry) beforeDelete(ctx context.Context, deletion Deletion) error {
+	for _, hooks := range r.hooks {
+		if hooks.BeforeDelete == nil {
+			continue
+		}
+		if err := hooks.BeforeDelete(ctx, deletion); err != nil {
+			return fmt.Errorf("%w: %v", ErrPolicyDenied, err)
+		}
+	}
+	return nil
+}
+
+func (r *Registry) deleted(ctx context.Context, deletion Deletion) {
+	for _, hooks := range r.hooks {
+		if hooks.OnDelete != nil {
+			hooks.OnDelete(ctx, deletion)
+		}
+	}
+}
+
+func (r *Registry) hasBeforeDelete() bool {
+	for _, hooks := range r.hooks {
+		if hooks.BeforeDelete != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestActor returns the actor making the request behind ctx, for hooks to
+// tell who pushes or deletes.
+func RequestActor(ctx context.Context) string {
+	return requestInfoFrom(ctx).Actor
+}
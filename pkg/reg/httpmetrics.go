@@ -0,0 +1,232 @@
+package reg
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Upper bounds in seconds of the request latency histogram, long enough for
+// uploads of large layers.
+var httpLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Upper bounds in bytes of the request and response size histograms.
+var httpSizeBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30, 4 << 30}
+
+type histogram struct {
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.count++
+	h.sum += value
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+}
+
+func (h *histogram) writeTo(w io.Writer, name string, labels string) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// httpMetrics measures the requests to the OCI endpoints, so that SLOs can be
+// set on pulls and pushes separately.
+type httpMetrics struct {
+	mu        sync.Mutex
+	endpoints map[string]*endpointMetrics
+}
+
+type endpointMetrics struct {
+	// Requests by HTTP status.
+	requests      map[int]uint64
+	latency       *histogram
+	requestSizes  *histogram
+	responseSizes *histogram
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{endpoints: make(map[string]*endpointMetrics)}
+}
+
+func (m *httpMetrics) record(endpoint string, status int, latency time.Duration, requestSize int64, responseSize int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.endpoints[endpoint]
+	if e == nil {
+		e = &endpointMetrics{
+			requests:      make(map[int]uint64),
+			latency:       newHistogram(httpLatencyBuckets),
+			requestSizes:  newHistogram(httpSizeBuckets),
+			responseSizes: newHistogram(httpSizeBuckets),
+		}
+		m.endpoints[endpoint] = e
+	}
+	e.requests[status]++
+	e.latency.observe(latency.Seconds())
+	e.requestSizes.observe(float64(requestSize))
+	e.responseSizes.observe(float64(responseSize))
+}
+
+// endpointName names the OCI endpoint a request was routed to, like
+// "manifest_get" or "upload_chunk".
+func endpointName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unknown"
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	method := strings.ToLower(r.Method)
+	switch {
+	case template == "/v2/":
+		return "api_version"
+	case strings.HasSuffix(template, "/manifests/{reference}"):
+		return "manifest_" + method
+	case strings.HasSuffix(template, "/blobs/uploads/"):
+		switch query := r.URL.Query(); {
+		case query.Has("mount"):
+			return "blob_mount"
+		case query.Has("digest"):
+			return "upload_monolithic"
+		}
+		return "upload_start"
+	case strings.HasSuffix(template, "/blobs/uploads/{reference}"):
+		switch r.Method {
+		case http.MethodPatch:
+			return "upload_chunk"
+		case http.MethodPut:
+			return "upload_complete"
+		case http.MethodDelete:
+			return "upload_cancel"
+		}
+		return "upload_status"
+	case strings.HasSuffix(template, "/blobs/{digest}"):
+		return "blob_" + method
+	case strings.HasSuffix(template, "/tags/list"):
+		return "tags_list"
+	case strings.HasSuffix(template, "/referrers/{digest}"):
+		return "referrers"
+	}
+	return "other"
+}
+
+func (h *Handler) httpMetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		mw := &metricsWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(mw, r)
+		// Bodies of responses to HEAD requests are written, but not sent.
+		if r.Method == http.MethodHead {
+			mw.n = 0
+		}
+		h.registry.httpMetrics.record(endpointName(r), mw.status, time.Since(start), body.n, mw.n)
+	})
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type metricsWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	n           int64
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (m *httpMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.endpoints))
+	for name := range m.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP reg_http_requests_total Requests to the OCI endpoints, by endpoint and HTTP status.")
+	fmt.Fprintln(w, "# TYPE reg_http_requests_total counter")
+	for _, name := range names {
+		e := m.endpoints[name]
+		statuses := make([]int, 0, len(e.requests))
+		for status := range e.requests {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "reg_http_requests_total{endpoint=%q,status=\"%d\"} %d\n", name, status, e.requests[status])
+		}
+	}
+
+	histograms := []struct {
+		name, help string
+		value      func(*endpointMetrics) *histogram
+	}{
+		{"reg_http_request_duration_seconds", "Duration of requests to the OCI endpoints.", func(e *endpointMetrics) *histogram { return e.latency }},
+		{"reg_http_request_size_bytes", "Size of the bodies of requests to the OCI endpoints.", func(e *endpointMetrics) *histogram { return e.requestSizes }},
+		{"reg_http_response_size_bytes", "Size of the bodies of responses of the OCI endpoints.", func(e *endpointMetrics) *histogram { return e.responseSizes }},
+	}
+	for _, hist := range histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hist.name, hist.help, hist.name)
+		for _, name := range names {
+			hist.value(m.endpoints[name]).writeTo(w, hist.name, fmt.Sprintf("endpoint=%q", name))
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var ErrTagImmutable = errors.New("tag is immutable")
+
+func (r *Registry) isTagImmutable(repo string, tag string) bool {
+	for _, rule := range r.immutableTags {
+		if rule.matches(repo, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) checkImmutableTag(ctx context.Context, repo string, tag string, newDigest digest.Digest) error {
+	if !r.isTagImmutable(repo, tag) && !r.isNamespaceImmutable(repo) {
+		return nil
+	}
+
+	var current digest.Digest
+	if manifestJSON, err := r.db.GetManifest(repo, tag); err == nil {
+		current = digest.FromString(manifestJSON)
+	} else {
+		sha, err := r.getManifestSHA(ctx, repo, tag)
+		if isNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check existing tag: %w", err)
+		}
+		current = sha
+	}
+
+	if current != newDigest {
+		return fmt.Errorf("%w: %s:%s already points to %s", ErrTagImmutable, repo, tag, current)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	mediaTypeDockerLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+type ImportOptions struct {
+	Repository string
+	Tag        string
+}
+
+type ImportedImage struct {
+	Repository string        `json:"repository"`
+	Tag        string        `json:"tag,omitempty"`
+	Digest     digest.Digest `json:"digest"`
+}
+
+// Import reads an OCI image layout or a docker save archive, from a directory
+// or a tarball, and pushes every image it contains.
+func (r *Registry) Import(ctx context.Context, archivePath string, opts ImportOptions) ([]ImportedImage, error) {
+	archive, err := openImageArchive(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+
+	indexBytes, err := readArchiveFile(archive, v1.ImageIndexFile)
+	if err == nil {
+		return r.importOCILayout(ctx, archive, indexBytes, opts)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	dockerManifest, err := readArchiveFile(archive, "manifest.json")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("%s is neither an OCI image layout nor a docker save archive", archivePath)
+		}
+		return nil, err
+	}
+	return r.importDockerArchive(ctx, archive, dockerManifest, opts)
+}
+
+func importTarget(opts ImportOptions, name string, count int) (string, string, error) {
+	if opts.Tag != "" && count > 1 {
+		return "", "", fmt.Errorf("archive contains %d images, a single tag cannot be applied", count)
+	}
+	repo, tag := opts.Repository, opts.Tag
+	if name != "" {
+		nameRepo, nameRef, err := ParseImageReference(name)
+		if err == nil {
+			if repo == "" {
+				repo = nameRepo
+			}
+			if tag == "" && !isDigest(nameRef) {
+				tag = nameRef
+			}
+		}
+	}
+	if repo == "" {
+		return "", "", fmt.Errorf("archive does not name its image, a repository is required")
+	}
+	return repo, tag, nil
+}
+
+func (r *Registry) importOCILayout(ctx context.Context, archive imageArchive, indexBytes []byte, opts ImportOptions) ([]ImportedImage, error) {
+	var index v1.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", v1.ImageIndexFile, err)
+	}
+	if len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("%s lists no images", v1.ImageIndexFile)
+	}
+
+	var imported []ImportedImage
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[annotationContainerdImageName]
+		if refName := desc.Annotations[v1.AnnotationRefName]; name == "" && strings.ContainsAny(refName, "/:@") {
+			name = refName
+		}
+		repo, tag, err := importTarget(opts, name, len(index.Manifests))
+		if err != nil {
+			return imported, err
+		}
+		if refName := desc.Annotations[v1.AnnotationRefName]; tag == "" && refName != "" && !strings.ContainsAny(refName, "/:@") {
+			tag = refName
+		}
+
+		manifestBytes, err := readArchiveFile(archive, ociBlobPath(desc.Digest))
+		if err != nil {
+			return imported, fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+		}
+		reference := tag
+		if reference == "" {
+			reference = desc.Digest.String()
+		}
+		if err := r.importManifest(ctx, archive, repo, reference, manifestBytes); err != nil {
+			return imported, err
+		}
+		imported = append(imported, ImportedImage{Repository: repo, Tag: tag, Digest: desc.Digest})
+	}
+	return imported, nil
+}
+
+func (r *Registry) importManifest(ctx context.Context, archive imageArchive, repo string, reference string, manifestBytes []byte) error {
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range manifest.Manifests {
+		childBytes, err := readArchiveFile(archive, ociBlobPath(child.Digest))
+		if errors.Is(err, fs.ErrNotExist) {
+			// docker save only includes the platforms present locally.
+			r.logger.Warn("child manifest missing from archive", "digest", child.Digest)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read child manifest %s: %w", child.Digest, err)
+		}
+		if err := r.importManifest(ctx, archive, repo, child.Digest.String(), childBytes); err != nil {
+			return err
+		}
+	}
+	for _, blob := range manifest.blobs() {
+		if len(blob.URLs) > 0 {
+			continue
+		}
+		if err := r.importBlob(ctx, archive, repo, ociBlobPath(blob.Digest), blob.Digest); err != nil {
+			return err
+		}
+	}
+	return r.putManifest(ctx, repo, reference, manifestBytes)
+}
+
+func (r *Registry) importBlob(ctx context.Context, archive imageArchive, repo string, name string, dgst digest.Digest) error {
+	exists, err := r.hasBlob(ctx, repo, dgst.String())
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	body, _, err := archive.open(name)
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", dgst, err)
+	}
+	if err := r.ingestBlob(ctx, repo, dgst, newVerifyingReader(body, dgst)); err != nil {
+		return fmt.Errorf("failed to store blob %s: %w", dgst, err)
+	}
+	return nil
+}
+
+func (r *Registry) importDockerArchive(ctx context.Context, archive imageArchive, manifestBytes []byte, opts ImportOptions) ([]ImportedImage, error) {
+	var entries []dockerArchiveManifest
+	if err := json.Unmarshal(manifestBytes, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest.json: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("manifest.json lists no images")
+	}
+
+	var imported []ImportedImage
+	for _, entry := range entries {
+		name := ""
+		if len(entry.RepoTags) > 0 {
+			name = entry.RepoTags[0]
+		}
+		repo, tag, err := importTarget(opts, name, len(entries))
+		if err != nil {
+			return imported, err
+		}
+
+		config, err := r.importDockerFile(ctx, archive, repo, entry.Config)
+		if err != nil {
+			return imported, err
+		}
+		config.MediaType = mediaTypeDockerConfig
+		manifest := v1.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: mediaTypeDockerManifest,
+			Config:    config,
+		}
+		for _, layerPath := range entry.Layers {
+			layer, err := r.importDockerFile(ctx, archive, repo, layerPath)
+			if err != nil {
+				return imported, err
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+		}
+
+		manifestBytes, err := json.Marshal(manifest)
+		if err != nil {
+			return imported, err
+		}
+		sha := digest.FromBytes(manifestBytes)
+		reference := tag
+		if reference == "" {
+			reference = sha.String()
+		}
+		if err := r.putManifest(ctx, repo, reference, manifestBytes); err != nil {
+			return imported, err
+		}
+		imported = append(imported, ImportedImage{Repository: repo, Tag: tag, Digest: sha})
+	}
+	return imported, nil
+}
+
+// importDockerFile stores a config or layer referenced by path from
+// manifest.json, whose digest is only known after reading it.
+func (r *Registry) importDockerFile(ctx context.Context, archive imageArchive, repo string, name string) (v1.Descriptor, error) {
+	body, size, err := archive.open(name)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	header := make([]byte, len(gzipMagic))
+	n, _ := io.ReadFull(body, header)
+	dgst, err := digest.FromReader(io.MultiReader(bytes.NewReader(header[:n]), body))
+	body.Close()
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	mediaType := mediaTypeDockerLayer
+	if bytes.Equal(header[:n], gzipMagic) {
+		mediaType = mediaTypeDockerLayerGzip
+	}
+	if err := r.importBlob(ctx, archive, repo, name, dgst); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: size}, nil
+}
+
+// errBlobDigestMismatch is returned by the final read of a verifying reader
+// whose content does not match its digest.
+var errBlobDigestMismatch = errors.New("content does not match digest")
+
+type verifyingReader struct {
+	io.ReadCloser
+	dgst     digest.Digest
+	verifier digest.Verifier
+}
+
+// newVerifyingReader fails the final read when the content does not match
+// dgst, so a corrupt blob never completes its upload.
+func newVerifyingReader(body io.ReadCloser, dgst digest.Digest) io.ReadCloser {
+	return &verifyingReader{ReadCloser: body, dgst: dgst, verifier: dgst.Verifier()}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.verifier.Write(p[:n])
+	if err == io.EOF && !v.verifier.Verified() {
+		return n, fmt.Errorf("%w %s", errBlobDigestMismatch, v.dgst)
+	}
+	return n, err
+}
@@ -0,0 +1,127 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type ImageInfo struct {
+	Repository   string            `json:"repository"`
+	Reference    string            `json:"reference,omitempty"`
+	Digest       digest.Digest     `json:"digest"`
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Platform     *v1.Platform      `json:"platform,omitempty"`
+	Created      *time.Time        `json:"created,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Layers       []v1.Descriptor   `json:"layers,omitempty"`
+	Size         int64             `json:"size"`
+	Manifests    []ImageInfo       `json:"manifests,omitempty"`
+	// Notation signatures, verified when a trust policy is configured.
+	Signatures *VerificationStatus `json:"signatures,omitempty"`
+	// Vulnerability scan, when the manifest was scanned.
+	Scan *ScanResult `json:"scan,omitempty"`
+	// When the reference was last pushed and pulled, as far as the registry
+	// recorded.
+	LastPushed *time.Time      `json:"lastPushed,omitempty"`
+	LastPulled *time.Time      `json:"lastPulled,omitempty"`
+	Manifest   json.RawMessage `json:"manifest"`
+}
+
+func (r *Registry) Inspect(ctx context.Context, repo string, reference string) (*ImageInfo, error) {
+	_, manifestBytes, err := r.getStoredManifest(ctx, repo, reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	info, err := r.inspectManifest(ctx, repo, manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	info.Reference = reference
+	status, err := r.notationStatus(ctx, repo, manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Signatures) > 0 {
+		info.Signatures = status
+	}
+	info.Scan, err = r.db.GetScan(repo, info.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	r.flushUsage()
+	usage, err := r.db.TagUsage(repo, reference)
+	if err != nil {
+		return nil, err
+	}
+	if usage != nil {
+		info.LastPushed, info.LastPulled = usage.LastPushed, usage.LastPulled
+	}
+	return info, nil
+}
+
+func (r *Registry) inspectManifest(ctx context.Context, repo string, manifestBytes []byte) (*ImageInfo, error) {
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	info := &ImageInfo{
+		Repository:   repo,
+		Digest:       digest.FromBytes(manifestBytes),
+		MediaType:    manifest.mediaType(),
+		ArtifactType: manifest.artifactType(),
+		Layers:       manifest.Layers,
+		Size:         int64(len(manifestBytes)),
+		Manifest:     manifestBytes,
+	}
+
+	for _, child := range manifest.Manifests {
+		childBytes, err := r.getManifestBlob(ctx, repo, child.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get child manifest %s: %w", child.Digest, err)
+		}
+		childInfo, err := r.inspectManifest(ctx, repo, childBytes)
+		if err != nil {
+			return nil, err
+		}
+		if childInfo.Platform == nil {
+			childInfo.Platform = child.Platform
+		}
+		info.Size += childInfo.Size
+		info.Manifests = append(info.Manifests, *childInfo)
+	}
+	for _, blob := range manifest.blobs() {
+		info.Size += blob.Size
+	}
+
+	if manifest.Config != nil && isImageConfig(manifest.Config.MediaType) {
+		config, err := r.imageConfig(ctx, repo, manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		info.Created = config.Created
+		info.Labels = config.Labels
+		if config.OS != "" {
+			info.Platform = &v1.Platform{
+				OS:           config.OS,
+				Architecture: config.Architecture,
+				Variant:      config.Variant,
+				OSVersion:    config.OSVersion,
+			}
+		}
+	}
+	return info, nil
+}
+
+func isImageConfig(mediaType string) bool {
+	switch mediaType {
+	case v1.MediaTypeImageConfig, mediaTypeDockerConfig:
+		return true
+	}
+	return false
+}
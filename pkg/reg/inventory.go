@@ -0,0 +1,209 @@
+package reg
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/parquet-go/parquet-go"
+)
+
+const inventoryManifestFile = "manifest.json"
+
+// inventoryManifest is the manifest.json S3 Inventory writes next to every
+// report, see https://docs.aws.amazon.com/AmazonS3/latest/userguide/storage-inventory-location.html
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	DestinationBucket string `json:"destinationBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	Files             []struct {
+		Key  string `json:"key"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+type inventoryRow struct {
+	Key string `parquet:"key"`
+}
+
+// BootstrapFromInventory bootstraps from an S3 Inventory report instead of
+// listing the bucket. location is either the report's manifest.json or the
+// inventory configuration prefix, in which case the latest report is used.
+// Both can be given as s3://bucket/key or as a key in the registry bucket.
+func (r *Registry) BootstrapFromInventory(ctx context.Context, location string, opts BootstrapOptions) error {
+	bucket, key := r.bucket, location
+	if u, err := url.Parse(location); err == nil && u.Scheme == "s3" {
+		bucket, key = u.Host, strings.TrimPrefix(u.Path, "/")
+	}
+	if !strings.HasSuffix(key, inventoryManifestFile) {
+		latest, err := r.latestInventoryManifest(ctx, bucket, key)
+		if err != nil {
+			return err
+		}
+		key = latest
+	}
+
+	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key}, forcePathStyle)
+	if err != nil {
+		return fmt.Errorf("failed to get inventory manifest s3://%s/%s: %w", bucket, key, err)
+	}
+	var manifest inventoryManifest
+	err = json.NewDecoder(obj.Body).Decode(&manifest)
+	obj.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to decode inventory manifest: %w", err)
+	}
+	if manifest.SourceBucket != "" && manifest.SourceBucket != r.bucket {
+		return fmt.Errorf("inventory is for bucket %s, not %s", manifest.SourceBucket, r.bucket)
+	}
+	if dest := strings.TrimPrefix(manifest.DestinationBucket, "arn:aws:s3:::"); dest != "" {
+		bucket = dest
+	}
+
+	b, err := r.startBootstrap(ctx, opts)
+	if err != nil {
+		return err
+	}
+	for _, file := range manifest.Files {
+		switch strings.ToUpper(manifest.FileFormat) {
+		case "CSV":
+			err = r.readInventoryCSV(b.ctx, bucket, file.Key, manifest.FileSchema, b.add)
+		case "PARQUET":
+			err = r.readInventoryParquet(b.ctx, bucket, file.Key, b.add)
+		default:
+			err = fmt.Errorf("unsupported inventory format %q", manifest.FileFormat)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return b.finish(err)
+}
+
+func (r *Registry) latestInventoryManifest(ctx context.Context, bucket string, prefix string) (string, error) {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	var reports []string
+	var continuationToken *string
+	for {
+		req, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &bucket,
+			Prefix:            &prefix,
+			Delimiter:         aws.String("/"),
+			ContinuationToken: continuationToken,
+		}, forcePathStyle)
+		if err != nil {
+			return "", fmt.Errorf("failed to list inventory reports: %w", err)
+		}
+		for _, p := range req.CommonPrefixes {
+			// Reports live in folders named after their creation time,
+			// e.g. 2024-05-01T01-00Z/, next to data/ and hive/.
+			name := strings.TrimPrefix(*p.Prefix, prefix)
+			if name != "" && name[0] >= '0' && name[0] <= '9' {
+				reports = append(reports, *p.Prefix)
+			}
+		}
+		if req.IsTruncated == nil || !*req.IsTruncated {
+			break
+		}
+		continuationToken = req.NextContinuationToken
+	}
+	if len(reports) == 0 {
+		return "", fmt.Errorf("no inventory reports found under s3://%s/%s", bucket, prefix)
+	}
+	sort.Strings(reports)
+	return reports[len(reports)-1] + inventoryManifestFile, nil
+}
+
+func (r *Registry) readInventoryCSV(ctx context.Context, bucket string, key string, schema string, fn func(string)) error {
+	keyColumn := -1
+	for i, field := range strings.Split(schema, ",") {
+		if strings.TrimSpace(field) == "Key" {
+			keyColumn = i
+		}
+	}
+	if keyColumn < 0 {
+		return fmt.Errorf("inventory schema %q has no Key field", schema)
+	}
+
+	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key}, forcePathStyle)
+	if err != nil {
+		return fmt.Errorf("failed to get inventory file %s: %w", key, err)
+	}
+	defer obj.Body.Close()
+	gz, err := gzip.NewReader(obj.Body)
+	if err != nil {
+		return fmt.Errorf("failed to decompress inventory file %s: %w", key, err)
+	}
+
+	reader := csv.NewReader(gz)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inventory file %s: %w", key, err)
+		}
+		if keyColumn >= len(record) {
+			continue
+		}
+		// Keys in CSV reports are URL-encoded.
+		objectKey, err := url.QueryUnescape(record[keyColumn])
+		if err != nil {
+			objectKey = record[keyColumn]
+		}
+		fn(objectKey)
+	}
+}
+
+func (r *Registry) readInventoryParquet(ctx context.Context, bucket string, key string, fn func(string)) error {
+	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key}, forcePathStyle)
+	if err != nil {
+		return fmt.Errorf("failed to get inventory file %s: %w", key, err)
+	}
+	defer obj.Body.Close()
+
+	// Parquet footers are at the end of the file, so it has to be seekable.
+	tmp, err := os.CreateTemp("", "reg-inventory-*.parquet")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, obj.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download inventory file %s: %w", key, err)
+	}
+
+	file, err := parquet.OpenFile(tmp, size)
+	if err != nil {
+		return fmt.Errorf("failed to open inventory file %s: %w", key, err)
+	}
+	reader := parquet.NewGenericReader[inventoryRow](file)
+	defer reader.Close()
+	rows := make([]inventoryRow, 1024)
+	for {
+		n, err := reader.Read(rows)
+		for _, row := range rows[:n] {
+			fn(row.Key)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inventory file %s: %w", key, err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+const kafkaCloseTimeout = 10 * time.Second
+
+type KafkaConfig struct {
+	Brokers      []string
+	Topic        string
+	Username     string
+	Password     string
+	BatchSize    int
+	BatchTimeout time.Duration
+}
+
+type KafkaSink struct {
+	writer       *kafka.Writer
+	topic        string
+	batchSize    int
+	batchTimeout time.Duration
+	pending      chan kafka.Message
+	done         chan struct{}
+}
+
+func NewKafkaSink(cfg KafkaConfig) *KafkaSink {
+	transport := &kafka.Transport{}
+	if cfg.Username != "" {
+		transport.SASL = plain.Mechanism{Username: cfg.Username, Password: cfg.Password}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = time.Second
+	}
+
+	s := &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  10,
+			BatchSize:    cfg.BatchSize,
+			BatchTimeout: cfg.BatchTimeout,
+			Transport:    transport,
+		},
+		topic:        cfg.Topic,
+		batchSize:    cfg.BatchSize,
+		batchTimeout: cfg.BatchTimeout,
+		pending:      make(chan kafka.Message, cfg.BatchSize),
+		done:         make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *KafkaSink) Name() string {
+	return "kafka " + s.topic
+}
+
+func (s *KafkaSink) Send(_ context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	s.pending <- kafka.Message{
+		Key:   []byte(event.Repository),
+		Value: data,
+		Headers: []kafka.Header{
+			{Key: "action", Value: []byte(event.Action)},
+		},
+	}
+	return nil
+}
+
+func (s *KafkaSink) run() {
+	defer close(s.done)
+	batch := make([]kafka.Message, 0, s.batchSize)
+	ticker := time.NewTicker(s.batchTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-s.pending:
+			if !ok {
+				ctx, cancel := context.WithTimeout(context.Background(), kafkaCloseTimeout)
+				s.flush(ctx, batch)
+				cancel()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= s.batchSize {
+				s.flush(context.Background(), batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.flush(context.Background(), batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// Messages are retried until the brokers acknowledge them, which gives
+// at-least-once delivery for as long as the process is alive.
+func (s *KafkaSink) flush(ctx context.Context, batch []kafka.Message) {
+	if len(batch) == 0 {
+		return
+	}
+	backoff := time.Second
+	for {
+		err := s.writer.WriteMessages(ctx, batch...)
+		if err == nil {
+			return
+		}
+		slog.Warn("failed to publish events to kafka", "topic", s.topic, "count", len(batch), "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			slog.Error("giving up on kafka events", "topic", s.topic, "count", len(batch))
+			return
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (s *KafkaSink) Close() error {
+	close(s.pending)
+	<-s.done
+	return s.writer.Close()
+}
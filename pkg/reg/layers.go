@@ -0,0 +1,169 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var ErrLayerUnknown = errors.New("layer unknown")
+
+type LayerReference struct {
+	Repository string `db:"repository" json:"repository"`
+	Tag        string `db:"tag" json:"tag"`
+	Digest     string `db:"digest" json:"digest"`
+	// For tags of an index, the manifest of the index using the layer.
+	Child string `db:"child" json:"child,omitempty"`
+}
+
+type LayerUsage struct {
+	Digest     string           `json:"digest"`
+	MediaType  string           `json:"mediaType"`
+	Size       int64            `json:"size"`
+	References []LayerReference `json:"references"`
+}
+
+// repositoryHasBlob tells whether a blob belongs to a repository, rather than
+// just to the bucket. In the distribution layout blobs are shared, and belong
+// to the repositories they were uploaded or mounted to, which link them, or
+// whose manifests reference them, for blobs pushed before uploads linked them.
+func (r *Registry) repositoryHasBlob(ctx context.Context, repo string, sha digest.Digest) (bool, error) {
+	if r.layout == LayoutOCI {
+		return r.hasBlob(ctx, repo, sha.String())
+	}
+	headCtx, cancel := r.metadataContext(ctx)
+	_, err := r.headObject(headCtx, layerLinkKey(repo, sha))
+	cancel()
+	if err == nil {
+		return true, nil
+	}
+	if !isNotFound(err) {
+		return false, fmt.Errorf("failed to check layer link: %w", err)
+	}
+	return r.db.RepositoryReferencesBlob(repo, sha.String())
+}
+
+// mountBlob makes a blob of from a blob of repo too, telling whether it could.
+// Repositories of the OCI layout keep their own copy of the blob.
+func (r *Registry) mountBlob(ctx context.Context, from string, repo string, dig string) (bool, error) {
+	sha, err := digest.Parse(dig)
+	if err != nil {
+		return false, nil
+	}
+	linked, err := r.repositoryHasBlob(ctx, from, sha)
+	if err != nil || !linked {
+		return false, err
+	}
+	// Claimed before it is checked for, like an uploaded blob, so that a
+	// collection either keeps it or deletes it before the check.
+	if err := r.claimBlobs(ctx, []digest.Digest{sha}); err != nil {
+		return false, err
+	}
+	if r.layout == LayoutOCI {
+		if err := r.copyOCIBlob(ctx, from, repo, sha); err != nil {
+			return false, fmt.Errorf("failed to copy blob: %w", err)
+		}
+		return true, nil
+	}
+	// The link may outlive a blob which was collected.
+	exists, err := r.hasBlob(ctx, repo, dig)
+	if err != nil || !exists {
+		return false, err
+	}
+	if err := r.putLink(ctx, layerLinkKey(repo, sha), sha); err != nil {
+		return false, fmt.Errorf("failed to link blob: %w", err)
+	}
+	return true, nil
+}
+
+// checkBlobLinked keeps repositories from serving the blobs of other
+// repositories, which they could otherwise name by digest, once pulls are
+// authenticated: a public repository must not hand out the blobs of a
+// private one. Without authentication every repository is public anyway.
+func (r *Registry) checkBlobLinked(ctx context.Context, repo string, dig string) error {
+	if r.layout != LayoutDistribution || (r.auth == nil && len(r.anonymousPull) == 0) {
+		return nil
+	}
+	sha, err := digest.Parse(dig)
+	if err != nil {
+		return fmt.Errorf("invalid digest format: %w", err)
+	}
+	linked, err := r.repositoryHasBlob(ctx, repo, sha)
+	if err != nil {
+		return err
+	}
+	if !linked {
+		return fmt.Errorf("%w: %s is not a blob of %s", fs.ErrNotExist, sha, repo)
+	}
+	return nil
+}
+
+// LayerUsage lists the tags whose image uses a layer, directly or through
+// an index. Platform manifests pushed only by digest are not indexed, so an
+// index is only found through children which are tagged themselves.
+func (r *Registry) LayerUsage(dgst digest.Digest) (*LayerUsage, error) {
+	usage, err := r.db.LayerUsage(dgst.String())
+	if err != nil {
+		return nil, err
+	}
+	if usage == nil {
+		return nil, fmt.Errorf("%w: %s", ErrLayerUnknown, dgst)
+	}
+	return usage, nil
+}
+
+// DedupReport compares the logical size of the registry, every manifest
+// counted with all its layers, to its physical size, every layer stored once.
+type DedupReport struct {
+	LogicalSize  int64   `json:"logicalSize"`
+	PhysicalSize int64   `json:"physicalSize"`
+	SavedSize    int64   `json:"savedSize"`
+	Ratio        float64 `json:"ratio"`
+	// Layers saving the most space, by the number of manifests using them.
+	SharedLayers []SharedLayer     `json:"sharedLayers"`
+	Repositories []RepositoryDedup `json:"repositories"`
+}
+
+type SharedLayer struct {
+	Digest       string `db:"digest" json:"digest"`
+	MediaType    string `db:"media_type" json:"mediaType"`
+	Size         int64  `db:"size" json:"size"`
+	Repositories int    `db:"repositories" json:"repositories"`
+	Manifests    int    `db:"manifests" json:"manifests"`
+	SavedSize    int64  `db:"saved_size" json:"savedSize"`
+}
+
+type RepositoryDedup struct {
+	Repository   string  `db:"repository" json:"repository"`
+	Manifests    int     `db:"manifests" json:"manifests"`
+	LogicalSize  int64   `db:"logical_size" json:"logicalSize"`
+	PhysicalSize int64   `db:"physical_size" json:"physicalSize"`
+	Ratio        float64 `db:"-" json:"ratio"`
+}
+
+// DedupReport reports how much layer sharing saves, overall and within each
+// repository, with the top shared layers. Ratios are logical over physical
+// size, 1 meaning no sharing at all.
+func (r *Registry) DedupReport(top int) (*DedupReport, error) {
+	report, err := r.db.DedupReport(top)
+	if err != nil {
+		return nil, err
+	}
+	report.SavedSize = report.LogicalSize - report.PhysicalSize
+	report.Ratio = dedupRatio(report.LogicalSize, report.PhysicalSize)
+	for i := range report.Repositories {
+		repo := &report.Repositories[i]
+		repo.Ratio = dedupRatio(repo.LogicalSize, repo.PhysicalSize)
+	}
+	return report, nil
+}
+
+func dedupRatio(logical int64, physical int64) float64 {
+	if physical == 0 {
+		return 1
+	}
+	return float64(logical) / float64(physical)
+}
@@ -0,0 +1,166 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// jobsLease is the lease held by the replica running the background jobs of
+// registries sharing a database.
+const jobsLease = "jobs"
+
+// leaseTTL is how long a lease lasts without renewal, so how long the jobs
+// stop when the leader dies.
+const leaseTTL = 30 * time.Second
+
+// leaderElection keeps replicas sharing a database from all running the
+// background jobs: the replication and scan queues, the audit export and the
+// periodic jobs only run on the replica holding the jobs lease.
+type leaderElection struct {
+	id     string
+	leader atomic.Bool
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newReplicaID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "reg"
+	}
+	return fmt.Sprintf("%s-%s", host, uuid.NewString()[:8])
+}
+
+// isLeader tells whether this replica runs the background jobs. Registries
+// with a database of their own always do.
+func (r *Registry) isLeader() bool {
+	return r.election == nil || r.election.leader.Load()
+}
+
+func (r *Registry) startLeaderElection() {
+	e := r.election
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			r.campaign()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// campaign acquires or renews the lease. A replica which cannot tell whether
+// it still holds the lease steps down, since another may have taken over.
+func (r *Registry) campaign() {
+	e := r.election
+	held, err := r.db.AcquireLease(jobsLease, e.id, leaseTTL)
+	if err != nil {
+		r.logger.Error("error acquiring jobs lease", "error", err)
+		held = false
+	}
+	if e.leader.Swap(held) != held {
+		if held {
+			r.logger.Info("became leader, running background jobs", "replica", e.id)
+		} else {
+			r.logger.Info("lost leadership, stopping background jobs", "replica", e.id)
+		}
+	}
+}
+
+func (r *Registry) stopLeaderElection() {
+	e := r.election
+	if e == nil || e.cancel == nil {
+		return
+	}
+	e.cancel()
+	e.wg.Wait()
+	if e.leader.Load() {
+		if err := r.db.ReleaseLease(jobsLease, e.id); err != nil {
+			r.logger.Warn("failed to release jobs lease", "error", err)
+		}
+	}
+}
+
+// periodicJobs cleans up abandoned uploads and applies the namespaces'
+// retention at a fixed interval, on the leader only.
+type periodicJobs struct {
+	interval time.Duration
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (r *Registry) startPeriodicJobs() {
+	j := r.jobs
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !r.isLeader() {
+				continue
+			}
+			if err := r.CleanupStaleUploads(ctx); err != nil {
+				r.logger.Error("error cleaning up stale uploads", "error", err)
+			}
+			if result, err := r.applyRetention(ctx, r.retentionDryRun); err != nil {
+				r.logger.Error("error applying retention", "error", err)
+			} else if result.DryRun && len(result.Deleted)+len(result.Expired) > 0 {
+				r.logger.Info("retention would delete tags", "tags", result.Deleted, "expired", result.Expired)
+			} else if len(result.Deleted)+len(result.Expired) > 0 {
+				r.logger.Info("applied retention", "deleted", len(result.Deleted), "expired", len(result.Expired))
+			}
+		}
+	}()
+}
+
+func (j *periodicJobs) stop() {
+	if j != nil && j.cancel != nil {
+		j.cancel()
+		j.wg.Wait()
+	}
+}
+
+// ReplicaStatus tells whether this replica runs the background jobs.
+type ReplicaStatus struct {
+	Replica        string `json:"replica,omitempty"`
+	SharedDatabase bool   `json:"sharedDatabase"`
+	Leader         bool   `json:"leader"`
+}
+
+func (r *Registry) ReplicaStatus() ReplicaStatus {
+	status := ReplicaStatus{SharedDatabase: r.election != nil, Leader: r.isLeader()}
+	if r.election != nil {
+		status.Replica = r.election.id
+	}
+	return status
+}
+
+func (h *Handler) getReplicaStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.registry.ReplicaStatus())
+}
@@ -0,0 +1,117 @@
+package reg
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// RepositorySummaries lists repositories with their tag counts and sizes from
+// the database. Reading from S3 instead only yields tag counts, since sizes
+// would require fetching every manifest.
+func (r *Registry) RepositorySummaries(ctx context.Context, fromS3 bool) ([]RepositorySummary, error) {
+	if !fromS3 {
+		return r.db.RepositorySummaries()
+	}
+
+	tagCounts := make(map[string]int)
+	prefix := repositoriesPrefix
+	if r.layout == LayoutOCI {
+		prefix = ""
+	}
+	var continuationToken *string
+	for {
+		req, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &r.bucket,
+			Prefix:            &prefix,
+			ContinuationToken: continuationToken,
+		}, forcePathStyle)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range req.Contents {
+			if r.layout == LayoutOCI {
+				repo, ok := ociRepositoryFromKey(*obj.Key)
+				if !ok {
+					continue
+				}
+				index, err := r.readOCIIndex(ctx, repo)
+				if err != nil {
+					return nil, err
+				}
+				if tags := len(index.tags()); tags > 0 {
+					tagCounts[repo] = tags
+				}
+				continue
+			}
+			if !strings.HasSuffix(*obj.Key, "/current/link") {
+				continue
+			}
+			repo, _, ok := strings.Cut(strings.TrimPrefix(*obj.Key, repositoriesPrefix), "/_manifests/tags/")
+			if ok {
+				tagCounts[repo]++
+			}
+		}
+		if req.IsTruncated == nil || !*req.IsTruncated {
+			break
+		}
+		continuationToken = req.NextContinuationToken
+	}
+
+	summaries := make([]RepositorySummary, 0, len(tagCounts))
+	for repo, tags := range tagCounts {
+		summaries = append(summaries, RepositorySummary{Repository: repo, Tags: tags})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Repository < summaries[j].Repository
+	})
+	return summaries, nil
+}
+
+// TagSummaries lists the tags of a repository with their size and when they
+// were last pushed and pulled, which the database has either way.
+func (r *Registry) TagSummaries(ctx context.Context, repo string, fromS3 bool) ([]TagSummary, error) {
+	r.flushUsage()
+	if !fromS3 {
+		return r.db.TagSummaries(repo)
+	}
+
+	tags, err := r.listStoredTags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := r.db.Popular(PopularityFilter{Repository: repo})
+	if err != nil {
+		return nil, err
+	}
+	tagUsage := make(map[string]UsageSummary, len(usage))
+	for _, u := range usage {
+		tagUsage[u.Tag] = u
+	}
+	sort.Strings(tags)
+	summaries := make([]TagSummary, 0, len(tags))
+	for _, tag := range tags {
+		summary := TagSummary{Tag: tag, LastPushed: tagUsage[tag].LastPushed, LastPulled: tagUsage[tag].LastPulled}
+		sha, err := r.getManifestSHA(ctx, repo, tag)
+		if err != nil {
+			return nil, err
+		}
+		summary.Digest = sha.String()
+		manifestBytes, err := r.getManifestBlob(ctx, repo, sha)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := parseAnyManifest(manifestBytes)
+		if err != nil {
+			return nil, err
+		}
+		summary.Layers = len(manifest.Layers)
+		for _, layer := range manifest.Layers {
+			summary.Size += layer.Size
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
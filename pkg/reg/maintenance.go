@@ -0,0 +1,53 @@
+package reg
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type MaintenanceStatus struct {
+	Enabled    bool `json:"enabled"`
+	RetryAfter int  `json:"retryAfterSeconds"`
+}
+
+type maintenanceMode struct {
+	mu         sync.RWMutex
+	enabled    bool
+	retryAfter time.Duration
+}
+
+// SetMaintenance turns maintenance mode on or off. While it is on, registry
+// API requests other than the base endpoint are answered with 503 and a
+// Retry-After header, so clients back off instead of failing mid-upload.
+func (r *Registry) SetMaintenance(enabled bool, retryAfter time.Duration) {
+	r.maintenance.mu.Lock()
+	defer r.maintenance.mu.Unlock()
+	r.maintenance.enabled = enabled
+	r.maintenance.retryAfter = retryAfter
+}
+
+func (r *Registry) Maintenance() MaintenanceStatus {
+	r.maintenance.mu.RLock()
+	defer r.maintenance.mu.RUnlock()
+	return MaintenanceStatus{
+		Enabled:    r.maintenance.enabled,
+		RetryAfter: int(r.maintenance.retryAfter.Seconds()),
+	}
+}
+
+func (h *Handler) maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := h.registry.Maintenance()
+		// The base endpoint doubles as the health check and keeps answering.
+		if !status.Enabled || r.URL.Path == "/v2/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if status.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(status.RetryAfter))
+		}
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "registry is in maintenance mode")
+	})
+}
@@ -0,0 +1,78 @@
+package reg
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+)
+
+// anyManifest covers both image manifests and indexes, so callers can walk
+// whatever was pushed without knowing its kind upfront.
+type anyManifest struct {
+	MediaType    string            `json:"mediaType,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Config       *v1.Descriptor    `json:"config,omitempty"`
+	Layers       []v1.Descriptor   `json:"layers,omitempty"`
+	Manifests    []v1.Descriptor   `json:"manifests,omitempty"`
+	Subject      *v1.Descriptor    `json:"subject,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+func parseAnyManifest(manifestBytes []byte) (*anyManifest, error) {
+	var m anyManifest
+	if err := json.Unmarshal(manifestBytes, &m); err != nil {
+		return nil, fmt.Errorf("error unmarshalling manifest: %w", err)
+	}
+	return &m, nil
+}
+
+func (m *anyManifest) isIndex() bool {
+	switch m.MediaType {
+	case v1.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		return true
+	case "":
+		return m.Manifests != nil && m.Config == nil
+	}
+	return false
+}
+
+func (m *anyManifest) mediaType() string {
+	if m.MediaType != "" {
+		return m.MediaType
+	}
+	if m.isIndex() {
+		return v1.MediaTypeImageIndex
+	}
+	return v1.MediaTypeImageManifest
+}
+
+// artifactType is the type of a non-image artifact: its artifactType, or the
+// media type of a config other than an image config. Images have none.
+func (m *anyManifest) artifactType() string {
+	if m.ArtifactType != "" {
+		return m.ArtifactType
+	}
+	if m.Config == nil {
+		return ""
+	}
+	switch m.Config.MediaType {
+	case v1.MediaTypeImageConfig, mediaTypeDockerConfig, v1.MediaTypeEmptyJSON:
+		return ""
+	}
+	return m.Config.MediaType
+}
+
+func (m *anyManifest) blobs() []v1.Descriptor {
+	var blobs []v1.Descriptor
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	return append(blobs, m.Layers...)
+}
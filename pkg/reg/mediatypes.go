@@ -0,0 +1,69 @@
+package reg
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var ErrMediaTypeDenied = errors.New("media type is not allowed")
+
+// Media type rules are written as "<repo-glob>=<type-glob>", or just
+// "<type-glob>" to apply to every repository. Both globs follow path.Match, so
+// "application/vnd.oci.image.*" covers OCI image manifests and indexes.
+type mediaTypeRule struct {
+	repo      repoTagPattern
+	mediaType string
+}
+
+func parseMediaTypeRule(rule string) mediaTypeRule {
+	repo, mediaType, found := strings.Cut(rule, "=")
+	if !found {
+		return mediaTypeRule{mediaType: rule}
+	}
+	return mediaTypeRule{repo: repoTagPattern{repo: repo}, mediaType: mediaType}
+}
+
+func (r mediaTypeRule) matches(repo string, mediaType string) bool {
+	if !r.repo.matchesRepo(repo) {
+		return false
+	}
+	ok, _ := path.Match(r.mediaType, mediaType)
+	return ok
+}
+
+// pushedType is what media type rules match a manifest by: its artifact type,
+// so that e.g. helm charts can be told apart from images, or its media type
+// for images and indexes.
+func (m *anyManifest) pushedType() string {
+	if artifactType := m.artifactType(); artifactType != "" {
+		return artifactType
+	}
+	return m.mediaType()
+}
+
+// checkMediaType rejects a manifest whose type is denied in the repository,
+// or not among the types allowed there when any are.
+func (r *Registry) checkMediaType(repo string, manifest *anyManifest) error {
+	pushed := manifest.pushedType()
+	for _, rule := range r.deniedMediaTypes {
+		if rule.matches(repo, pushed) {
+			return fmt.Errorf("%w: %s is denied in %s", ErrMediaTypeDenied, pushed, repo)
+		}
+	}
+	restricted := false
+	for _, rule := range r.allowedMediaTypes {
+		if !rule.repo.matchesRepo(repo) {
+			continue
+		}
+		if rule.matches(repo, pushed) {
+			return nil
+		}
+		restricted = true
+	}
+	if restricted {
+		return fmt.Errorf("%w: %s is not allowed in %s", ErrMediaTypeDenied, pushed, repo)
+	}
+	return nil
+}
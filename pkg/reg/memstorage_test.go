@@ -0,0 +1,216 @@
+package reg_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/psarna/reg/pkg/plugin"
+)
+
+// minPartSize is the smallest part S3 accepts but for the last.
+const minPartSize = 5 << 20
+
+// memStorage keeps the registry's objects in memory, so that tests run
+// without a bucket.
+type memStorage struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	uploads  map[string]map[int32][]byte
+	// afterList, if set, is called after each listing, with the listing's
+	// result already taken.
+	afterList func(prefix string)
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		objects:  make(map[string][]byte),
+		modified: make(map[string]time.Time),
+		uploads:  make(map[string]map[int32][]byte),
+	}
+}
+
+func etagOf(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func (m *memStorage) object(key string) plugin.Object {
+	data := m.objects[key]
+	return plugin.Object{Key: key, Size: int64(len(data)), ETag: etagOf(data), LastModified: m.modified[key]}
+}
+
+func (m *memStorage) put(key string, data []byte) plugin.Object {
+	m.objects[key] = data
+	m.modified[key] = time.Now()
+	return m.object(key)
+}
+
+func (m *memStorage) Ping(context.Context) error {
+	return nil
+}
+
+func (m *memStorage) Stat(_ context.Context, key string) (plugin.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[key]; !ok {
+		return plugin.Object{}, fmt.Errorf("%w: %s", plugin.ErrNotFound, key)
+	}
+	return m.object(key), nil
+}
+
+func (m *memStorage) Get(_ context.Context, key string) (io.ReadCloser, plugin.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, plugin.Object{}, fmt.Errorf("%w: %s", plugin.ErrNotFound, key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), m.object(key), nil
+}
+
+func (m *memStorage) Put(_ context.Context, key string, body io.Reader, ifMatch string) (plugin.Object, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = io.ReadAll(body); err != nil {
+			return plugin.Object{}, err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ifMatch != "" {
+		current, ok := m.objects[key]
+		if !ok || etagOf(current) != strings.Trim(ifMatch, `"`) {
+			return plugin.Object{}, plugin.ErrPreconditionFailed
+		}
+	}
+	return m.put(key, data), nil
+}
+
+func (m *memStorage) Delete(_ context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.objects, key)
+		delete(m.modified, key)
+	}
+	return nil
+}
+
+func (m *memStorage) List(_ context.Context, prefix string, delimiter string, token string) (plugin.ListResult, error) {
+	result := m.list(prefix, delimiter, token)
+	if m.afterList != nil {
+		m.afterList(prefix)
+	}
+	return result, nil
+}
+
+func (m *memStorage) list(prefix string, delimiter string, token string) plugin.ListResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var result plugin.ListResult
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					result.Prefixes = append(result.Prefixes, p)
+				}
+				continue
+			}
+		}
+		result.Objects = append(result.Objects, m.object(key))
+	}
+	return result
+}
+
+func (m *memStorage) Copy(_ context.Context, src string, dst string) (plugin.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[src]
+	if !ok {
+		return plugin.Object{}, fmt.Errorf("%w: %s", plugin.ErrNotFound, src)
+	}
+	return m.put(dst, data), nil
+}
+
+func (m *memStorage) CreateUpload(context.Context, string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := uuid.NewString()
+	m.uploads[id] = make(map[int32][]byte)
+	return id, nil
+}
+
+func (m *memStorage) UploadPart(_ context.Context, _ string, uploadID string, number int32, body io.Reader) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts, ok := m.uploads[uploadID]
+	if !ok {
+		return "", fmt.Errorf("%w: upload %s", plugin.ErrNotFound, uploadID)
+	}
+	parts[number] = data
+	return etagOf(data), nil
+}
+
+func (m *memStorage) ListParts(_ context.Context, _ string, uploadID string) ([]plugin.Part, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts, ok := m.uploads[uploadID]
+	if !ok {
+		return nil, fmt.Errorf("%w: upload %s", plugin.ErrNotFound, uploadID)
+	}
+	var result []plugin.Part
+	for number, data := range parts {
+		result = append(result, plugin.Part{Number: number, ETag: etagOf(data), Size: int64(len(data))})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Number < result[j].Number })
+	return result, nil
+}
+
+func (m *memStorage) CompleteUpload(_ context.Context, key string, uploadID string, parts []plugin.Part) (plugin.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	uploaded, ok := m.uploads[uploadID]
+	if !ok {
+		return plugin.Object{}, fmt.Errorf("%w: upload %s", plugin.ErrNotFound, uploadID)
+	}
+	var buf bytes.Buffer
+	for i, part := range parts {
+		// Like S3, which rejects uploads with small parts but the last.
+		if i < len(parts)-1 && len(uploaded[part.Number]) < minPartSize {
+			return plugin.Object{}, fmt.Errorf("part %d is smaller than %d bytes", part.Number, minPartSize)
+		}
+		buf.Write(uploaded[part.Number])
+	}
+	delete(m.uploads, uploadID)
+	return m.put(key, buf.Bytes()), nil
+}
+
+func (m *memStorage) AbortUpload(_ context.Context, _ string, uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, uploadID)
+	return nil
+}
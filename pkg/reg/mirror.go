@@ -0,0 +1,180 @@
+package reg
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
+)
+
+type MirrorOptions struct {
+	Repositories []string
+	Include      []string
+	Exclude      []string
+	Concurrency  int
+}
+
+type MirrorResult struct {
+	Mirrored uint64
+	Skipped  uint64
+	Failed   uint64
+}
+
+func (r *Registry) MirrorFrom(ctx context.Context, upstream *url.URL, opts MirrorOptions) (MirrorResult, error) {
+	client := newUpstreamClient(upstream)
+	repos := opts.Repositories
+	if len(repos) == 0 {
+		var err error
+		repos, err = client.catalog(ctx)
+		if err != nil {
+			return MirrorResult{}, fmt.Errorf("failed to list upstream repositories: %w", err)
+		}
+	}
+
+	listTags := func(ctx context.Context, repo string) ([]string, error) {
+		return client.listTags(ctx, repo)
+	}
+	mirrorTag := func(ctx context.Context, repo string, tag string) (bool, error) {
+		manifestBytes, _, err := client.getManifest(ctx, repo, tag)
+		if err != nil {
+			return false, err
+		}
+		if current, err := r.getManifestSHA(ctx, repo, tag); err == nil && current == digest.FromBytes(manifestBytes) {
+			return false, nil
+		}
+		return true, r.mirrorManifestFrom(ctx, client, repo, tag, manifestBytes)
+	}
+	return r.mirror(ctx, repos, opts, listTags, mirrorTag)
+}
+
+func (r *Registry) MirrorTo(ctx context.Context, target *url.URL, opts MirrorOptions) (MirrorResult, error) {
+	downstream := newReplicationTarget(target)
+	repos := opts.Repositories
+	if len(repos) == 0 {
+		var err error
+		repos, err = r.allRepositories(ctx)
+		if err != nil {
+			return MirrorResult{}, err
+		}
+	}
+
+	mirrorTag := func(ctx context.Context, repo string, tag string) (bool, error) {
+		sha, err := r.getManifestSHA(ctx, repo, tag)
+		if err != nil {
+			return false, err
+		}
+		if current, err := downstream.client.manifestDigest(ctx, downstream.repository(repo), tag); err == nil && current == sha {
+			return false, nil
+		}
+		return true, r.replicateManifest(ctx, downstream, repo, tag, sha)
+	}
+	return r.mirror(ctx, repos, opts, r.listTags, mirrorTag)
+}
+
+func (r *Registry) mirror(
+	ctx context.Context,
+	repos []string,
+	opts MirrorOptions,
+	listTags func(context.Context, string) ([]string, error),
+	mirrorTag func(context.Context, string, string) (bool, error),
+) (MirrorResult, error) {
+	filter := newRepoFilter(opts.Include, opts.Exclude)
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var result MirrorResult
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	for _, repo := range repos {
+		if !filter.repoSelected(repo) {
+			continue
+		}
+		tags, err := listTags(ctx, repo)
+		if err != nil {
+			r.logger.Warn("failed to list tags", "repo", repo, "error", err)
+			atomic.AddUint64(&result.Failed, 1)
+			continue
+		}
+		for _, tag := range tags {
+			if !filter.tagSelected(repo, tag) {
+				continue
+			}
+			group.Go(func() error {
+				mirrored, err := mirrorTag(ctx, repo, tag)
+				switch {
+				case err != nil:
+					r.logger.Warn("failed to mirror tag", "repo", repo, "tag", tag, "error", err)
+					atomic.AddUint64(&result.Failed, 1)
+				case mirrored:
+					r.logger.Info("mirrored tag", "repo", repo, "tag", tag)
+					atomic.AddUint64(&result.Mirrored, 1)
+				default:
+					atomic.AddUint64(&result.Skipped, 1)
+				}
+				return nil
+			})
+		}
+	}
+	err := group.Wait()
+	return result, err
+}
+
+func (r *Registry) mirrorManifestFrom(ctx context.Context, client *upstreamClient, repo string, reference string, manifestBytes []byte) error {
+	if err := checkManifestDigest(reference, manifestBytes); err != nil {
+		return err
+	}
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range manifest.Manifests {
+		childBytes, _, err := client.getManifest(ctx, repo, child.Digest.String())
+		if err != nil {
+			return fmt.Errorf("failed to fetch child manifest %s: %w", child.Digest, err)
+		}
+		if err := r.mirrorManifestFrom(ctx, client, repo, child.Digest.String(), childBytes); err != nil {
+			return err
+		}
+	}
+	for _, blob := range manifest.blobs() {
+		exists, err := r.hasBlob(ctx, repo, blob.Digest.String())
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		body, _, err := client.getBlob(ctx, repo, blob.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to fetch blob %s: %w", blob.Digest, err)
+		}
+		if err := r.ingestBlob(ctx, repo, blob.Digest, newVerifyingReader(body, blob.Digest)); err != nil {
+			return fmt.Errorf("failed to store blob %s: %w", blob.Digest, err)
+		}
+	}
+
+	// Mirrored manifests go through the checks, events and audit of any push.
+	return r.pushManifest(ctx, repo, reference, manifestBytes, nil)
+}
+
+func (r *Registry) allRepositories(ctx context.Context) ([]string, error) {
+	var repos []string
+	var token *string
+	for {
+		page, next, err := r.listRepositories(ctx, token, 1000)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return repos, nil
+		}
+		repos = append(repos, page...)
+		token = next
+	}
+}
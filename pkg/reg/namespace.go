@@ -0,0 +1,576 @@
+package reg
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gorilla/mux"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+	ErrAccessDenied     = errors.New("access denied")
+	ErrInvalidNamespace = errors.New("invalid namespace")
+)
+
+const (
+	NamespaceOrg     = "org"
+	NamespaceProject = "project"
+)
+
+const (
+	AccessPull = "pull"
+	AccessPush = "push"
+)
+
+// A principal of "*" matches every actor, and push access implies pull.
+type ACLEntry struct {
+	Principal string `json:"principal"`
+	Access    string `json:"access"`
+}
+
+// Unset fields are inherited from the enclosing org; a project's ACL replaces
+// the org's rather than extending it.
+type NamespaceSettings struct {
+	QuotaBytes    *int64     `json:"quotaBytes,omitempty"`
+	RetentionKeep *int       `json:"retentionKeep,omitempty"`
+	RetentionDays *int       `json:"retentionDays,omitempty"`
+	Immutable     *bool      `json:"immutable,omitempty"`
+	ACL           []ACLEntry `json:"acl,omitempty"`
+}
+
+type Namespace struct {
+	Path      string            `json:"path"`
+	Level     string            `json:"level"`
+	Settings  NamespaceSettings `json:"settings"`
+	UpdatedAt time.Time         `json:"updatedAt"`
+}
+
+type RepositorySettings struct {
+	Repository string            `json:"repository"`
+	Org        string            `json:"org,omitempty"`
+	Project    string            `json:"project,omitempty"`
+	Settings   NamespaceSettings `json:"settings"`
+	// The namespace whose usage counts against the quota.
+	QuotaNamespace string `json:"quotaNamespace,omitempty"`
+}
+
+// keepAnnotation set to "true" on a manifest keeps the tags pointing at it
+// from expiring.
+const keepAnnotation = "org.opencontainers.image.ref.keep"
+
+type RetentionResult struct {
+	Repositories int `json:"repositories"`
+	// Tags deleted, or which would have been on a dry run.
+	Deleted []string `json:"deleted"`
+	// Tags which would have expired but for the keep annotation.
+	Kept []string `json:"kept,omitempty"`
+	// Manifests deleted, or which would have been, as their expiry
+	// annotation passed.
+	Expired []string `json:"expired,omitempty"`
+	DryRun  bool     `json:"dryRun,omitempty"`
+}
+
+// namespaceLevel returns the level of an org ("acme") or project
+// ("acme/web") path.
+func namespaceLevel(path string) (string, error) {
+	parts := strings.Split(path, "/")
+	if slices.Contains(parts, "") || len(parts) > 2 {
+		return "", fmt.Errorf("%w: %q is neither an org nor an org/project", ErrInvalidNamespace, path)
+	}
+	if len(parts) == 1 {
+		return NamespaceOrg, nil
+	}
+	return NamespaceProject, nil
+}
+
+// repositoryNamespaces returns the org and project a repository belongs to.
+// A repository name needs a further component below a level to belong to it,
+// so "acme/app" is in org "acme" and "acme/web/app" is also in project "acme/web".
+func repositoryNamespaces(repo string) (org string, project string) {
+	parts := strings.Split(repo, "/")
+	if len(parts) > 1 {
+		org = parts[0]
+	}
+	if len(parts) > 2 {
+		project = parts[0] + "/" + parts[1]
+	}
+	return org, project
+}
+
+func (s NamespaceSettings) validate() error {
+	if s.QuotaBytes != nil && *s.QuotaBytes < 0 {
+		return fmt.Errorf("%w: quotaBytes must not be negative", ErrInvalidNamespace)
+	}
+	if s.RetentionKeep != nil && *s.RetentionKeep < 1 {
+		return fmt.Errorf("%w: retentionKeep must be positive", ErrInvalidNamespace)
+	}
+	if s.RetentionDays != nil && *s.RetentionDays < 1 {
+		return fmt.Errorf("%w: retentionDays must be positive", ErrInvalidNamespace)
+	}
+	for _, entry := range s.ACL {
+		if entry.Principal == "" {
+			return fmt.Errorf("%w: acl entries need a principal", ErrInvalidNamespace)
+		}
+		if entry.Access != AccessPull && entry.Access != AccessPush {
+			return fmt.Errorf("%w: acl access must be %q or %q", ErrInvalidNamespace, AccessPull, AccessPush)
+		}
+	}
+	return nil
+}
+
+func (s NamespaceSettings) inherit(parent NamespaceSettings) NamespaceSettings {
+	if s.QuotaBytes == nil {
+		s.QuotaBytes = parent.QuotaBytes
+	}
+	if s.RetentionKeep == nil {
+		s.RetentionKeep = parent.RetentionKeep
+	}
+	if s.RetentionDays == nil {
+		s.RetentionDays = parent.RetentionDays
+	}
+	if s.Immutable == nil {
+		s.Immutable = parent.Immutable
+	}
+	if s.ACL == nil {
+		s.ACL = parent.ACL
+	}
+	return s
+}
+
+func (s NamespaceSettings) allows(actor string, access string) bool {
+	if len(s.ACL) == 0 {
+		return true
+	}
+	for _, entry := range s.ACL {
+		if entry.Principal != "*" && entry.Principal != actor {
+			continue
+		}
+		if entry.Access == AccessPush || entry.Access == access {
+			return true
+		}
+	}
+	return false
+}
+
+func namespaceFromRow(row namespaceRow) (Namespace, error) {
+	ns := Namespace{Path: row.Path, UpdatedAt: row.UpdatedAt}
+	ns.Level, _ = namespaceLevel(row.Path)
+	if err := json.Unmarshal([]byte(row.Settings), &ns.Settings); err != nil {
+		return ns, fmt.Errorf("failed to decode settings of %s: %w", row.Path, err)
+	}
+	return ns, nil
+}
+
+func (r *Registry) Namespaces() ([]Namespace, error) {
+	rows, err := r.db.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]Namespace, 0, len(rows))
+	for _, row := range rows {
+		ns, err := namespaceFromRow(row)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
+}
+
+// Namespace returns the settings of an org or project, or sql.ErrNoRows when
+// none were set.
+func (r *Registry) Namespace(path string) (Namespace, error) {
+	if _, err := namespaceLevel(path); err != nil {
+		return Namespace{}, err
+	}
+	rows, err := r.db.Namespaces(path)
+	if err != nil {
+		return Namespace{}, err
+	}
+	if len(rows) == 0 {
+		return Namespace{}, sql.ErrNoRows
+	}
+	return namespaceFromRow(rows[0])
+}
+
+func (r *Registry) SetNamespace(path string, settings NamespaceSettings) (Namespace, error) {
+	if _, err := namespaceLevel(path); err != nil {
+		return Namespace{}, err
+	}
+	if err := settings.validate(); err != nil {
+		return Namespace{}, err
+	}
+	if len(settings.ACL) > 0 && r.auth == nil {
+		return Namespace{}, fmt.Errorf("%w: an acl needs an authenticator to identify principals", ErrInvalidNamespace)
+	}
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return Namespace{}, fmt.Errorf("failed to encode settings: %w", err)
+	}
+	if err := r.db.PutNamespace(path, string(encoded)); err != nil {
+		return Namespace{}, err
+	}
+	return r.Namespace(path)
+}
+
+func (r *Registry) DeleteNamespace(path string) error {
+	if _, err := namespaceLevel(path); err != nil {
+		return err
+	}
+	return r.db.DeleteNamespace(path)
+}
+
+// RepositorySettings resolves what a repository inherits from its org and
+// project.
+func (r *Registry) RepositorySettings(repo string) (RepositorySettings, error) {
+	org, project := repositoryNamespaces(repo)
+	resolved := RepositorySettings{Repository: repo, Org: org, Project: project}
+	if org == "" {
+		return resolved, nil
+	}
+	rows, err := r.db.Namespaces(org, project)
+	if err != nil {
+		return resolved, err
+	}
+	var orgSettings, projectSettings NamespaceSettings
+	for _, row := range rows {
+		ns, err := namespaceFromRow(row)
+		if err != nil {
+			return resolved, err
+		}
+		if ns.Path == org {
+			orgSettings = ns.Settings
+		} else {
+			projectSettings = ns.Settings
+		}
+	}
+	resolved.Settings = projectSettings.inherit(orgSettings)
+	switch {
+	case projectSettings.QuotaBytes != nil:
+		resolved.QuotaNamespace = project
+	case orgSettings.QuotaBytes != nil:
+		resolved.QuotaNamespace = org
+	}
+	return resolved, nil
+}
+
+// authorize checks the actor of ctx against the ACL a repository inherits.
+// Without an authenticator nobody has a verified identity, so repositories
+// with an ACL deny everyone.
+func (r *Registry) authorize(ctx context.Context, repo string, access string) error {
+	settings, err := r.RepositorySettings(repo)
+	if err != nil {
+		return err
+	}
+	if len(settings.Settings.ACL) > 0 && r.auth == nil {
+		return fmt.Errorf("%w: %s has an ACL, which needs an authenticator", ErrAccessDenied, repo)
+	}
+	actor := requestInfoFrom(ctx).Actor
+	if !settings.Settings.allows(actor, access) {
+		return fmt.Errorf("%w: %q may not %s %s", ErrAccessDenied, actor, access, repo)
+	}
+	return nil
+}
+
+// canPull tells whether the actor of a request may pull a repository. Outside
+// of a request, like for background jobs, every repository may be pulled.
+func (r *Registry) canPull(ctx context.Context, repo string) (bool, error) {
+	if !onBehalfOfRequest(ctx) {
+		return true, nil
+	}
+	err := r.authorize(ctx, repo, AccessPull)
+	if errors.Is(err, ErrAccessDenied) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// pullableOnly leaves out the items of repositories the actor of a request may
+// not pull. Listings keep the continuation token of the unfiltered page, so
+// their pages may come out short.
+func pullableOnly[T any](ctx context.Context, r *Registry, items []T, repo func(T) string) ([]T, error) {
+	visible := make(map[string]bool)
+	kept := items[:0]
+	for _, item := range items {
+		name := repo(item)
+		allowed, checked := visible[name]
+		if !checked {
+			var err error
+			allowed, err = r.canPull(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			visible[name] = allowed
+		}
+		if allowed {
+			kept = append(kept, item)
+		}
+	}
+	return kept, nil
+}
+
+func (r *Registry) isNamespaceImmutable(repo string) bool {
+	settings, err := r.RepositorySettings(repo)
+	if err != nil {
+		r.logger.Error("error resolving repository settings", "error", err)
+		return false
+	}
+	return settings.Settings.Immutable != nil && *settings.Settings.Immutable
+}
+
+// checkQuota rejects a manifest whose layers, where not already stored in the
+// namespace, would take it over its quota.
+func (r *Registry) checkQuota(repo string, layers []v1.Descriptor) error {
+	settings, err := r.RepositorySettings(repo)
+	if err != nil {
+		return err
+	}
+	if settings.Settings.QuotaBytes == nil {
+		return nil
+	}
+	digests := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		digests = append(digests, layer.Digest.String())
+	}
+	usage, present, err := r.db.NamespaceUsage(settings.QuotaNamespace+"/", digests)
+	if err != nil {
+		return err
+	}
+	added := int64(0)
+	for _, layer := range layers {
+		if !slices.Contains(present, layer.Digest.String()) {
+			added += layer.Size
+		}
+	}
+	if quota := *settings.Settings.QuotaBytes; usage+added > quota {
+		return fmt.Errorf("%w: %s would use %d of %d bytes", ErrQuotaExceeded, settings.QuotaNamespace, usage+added, quota)
+	}
+	return nil
+}
+
+type taggedAt struct {
+	tag      string
+	modified time.Time
+}
+
+// tagTimes lists the tags of a repository with when they were last pushed.
+func (r *Registry) tagTimes(ctx context.Context, repo string) ([]taggedAt, error) {
+	if r.layout == LayoutOCI {
+		return r.ociTaggedAt(ctx, repo)
+	}
+	prefix := tagsPrefix(repo)
+	var tags []taggedAt
+	input := &s3.ListObjectsV2Input{Bucket: &r.bucket, Prefix: &prefix}
+	for {
+		req, err := r.s3Client.ListObjectsV2(ctx, input, forcePathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", err)
+		}
+		for _, obj := range req.Contents {
+			tag, ok := strings.CutSuffix(strings.TrimPrefix(*obj.Key, prefix), "/current/link")
+			if ok && obj.LastModified != nil {
+				tags = append(tags, taggedAt{tag, *obj.LastModified})
+			}
+		}
+		if req.IsTruncated == nil || !*req.IsTruncated {
+			return tags, nil
+		}
+		input.ContinuationToken = req.NextContinuationToken
+	}
+}
+
+// ApplyRetention deletes the tags that fall outside the retention of their
+// org or project, keeping the newest retentionKeep tags and those pushed
+// within retentionDays. Repositories whose namespaces set no retention expire
+// their tags after the registry's tag expiry, if any. Immutable tags, and tags
+// of manifests with the keep annotation, are never deleted. Manifests whose
+// expiry annotation passed are deleted first.
+func (r *Registry) ApplyRetention(ctx context.Context) (*RetentionResult, error) {
+	return r.applyRetention(ctx, false)
+}
+
+// PlanRetention reports what ApplyRetention would delete, without deleting
+// anything.
+func (r *Registry) PlanRetention(ctx context.Context) (*RetentionResult, error) {
+	return r.applyRetention(ctx, true)
+}
+
+func (r *Registry) applyRetention(ctx context.Context, dryRun bool) (*RetentionResult, error) {
+	result := &RetentionResult{Deleted: []string{}, DryRun: dryRun}
+	expired, err := r.expireManifests(ctx, dryRun)
+	result.Expired = expired
+	if err != nil {
+		return result, err
+	}
+	repos, err := r.retentionRepositories()
+	if err != nil {
+		return result, err
+	}
+	for _, repo := range repos {
+		settings, err := r.RepositorySettings(repo)
+		if err != nil {
+			return result, err
+		}
+		retention := settings.Settings
+		if retention.RetentionKeep == nil && retention.RetentionDays == nil && r.tagExpiryDays > 0 {
+			retention.RetentionDays = &r.tagExpiryDays
+		}
+		if retention.RetentionKeep == nil && retention.RetentionDays == nil {
+			continue
+		}
+		result.Repositories++
+		deleted, kept, err := r.applyRepositoryRetention(ctx, repo, retention, dryRun)
+		for _, tag := range deleted {
+			result.Deleted = append(result.Deleted, repo+":"+tag)
+		}
+		for _, tag := range kept {
+			result.Kept = append(result.Kept, repo+":"+tag)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// retentionRepositories lists the repositories retention may apply to: every
+// one with a tag expiry, or else those of namespaces setting a retention.
+func (r *Registry) retentionRepositories() ([]string, error) {
+	if r.tagExpiryDays > 0 {
+		return r.db.CachedRepositories("")
+	}
+	namespaces, err := r.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	seen := make(map[string]bool)
+	for _, ns := range namespaces {
+		if ns.Settings.RetentionKeep == nil && ns.Settings.RetentionDays == nil {
+			continue
+		}
+		nsRepos, err := r.db.CachedRepositories(ns.Path + "/")
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range nsRepos {
+			if !seen[repo] {
+				seen[repo] = true
+				repos = append(repos, repo)
+			}
+		}
+	}
+	return repos, nil
+}
+
+func (r *Registry) applyRepositoryRetention(ctx context.Context, repo string, settings NamespaceSettings, dryRun bool) ([]string, []string, error) {
+	tags, err := r.tagTimes(ctx, repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].modified.After(tags[j].modified) })
+
+	immutable := settings.Immutable != nil && *settings.Immutable
+	var deleted, kept []string
+	expire := func(tag string) error {
+		if !dryRun {
+			if err := r.deleteTag(ctx, repo, tag); err != nil {
+				return fmt.Errorf("failed to delete %s:%s: %w", repo, tag, err)
+			}
+		}
+		deleted = append(deleted, tag)
+		return nil
+	}
+	// Referrers tags live as long as their subject, regardless of age, and do
+	// not count towards the kept tags.
+	versions := tags[:0]
+	for _, t := range tags {
+		subject, ok := referrersTagSubject(t.tag)
+		if !ok {
+			versions = append(versions, t)
+			continue
+		}
+		exists, err := r.manifestExists(ctx, repo, subject)
+		if err != nil {
+			return deleted, kept, err
+		}
+		if exists || immutable || r.isTagImmutable(repo, t.tag) {
+			continue
+		}
+		if err := expire(t.tag); err != nil {
+			return deleted, kept, err
+		}
+	}
+	for i, t := range versions {
+		keep := settings.RetentionKeep != nil && i < *settings.RetentionKeep
+		if settings.RetentionDays != nil && time.Since(t.modified) < time.Duration(*settings.RetentionDays)*24*time.Hour {
+			keep = true
+		}
+		if keep || immutable || r.isTagImmutable(repo, t.tag) {
+			continue
+		}
+		annotated, err := r.hasKeepAnnotation(ctx, repo, t.tag)
+		if err != nil {
+			return deleted, kept, err
+		}
+		if annotated {
+			kept = append(kept, t.tag)
+			continue
+		}
+		if err := expire(t.tag); err != nil {
+			return deleted, kept, err
+		}
+	}
+	return deleted, kept, nil
+}
+
+func (r *Registry) hasKeepAnnotation(ctx context.Context, repo string, tag string) (bool, error) {
+	_, manifestBytes, err := r.getManifest(ctx, repo, tag)
+	if err != nil {
+		return false, fmt.Errorf("failed to get manifest of %s:%s: %w", repo, tag, err)
+	}
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return false, err
+	}
+	return manifest.Annotations[keepAnnotation] == "true", nil
+}
+
+// aclMiddleware enforces namespace ACLs on repository routes, treating GET and
+// HEAD as pull and everything else as push.
+func (h *Handler) aclMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		access := AccessPush
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			access = AccessPull
+		}
+		err := h.registry.authorize(r.Context(), name, access)
+		switch {
+		case err == nil:
+			next.ServeHTTP(w, r)
+		case errors.Is(err, ErrAccessDenied) && requestInfoFrom(r.Context()).Actor == "" && h.registry.auth != nil:
+			writeAuthChallenge(w, ErrUnauthenticated.Error())
+		case errors.Is(err, ErrAccessDenied):
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+		default:
+			h.registry.logger.Error("error checking access", "error", err)
+			http.Error(w, fmt.Sprintf("error checking access: %v", err), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+type NATSConfig struct {
+	URL           string
+	SubjectPrefix string
+	CredsFile     string
+	Token         string
+}
+
+type NATSSink struct {
+	conn          *nats.Conn
+	subjectPrefix string
+}
+
+func NewNATSSink(cfg NATSConfig) (*NATSSink, error) {
+	opts := []nats.Option{
+		nats.Name("reg"),
+		nats.MaxReconnects(-1),
+	}
+	if cfg.CredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.CredsFile))
+	}
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+
+	conn, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	prefix := cfg.SubjectPrefix
+	if prefix == "" {
+		prefix = "reg.events"
+	}
+	return &NATSSink{conn: conn, subjectPrefix: prefix}, nil
+}
+
+func (s *NATSSink) Name() string {
+	return "nats " + s.conn.ConnectedUrlRedacted()
+}
+
+func (s *NATSSink) Send(_ context.Context, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	subject := fmt.Sprintf("%s.%s", s.subjectPrefix, event.Action)
+	if err := s.conn.Publish(subject, data); err != nil {
+		return fmt.Errorf("failed to publish event to %s: %w", subject, err)
+	}
+	return nil
+}
+
+func (s *NATSSink) Close() error {
+	return s.conn.Drain()
+}
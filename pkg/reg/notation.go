@@ -0,0 +1,551 @@
+package reg
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	notationSignatureArtifactType = "application/vnd.cncf.notary.signature"
+	notationJWSMediaType          = "application/jose+json"
+	notationCOSEMediaType         = "application/cose"
+)
+
+// NotationTrustPolicy is notation's trustpolicy.json. Registry scopes name
+// repositories, with or without the registry host, or are "*".
+type NotationTrustPolicy struct {
+	Version       string           `json:"version"`
+	TrustPolicies []NotationPolicy `json:"trustPolicies"`
+}
+
+type NotationPolicy struct {
+	Name                  string   `json:"name"`
+	RegistryScopes        []string `json:"registryScopes"`
+	SignatureVerification struct {
+		// strict and permissive deny unverified pushes, audit only logs them
+		// and skip does not verify at all.
+		Level string `json:"level"`
+	} `json:"signatureVerification"`
+	// Named "ca:<name>" or "signingAuthority:<name>".
+	TrustStores []string `json:"trustStores,omitempty"`
+	// "*" or "x509.subject: <DN>", e.g. "x509.subject: C=US, O=Acme, CN=release".
+	TrustedIdentities []string `json:"trustedIdentities,omitempty"`
+}
+
+// NotationVerifier checks notation JWS signatures attached through the
+// referrers API against a trust policy and the certificates of a trust store
+// laid out like notation's, as <dir>/x509/<type>/<name>/*.
+type NotationVerifier struct {
+	policies []*notationPolicy
+}
+
+type notationPolicy struct {
+	name       string
+	scopes     []string
+	level      string
+	roots      *x509.CertPool
+	anyone     bool
+	identities []map[string]string
+}
+
+type SignatureStatus struct {
+	Digest      digest.Digest `json:"digest"`
+	MediaType   string        `json:"mediaType"`
+	Verified    bool          `json:"verified"`
+	Signer      string        `json:"signer,omitempty"`
+	SigningTime *time.Time    `json:"signingTime,omitempty"`
+	// Expired signatures only fail under strict policies.
+	Expired bool   `json:"expired,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type VerificationStatus struct {
+	Repository string            `json:"repository"`
+	Reference  string            `json:"reference,omitempty"`
+	Digest     digest.Digest     `json:"digest"`
+	Policy     string            `json:"policy,omitempty"`
+	Level      string            `json:"level,omitempty"`
+	Verified   bool              `json:"verified"`
+	Signatures []SignatureStatus `json:"signatures"`
+}
+
+func LoadNotationTrustPolicy(policyPath string, trustStoreDir string) (*NotationVerifier, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust policy: %w", err)
+	}
+	var policy NotationTrustPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse trust policy: %w", err)
+	}
+	return NewNotationVerifier(policy, trustStoreDir)
+}
+
+func NewNotationVerifier(trustPolicy NotationTrustPolicy, trustStoreDir string) (*NotationVerifier, error) {
+	v := &NotationVerifier{}
+	for _, p := range trustPolicy.TrustPolicies {
+		policy := &notationPolicy{
+			name:   p.Name,
+			scopes: p.RegistryScopes,
+			level:  p.SignatureVerification.Level,
+			roots:  x509.NewCertPool(),
+		}
+		switch policy.level {
+		case "strict", "permissive", "audit":
+		case "skip":
+			v.policies = append(v.policies, policy)
+			continue
+		default:
+			return nil, fmt.Errorf("trust policy %s: invalid verification level %q", p.Name, policy.level)
+		}
+
+		if len(p.TrustStores) == 0 {
+			return nil, fmt.Errorf("trust policy %s: no trust stores", p.Name)
+		}
+		for _, store := range p.TrustStores {
+			storeType, storeName, ok := strings.Cut(store, ":")
+			if !ok || (storeType != "ca" && storeType != "signingAuthority") {
+				return nil, fmt.Errorf("trust policy %s: invalid trust store %q", p.Name, store)
+			}
+			certs, err := loadTrustStore(filepath.Join(trustStoreDir, "x509", storeType, storeName))
+			if err != nil {
+				return nil, fmt.Errorf("trust policy %s: %w", p.Name, err)
+			}
+			for _, cert := range certs {
+				policy.roots.AddCert(cert)
+			}
+		}
+
+		for _, identity := range p.TrustedIdentities {
+			if identity == "*" {
+				policy.anyone = true
+				continue
+			}
+			dn, ok := strings.CutPrefix(identity, "x509.subject:")
+			if !ok {
+				return nil, fmt.Errorf("trust policy %s: invalid trusted identity %q", p.Name, identity)
+			}
+			attrs, err := parseDistinguishedName(dn)
+			if err != nil {
+				return nil, fmt.Errorf("trust policy %s: %w", p.Name, err)
+			}
+			policy.identities = append(policy.identities, attrs)
+		}
+		if !policy.anyone && len(policy.identities) == 0 {
+			return nil, fmt.Errorf("trust policy %s: no trusted identities", p.Name)
+		}
+		v.policies = append(v.policies, policy)
+	}
+	return v, nil
+}
+
+func loadTrustStore(dir string) ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read trust store: %w", err)
+	}
+	var certs []*x509.Certificate
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read certificate: %w", err)
+		}
+		parsed, err := parseCertificates(data)
+		if err != nil {
+			// Notation also accepts DER files.
+			cert, derErr := x509.ParseCertificate(data)
+			if derErr != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", entry.Name(), err)
+			}
+			parsed = []*x509.Certificate{cert}
+		}
+		certs = append(certs, parsed...)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("trust store %s has no certificates", dir)
+	}
+	return certs, nil
+}
+
+// parseDistinguishedName reads "C=US, O=Acme, CN=release" into its
+// attributes, which a signer's subject must all have.
+func parseDistinguishedName(dn string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(dn, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid distinguished name %q", dn)
+		}
+		attrs[strings.ToUpper(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return attrs, nil
+}
+
+func subjectMatches(cert *x509.Certificate, attrs map[string]string) bool {
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+	subject := map[string]string{
+		"C":  first(cert.Subject.Country),
+		"ST": first(cert.Subject.Province),
+		"L":  first(cert.Subject.Locality),
+		"O":  first(cert.Subject.Organization),
+		"OU": first(cert.Subject.OrganizationalUnit),
+		"CN": cert.Subject.CommonName,
+	}
+	for key, value := range attrs {
+		if subject[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// policyFor prefers a scope naming the repository over globs and "*".
+func (v *NotationVerifier) policyFor(repo string) *notationPolicy {
+	var glob, wildcard *notationPolicy
+	for _, policy := range v.policies {
+		for _, scope := range policy.scopes {
+			switch {
+			case scope == "*":
+				if wildcard == nil {
+					wildcard = policy
+				}
+			case scope == repo || stripRegistryHost(scope) == repo:
+				return policy
+			case glob == nil && parseRepoPattern(stripRegistryHost(scope)).matchesRepo(repo):
+				glob = policy
+			}
+		}
+	}
+	if glob != nil {
+		return glob
+	}
+	return wildcard
+}
+
+func stripRegistryHost(scope string) string {
+	host, rest, ok := strings.Cut(scope, "/")
+	if ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		return rest
+	}
+	return scope
+}
+
+type jwsEnvelope struct {
+	Payload   string `json:"payload"`
+	Protected string `json:"protected"`
+	Header    struct {
+		// Leaf certificate first, as base64 DER.
+		X5C [][]byte `json:"x5c"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+}
+
+type jwsProtectedHeader struct {
+	Alg                  string     `json:"alg"`
+	Cty                  string     `json:"cty"`
+	SigningScheme        string     `json:"io.cncf.notary.signingScheme"`
+	SigningTime          *time.Time `json:"io.cncf.notary.signingTime"`
+	AuthenticSigningTime *time.Time `json:"io.cncf.notary.authenticSigningTime"`
+	Expiry               *time.Time `json:"io.cncf.notary.expiry"`
+}
+
+type notationPayload struct {
+	TargetArtifact v1.Descriptor `json:"targetArtifact"`
+}
+
+// verifyJWS checks a notation JWS envelope signing target, filling in the
+// signer and signing time of status. The policy's level decides whether an
+// expired signature fails.
+func (p *notationPolicy) verifyJWS(envelopeBytes []byte, target digest.Digest, targetSize int64, status *SignatureStatus) error {
+	var envelope jwsEnvelope
+	if err := json.Unmarshal(envelopeBytes, &envelope); err != nil {
+		return fmt.Errorf("invalid JWS envelope: %w", err)
+	}
+	protectedBytes, err := base64.RawURLEncoding.DecodeString(envelope.Protected)
+	if err != nil {
+		return fmt.Errorf("invalid protected header: %w", err)
+	}
+	var protected jwsProtectedHeader
+	if err := json.Unmarshal(protectedBytes, &protected); err != nil {
+		return fmt.Errorf("invalid protected header: %w", err)
+	}
+	status.SigningTime = protected.SigningTime
+	if protected.AuthenticSigningTime != nil {
+		status.SigningTime = protected.AuthenticSigningTime
+	}
+	if len(envelope.Header.X5C) == 0 {
+		return errors.New("no certificate chain")
+	}
+
+	leaf, err := x509.ParseCertificate(envelope.Header.X5C[0])
+	if err != nil {
+		return fmt.Errorf("invalid signing certificate: %w", err)
+	}
+	status.Signer = leaf.Subject.String()
+	intermediates := x509.NewCertPool()
+	for _, der := range envelope.Header.X5C[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("invalid certificate chain: %w", err)
+		}
+		intermediates.AddCert(cert)
+	}
+	at := time.Now()
+	if protected.SigningScheme == "notary.x509.signingAuthority" {
+		if protected.AuthenticSigningTime == nil {
+			return errors.New("signing authority signature without authentic signing time")
+		}
+		at = *protected.AuthenticSigningTime
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         p.roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("untrusted signing certificate: %w", err)
+	}
+	if !p.anyone {
+		trusted := false
+		for _, attrs := range p.identities {
+			if subjectMatches(leaf, attrs) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return fmt.Errorf("signer %s is not a trusted identity", status.Signer)
+		}
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(envelope.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if err := verifyJWSSignature(protected.Alg, leaf.PublicKey, []byte(envelope.Protected+"."+envelope.Payload), sig); err != nil {
+		return err
+	}
+	// As in notation, only strict policies enforce expiry, the others log it.
+	if protected.Expiry != nil && time.Now().After(*protected.Expiry) {
+		if p.level == "strict" {
+			return fmt.Errorf("signature expired at %s", protected.Expiry.Format(time.RFC3339))
+		}
+		status.Expired = true
+	}
+
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid payload encoding: %w", err)
+	}
+	var payload notationPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+	if payload.TargetArtifact.Digest != target || payload.TargetArtifact.Size != targetSize {
+		return errors.New("signature is for another manifest")
+	}
+	return nil
+}
+
+func verifyJWSSignature(alg string, pub crypto.PublicKey, signingInput []byte, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signingInput)
+	hashed := h.Sum(nil)
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "PS") {
+			return fmt.Errorf("algorithm %s does not match an RSA key", alg)
+		}
+		if err := rsa.VerifyPSS(key, hash, hashed, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("algorithm %s does not match an ECDSA key", alg)
+		}
+		// JWS encodes ECDSA signatures as r and s of the curve's size.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		rInt := new(big.Int).SetBytes(sig[:size])
+		sInt := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, hashed, rInt, sInt) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signing key %T", pub)
+}
+
+// NotationStatus verifies every notation signature of a manifest against the
+// trust policy of its repository.
+func (r *Registry) NotationStatus(ctx context.Context, name string, reference string) (*VerificationStatus, error) {
+	_, manifestBytes, err := r.getStoredManifest(ctx, name, reference)
+	if err != nil {
+		return nil, err
+	}
+	status, err := r.notationStatus(ctx, name, manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !isDigest(reference) {
+		status.Reference = reference
+	}
+	return status, nil
+}
+
+func (r *Registry) notationStatus(ctx context.Context, name string, manifestBytes []byte) (*VerificationStatus, error) {
+	dgst := digest.FromBytes(manifestBytes)
+	status := &VerificationStatus{
+		Repository: name,
+		Digest:     dgst,
+		Signatures: []SignatureStatus{},
+	}
+	var policy *notationPolicy
+	if r.notation != nil {
+		policy = r.notation.policyFor(name)
+	}
+	if policy != nil {
+		status.Policy = policy.name
+		status.Level = policy.level
+	}
+
+	referrers, err := r.Referrers(ctx, name, dgst, notationSignatureArtifactType)
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range referrers {
+		sigStatus := SignatureStatus{Digest: desc.Digest}
+		err := r.verifyNotationSignature(ctx, name, desc.Digest, dgst, int64(len(manifestBytes)), policy, &sigStatus)
+		if err != nil {
+			sigStatus.Error = err.Error()
+		} else {
+			sigStatus.Verified = true
+			status.Verified = true
+		}
+		status.Signatures = append(status.Signatures, sigStatus)
+	}
+	return status, nil
+}
+
+func (r *Registry) verifyNotationSignature(ctx context.Context, name string, sigDigest digest.Digest, target digest.Digest, targetSize int64, policy *notationPolicy, status *SignatureStatus) error {
+	_, sigBytes, err := r.getManifestByDigest(ctx, name, sigDigest)
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+	m, err := parseAnyManifest(sigBytes)
+	if err != nil {
+		return err
+	}
+	if len(m.Layers) != 1 {
+		return errors.New("signature manifest must have exactly one layer")
+	}
+	envelope := m.Layers[0]
+	status.MediaType = envelope.MediaType
+	if policy == nil {
+		return errors.New("no trust policy applies")
+	}
+	if policy.level == "skip" {
+		return errors.New("verification skipped by trust policy")
+	}
+	switch envelope.MediaType {
+	case notationJWSMediaType:
+	case notationCOSEMediaType:
+		return errors.New("COSE signature envelopes are not supported")
+	default:
+		return fmt.Errorf("unknown signature envelope %s", envelope.MediaType)
+	}
+	if envelope.Size > maxSignaturePayloadSize {
+		return errors.New("signature envelope too large")
+	}
+	envelopeBytes, err := r.getManifestBlob(ctx, name, envelope.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to read signature envelope: %w", err)
+	}
+	if digest.FromBytes(envelopeBytes) != envelope.Digest {
+		return errors.New("signature envelope does not match its digest")
+	}
+	if err := policy.verifyJWS(envelopeBytes, target, targetSize, status); err != nil {
+		return err
+	}
+	if status.Expired {
+		r.logger.Warn("trusting expired notation signature", "repository", name, "policy", policy.name, "level", policy.level, "signer", status.Signer)
+	}
+	return nil
+}
+
+// requireNotationSignature denies a tag push unless the manifest has a
+// notation signature trusted by a strict or permissive policy.
+func (r *Registry) requireNotationSignature(ctx context.Context, name string, reference string, manifestBytes []byte) error {
+	if r.notation == nil {
+		return nil
+	}
+	policy := r.notation.policyFor(name)
+	if policy == nil || policy.level == "skip" {
+		return nil
+	}
+	m, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	if isAttachedArtifact(m) {
+		return nil
+	}
+	status, err := r.notationStatus(ctx, name, manifestBytes)
+	if err != nil {
+		return err
+	}
+	if status.Verified {
+		return nil
+	}
+	reason := "no notation signatures found"
+	if len(status.Signatures) > 0 {
+		reason = status.Signatures[len(status.Signatures)-1].Error
+	}
+	if policy.level == "audit" {
+		r.logger.Warn("admitting push without trusted notation signature", "repository", name, "reference", reference, "policy", policy.name, "reason", reason)
+		return nil
+	}
+	return fmt.Errorf("%w for %s@%s: %s", ErrSignatureRequired, name, status.Digest, reason)
+}
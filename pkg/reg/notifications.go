@@ -0,0 +1,136 @@
+package reg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const mediaTypeDistributionEvents = "application/vnd.docker.distribution.events.v1+json"
+
+type WebhookFormat string
+
+const (
+	// Webhooks receive each event as a JSON object of its own.
+	WebhookFormatReg WebhookFormat = "reg"
+	// Webhooks receive events in the envelope of Docker distribution
+	// notifications, for consumers written against it, like Harbor.
+	WebhookFormatDistribution WebhookFormat = "distribution"
+)
+
+type distributionEnvelope struct {
+	Events []distributionEvent `json:"events"`
+}
+
+type distributionEvent struct {
+	ID        string              `json:"id"`
+	Timestamp time.Time           `json:"timestamp"`
+	Action    string              `json:"action"`
+	Target    distributionTarget  `json:"target"`
+	Request   distributionRequest `json:"request"`
+	Actor     distributionActor   `json:"actor"`
+	Source    distributionSource  `json:"source"`
+}
+
+type distributionTarget struct {
+	MediaType  string `json:"mediaType,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Length     int64  `json:"length,omitempty"`
+	Repository string `json:"repository"`
+	URL        string `json:"url,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+type distributionRequest struct {
+	ID        string `json:"id"`
+	Addr      string `json:"addr,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Method    string `json:"method,omitempty"`
+	UserAgent string `json:"useragent,omitempty"`
+}
+
+type distributionActor struct {
+	Name string `json:"name,omitempty"`
+}
+
+type distributionSource struct {
+	Addr       string `json:"addr,omitempty"`
+	InstanceID string `json:"instanceID"`
+}
+
+// distributionEvent translates an event the way Docker distribution reports
+// the same operation: pushes of manifests and blobs are "push", and all
+// deletions are "delete".
+func (r *Registry) distributionEvent(event Event) distributionEvent {
+	target := distributionTarget{
+		MediaType:  event.MediaType,
+		Size:       event.Size,
+		Digest:     event.Digest,
+		Length:     event.Size,
+		Repository: event.Repository,
+		Tag:        event.Tag,
+	}
+	action := "delete"
+	switch event.Action {
+	case EventManifestPushed:
+		action = "push"
+		target.URL = r.eventURL(event, "manifests")
+	case EventBlobUploaded:
+		action = "push"
+		target.MediaType = "application/octet-stream"
+		target.URL = r.eventURL(event, "blobs")
+	}
+	source := distributionSource{InstanceID: r.replicaID}
+	if r.publicURL != nil {
+		source.Addr = r.publicURL.Host
+	}
+	return distributionEvent{
+		ID:        event.ID,
+		Timestamp: event.Timestamp,
+		Action:    action,
+		Target:    target,
+		Request: distributionRequest{
+			ID:        event.ID,
+			Addr:      event.Addr,
+			Host:      event.request.Host,
+			Method:    event.request.Method,
+			UserAgent: event.request.UserAgent,
+		},
+		Actor:  distributionActor{Name: event.Actor},
+		Source: source,
+	}
+}
+
+// eventURL is where the manifest or blob of an event can be pulled from, when
+// the registry knows how clients reach it.
+func (r *Registry) eventURL(event Event, kind string) string {
+	var base string
+	switch {
+	case r.publicURL != nil:
+		base = strings.TrimSuffix(r.publicURL.String(), "/")
+	case event.request.Host != "":
+		base = event.request.Scheme + "://" + event.request.Host
+	default:
+		return ""
+	}
+	return fmt.Sprintf("%s/v2/%s/%s/%s", base, event.Repository, kind, event.Digest)
+}
+
+// webhookPayload encodes an event in the webhook format, and returns it with
+// its content type.
+func (r *Registry) webhookPayload(event Event) ([]byte, string, error) {
+	if r.webhookFormat == WebhookFormatDistribution {
+		payload, err := json.Marshal(distributionEnvelope{Events: []distributionEvent{r.distributionEvent(event)}})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to marshal event: %w", err)
+		}
+		return payload, mediaTypeDistributionEvents, nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return payload, "application/json", nil
+}
@@ -0,0 +1,384 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// StorageLayout is how the registry lays out its objects in the bucket.
+type StorageLayout string
+
+const (
+	// The docker/registry/v2 tree of the distribution registry, where
+	// repositories link to blobs shared by the whole bucket.
+	LayoutDistribution StorageLayout = "distribution"
+	// An OCI image layout per repository, at the repository's name, which
+	// skopeo, oras and other tools read as is. Tags are the ref names of the
+	// index.json entries, and each repository keeps its own copy of its blobs.
+	LayoutOCI StorageLayout = "oci"
+)
+
+var ErrRepositoryNameReserved = errors.New("repository name is reserved")
+
+const (
+	// ociTaggedAnnotation records when a tag was last pushed, which the index
+	// only has one modification time for.
+	ociTaggedAnnotation = "com.github.psarna.reg.tagged"
+	// ociIndexAttempts bounds the retries of an index update which keeps
+	// losing races with other updates.
+	ociIndexAttempts = 10
+)
+
+// ociReservedNames are the top-level prefixes the registry keeps its own
+// objects under, which repositories at the bucket root must not collide with.
+var ociReservedNames = []string{"uploads", "audit", "invalidations", "locks"}
+
+// checkRepositoryName rejects, in the OCI layout, names whose objects would
+// mix with the registry's own or with another repository's layout.
+func (r *Registry) checkRepositoryName(name string) error {
+	if r.layout != LayoutOCI {
+		return nil
+	}
+	components := strings.Split(name, "/")
+	if slices.Contains(ociReservedNames, components[0]) {
+		return fmt.Errorf("%w: %s", ErrRepositoryNameReserved, name)
+	}
+	for _, component := range components {
+		switch component {
+		case v1.ImageBlobsDir, v1.ImageIndexFile, v1.ImageLayoutFile:
+			return fmt.Errorf("%w: %s", ErrRepositoryNameReserved, name)
+		}
+	}
+	return nil
+}
+
+// ociRepositoryFromKey returns the repository whose index.json key is key.
+func ociRepositoryFromKey(key string) (string, bool) {
+	repo, ok := strings.CutSuffix(key, "/"+v1.ImageIndexFile)
+	return repo, ok && repo != ""
+}
+
+// ociBlobFromKey returns the repository and digest of the blob stored at key.
+func ociBlobFromKey(key string) (string, digest.Digest, bool) {
+	repo, path, ok := strings.Cut(key, "/blobs/")
+	if !ok || repo == "" {
+		return "", "", false
+	}
+	alg, encoded, ok := strings.Cut(path, "/")
+	if !ok {
+		return "", "", false
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded)
+	return repo, dgst, dgst.Validate() == nil
+}
+
+// ociIndex is the index.json of a repository, which lists every manifest of
+// the repository: once per tag pointing at it, or once untagged if none does.
+type ociIndex struct {
+	v1.Index
+	// Empty while the repository has no index.
+	etag     string
+	modified time.Time
+}
+
+func ociRefName(desc v1.Descriptor) string {
+	return desc.Annotations[v1.AnnotationRefName]
+}
+
+func (x *ociIndex) tagDigest(tag string) (digest.Digest, bool) {
+	for _, desc := range x.Manifests {
+		if ociRefName(desc) == tag {
+			return desc.Digest, true
+		}
+	}
+	return "", false
+}
+
+func (x *ociIndex) tags() []string {
+	var tags []string
+	for _, desc := range x.Manifests {
+		if tag := ociRefName(desc); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func (x *ociIndex) hasManifest(dgst digest.Digest) bool {
+	return slices.ContainsFunc(x.Manifests, func(desc v1.Descriptor) bool {
+		return desc.Digest == dgst
+	})
+}
+
+// taggedAt tells when tag was last pushed, or when the index was written for
+// tags pushed by other tools.
+func (x *ociIndex) taggedAt(desc v1.Descriptor) time.Time {
+	if t, err := time.Parse(time.RFC3339, desc.Annotations[ociTaggedAnnotation]); err == nil {
+		return t
+	}
+	return x.modified
+}
+
+func (x *ociIndex) addRevision(desc v1.Descriptor) bool {
+	if x.hasManifest(desc.Digest) {
+		return false
+	}
+	desc.Annotations = nil
+	x.Manifests = append(x.Manifests, desc)
+	return true
+}
+
+func (x *ociIndex) setTag(tag string, desc v1.Descriptor, now time.Time) {
+	x.removeTag(tag)
+	x.Manifests = slices.DeleteFunc(x.Manifests, func(m v1.Descriptor) bool {
+		return m.Digest == desc.Digest && ociRefName(m) == ""
+	})
+	desc.Annotations = map[string]string{
+		v1.AnnotationRefName: tag,
+		ociTaggedAnnotation:  now.UTC().Format(time.RFC3339),
+	}
+	x.Manifests = append(x.Manifests, desc)
+}
+
+// removeTag drops the entry of tag. Its manifest stays in the index untagged,
+// as a revision of the repository, unless another tag points at it.
+func (x *ociIndex) removeTag(tag string) bool {
+	i := slices.IndexFunc(x.Manifests, func(m v1.Descriptor) bool {
+		return ociRefName(m) == tag
+	})
+	if i < 0 {
+		return false
+	}
+	desc := x.Manifests[i]
+	x.Manifests = slices.Delete(x.Manifests, i, i+1)
+	x.addRevision(desc)
+	return true
+}
+
+func (x *ociIndex) removeManifest(dgst digest.Digest) bool {
+	n := len(x.Manifests)
+	x.Manifests = slices.DeleteFunc(x.Manifests, func(m v1.Descriptor) bool {
+		return m.Digest == dgst
+	})
+	return len(x.Manifests) != n
+}
+
+func newOCIDescriptor(manifestBytes []byte) (v1.Descriptor, error) {
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{
+		MediaType:    manifest.mediaType(),
+		ArtifactType: manifest.ArtifactType,
+		Digest:       digest.FromBytes(manifestBytes),
+		Size:         int64(len(manifestBytes)),
+	}, nil
+}
+
+func ociTagNotFound(repo string, tag string) error {
+	return &types.NoSuchKey{Message: aws.String(fmt.Sprintf("tag %s not found in %s", tag, ociIndexKey(repo)))}
+}
+
+// readOCIIndex returns the index of a repository, empty if it has none.
+func (r *Registry) readOCIIndex(ctx context.Context, repo string) (*ociIndex, error) {
+	ctx, cancel := r.metadataContext(ctx)
+	defer cancel()
+	index := &ociIndex{Index: v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}}
+	key := ociIndexKey(repo)
+	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    &key,
+	}, forcePathStyle)
+	if err != nil {
+		if isNotFound(err) {
+			return index, nil
+		}
+		return nil, fmt.Errorf("failed to get index: %w", err)
+	}
+	defer obj.Body.Close()
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	if err := json.Unmarshal(data, &index.Index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal index %s: %w", key, err)
+	}
+	index.etag = aws.ToString(obj.ETag)
+	index.modified = aws.ToTime(obj.LastModified)
+	return index, nil
+}
+
+// updateOCIIndex applies update to the index of a repository and writes it
+// back if it changed, provided nobody wrote it in between, and otherwise
+// starts over. With a precondition, the write instead requires the index to
+// still be the one the precondition was taken on, and is not retried.
+func (r *Registry) updateOCIIndex(ctx context.Context, repo string, precondition *linkPrecondition, update func(*ociIndex) bool) error {
+	defer r.ociIndexLocks.lock(repo, "")()
+	key := ociIndexKey(repo)
+	for attempt := 1; ; attempt++ {
+		index, err := r.readOCIIndex(ctx, repo)
+		if err != nil {
+			return err
+		}
+		if !update(index) {
+			return nil
+		}
+		data, err := json.Marshal(index.Index)
+		if err != nil {
+			return fmt.Errorf("failed to marshal index: %w", err)
+		}
+		input := &s3.PutObjectInput{
+			Bucket: &r.bucket,
+			Key:    &key,
+			Body:   bytes.NewReader(data),
+		}
+		switch {
+		case precondition != nil:
+			precondition.apply(input)
+		case index.etag != "":
+			input.IfMatch = aws.String(index.etag)
+		default:
+			if err := r.putOCILayout(ctx, repo); err != nil {
+				return err
+			}
+			input.IfNoneMatch = aws.String("*")
+		}
+		_, err = r.s3Client.PutObject(ctx, input, forcePathStyle)
+		if err == nil {
+			return nil
+		}
+		if !isPreconditionFailed(err) || precondition != nil || attempt == ociIndexAttempts {
+			return fmt.Errorf("failed to put index: %w", err)
+		}
+	}
+}
+
+func (r *Registry) putOCILayout(ctx context.Context, repo string) error {
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	key := ociLayoutKey(repo)
+	_, err = r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &r.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(layout),
+	}, forcePathStyle)
+	if err != nil {
+		return fmt.Errorf("failed to put oci-layout: %w", err)
+	}
+	return nil
+}
+
+func (r *Registry) ociTagDigest(ctx context.Context, repo string, tag string) (digest.Digest, string, error) {
+	index, err := r.readOCIIndex(ctx, repo)
+	if err != nil {
+		return "", "", err
+	}
+	dgst, ok := index.tagDigest(tag)
+	if !ok {
+		return "", "", ociTagNotFound(repo, tag)
+	}
+	return dgst, index.etag, nil
+}
+
+func (r *Registry) putOCIRevision(ctx context.Context, repo string, manifestBytes []byte) error {
+	desc, err := newOCIDescriptor(manifestBytes)
+	if err != nil {
+		return err
+	}
+	return r.updateOCIIndex(ctx, repo, nil, func(index *ociIndex) bool {
+		return index.addRevision(desc)
+	})
+}
+
+func (r *Registry) putOCITag(ctx context.Context, repo string, tag string, manifestBytes []byte, precondition *linkPrecondition) error {
+	desc, err := newOCIDescriptor(manifestBytes)
+	if err != nil {
+		return err
+	}
+	return r.updateOCIIndex(ctx, repo, precondition, func(index *ociIndex) bool {
+		index.setTag(tag, desc, time.Now())
+		return true
+	})
+}
+
+func (r *Registry) deleteOCITag(ctx context.Context, repo string, tag string) error {
+	return r.updateOCIIndex(ctx, repo, nil, func(index *ociIndex) bool {
+		return index.removeTag(tag)
+	})
+}
+
+// ociManifestTags returns the tags pointing at a manifest of the repository.
+func (r *Registry) ociManifestTags(ctx context.Context, repo string, dgst digest.Digest) ([]string, error) {
+	index, err := r.readOCIIndex(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	if !index.hasManifest(dgst) {
+		return nil, fmt.Errorf("%w: manifest %s not found in %s", fs.ErrNotExist, dgst, ociIndexKey(repo))
+	}
+	var tags []string
+	for _, desc := range index.Manifests {
+		if tag := ociRefName(desc); tag != "" && desc.Digest == dgst {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+func (r *Registry) deleteOCIManifest(ctx context.Context, repo string, dgst digest.Digest) error {
+	return r.updateOCIIndex(ctx, repo, nil, func(index *ociIndex) bool {
+		return index.removeManifest(dgst)
+	})
+}
+
+func (r *Registry) ociHasManifest(ctx context.Context, repo string, dgst digest.Digest) (bool, error) {
+	index, err := r.readOCIIndex(ctx, repo)
+	if err != nil {
+		return false, err
+	}
+	return index.hasManifest(dgst), nil
+}
+
+func (r *Registry) listOCITags(ctx context.Context, repo string) ([]string, error) {
+	index, err := r.readOCIIndex(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return index.tags(), nil
+}
+
+func (r *Registry) ociTaggedAt(ctx context.Context, repo string) ([]taggedAt, error) {
+	index, err := r.readOCIIndex(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	var tags []taggedAt
+	for _, desc := range index.Manifests {
+		if tag := ociRefName(desc); tag != "" {
+			tags = append(tags, taggedAt{tag, index.taggedAt(desc)})
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,265 @@
+package reg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// operationSummaries describes the registered routes, keyed by method and path
+// template. Routes which only differ by their query parameters share one entry.
+var operationSummaries = map[string]string{
+	"GET /v2/":                                       "Check API support",
+	"GET /v2/{name}/blobs/{digest}":                  "Get blob",
+	"HEAD /v2/{name}/blobs/{digest}":                 "Check blob existence",
+	"DELETE /v2/{name}/blobs/{digest}":               "Delete blob",
+	"GET /v2/{name}/manifests/{reference}":           "Get manifest, or the manifest of one platform of an index",
+	"HEAD /v2/{name}/manifests/{reference}":          "Check manifest existence",
+	"PUT /v2/{name}/manifests/{reference}":           "Put manifest",
+	"DELETE /v2/{name}/manifests/{reference}":        "Delete manifest",
+	"POST /v2/{name}/blobs/uploads/":                 "Start upload, upload a blob in one request or mount it from another repository",
+	"PUT /v2/{name}/blobs/uploads/{reference}":       "Upload chunk or complete upload",
+	"PATCH /v2/{name}/blobs/uploads/{reference}":     "Upload chunk or complete upload",
+	"GET /v2/{name}/blobs/uploads/{reference}":       "Get upload status, with its progress as JSON if asked for",
+	"DELETE /v2/{name}/blobs/uploads/{reference}":    "Cancel upload",
+	"GET /v2/{name}/tags/list":                       "List tags",
+	"GET /v2/{name}/referrers/{digest}":              "Get referrers",
+	"GET /v2/repositories":                           "List all repositories",
+	"GET /v2/tags":                                   "List all tags",
+	"GET /v2/layers":                                 "List all layers",
+	"GET /v2/manifests":                              "List all manifests",
+	"GET /v2/upload-sessions":                        "List upload sessions",
+	"GET /v2/stats":                                  "Get registry stats",
+	"GET /v2/images":                                 "Find images by platform and config labels",
+	"GET /v2/_search":                                "Search repositories, tags and labels",
+	"GET /v2/_spec":                                  "Get this API description",
+	"GET /metrics":                                   "Get S3 client, cache and endpoint metrics in the Prometheus format",
+	"GET /helm/index.yaml":                           "Get the chart repository index of top-level charts",
+	"HEAD /helm/index.yaml":                          "Check the chart repository index of top-level charts",
+	"GET /helm/{namespace}/index.yaml":               "Get the chart repository index of a namespace",
+	"HEAD /helm/{namespace}/index.yaml":              "Check the chart repository index of a namespace",
+	"GET /helm/charts/{file}":                        "Download a top-level chart archive",
+	"HEAD /helm/charts/{file}":                       "Check a top-level chart archive",
+	"GET /helm/{namespace}/charts/{file}":            "Download a chart archive",
+	"HEAD /helm/{namespace}/charts/{file}":           "Check a chart archive",
+	"GET /admin/events":                              "Stream registry events",
+	"POST /admin/copy":                               "Copy or retag an image",
+	"GET /admin/bootstrap":                           "Get bootstrap progress",
+	"GET /admin/maintenance":                         "Get maintenance mode",
+	"PUT /admin/maintenance":                         "Set maintenance mode",
+	"GET /admin/audit":                               "Query the audit log",
+	"POST /admin/audit/export":                       "Export the audit log",
+	"GET /admin/stats":                               "Get registry stats with per-repository breakdowns",
+	"GET /admin/stats/{name}":                        "Get repository stats",
+	"GET /admin/cache":                               "List cached tags",
+	"POST /admin/cache/resync":                       "Resync the database cache from S3",
+	"DELETE /admin/cache/{name}":                     "Evict a repository or tag from the database cache",
+	"DELETE /admin/repositories/{name}":              "Delete a repository",
+	"GET /admin/namespaces":                          "List namespaces",
+	"GET /admin/namespaces/{path}":                   "Get namespace settings",
+	"PUT /admin/namespaces/{path}":                   "Set namespace settings",
+	"DELETE /admin/namespaces/{path}":                "Delete namespace settings",
+	"GET /admin/settings/{name}":                     "Get the effective settings of a repository",
+	"POST /admin/retention":                          "Apply namespace retention and manifest expiry",
+	"GET /admin/popular":                             "Get the most pulled or pushed repositories and tags",
+	"GET /admin/signatures/{name}":                   "Get the notation signature verification status of a manifest",
+	"GET /admin/scans/{name}":                        "Get the vulnerability scan of a manifest",
+	"POST /admin/scans/{name}":                       "Rescan a manifest for vulnerabilities",
+	"GET /admin/layers/{digest}/usage":               "List the tags of images using a layer",
+	"GET /admin/dedup":                               "Report the storage saved by sharing layers",
+	"GET /admin/repositories/{name}/usage":           "Get the storage used by a repository",
+	"GET /admin/restores":                            "List restores of archived blobs",
+	"POST /admin/restores/{digest}":                  "Restore an archived blob",
+	"GET /admin/regions":                             "Get the health of this region and its peers",
+	"POST /admin/regions/events":                     "Receive a write made in another region",
+	"GET /admin/replica":                             "Tell whether this replica runs the background jobs",
+	"GET /admin/changes":                             "List the tags created, updated and deleted since a point in time",
+	"GET /admin/webhooks/deliveries":                 "List webhook deliveries, pending, delivered and failed",
+	"POST /admin/webhooks/deliveries/{id}/redeliver": "Queue the event of a webhook delivery again",
+}
+
+var routeVariable = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+type openAPIParameter struct {
+	Name     string            `json:"name"`
+	In       string            `json:"in"`
+	Required bool              `json:"required"`
+	Schema   map[string]string `json:"schema"`
+}
+
+type openAPIOperation struct {
+	OperationID string                    `json:"operationId"`
+	Summary     string                    `json:"summary,omitempty"`
+	Tags        []string                  `json:"tags"`
+	Parameters  []openAPIParameter        `json:"parameters,omitempty"`
+	Responses   map[string]map[string]any `json:"responses"`
+}
+
+// buildOpenAPI describes every route of the router as an OpenAPI 3 document.
+func buildOpenAPI(router *mux.Router) ([]byte, error) {
+	paths := make(map[string]map[string]*openAPIOperation)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouter prefixes have no methods.
+			return nil
+		}
+		path := routeVariable.ReplaceAllString(tpl, "{$1}")
+		var queries []string
+		if templates, err := route.GetQueriesTemplates(); err == nil {
+			for _, q := range templates {
+				name, _, _ := strings.Cut(q, "=")
+				queries = append(queries, name)
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = make(map[string]*openAPIOperation)
+		}
+		for _, method := range methods {
+			key := strings.ToLower(method)
+			op := paths[path][key]
+			if op == nil {
+				op = newOpenAPIOperation(method, path)
+				paths[path][key] = op
+			}
+			for _, q := range queries {
+				op.addParameter(q, "query", false)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk routes: %w", err)
+	}
+
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content": map[string]any{
+			"application/json": map[string]any{
+				"schema": map[string]string{"$ref": "#/components/schemas/ErrorResponse"},
+			},
+		},
+	}
+	for _, ops := range paths {
+		for _, op := range ops {
+			op.Responses["default"] = errorResponse
+		}
+	}
+
+	errorCodes := []string{
+		errCodeBlobUnknown, errCodeBlobUploadUnknown, errCodeDigestInvalid,
+		errCodeManifestInvalid, errCodeManifestUnknown, errCodeNameInvalid,
+		errCodeNameUnknown, errCodeUnauthorized, errCodeDenied,
+		errCodeUnsupported, errCodeUnavailable,
+	}
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "reg",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"ErrorResponse": map[string]any{
+					"type":     "object",
+					"required": []string{"errors"},
+					"properties": map[string]any{
+						"errors": map[string]any{
+							"type":  "array",
+							"items": map[string]string{"$ref": "#/components/schemas/Error"},
+						},
+					},
+				},
+				"Error": map[string]any{
+					"type":     "object",
+					"required": []string{"code", "message"},
+					"properties": map[string]any{
+						"code":    map[string]any{"type": "string", "enum": errorCodes},
+						"message": map[string]string{"type": "string"},
+						"detail":  map[string]string{},
+					},
+				},
+			},
+		},
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func newOpenAPIOperation(method string, path string) *openAPIOperation {
+	tag := "registry"
+	switch {
+	case strings.HasPrefix(path, "/admin/"):
+		tag = "admin"
+	case strings.HasPrefix(path, "/helm/"):
+		tag = "helm"
+	case !strings.Contains(path, "{name}") && path != "/v2/":
+		tag = "custom"
+	}
+	op := &openAPIOperation{
+		OperationID: operationID(method, path),
+		Summary:     operationSummaries[method+" "+path],
+		Tags:        []string{tag},
+		Responses: map[string]map[string]any{
+			"2XX": {"description": "Success"},
+		},
+	}
+	for _, m := range routeVariable.FindAllStringSubmatch(path, -1) {
+		op.addParameter(m[1], "path", true)
+	}
+	return op
+}
+
+func (op *openAPIOperation) addParameter(name string, in string, required bool) {
+	for _, p := range op.Parameters {
+		if p.Name == name && p.In == in {
+			return
+		}
+	}
+	op.Parameters = append(op.Parameters, openAPIParameter{
+		Name:     name,
+		In:       in,
+		Required: required,
+		Schema:   map[string]string{"type": "string"},
+	})
+	sort.SliceStable(op.Parameters, func(i, j int) bool {
+		return op.Parameters[i].In == "path" && op.Parameters[j].In != "path"
+	})
+}
+
+// operationID turns e.g. "GET /v2/{name}/tags/list" into "getNameTagsList".
+func operationID(method string, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	upper := true
+	for _, c := range path {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			if upper && c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			b.WriteRune(c)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	return b.String()
+}
+
+func (h *Handler) getSpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(h.spec)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(h.spec)
+}
@@ -0,0 +1,557 @@
+package reg
+
+import (
+	"io"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/psarna/reg/pkg/plugin"
+)
+
+type Option func(*Registry)
+
+// WithBucket sets the S3 bucket the registry stores everything in.
+func WithBucket(bucket string) Option {
+	return func(r *Registry) {
+		r.bucket = bucket
+	}
+}
+
+// WithCreateBucket creates the bucket if it does not exist, in the region of
+// the AWS configuration, with a lifecycle rule cleaning up abandoned uploads
+// and, if versioning is set, object versioning.
+func WithCreateBucket(versioning bool) Option {
+	return func(r *Registry) {
+		r.provisioning = &bucketProvisioning{versioning: versioning}
+	}
+}
+
+// WithBlobShards stores blobs in the given buckets, picked by digest, instead
+// of the primary bucket, which keeps everything else. The buckets must be
+// reachable with the same credentials and region.
+func WithBlobShards(buckets ...string) Option {
+	return func(r *Registry) {
+		r.blobShards = &blobShards{buckets: buckets}
+	}
+}
+
+// WithAWSConfig replaces the AWS configuration loaded from the environment,
+// with its credentials, region and S3 endpoint.
+func WithAWSConfig(cfg aws.Config) Option {
+	return func(r *Registry) {
+		r.customAWSConfig = &cfg
+	}
+}
+
+// WithDatabase sets the path of the SQLite database caching the bucket's
+// metadata, registry.db in the working directory by default.
+func WithDatabase(path string) Option {
+	return func(r *Registry) {
+		r.dbPath = path
+	}
+}
+
+// WithSharedDatabase keeps the metadata in a database on a libsql server,
+// e.g. libsql://reg.example.com?authToken=... or http://sqld:8080, in place
+// of the local SQLite file, so that any number of replicas serve the same
+// uploads and caches. One replica at a time, elected through a lease in the
+// database, runs the background jobs.
+func WithSharedDatabase(url string) Option {
+	return func(r *Registry) {
+		r.databaseURL = url
+	}
+}
+
+// WithPeriodicJobs cleans up uploads abandoned for a day and applies the
+// namespaces' retention at the given interval.
+func WithPeriodicJobs(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.jobs = &periodicJobs{interval: interval}
+	}
+}
+
+// WithRetentionDryRun has the periodic jobs only log the tags and manifests
+// retention would delete.
+func WithRetentionDryRun() Option {
+	return func(r *Registry) {
+		r.retentionDryRun = true
+	}
+}
+
+// WithBlobScrubbing verifies a random sample of blobs against their digests
+// at every interval, on one replica at a time, and reports corrupted blobs as
+// blob.corrupted events.
+func WithBlobScrubbing(cfg BlobScrubConfig) Option {
+	return func(r *Registry) {
+		r.scrubber = &blobScrubber{config: cfg, results: make(map[string]uint64)}
+	}
+}
+
+// WithTagExpiry expires tags pushed more than days ago in repositories whose
+// org or project sets no retention of its own. Tags of manifests annotated
+// with org.opencontainers.image.ref.keep=true are kept.
+func WithTagExpiry(days int) Option {
+	return func(r *Registry) {
+		r.tagExpiryDays = days
+	}
+}
+
+// WithCacheBus keeps replicas which share the bucket, but each have a
+// database of their own, from serving tags a sibling has since overwritten or
+// deleted: every write is broadcast to the others, which drop the tag from
+// their database and fetch it again from the bucket on the next request.
+func WithCacheBus(cfg CacheBusConfig) Option {
+	return func(r *Registry) {
+		r.cacheBus = &cfg
+	}
+}
+
+// WithTagLocks makes replicas which share the bucket, but not a database,
+// take a lock in the bucket before writing a tag, so that concurrent pushes of
+// the same tag cannot leave its links and database row pointing at different
+// manifests. Replicas sharing a database always lock tags through it.
+func WithTagLocks() Option {
+	return func(r *Registry) {
+		r.bucketTagLocks = true
+	}
+}
+
+// WithStorageLayout picks how repositories are laid out in the bucket. The
+// layout cannot change once the bucket holds images.
+func WithStorageLayout(layout StorageLayout) Option {
+	return func(r *Registry) {
+		r.layout = layout
+	}
+}
+
+// WithUploadParts makes chunks of blob uploads go to S3 in parts of partSize
+// bytes, at least 5MiB, of which concurrency are uploaded at once while the
+// next are read from the client. Each upload request buffers up to
+// concurrency+2 parts in memory.
+func WithUploadParts(partSize int64, concurrency int) Option {
+	return func(r *Registry) {
+		r.uploadPartSize = partSize
+		r.uploadPartConcurrency = concurrency
+	}
+}
+
+// WithLogger has the registry log to logger rather than the default slog
+// logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(r *Registry) {
+		r.logger = logger
+	}
+}
+
+func WithEventSink(sink EventSink) Option {
+	return func(r *Registry) {
+		r.events.addSink(sink)
+	}
+}
+
+// WithWebhookFormat sets the payload format of webhooks added with
+// WithWebhook.
+func WithWebhookFormat(format WebhookFormat) Option {
+	return func(r *Registry) {
+		r.webhookFormat = format
+	}
+}
+
+// WithEventFilter narrows the events sent to the sinks named sink, like
+// "webhook https://ci.example.com/hook", or to all sinks of a kind, like
+// "nats". A sink covered by several filters receives the events matching any.
+func WithEventFilter(sink string, filter EventFilter) Option {
+	return func(r *Registry) {
+		r.events.addFilter(sink, filter)
+	}
+}
+
+// WithWebhook posts events to url, through a delivery queue kept in the
+// database. Failed deliveries are retried up to maxRetries times with
+// exponential backoff.
+func WithWebhook(url string, timeout time.Duration, maxRetries int) Option {
+	return func(r *Registry) {
+		r.addWebhook(NewWebhookSink(url, timeout, maxRetries))
+	}
+}
+
+// The AWS sinks reuse the configuration loaded for S3, so they pick up the
+// same credentials and region.
+func WithSNSTopic(topicARN string) Option {
+	return func(r *Registry) {
+		r.snsTopics = append(r.snsTopics, topicARN)
+	}
+}
+
+func WithSQSQueue(queueURL string) Option {
+	return func(r *Registry) {
+		r.sqsQueues = append(r.sqsQueues, queueURL)
+	}
+}
+
+func WithPullThroughCache(prefix string, upstream *url.URL) Option {
+	return func(r *Registry) {
+		r.proxies = append(r.proxies, newPullThroughCache(prefix, upstream))
+	}
+}
+
+// WithProxyTagTTL sets how long tags of pull-through caches are served from
+// the cache before upstream is asked whether they moved. Zero never asks.
+func WithProxyTagTTL(ttl time.Duration) Option {
+	return func(r *Registry) {
+		r.proxyTagTTL = ttl
+	}
+}
+
+func WithReplicationTarget(target *url.URL) Option {
+	return func(r *Registry) {
+		r.addReplicationTarget(target)
+	}
+}
+
+func WithPresignExpiry(expiry time.Duration) Option {
+	return func(r *Registry) {
+		r.presignExpiry = expiry
+	}
+}
+
+// WithRedirectStatus sets the status used to redirect blob requests to S3,
+// typically 302 or 307.
+func WithRedirectStatus(status int) Option {
+	return func(r *Registry) {
+		r.redirectStatus = status
+	}
+}
+
+// WithHeadRedirect makes HEAD blob requests redirect to S3 like GETs do,
+// instead of being answered locally from known blob metadata.
+func WithHeadRedirect(redirect bool) Option {
+	return func(r *Registry) {
+		r.redirectHead = redirect
+	}
+}
+
+// WithPublicURL sets the external URL of the registry, used for Location and
+// Link headers instead of the scheme and host of incoming requests.
+func WithPublicURL(publicURL *url.URL) Option {
+	return func(r *Registry) {
+		r.publicURL = publicURL
+	}
+}
+
+// WithTrustedProxies believes the X-Forwarded-Proto and X-Forwarded-Host
+// headers of requests coming from the given networks, which should be those of
+// the proxies in front of the registry. The headers of other clients are
+// ignored, so that they cannot make the registry point elsewhere.
+func WithTrustedProxies(networks []netip.Prefix) Option {
+	return func(r *Registry) {
+		r.trustedProxies = networks
+	}
+}
+
+// WithCompressionMinSize sets the size from which JSON responses are gzip or
+// deflate compressed, zero disables compression.
+func WithCompressionMinSize(size int) Option {
+	return func(r *Registry) {
+		r.compressMinSize = size
+	}
+}
+
+// WithManifestCacheControl sets the Cache-Control header of manifests fetched
+// by digest, which never change, and by tag, which can move at any time.
+func WithManifestCacheControl(byDigest string, byTag string) Option {
+	return func(r *Registry) {
+		r.digestCacheControl = byDigest
+		r.tagCacheControl = byTag
+	}
+}
+
+// WithLongRequestTimeout bounds blob uploads and downloads and event streams,
+// which are exempt from the server's read and write timeouts. Zero leaves
+// them unbounded.
+func WithLongRequestTimeout(timeout time.Duration) Option {
+	return func(r *Registry) {
+		r.longRequestTimeout = timeout
+	}
+}
+
+// WithPushPolicy submits every manifest push to an admission policy. When
+// failOpen is set, pushes go through if the policy cannot be evaluated.
+func WithPushPolicy(policy PushPolicy, failOpen bool) Option {
+	return func(r *Registry) {
+		r.pushPolicy = policy
+		r.policyFailOpen = failOpen
+	}
+}
+
+// WithAuditWriter mirrors audit entries as JSON lines to w, in addition to
+// the audit table in the database.
+func WithAuditWriter(w io.Writer) Option {
+	return func(r *Registry) {
+		r.auditLog.out = w
+	}
+}
+
+// WithAuditExport uploads new audit entries to the bucket under audit/ at the
+// given interval.
+func WithAuditExport(interval time.Duration) Option {
+	return func(r *Registry) {
+		r.auditLog.exportInterval = interval
+	}
+}
+
+// WithHtpasswd requires every registry request to authenticate with one of
+// the given credentials, except pulls allowed by WithAnonymousPull.
+func WithHtpasswd(htpasswd *Htpasswd) Option {
+	return func(r *Registry) {
+		r.htpasswd = htpasswd
+		r.auth = r.htpasswdAuth
+	}
+}
+
+// WithAnonymousPull lets unauthenticated clients pull from repositories
+// matching any of the patterns, while pushes still need credentials.
+func WithAnonymousPull(patterns ...string) Option {
+	return func(r *Registry) {
+		for _, pattern := range patterns {
+			r.anonymousPull = append(r.anonymousPull, parseRepoPattern(pattern))
+		}
+	}
+}
+
+// WithAdmins restricts the admin API to the given authenticated actors. By
+// default every authenticated actor may use it.
+func WithAdmins(actors ...string) Option {
+	return func(r *Registry) {
+		r.admins = append(r.admins, actors...)
+	}
+}
+
+// WithReferrersFallbackTags keeps the "<alg>-<digest>" tags of the referrers
+// tag schema up to date when manifests with a subject are pushed or deleted,
+// for clients which do not use the referrers API.
+func WithReferrersFallbackTags(enabled bool) Option {
+	return func(r *Registry) {
+		r.referrersFallbackTags = enabled
+	}
+}
+
+// WithCascadeReferrers deletes the signatures, SBOMs and other manifests
+// referring to a manifest when it is deleted by digest.
+func WithCascadeReferrers(enabled bool) Option {
+	return func(r *Registry) {
+		r.cascadeReferrers = enabled
+	}
+}
+
+// WithSignatureVerifier requires trusted cosign signatures on tag pushes to,
+// or pulls from, the repositories its policies protect.
+func WithSignatureVerifier(verifier *SignatureVerifier) Option {
+	return func(r *Registry) {
+		r.signatures = verifier
+	}
+}
+
+// WithNotationVerifier requires notation signatures trusted by its trust
+// policy on tag pushes to the repositories the policy covers.
+func WithNotationVerifier(verifier *NotationVerifier) Option {
+	return func(r *Registry) {
+		r.notation = verifier
+	}
+}
+
+// WithScanner submits pushed manifests to a vulnerability scanner. A scan
+// fails if it finds a vulnerability of one of the failOn severities.
+func WithScanner(scanner Scanner, failOn ...string) Option {
+	return func(r *Registry) {
+		q := &scanQueue{
+			registry: r,
+			scanner:  scanner,
+			wake:     make(chan struct{}, 1),
+		}
+		for _, severity := range failOn {
+			q.failOn = append(q.failOn, strings.ToUpper(severity))
+		}
+		r.scans = q
+	}
+}
+
+// WithQuarantine denies pulls of manifests in repositories matching the
+// patterns until their vulnerability scan passes. Pulls by actor, which the
+// scanner authenticates as, are exempt once the authenticator verified it.
+func WithQuarantine(actor string, patterns ...string) Option {
+	return func(r *Registry) {
+		r.scanActor = actor
+		for _, pattern := range patterns {
+			r.quarantine = append(r.quarantine, parseRepoPattern(pattern))
+		}
+	}
+}
+
+// WithHelmRepository serves the helm charts of each namespace as a classic
+// chart repository under /helm/<namespace>/index.yaml.
+func WithHelmRepository(enabled bool) Option {
+	return func(r *Registry) {
+		r.helmRepository = enabled
+	}
+}
+
+// WithArchiveRestore restores blobs which S3 lifecycle rules moved to an
+// archive storage class when they are pulled, for days, with the given
+// retrieval tier: Expedited, Standard or Bulk. Pulls fail with 503 until the
+// restored copy is readable.
+func WithArchiveRestore(days int, tier string) Option {
+	return func(r *Registry) {
+		r.archiveRestore = &archiveRestore{days: int32(days), tier: types.Tier(tier)}
+	}
+}
+
+// WithS3Policy sets how requests to S3 are retried and timed out.
+func WithS3Policy(policy S3Policy) Option {
+	return func(r *Registry) {
+		r.s3Policy = &policy
+	}
+}
+
+// WithS3CircuitBreaker stops sending requests to S3 for cooldown after
+// threshold consecutive failures. Requests needing S3 meanwhile fail fast with
+// 503, while those served from the database keep working.
+func WithS3CircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(r *Registry) {
+		r.s3Breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	}
+}
+
+// WithAdaptiveS3Concurrency bounds the requests in flight to S3 to at most
+// maxInFlight, lowering the bound while S3 answers with SlowDown. Bootstrap
+// then runs up to maxInFlight workers instead of four per CPU.
+func WithAdaptiveS3Concurrency(maxInFlight int) Option {
+	return func(r *Registry) {
+		r.s3Limiter = newAdaptiveLimiter(maxInFlight)
+	}
+}
+
+// WithFallbackBucket reads blobs and links from a replica of the bucket, in
+// region or the default one if empty, while the primary bucket fails, and
+// redirects pulls to it.
+func WithFallbackBucket(bucket string, region string) Option {
+	return func(r *Registry) {
+		r.fallback = &fallbackBucket{bucket: bucket, region: region}
+	}
+}
+
+// WithRegion runs the registry as one region of an active/active deployment,
+// against a bucket replicated with the buckets of its peers.
+func WithRegion(name string, conflictPolicy TagConflictPolicy) Option {
+	return func(r *Registry) {
+		rs := r.regionSet()
+		rs.name = name
+		rs.conflictPolicy = conflictPolicy
+	}
+}
+
+// WithPeerRegion adds another region of the deployment, reachable at
+// baseURL, which is told about tag writes and downloads are redirected to.
+func WithPeerRegion(name string, baseURL *url.URL) Option {
+	return func(r *Registry) {
+		rs := r.regionSet()
+		rs.peers = append(rs.peers, &peerRegion{name: name, url: baseURL})
+	}
+}
+
+// WithS3TransferEndpoints sends upload parts and presigned downloads through
+// the Transfer Acceleration endpoint, which the bucket must have enabled,
+// and/or the dual-stack endpoints, which also serve clients over IPv6.
+func WithS3TransferEndpoints(accelerate bool, dualStack bool) Option {
+	return func(r *Registry) {
+		r.s3Accelerate = accelerate
+		r.s3DualStack = dualStack
+	}
+}
+
+// WithStorageTimeouts bounds the storage calls of the registry by class.
+func WithStorageTimeouts(timeouts StorageTimeouts) Option {
+	return func(r *Registry) {
+		r.storageTimeouts = timeouts
+	}
+}
+
+// WithStoragePlugin keeps the registry's objects in a storage plugin instead
+// of the bucket, which then only names the registry's storage to the plugin.
+// Blobs are streamed through the registry rather than redirected to.
+func WithStoragePlugin(storage plugin.Storage) Option {
+	return func(r *Registry) {
+		r.storagePlugin = &storagePlugin{storage: storage}
+	}
+}
+
+// WithAuthPlugin authenticates registry requests with an auth plugin, in
+// place of WithHtpasswd.
+func WithAuthPlugin(auth plugin.Auth) Option {
+	return func(r *Registry) {
+		r.auth = pluginAuth(auth)
+	}
+}
+
+// WithHooks registers hooks called around registry operations, after those
+// registered earlier. An Auth hook replaces the authentication set by earlier
+// options, WithHtpasswd included.
+func WithHooks(hooks Hooks) Option {
+	return func(r *Registry) {
+		if hooks.Auth != nil {
+			r.auth = hooks.Auth
+		}
+		r.hooks = append(r.hooks, hooks)
+	}
+}
+
+func WithImmutableTags(patterns ...string) Option {
+	return func(r *Registry) {
+		for _, pattern := range patterns {
+			r.immutableTags = append(r.immutableTags, parseRepoTagPattern(pattern))
+		}
+	}
+}
+
+// WithAllowedMediaTypes only lets manifests of the given types be pushed to
+// the repositories the rules name, as "<repo-glob>=<type-glob>". A manifest's
+// type is its artifact type, or its media type if it has none.
+func WithAllowedMediaTypes(rules ...string) Option {
+	return func(r *Registry) {
+		for _, rule := range rules {
+			r.allowedMediaTypes = append(r.allowedMediaTypes, parseMediaTypeRule(rule))
+		}
+	}
+}
+
+// WithDeniedMediaTypes keeps manifests of the given types out of the
+// repositories the rules name, whatever WithAllowedMediaTypes allows.
+func WithDeniedMediaTypes(rules ...string) Option {
+	return func(r *Registry) {
+		for _, rule := range rules {
+			r.deniedMediaTypes = append(r.deniedMediaTypes, parseMediaTypeRule(rule))
+		}
+	}
+}
+
+// WithGCGracePeriod keeps blobs pushed or referred to by a push within the
+// period from being collected, as the manifest of their image may still be on
+// its way. It defaults to an hour.
+func WithGCGracePeriod(period time.Duration) Option {
+	return func(r *Registry) {
+		r.gcGracePeriod = period
+	}
+}
+
+// WithForeignLayerPolicy sets how manifests with foreign layers, whose blobs
+// are pulled from their URLs rather than the bucket, are pushed.
+func WithForeignLayerPolicy(policy ForeignLayerPolicy) Option {
+	return func(r *Registry) {
+		r.foreignLayers = policy
+	}
+}
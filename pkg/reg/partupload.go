@@ -0,0 +1,142 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// Smallest size S3 accepts for every part but the last. Part numbers are
+	// derived from the offset in units of it, so parts of at least this size
+	// never share a number.
+	minPartSize = 5 * 1024 * 1024
+
+	defaultUploadPartSize        = 64 * 1024 * 1024
+	defaultUploadPartConcurrency = 4
+)
+
+// partNumber returns the number of the part starting at offset.
+func partNumber(offset int64) int32 {
+	return int32(offset/minPartSize) + 1
+}
+
+// partBuffers holds the buffers parts are read into, which readPart grows up
+// to the part size as data arrives, so that small chunks do not allocate whole
+// parts.
+var partBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// readPart reads up to size bytes of body into buf, reporting io.EOF only
+// once body ends.
+func readPart(body io.Reader, buf []byte, size int64) ([]byte, error) {
+	buf = buf[:0]
+	for int64(len(buf)) < size {
+		if len(buf) == cap(buf) {
+			grown := make([]byte, len(buf), min(max(2*int64(cap(buf)), 64*1024), size))
+			copy(grown, buf)
+			buf = grown
+		}
+		n, err := body.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// uploadParts uploads body, starting at offset, as parts of uploadPartSize
+// bytes. Once the chunk turns out to span several parts, up to
+// uploadPartConcurrency of them are uploaded at a time while the next ones are
+// read from the client. A remainder smaller than minPartSize goes into the
+// last part, so that the chunk may be followed by others. It returns how many
+// bytes were uploaded in how many parts.
+func (r *Registry) uploadParts(ctx context.Context, s3Key string, s3UploadID string, offset int64, body io.Reader) (int64, int, error) {
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(r.uploadPartConcurrency)
+	parts := 0
+	uploadPart := func(ctx context.Context, partOffset int64, data *[]byte) error {
+		defer partBuffers.Put(data)
+		number := partNumber(partOffset)
+		// The part was read from the client already, only its upload to S3
+		// is bounded.
+		uploadCtx, cancel := r.uploadContext(ctx)
+		defer cancel()
+		_, err := r.s3Client.UploadPart(uploadCtx, &s3.UploadPartInput{
+			Bucket:     &r.bucket,
+			Key:        &s3Key,
+			PartNumber: &number,
+			UploadId:   &s3UploadID,
+			Body:       bytes.NewReader(*data),
+		}, forcePathStyle, r.transferEndpoint)
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", number, err)
+		}
+		return nil
+	}
+
+	var pending *[]byte
+	pendingOffset := offset
+	var n int64
+	for {
+		part := partBuffers.Get().(*[]byte)
+		var err error
+		*part, err = readPart(body, *part, r.uploadPartSize)
+		read := int64(len(*part))
+		n += read
+		eof := errors.Is(err, io.EOF)
+		if err != nil && !eof {
+			partBuffers.Put(part)
+			if pending != nil {
+				partBuffers.Put(pending)
+			}
+			g.Wait()
+			return 0, 0, fmt.Errorf("failed to read request body: %w", err)
+		}
+		if eof && pending != nil && read < minPartSize {
+			*pending = append(*pending, *part...)
+			partBuffers.Put(part)
+			part = nil
+		}
+		if pending != nil {
+			parts++
+			partOffset, data := pendingOffset, pending
+			g.Go(func() error { return uploadPart(gctx, partOffset, data) })
+			pendingOffset += int64(len(*data))
+		}
+		pending = part
+		if eof {
+			break
+		}
+		if gctx.Err() != nil {
+			// A part failed, which Wait reports.
+			partBuffers.Put(pending)
+			pending = nil
+			break
+		}
+	}
+	// The last part, which is the only one of chunks up to a part long, is
+	// uploaded without a goroutine of its own. An empty chunk makes a part
+	// only at the start of the upload, so that an empty blob has one, as a
+	// part at any other offset would replace the part ending there.
+	var err error
+	if pending != nil && (len(*pending) > 0 || offset == 0) {
+		parts++
+		err = uploadPart(gctx, pendingOffset, pending)
+	} else if pending != nil {
+		partBuffers.Put(pending)
+	}
+	if waitErr := g.Wait(); waitErr != nil {
+		return 0, 0, waitErr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, parts, nil
+}
@@ -0,0 +1,82 @@
+package reg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	repositoriesPrefix = "docker/registry/v2/repositories/"
+	blobsPrefix        = "docker/registry/v2/blobs/"
+)
+
+func isDigest(reference string) bool {
+	_, err := digest.Parse(reference)
+	return err == nil
+}
+
+func blobKey(dgst digest.Digest) string {
+	hex := dgst.Encoded()
+	return fmt.Sprintf("%s%s/%s/%s/data", blobsPrefix, dgst.Algorithm(), hex[0:2], hex)
+}
+
+func digestFromBlobKey(key string) (digest.Digest, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, blobsPrefix), "/")
+	if len(parts) != 4 || parts[3] != "data" {
+		return "", false
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[0]), parts[2])
+	return dgst, dgst.Validate() == nil
+}
+
+func tagsPrefix(repo string) string {
+	return fmt.Sprintf("%s%s/_manifests/tags/", repositoriesPrefix, repo)
+}
+
+func tagPrefix(repo string, tag string) string {
+	return fmt.Sprintf("%s%s/", tagsPrefix(repo), tag)
+}
+
+func tagCurrentLinkKey(repo string, tag string) string {
+	return tagPrefix(repo, tag) + "current/link"
+}
+
+func tagIndexLinkKey(repo string, tag string, dgst digest.Digest) string {
+	return fmt.Sprintf("%sindex/%s/%s/link", tagPrefix(repo, tag), dgst.Algorithm(), dgst.Encoded())
+}
+
+func revisionLinkKey(repo string, dgst digest.Digest) string {
+	return fmt.Sprintf("%s%s/_manifests/revisions/%s/%s/link", repositoriesPrefix, repo, dgst.Algorithm(), dgst.Encoded())
+}
+
+func layerLinkKey(repo string, dgst digest.Digest) string {
+	return fmt.Sprintf("%s%s/_layers/%s/%s/link", repositoriesPrefix, repo, dgst.Algorithm(), dgst.Encoded())
+}
+
+func ociLayoutKey(repo string) string {
+	return repo + "/" + v1.ImageLayoutFile
+}
+
+func ociIndexKey(repo string) string {
+	return repo + "/" + v1.ImageIndexFile
+}
+
+func ociBlobsPrefix(repo string) string {
+	return repo + "/" + v1.ImageBlobsDir + "/"
+}
+
+func ociBlobKey(repo string, dgst digest.Digest) string {
+	return repo + "/" + ociBlobPath(dgst)
+}
+
+// layoutBlobKey is where the blob of a repository is stored, which only
+// depends on the repository in the OCI layout.
+func (r *Registry) layoutBlobKey(repo string, dgst digest.Digest) string {
+	if r.layout == LayoutOCI {
+		return ociBlobKey(repo, dgst)
+	}
+	return blobKey(dgst)
+}
@@ -0,0 +1,98 @@
+package reg
+
+import (
+	"path"
+	"strings"
+)
+
+// Patterns are written as "<repo-glob>:<tag-glob>", or just "<tag-glob>" to
+// apply to every repository. Globs follow path.Match, so "*" does not cross "/".
+type repoTagPattern struct {
+	repo string
+	tag  string
+}
+
+func parseRepoTagPattern(pattern string) repoTagPattern {
+	repo, tag, found := strings.Cut(pattern, ":")
+	if !found {
+		return repoTagPattern{tag: pattern}
+	}
+	return repoTagPattern{repo: repo, tag: tag}
+}
+
+// Unlike parseRepoTagPattern, a bare pattern here selects repositories.
+func parseRepoPattern(pattern string) repoTagPattern {
+	repo, tag, found := strings.Cut(pattern, ":")
+	if !found {
+		return repoTagPattern{repo: pattern, tag: "*"}
+	}
+	return repoTagPattern{repo: repo, tag: tag}
+}
+
+func (p repoTagPattern) matchesRepo(repo string) bool {
+	if p.repo == "" {
+		return true
+	}
+	ok, _ := path.Match(p.repo, repo)
+	return ok
+}
+
+func (p repoTagPattern) matches(repo string, tag string) bool {
+	if !p.matchesRepo(repo) {
+		return false
+	}
+	ok, _ := path.Match(p.tag, tag)
+	return ok
+}
+
+// repoFilter selects repositories and tags by include and exclude patterns
+// parsed with parseRepoPattern. Exclusions win, and no includes selects all.
+type repoFilter struct {
+	include []repoTagPattern
+	exclude []repoTagPattern
+}
+
+func newRepoFilter(include []string, exclude []string) repoFilter {
+	var f repoFilter
+	for _, pattern := range include {
+		f.include = append(f.include, parseRepoPattern(pattern))
+	}
+	for _, pattern := range exclude {
+		f.exclude = append(f.exclude, parseRepoPattern(pattern))
+	}
+	return f
+}
+
+func (f repoFilter) repoSelected(repo string) bool {
+	for _, p := range f.exclude {
+		if p.tag == "*" && p.matchesRepo(repo) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if p.matchesRepo(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f repoFilter) tagSelected(repo string, tag string) bool {
+	for _, p := range f.exclude {
+		if p.matches(repo, tag) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if p.matches(repo, tag) {
+			return true
+		}
+	}
+	return false
+}
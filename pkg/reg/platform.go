@@ -0,0 +1,164 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var ErrPlatformNotFound = errors.New("no manifest for platform")
+
+// parsePlatform parses "os/architecture[/variant]", e.g. "linux/arm64/v8".
+func parsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", s)
+	}
+	platform := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// platformMatches tells whether have satisfies want, which matches any
+// variant when it names none. arm64 without a variant is arm64/v8.
+func platformMatches(want v1.Platform, have v1.Platform) bool {
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return false
+	}
+	if want.Variant == "" {
+		return true
+	}
+	variant := have.Variant
+	if variant == "" && have.Architecture == "arm64" {
+		variant = "v8"
+	}
+	return want.Variant == variant
+}
+
+// indexChildren records the manifests listed by a pushed index.
+func (r *Registry) indexChildren(name string, manifestBytes []byte) error {
+	m, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	if !m.isIndex() || len(m.Manifests) == 0 {
+		return nil
+	}
+	return r.db.PutIndexChildren(name, digest.FromBytes(manifestBytes).String(), m.Manifests)
+}
+
+// ResolvePlatform returns the manifest of reference for a platform: the
+// matching child of an index, or the manifest itself if its config is of
+// that platform.
+func (r *Registry) ResolvePlatform(ctx context.Context, name string, reference string, platform v1.Platform) (digest.Digest, []byte, error) {
+	return r.resolvePlatform(ctx, name, reference, platform, 0)
+}
+
+func (r *Registry) resolvePlatform(ctx context.Context, name string, reference string, platform v1.Platform, depth int) (digest.Digest, []byte, error) {
+	// Nested indexes are followed, within reason.
+	if depth > 4 {
+		return "", nil, ErrPlatformNotFound
+	}
+
+	// Indexes known to the database need not be fetched to pick a child.
+	var children []v1.Descriptor
+	if isDigest(reference) {
+		known, err := r.db.IndexChildren(name, reference)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, child := range known {
+			children = append(children, child.descriptor())
+		}
+	}
+	if children == nil {
+		_, manifestBytes, err := r.getManifest(ctx, name, reference)
+		if err != nil {
+			return "", nil, err
+		}
+		m, err := parseAnyManifest(manifestBytes)
+		if err != nil {
+			return "", nil, err
+		}
+		if !m.isIndex() {
+			if m.Config == nil || !isImageConfig(m.Config.MediaType) {
+				return "", nil, ErrPlatformNotFound
+			}
+			config, err := r.imageConfig(ctx, name, m.Config.Digest)
+			if err != nil {
+				return "", nil, err
+			}
+			have := v1.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+			if !platformMatches(platform, have) {
+				return "", nil, ErrPlatformNotFound
+			}
+			return digest.FromBytes(manifestBytes), manifestBytes, nil
+		}
+		children = m.Manifests
+	}
+
+	for _, child := range children {
+		if child.Platform == nil || !platformMatches(platform, *child.Platform) {
+			continue
+		}
+		if child.MediaType == v1.MediaTypeImageIndex || child.MediaType == mediaTypeDockerManifestList {
+			return r.resolvePlatform(ctx, name, child.Digest.String(), platform, depth+1)
+		}
+		_, manifestBytes, err := r.getManifest(ctx, name, child.Digest.String())
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to get manifest %s: %w", child.Digest, err)
+		}
+		return child.Digest, manifestBytes, nil
+	}
+	return "", nil, ErrPlatformNotFound
+}
+
+func (h *Handler) getManifestForPlatform(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	reference := vars["reference"]
+
+	platform, err := parsePlatform(vars["platform"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, manifestBytes, err := h.registry.ResolvePlatform(r.Context(), name, reference, platform)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("manifest not found: %v", err), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrPlatformNotFound) {
+			writeError(w, http.StatusNotFound, errCodeManifestUnknown, fmt.Sprintf("%s:%s has no manifest for %s", name, reference, vars["platform"]))
+			return
+		}
+		h.registry.logger.Error("error resolving platform", "error", err)
+		http.Error(w, fmt.Sprintf("error resolving platform: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.registry.checkPull(r.Context(), name, reference, manifestBytes); err != nil {
+		if errors.Is(err, ErrSignatureRequired) || errors.Is(err, ErrQuarantined) {
+			writeError(w, http.StatusForbidden, errCodeDenied, err.Error())
+			return
+		}
+		h.registry.logger.Error("error checking pull", "error", err)
+		http.Error(w, fmt.Sprintf("error checking pull: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodGet {
+		h.registry.recordPull(name, reference)
+	}
+	h.writeManifest(w, r, reference, manifestBytes)
+}
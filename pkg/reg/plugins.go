@@ -0,0 +1,262 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/psarna/reg/pkg/plugin"
+)
+
+// storagePlugin serves the S3 operations of the registry from a storage
+// plugin instead of a bucket. It answers them in the initialize step, before
+// anything is signed or sent, so the rest of the registry is unaware of it.
+// Presigning is not possible, so blobs are streamed through the registry.
+type storagePlugin struct {
+	storage plugin.Storage
+}
+
+func (p *storagePlugin) addMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("StoragePlugin", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		result, err := p.handle(ctx, in.Parameters)
+		if err != nil {
+			return middleware.InitializeOutput{}, middleware.Metadata{}, p.translateError(in.Parameters, err)
+		}
+		return middleware.InitializeOutput{Result: result}, middleware.Metadata{}, nil
+	}), middleware.After)
+}
+
+func (p *storagePlugin) handle(ctx context.Context, params any) (any, error) {
+	s := p.storage
+	switch in := params.(type) {
+	case *s3.HeadBucketInput:
+		return &s3.HeadBucketOutput{}, s.Ping(ctx)
+	case *s3.HeadObjectInput:
+		obj, err := s.Stat(ctx, aws.ToString(in.Key))
+		if err != nil {
+			return nil, err
+		}
+		return &s3.HeadObjectOutput{ContentLength: &obj.Size, ETag: aws.String(obj.ETag), LastModified: &obj.LastModified}, nil
+	case *s3.GetObjectInput:
+		body, obj, err := s.Get(ctx, aws.ToString(in.Key))
+		if err != nil {
+			return nil, err
+		}
+		out := &s3.GetObjectOutput{Body: body, ContentLength: &obj.Size, ETag: aws.String(obj.ETag), LastModified: &obj.LastModified}
+		if in.Range != nil {
+			if err := sliceObject(out, aws.ToString(in.Range), obj.Size); err != nil {
+				body.Close()
+				return nil, err
+			}
+		}
+		return out, nil
+	case *s3.PutObjectInput:
+		obj, err := s.Put(ctx, aws.ToString(in.Key), in.Body, aws.ToString(in.IfMatch))
+		if err != nil {
+			return nil, err
+		}
+		return &s3.PutObjectOutput{ETag: aws.String(obj.ETag)}, nil
+	case *s3.DeleteObjectInput:
+		return &s3.DeleteObjectOutput{}, s.Delete(ctx, aws.ToString(in.Key))
+	case *s3.DeleteObjectsInput:
+		var keys []string
+		for _, obj := range in.Delete.Objects {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+		return &s3.DeleteObjectsOutput{}, s.Delete(ctx, keys...)
+	case *s3.ListObjectsV2Input:
+		result, err := s.List(ctx, aws.ToString(in.Prefix), aws.ToString(in.Delimiter), aws.ToString(in.ContinuationToken))
+		if err != nil {
+			return nil, err
+		}
+		out := &s3.ListObjectsV2Output{
+			IsTruncated: aws.Bool(result.NextToken != ""),
+			KeyCount:    aws.Int32(int32(len(result.Objects) + len(result.Prefixes))),
+		}
+		if result.NextToken != "" {
+			out.NextContinuationToken = aws.String(result.NextToken)
+		}
+		for _, obj := range result.Objects {
+			out.Contents = append(out.Contents, types.Object{
+				Key:          aws.String(obj.Key),
+				Size:         aws.Int64(obj.Size),
+				ETag:         aws.String(obj.ETag),
+				LastModified: aws.Time(obj.LastModified),
+			})
+		}
+		for _, prefix := range result.Prefixes {
+			out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(prefix)})
+		}
+		return out, nil
+	case *s3.CopyObjectInput:
+		// The source is addressed as bucket/key.
+		_, src, _ := strings.Cut(aws.ToString(in.CopySource), "/")
+		obj, err := s.Copy(ctx, src, aws.ToString(in.Key))
+		if err != nil {
+			return nil, err
+		}
+		return &s3.CopyObjectOutput{CopyObjectResult: &types.CopyObjectResult{ETag: aws.String(obj.ETag)}}, nil
+	case *s3.CreateMultipartUploadInput:
+		uploadID, err := s.CreateUpload(ctx, aws.ToString(in.Key))
+		if err != nil {
+			return nil, err
+		}
+		return &s3.CreateMultipartUploadOutput{Key: in.Key, UploadId: aws.String(uploadID)}, nil
+	case *s3.UploadPartInput:
+		etag, err := s.UploadPart(ctx, aws.ToString(in.Key), aws.ToString(in.UploadId), aws.ToInt32(in.PartNumber), in.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &s3.UploadPartOutput{ETag: aws.String(etag)}, nil
+	case *s3.ListPartsInput:
+		parts, err := s.ListParts(ctx, aws.ToString(in.Key), aws.ToString(in.UploadId))
+		if err != nil {
+			return nil, err
+		}
+		out := &s3.ListPartsOutput{IsTruncated: aws.Bool(false)}
+		for _, part := range parts {
+			out.Parts = append(out.Parts, types.Part{
+				PartNumber: aws.Int32(part.Number),
+				ETag:       aws.String(part.ETag),
+				Size:       aws.Int64(part.Size),
+			})
+		}
+		return out, nil
+	case *s3.CompleteMultipartUploadInput:
+		var parts []plugin.Part
+		if in.MultipartUpload != nil {
+			for _, part := range in.MultipartUpload.Parts {
+				parts = append(parts, plugin.Part{Number: aws.ToInt32(part.PartNumber), ETag: aws.ToString(part.ETag)})
+			}
+		}
+		obj, err := s.CompleteUpload(ctx, aws.ToString(in.Key), aws.ToString(in.UploadId), parts)
+		if err != nil {
+			return nil, err
+		}
+		return &s3.CompleteMultipartUploadOutput{Key: in.Key, ETag: aws.String(obj.ETag)}, nil
+	case *s3.AbortMultipartUploadInput:
+		return &s3.AbortMultipartUploadOutput{}, s.AbortUpload(ctx, aws.ToString(in.Key), aws.ToString(in.UploadId))
+	}
+	return nil, fmt.Errorf("storage plugins do not support %s", middleware.GetOperationName(ctx))
+}
+
+// sliceObject narrows the body of a GetObject output down to a byte range,
+// "bytes=start-" or "bytes=start-end". Plugins have no ranged reads, so the
+// bytes before the range are read and thrown away.
+func sliceObject(out *s3.GetObjectOutput, byteRange string, size int64) error {
+	start, end, found := strings.Cut(strings.TrimPrefix(byteRange, "bytes="), "-")
+	first, err := strconv.ParseInt(start, 10, 64)
+	if !found || err != nil || first < 0 || first >= size {
+		return &smithy.GenericAPIError{Code: "InvalidRange", Message: fmt.Sprintf("invalid range %q of object of %d bytes", byteRange, size)}
+	}
+	last := size - 1
+	if end != "" {
+		if last, err = strconv.ParseInt(end, 10, 64); err != nil || last < first {
+			return &smithy.GenericAPIError{Code: "InvalidRange", Message: fmt.Sprintf("invalid range %q", byteRange)}
+		}
+		last = min(last, size-1)
+	}
+	if _, err := io.CopyN(io.Discard, out.Body, first); err != nil {
+		return fmt.Errorf("failed to skip to range: %w", err)
+	}
+	out.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(out.Body, last-first+1), out.Body}
+	out.ContentLength = aws.Int64(last - first + 1)
+	out.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+	return nil
+}
+
+// translateError turns the plugin's errors into the S3 errors the registry
+// checks for.
+func (p *storagePlugin) translateError(params any, err error) error {
+	switch {
+	case errors.Is(err, plugin.ErrNotFound):
+		switch params.(type) {
+		case *s3.HeadObjectInput:
+			return &types.NotFound{Message: aws.String(err.Error())}
+		case *s3.UploadPartInput, *s3.ListPartsInput, *s3.CompleteMultipartUploadInput, *s3.AbortMultipartUploadInput:
+			return &types.NoSuchUpload{Message: aws.String(err.Error())}
+		}
+		return &types.NoSuchKey{Message: aws.String(err.Error())}
+	case errors.Is(err, plugin.ErrPreconditionFailed):
+		return &smithy.GenericAPIError{Code: "PreconditionFailed", Message: err.Error()}
+	}
+	return err
+}
+
+// streamBlob serves a blob through the registry, for storage which cannot
+// hand out presigned URLs. Range requests are answered with ranged GETs, for
+// resumed pulls and clients lazily fetching parts of layers.
+func (h *Handler) streamBlob(w http.ResponseWriter, r *http.Request, name string, dig string) {
+	sha, err := digest.Parse(dig)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+	size, err := h.registry.blobSize(r.Context(), name, dig)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, errCodeBlobUnknown, "blob not found")
+			return
+		}
+		h.registry.logger.Error("error opening blob", "error", err)
+		http.Error(w, fmt.Sprintf("error opening blob: %v", err), http.StatusInternalServerError)
+		return
+	}
+	blob := &blobRangeReader{ctx: r.Context(), registry: h.registry, repo: name, digest: sha, size: size}
+	defer blob.Close()
+	setBlobHeaders(w, r, dig)
+	http.ServeContent(w, r, "", time.Time{}, blob)
+	if blob.err != nil {
+		h.registry.logger.Warn("error streaming blob", "digest", dig, "error", blob.err)
+	}
+}
+
+// pluginAuth is the AuthFunc of WithAuthPlugin.
+func pluginAuth(auth plugin.Auth) AuthFunc {
+	return func(req *http.Request) (string, error) {
+		actor, err := auth.Authenticate(req.Context(), plugin.AuthRequest{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			Repository: mux.Vars(req)["name"],
+			Header:     req.Header,
+			RemoteAddr: req.RemoteAddr,
+		})
+		switch {
+		case errors.Is(err, plugin.ErrUnauthenticated):
+			return "", &pluginError{err: err, sentinel: ErrUnauthenticated}
+		case errors.Is(err, plugin.ErrAccessDenied):
+			return "", &pluginError{err: err, sentinel: ErrAccessDenied}
+		case err != nil:
+			return "", fmt.Errorf("failed to call auth plugin: %w", err)
+		}
+		return actor, nil
+	}
+}
+
+// pluginError keeps the message of a plugin's error while matching the
+// registry's error of the same meaning.
+type pluginError struct {
+	err      error
+	sentinel error
+}
+
+func (e *pluginError) Error() string   { return e.err.Error() }
+func (e *pluginError) Unwrap() []error { return []error{e.err, e.sentinel} }
@@ -0,0 +1,138 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var ErrPolicyDenied = errors.New("denied by policy")
+
+// PushRequest is what an admission policy sees for every manifest push.
+type PushRequest struct {
+	Repository string          `json:"repository"`
+	Tag        string          `json:"tag,omitempty"`
+	Digest     string          `json:"digest"`
+	MediaType  string          `json:"mediaType,omitempty"`
+	Manifest   json.RawMessage `json:"manifest"`
+	Identity   PushIdentity    `json:"identity"`
+}
+
+type PushIdentity struct {
+	Actor     string `json:"actor,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+type PushPolicy interface {
+	// Admit returns the reasons a push is denied, none meaning it is allowed.
+	Admit(ctx context.Context, req PushRequest) ([]string, error)
+}
+
+// OPAPolicy asks an Open Policy Agent server to decide on pushes, querying a
+// rule through the data API, e.g. http://opa:8181/v1/data/registry/push. The
+// rule evaluates either to a boolean, or to an object with an "allow" boolean
+// and optional "reasons".
+type OPAPolicy struct {
+	url    string
+	client *http.Client
+}
+
+func NewOPAPolicy(url string, timeout time.Duration) *OPAPolicy {
+	return &OPAPolicy{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (p *OPAPolicy) Admit(ctx context.Context, req PushRequest) ([]string, error) {
+	body, err := json.Marshal(map[string]any{"input": req})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal policy input: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create policy request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query policy: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("policy responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return nil, fmt.Errorf("failed to decode policy decision: %w", err)
+	}
+	// An undefined rule has no result, which denies like OPA's default does.
+	if len(decision.Result) == 0 {
+		return []string{"policy decision is undefined"}, nil
+	}
+	var allow bool
+	if err := json.Unmarshal(decision.Result, &allow); err == nil {
+		if allow {
+			return nil, nil
+		}
+		return []string{"push not allowed"}, nil
+	}
+	var result struct {
+		Allow   bool     `json:"allow"`
+		Reasons []string `json:"reasons"`
+	}
+	if err := json.Unmarshal(decision.Result, &result); err != nil {
+		return nil, fmt.Errorf("unexpected policy decision %s", decision.Result)
+	}
+	if result.Allow {
+		return nil, nil
+	}
+	if len(result.Reasons) == 0 {
+		return []string{"push not allowed"}, nil
+	}
+	return result.Reasons, nil
+}
+
+func (r *Registry) admitPush(ctx context.Context, repo string, reference string, sha digest.Digest, manifestBytes []byte, mediaType string) error {
+	if r.pushPolicy == nil {
+		return nil
+	}
+	info := requestInfoFrom(ctx)
+	req := PushRequest{
+		Repository: repo,
+		Digest:     sha.String(),
+		MediaType:  mediaType,
+		Manifest:   manifestBytes,
+		Identity: PushIdentity{
+			Actor:     info.Actor,
+			Addr:      info.Addr,
+			UserAgent: info.UserAgent,
+		},
+	}
+	if !isDigest(reference) {
+		req.Tag = reference
+	}
+
+	reasons, err := r.pushPolicy.Admit(ctx, req)
+	if err != nil {
+		if r.policyFailOpen {
+			r.logger.Warn("push policy failed, admitting push", "repository", repo, "reference", reference, "error", err)
+			return nil
+		}
+		return fmt.Errorf("%w: %v", ErrPolicyDenied, err)
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("%w: %s", ErrPolicyDenied, strings.Join(reasons, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// preflightPrefix holds the objects written to probe the bucket, outside of
+// any repository since repository names cannot start with an underscore.
+const preflightPrefix = "_reg/preflight/"
+
+const preflightTimeout = 10 * time.Second
+
+// PreflightCheck is the result of one probe of the bucket.
+type PreflightCheck struct {
+	Name string `json:"name"`
+	// The IAM permission the probe needs.
+	Permission string        `json:"permission,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Hint       string        `json:"hint,omitempty"`
+	Skipped    bool          `json:"skipped,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+type PreflightReport struct {
+	Bucket string           `json:"bucket"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+func (p *PreflightReport) Failed() bool {
+	for _, check := range p.Checks {
+		if check.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the report for a terminal, one line per check.
+func (p *PreflightReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Preflight of bucket %s:\n", p.Bucket)
+	for _, check := range p.Checks {
+		switch {
+		case check.Skipped:
+			fmt.Fprintf(&b, "  skip  %s\n", check.Name)
+		case check.Error == "":
+			fmt.Fprintf(&b, "  ok    %s (%s)\n", check.Name, check.Duration.Round(time.Millisecond))
+		default:
+			fmt.Fprintf(&b, "  FAIL  %s: %s\n", check.Name, check.Error)
+			if check.Hint != "" {
+				fmt.Fprintf(&b, "        %s\n", check.Hint)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Preflight probes the bucket with every kind of request the registry makes,
+// so that missing permissions show up at startup rather than on the first
+// push. It writes and deletes an object under _reg/preflight/.
+func (r *Registry) Preflight(ctx context.Context) *PreflightReport {
+	report := &PreflightReport{Bucket: r.bucket}
+	key := preflightPrefix + r.replicaID
+	body := []byte("reg preflight " + time.Now().UTC().Format(time.RFC3339))
+	bucketARN := "arn:aws:s3:::" + r.bucket
+	objectsARN := bucketARN + "/*"
+
+	run := func(name string, permission string, resource string, probe func(ctx context.Context) error) bool {
+		ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+		defer cancel()
+		start := time.Now()
+		err := probe(ctx)
+		check := PreflightCheck{Name: name, Permission: permission, Duration: time.Since(start)}
+		if err != nil {
+			check.Error = err.Error()
+			check.Hint = preflightHint(err, permission, resource)
+		}
+		report.Checks = append(report.Checks, check)
+		return err == nil
+	}
+	skip := func(name string) {
+		report.Checks = append(report.Checks, PreflightCheck{Name: name, Skipped: true})
+	}
+
+	run("head bucket", "s3:ListBucket", bucketARN, func(ctx context.Context) error {
+		_, err := r.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &r.bucket}, forcePathStyle)
+		return err
+	})
+	run("list objects", "s3:ListBucket", bucketARN, func(ctx context.Context) error {
+		_, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  &r.bucket,
+			Prefix:  aws.String(preflightPrefix),
+			MaxKeys: aws.Int32(1),
+		}, forcePathStyle)
+		return err
+	})
+	written := run("put object", "s3:PutObject", objectsARN, func(ctx context.Context) error {
+		_, err := r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &r.bucket,
+			Key:    &key,
+			Body:   bytes.NewReader(body),
+		}, forcePathStyle)
+		return err
+	})
+	if written {
+		run("get object", "s3:GetObject", objectsARN, func(ctx context.Context) error {
+			obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &r.bucket, Key: &key}, forcePathStyle)
+			if err != nil {
+				return err
+			}
+			defer obj.Body.Close()
+			data, err := io.ReadAll(obj.Body)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(data, body) {
+				return errors.New("read back different content than was written")
+			}
+			return nil
+		})
+	} else {
+		skip("get object")
+	}
+	// Storage plugins cannot presign, and blobs are streamed instead.
+	if written && r.storagePlugin == nil {
+		run("presigned download", "s3:GetObject", objectsARN, func(ctx context.Context) error {
+			return r.probePresignedURL(ctx, key, body)
+		})
+	} else {
+		skip("presigned download")
+	}
+	// Blobs are written to and read from the shards by copying them out of
+	// the uploads in the primary bucket.
+	if written && r.blobShards != nil {
+		for _, shard := range r.blobShards.buckets {
+			if shard == r.bucket {
+				continue
+			}
+			shardARN := "arn:aws:s3:::" + shard
+			copied := run("copy object to shard "+shard, "s3:PutObject", shardARN+"/*", func(ctx context.Context) error {
+				_, err := r.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+					Bucket:     &shard,
+					Key:        &key,
+					CopySource: aws.String(r.bucket + "/" + key),
+				}, forcePathStyle)
+				return err
+			})
+			if copied {
+				run("delete object from shard "+shard, "s3:DeleteObject", shardARN+"/*", func(ctx context.Context) error {
+					_, err := r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &shard, Key: &key}, forcePathStyle)
+					return err
+				})
+			} else {
+				skip("delete object from shard " + shard)
+			}
+		}
+	}
+	if written {
+		run("delete object", "s3:DeleteObject", objectsARN, func(ctx context.Context) error {
+			_, err := r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &r.bucket, Key: &key}, forcePathStyle)
+			return err
+		})
+	} else {
+		skip("delete object")
+	}
+	run("multipart upload", "s3:PutObject, s3:AbortMultipartUpload", objectsARN, func(ctx context.Context) error {
+		upload, err := r.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: &r.bucket, Key: &key}, forcePathStyle)
+		if err != nil {
+			return err
+		}
+		_, err = r.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   &r.bucket,
+			Key:      &key,
+			UploadId: upload.UploadId,
+		}, forcePathStyle)
+		if err != nil {
+			return fmt.Errorf("failed to abort multipart upload: %w", err)
+		}
+		return nil
+	})
+	return report
+}
+
+// probePresignedURL downloads an object through a presigned URL the way
+// clients redirected to the bucket do.
+func (r *Registry) probePresignedURL(ctx context.Context, key string, expected []byte) error {
+	url, err := r.presign(ctx, r.s3Client, r.bucket, key, http.MethodGet, r.transferEndpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch presigned URL: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return fmt.Errorf("failed to fetch presigned URL: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("presigned URL responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if !bytes.Equal(data, expected) {
+		return errors.New("presigned URL served different content than was written")
+	}
+	return nil
+}
+
+// preflightHint suggests a fix for the usual causes of a failed probe.
+func preflightHint(err error, permission string, resource string) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "the bucket did not answer in time, check the endpoint and network access to it"
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		if strings.Contains(err.Error(), "status 403") {
+			return "presigned URLs are rejected, check the clock is in sync and the credentials outlive the presign expiry"
+		}
+		return ""
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "Forbidden", "AllAccessDisabled":
+		return fmt.Sprintf("grant %s on %s to the registry's credentials", permission, resource)
+	case "NoSuchBucket", "NotFound":
+		return "the bucket does not exist, or is in another region than the client is configured for"
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch":
+		return "the credentials are invalid, check AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY"
+	case "ExpiredToken", "RequestTimeTooSkewed":
+		return "the credentials expired or the clock is out of sync"
+	case "PermanentRedirect", "AuthorizationHeaderMalformed":
+		return "the bucket is in another region, set AWS_REGION accordingly"
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package reg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Cached URLs are handed out for at most this fraction of their validity, so
+// a client that receives one late still has time to follow the redirect.
+const presignCacheFraction = 2
+
+const presignCacheSweepSize = 4096
+
+type presignKey struct {
+	digest digest.Digest
+	method string
+}
+
+type presignedURL struct {
+	url       string
+	expiresAt time.Time
+}
+
+type presignCache struct {
+	mu      sync.Mutex
+	entries map[presignKey]presignedURL
+}
+
+func newPresignCache() *presignCache {
+	return &presignCache{entries: make(map[presignKey]presignedURL)}
+}
+
+func (c *presignCache) get(dgst digest.Digest, method string) (string, bool) {
+	key := presignKey{dgst, method}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.url, true
+}
+
+func (c *presignCache) put(dgst digest.Digest, method string, url string, validity time.Duration) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= presignCacheSweepSize {
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.entries[presignKey{dgst, method}] = presignedURL{
+		url:       url,
+		expiresAt: now.Add(validity / presignCacheFraction),
+	}
+}
+
+func (c *presignCache) forget(dgst digest.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if key.digest == dgst {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// multipartUploadsPrefix holds the objects of uploads in progress.
+const multipartUploadsPrefix = "uploads/"
+
+// uploadsLifecycleDays is how long S3 keeps what uploads leave behind, beyond
+// the day after which the periodic jobs consider them abandoned.
+const uploadsLifecycleDays = 2
+
+// bucketProvisioning creates the bucket when it does not exist yet.
+type bucketProvisioning struct {
+	versioning bool
+}
+
+// ensureBucket creates a bucket in the region of the S3 client, unless it
+// already exists, with versioning if enabled and, where the store supports
+// it, a lifecycle expiring abandoned uploads in the primary bucket. An
+// existing bucket is left as it is.
+func (r *Registry) ensureBucket(ctx context.Context, bucket string) error {
+	_, err := r.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket}, forcePathStyle)
+	if err == nil {
+		return nil
+	}
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || (apiErr.ErrorCode() != "NotFound" && apiErr.ErrorCode() != "NoSuchBucket") {
+		return fmt.Errorf("failed to check bucket %s: %w", bucket, err)
+	}
+
+	input := &s3.CreateBucketInput{Bucket: &bucket}
+	// us-east-1 is the default location, which S3 refuses to be given.
+	if region := r.s3Client.Options().Region; region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+	if _, err := r.s3Client.CreateBucket(ctx, input, forcePathStyle); err != nil {
+		// Another replica starting at the same time created it first.
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "BucketAlreadyOwnedByYou" {
+			return nil
+		}
+		return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+	}
+	r.logger.Info("created bucket", "bucket", bucket, "region", r.s3Client.Options().Region)
+
+	if r.provisioning.versioning {
+		_, err := r.s3Client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  &bucket,
+			VersioningConfiguration: &types.VersioningConfiguration{Status: types.BucketVersioningStatusEnabled},
+		}, forcePathStyle)
+		if err != nil {
+			return fmt.Errorf("failed to enable versioning of bucket %s: %w", bucket, err)
+		}
+	}
+
+	// Uploads are only ever in the primary bucket.
+	if bucket != r.bucket {
+		return nil
+	}
+	rule := types.LifecycleRule{
+		ID:     aws.String("reg-uploads"),
+		Status: types.ExpirationStatusEnabled,
+		Filter: &types.LifecycleRuleFilter{Prefix: aws.String(multipartUploadsPrefix)},
+		AbortIncompleteMultipartUpload: &types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(uploadsLifecycleDays),
+		},
+		Expiration: &types.LifecycleExpiration{Days: aws.Int32(uploadsLifecycleDays)},
+	}
+	if r.provisioning.versioning {
+		rule.NoncurrentVersionExpiration = &types.NoncurrentVersionExpiration{NoncurrentDays: aws.Int32(uploadsLifecycleDays)}
+	}
+	_, err = r.s3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 &bucket,
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: []types.LifecycleRule{rule}},
+	}, forcePathStyle)
+	// Not every S3 compatible store has lifecycles, and the periodic jobs
+	// clean up abandoned uploads as well.
+	if err != nil {
+		r.logger.Warn("failed to set lifecycle of bucket, abandoned uploads are only cleaned up by the periodic jobs", "bucket", bucket, "error", err)
+	}
+	return nil
+}
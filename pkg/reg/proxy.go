@@ -0,0 +1,151 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const dockerHubHost = "registry-1.docker.io"
+
+const defaultProxyTagTTL = 5 * time.Minute
+
+type pullThroughCache struct {
+	prefix   string
+	upstream *upstreamClient
+}
+
+func newPullThroughCache(prefix string, upstream *url.URL) *pullThroughCache {
+	return &pullThroughCache{
+		prefix:   strings.Trim(prefix, "/"),
+		upstream: newUpstreamClient(upstream),
+	}
+}
+
+func (p *pullThroughCache) upstreamName(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, p.prefix+"/")
+	if !ok || rest == "" {
+		return "", false
+	}
+	// Docker Hub keeps official images under the implicit "library" namespace.
+	if p.upstream.base.Host == dockerHubHost && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	return rest, true
+}
+
+func (r *Registry) proxyFor(name string) (*pullThroughCache, string) {
+	for _, proxy := range r.proxies {
+		if upstreamName, ok := proxy.upstreamName(name); ok {
+			return proxy, upstreamName
+		}
+	}
+	return nil, ""
+}
+
+func (r *Registry) fetchUpstreamManifest(ctx context.Context, proxy *pullThroughCache, name string, upstreamName string, reference string) (*v1.Manifest, []byte, error) {
+	r.logger.Debug("fetching manifest from upstream", "upstream", proxy.upstream, "name", upstreamName, "reference", reference)
+	manifestBytes, _, err := proxy.upstream.getManifest(ctx, upstreamName, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling upstream manifest: %w", err)
+	}
+
+	// A failure to cache is not a failure to serve, the client still gets the manifest.
+	if err := r.storeManifest(ctx, name, reference, manifestBytes, &manifest); err != nil {
+		r.logger.Warn("failed to cache upstream manifest", "name", name, "reference", reference, "error", err)
+	} else if !isDigest(reference) {
+		if err := r.db.PutProxyTag(name, reference, time.Now()); err != nil {
+			r.logger.Error("error recording proxy tag fetch", "error", err)
+		}
+	}
+	return &manifest, manifestBytes, nil
+}
+
+// revalidateProxyTag asks upstream for the digest of a cached tag once it is
+// older than the proxy tag TTL, and fetches the manifest again if the tag
+// moved. The cached manifest is served while upstream is unreachable.
+func (r *Registry) revalidateProxyTag(ctx context.Context, proxy *pullThroughCache, name string, upstreamName string, tag string, manifest *v1.Manifest, manifestBytes []byte) (*v1.Manifest, []byte, error) {
+	if r.proxyTagTTL <= 0 {
+		return manifest, manifestBytes, nil
+	}
+	fetchedAt, err := r.db.ProxyTagFetchedAt(name, tag)
+	if err != nil {
+		r.logger.Error("error getting proxy tag fetch time", "error", err)
+		return manifest, manifestBytes, nil
+	}
+	if time.Since(fetchedAt) < r.proxyTagTTL {
+		return manifest, manifestBytes, nil
+	}
+
+	upstreamDigest, err := proxy.upstream.manifestDigest(ctx, upstreamName, tag)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil, err
+	case err != nil:
+		r.logger.Warn("failed to revalidate cached upstream tag, serving it stale", "name", name, "tag", tag, "error", err)
+		return manifest, manifestBytes, nil
+	case upstreamDigest == digest.FromBytes(manifestBytes):
+		if err := r.db.PutProxyTag(name, tag, time.Now()); err != nil {
+			r.logger.Error("error recording proxy tag fetch", "error", err)
+		}
+		return manifest, manifestBytes, nil
+	}
+	return r.fetchUpstreamManifest(ctx, proxy, name, upstreamName, tag)
+}
+
+func (r *Registry) ensureBlob(ctx context.Context, name string, dig string) error {
+	proxy, upstreamName := r.proxyFor(name)
+	if proxy == nil {
+		return nil
+	}
+	exists, err := r.hasBlob(ctx, name, dig)
+	if err != nil {
+		return err
+	}
+	if exists {
+		// A blob cached through another repository is only served once this
+		// repository's upstream provided it too.
+		if err := r.checkBlobLinked(ctx, name, dig); !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	sha, err := digest.Parse(dig)
+	if err != nil {
+		return fmt.Errorf("invalid digest format: %w", err)
+	}
+	r.logger.Debug("fetching blob from upstream", "upstream", proxy.upstream, "name", upstreamName, "digest", sha)
+	body, _, err := proxy.upstream.getBlob(ctx, upstreamName, sha)
+	if err != nil {
+		return err
+	}
+	return r.ingestBlob(ctx, name, sha, newVerifyingReader(body, sha))
+}
+
+func (r *Registry) ingestBlob(ctx context.Context, name string, sha digest.Digest, body io.ReadCloser) error {
+	defer body.Close()
+	uploadID := uuid.New().String()
+	if err := r.startUpload(ctx, name, uploadID, 0); err != nil {
+		return err
+	}
+	if _, err := r.uploadChunk(ctx, uploadID, 0, body); err != nil {
+		_ = r.abortUpload(ctx, uploadID)
+		return err
+	}
+	return r.completeUpload(ctx, name, uploadID, sha.String(), true)
+}
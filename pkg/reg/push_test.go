@@ -0,0 +1,194 @@
+package reg_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/psarna/reg/pkg/reg"
+)
+
+func TestConditionalManifestPush(t *testing.T) {
+	c := newConformanceRegistry(t)
+	const repo = "conditional/push"
+	first := newImage(t, "first", nil, "")
+	second := newImage(t, "second", nil, "")
+	third := newImage(t, "third", nil, "")
+	c.pushImage(repo, "latest", first)
+	c.pushImage(repo, "latest", second)
+	c.pushBlob(repo, third.config)
+	c.pushBlob(repo, third.layer)
+
+	tests := []struct {
+		name    string
+		tag     string
+		ifMatch string
+		status  int
+		code    string
+	}{
+		{name: "stale digest", tag: "latest", ifMatch: `"` + first.digest.String() + `"`, status: http.StatusPreconditionFailed, code: "DENIED"},
+		{name: "missing tag", tag: "missing", ifMatch: `"` + second.digest.String() + `"`, status: http.StatusPreconditionFailed, code: "DENIED"},
+		{name: "missing tag with any digest", tag: "missing", ifMatch: "*", status: http.StatusPreconditionFailed, code: "DENIED"},
+		{name: "unquoted digest", tag: "latest", ifMatch: second.digest.String(), status: http.StatusBadRequest, code: "UNSUPPORTED"},
+		{name: "current digest", tag: "latest", ifMatch: `"` + second.digest.String() + `"`, status: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := c.sub(t)
+			resp := c.do(http.MethodPut, fmt.Sprintf("/v2/%s/manifests/%s", repo, tt.tag), third.manifest, map[string]string{
+				"Content-Type": v1.MediaTypeImageManifest,
+				"If-Match":     tt.ifMatch,
+			})
+			if tt.code != "" {
+				c.expectError(resp, tt.status, tt.code, "conditional push")
+				return
+			}
+			c.expect(resp, tt.status, "conditional push")
+		})
+	}
+
+	resp := c.do(http.MethodGet, fmt.Sprintf("/v2/%s/manifests/latest", repo), nil, map[string]string{"Accept": v1.MediaTypeImageManifest})
+	c.expect(resp, http.StatusOK, "get tag")
+	if got := resp.Header.Get("Docker-Content-Digest"); got != third.digest.String() {
+		t.Errorf("tag points to %s, want %s", got, third.digest)
+	}
+}
+
+func TestUploadParts(t *testing.T) {
+	// Parts of the smallest size S3 accepts, so that chunks span several.
+	c := newConformanceRegistry(t, reg.WithUploadParts(minPartSize, 2))
+	const repo = "upload/parts"
+
+	tests := []struct {
+		name   string
+		chunks []int
+	}{
+		{name: "single small chunk", chunks: []int{1024}},
+		{name: "one part", chunks: []int{minPartSize}},
+		{name: "two parts", chunks: []int{2 * minPartSize}},
+		{name: "small tail merged into last part", chunks: []int{2*minPartSize + 1024, 1024}},
+		{name: "chunks of whole parts", chunks: []int{minPartSize, minPartSize, 7}},
+		{name: "empty first chunk", chunks: []int{0, minPartSize, 1024}},
+		{name: "empty chunk between", chunks: []int{minPartSize, 0, 1024}},
+		{name: "empty last chunk", chunks: []int{minPartSize + 1024, 0}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := c.sub(t)
+			var chunks [][]byte
+			for j, size := range tt.chunks {
+				chunks = append(chunks, bytes.Repeat([]byte{byte('a' + i), byte('0' + j)}, size/2+1)[:size])
+			}
+			data := bytes.Join(chunks, nil)
+			dgst := digest.FromBytes(data)
+
+			resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/", repo), nil, nil)
+			c.expect(resp, http.StatusAccepted, "start upload")
+			location := c.location(resp)
+			offset := 0
+			for _, chunk := range chunks {
+				resp = c.do(http.MethodPatch, location, chunk, map[string]string{
+					"Content-Type":  "application/octet-stream",
+					"Content-Range": fmt.Sprintf("%d-%d", offset, offset+len(chunk)-1),
+				})
+				c.expect(resp, http.StatusAccepted, "upload chunk")
+				offset += len(chunk)
+				location = c.location(resp)
+			}
+
+			resp = c.do(http.MethodPut, withDigest(location, dgst), nil, nil)
+			c.expect(resp, http.StatusCreated, "complete upload")
+			resp = c.do(http.MethodGet, fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst), nil, nil)
+			c.expect(resp, http.StatusOK, "get blob")
+			if !bytes.Equal(resp.body, data) {
+				t.Errorf("get blob: got %d bytes, want %d", len(resp.body), len(data))
+			}
+		})
+	}
+}
+
+func TestCollectBlobsKeepsClaimedBlob(t *testing.T) {
+	c := newConformanceRegistry(t, reg.WithGCGracePeriod(0))
+	claimed := c.pushBlob("collect/deleted", []byte("claimed while collecting"))
+	unclaimed := c.pushBlob("collect/deleted", []byte("left unreferenced"))
+	deletion, err := c.registry.DeleteRepository(context.Background(), "collect/deleted")
+	if err != nil {
+		t.Fatalf("failed to delete repository: %v", err)
+	}
+
+	// The blob is pushed again once the collection listed the links, so
+	// only its claim can keep it.
+	var pushed atomic.Bool
+	c.storage.afterList = func(prefix string) {
+		if strings.HasSuffix(prefix, "/repositories/") && pushed.CompareAndSwap(false, true) {
+			c.pushBlob("collect/pushed", []byte("claimed while collecting"))
+		}
+	}
+	collected, err := c.registry.CollectBlobs(context.Background(), deletion.Blobs)
+	if err != nil {
+		t.Fatalf("failed to collect blobs: %v", err)
+	}
+	if !pushed.Load() {
+		t.Fatalf("collection listed no links")
+	}
+	if collected != 1 {
+		t.Errorf("collected %d blobs, want 1", collected)
+	}
+
+	resp := c.do(http.MethodHead, fmt.Sprintf("/v2/collect/pushed/blobs/%s", claimed), nil, nil)
+	c.expect(resp, http.StatusOK, "head claimed blob")
+	if _, _, err := c.storage.Get(context.Background(), storedBlobKey(unclaimed)); err == nil {
+		t.Errorf("unreferenced blob %s was kept", unclaimed)
+	}
+}
+
+func storedBlobKey(dgst digest.Digest) string {
+	return fmt.Sprintf("docker/registry/v2/blobs/%s/%s/%s/data", dgst.Algorithm(), dgst.Encoded()[:2], dgst.Encoded())
+}
+
+func TestUploadLocationBehindProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []netip.Prefix
+		proto   string
+		want    string
+	}{
+		{name: "untrusted client", proto: "https", want: "http://127.0.0.1:"},
+		{name: "trusted proxy", proxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, proto: "https", want: "https://registry.example.com/"},
+		{name: "trusted proxy with other scheme", proxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, proto: "javascript", want: "http://registry.example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConformanceRegistry(t, reg.WithTrustedProxies(tt.proxies))
+			resp := c.do(http.MethodPost, "/v2/proxied/blobs/uploads/", nil, map[string]string{
+				"X-Forwarded-Proto": tt.proto,
+				"X-Forwarded-Host":  "registry.example.com",
+			})
+			c.expect(resp, http.StatusAccepted, "start upload")
+			location := resp.Header.Get("Location")
+			if !strings.HasPrefix(location, tt.want) {
+				t.Errorf("Location %s, want it to start with %s", location, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushDuringMaintenance(t *testing.T) {
+	c := newConformanceRegistry(t)
+	c.registry.SetMaintenance(true, 30*time.Second)
+	resp := c.do(http.MethodPost, "/v2/maintenance/blobs/uploads/", nil, nil)
+	c.expectError(resp, http.StatusServiceUnavailable, "UNAVAILABLE", "start upload")
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After %q, want 30", got)
+	}
+	resp = c.do(http.MethodGet, "/v2/", nil, nil)
+	c.expect(resp, http.StatusOK, "base endpoint")
+}
@@ -0,0 +1,27 @@
+package reg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ParseImageReference splits repo:tag or repo@digest into the repository and
+// the tag or digest, defaulting to the latest tag.
+func ParseImageReference(image string) (string, string, error) {
+	if repo, dgst, found := strings.Cut(image, "@"); found {
+		if _, err := digest.Parse(dgst); err != nil {
+			return "", "", fmt.Errorf("invalid digest in %q: %w", image, err)
+		}
+		return repo, dgst, nil
+	}
+	repo, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repo, tag = image[:i], image[i+1:]
+	}
+	if repo == "" || tag == "" {
+		return "", "", fmt.Errorf("invalid image reference %q", image)
+	}
+	return repo, tag, nil
+}
@@ -0,0 +1,199 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// referrersTag is the tag of the referrers tag schema under which clients
+// without referrers API support keep an index of the subject's referrers.
+func referrersTag(subject digest.Digest) string {
+	return fmt.Sprintf("%s-%s", subject.Algorithm(), subject.Encoded())
+}
+
+func referrersTagSubject(tag string) (digest.Digest, bool) {
+	alg, encoded, ok := strings.Cut(tag, "-")
+	if !ok {
+		return "", false
+	}
+	subject := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded)
+	return subject, subject.Validate() == nil
+}
+
+func referrerDescriptor(dgst digest.Digest, manifestBytes []byte, m *anyManifest) v1.Descriptor {
+	artifactType := m.ArtifactType
+	if artifactType == "" && m.Config != nil {
+		artifactType = m.Config.MediaType
+	}
+	return v1.Descriptor{
+		MediaType:    m.mediaType(),
+		ArtifactType: artifactType,
+		Digest:       dgst,
+		Size:         int64(len(manifestBytes)),
+		Annotations:  m.Annotations,
+	}
+}
+
+// indexReferrers adds a pushed manifest to the referrers index of its
+// subject, and the entries of a pushed referrers tag to the index of theirs.
+func (r *Registry) indexReferrers(ctx context.Context, name string, reference string, manifestBytes []byte) error {
+	m, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	if m.Subject != nil {
+		desc := referrerDescriptor(digest.FromBytes(manifestBytes), manifestBytes, m)
+		if err := r.db.PutReferrers(name, m.Subject.Digest.String(), []v1.Descriptor{desc}); err != nil {
+			return err
+		}
+		if r.referrersFallbackTags {
+			if err := r.updateReferrersTag(ctx, name, m.Subject.Digest, &desc, ""); err != nil {
+				return fmt.Errorf("failed to update referrers tag: %w", err)
+			}
+		}
+	}
+	if isDigest(reference) {
+		return nil
+	}
+	if subject, ok := referrersTagSubject(reference); ok && m.isIndex() {
+		return r.db.PutReferrers(name, subject.String(), m.Manifests)
+	}
+	return nil
+}
+
+// updateReferrersTag adds added to, or removes the manifest removed from, the
+// referrers tag of subject.
+func (r *Registry) updateReferrersTag(ctx context.Context, name string, subject digest.Digest, added *v1.Descriptor, removed digest.Digest) error {
+	tag := referrersTag(subject)
+	defer r.referrersLocks.lock(name, tag)()
+
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+	}
+	_, indexBytes, err := r.readTagManifest(ctx, name, tag)
+	if err == nil {
+		if err := json.Unmarshal(indexBytes, &index); err != nil {
+			return fmt.Errorf("error unmarshalling referrers tag: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	manifests := index.Manifests[:0]
+	changed := false
+	for _, desc := range index.Manifests {
+		if added != nil && desc.Digest == added.Digest {
+			return nil
+		}
+		if desc.Digest == removed {
+			changed = true
+			continue
+		}
+		manifests = append(manifests, desc)
+	}
+	if added != nil {
+		manifests = append(manifests, *added)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if len(manifests) == 0 {
+		return r.deleteTag(ctx, name, tag)
+	}
+	index.Manifests = manifests
+
+	indexBytes, err = json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("error marshalling referrers tag: %w", err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(indexBytes, &manifest); err != nil {
+		return err
+	}
+	return r.storeManifest(ctx, name, tag, indexBytes, &manifest)
+}
+
+// forgetReferrer drops a deleted manifest from the referrers index.
+func (r *Registry) forgetReferrer(ctx context.Context, name string, dgst digest.Digest) {
+	subjects, err := r.db.DeleteReferrer(name, dgst.String())
+	if err != nil {
+		r.logger.Error("error deleting referrer", "error", err)
+		return
+	}
+	if !r.referrersFallbackTags {
+		return
+	}
+	for _, subject := range subjects {
+		if err := r.updateReferrersTag(ctx, name, digest.Digest(subject), nil, dgst); err != nil {
+			r.logger.Error("error updating referrers tag", "subject", subject, "error", err)
+		}
+	}
+}
+
+// Referrers lists the manifests referring to subject, only those of
+// artifactType if it is set.
+func (r *Registry) Referrers(ctx context.Context, name string, subject digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	// Referrers attached by clients that only know the tag schema, before
+	// this registry indexed them, are picked up from the referrers tag.
+	_, indexBytes, err := r.getStoredManifest(ctx, name, referrersTag(subject))
+	if err == nil {
+		if m, err := parseAnyManifest(indexBytes); err == nil && m.isIndex() {
+			if err := r.db.PutReferrers(name, subject.String(), m.Manifests); err != nil {
+				r.logger.Error("error migrating referrers tag", "error", err)
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		r.logger.Warn("error reading referrers tag", "repository", name, "subject", subject, "error", err)
+	}
+	return r.db.Referrers(name, subject.String(), artifactType)
+}
+
+// deleteReferrersOf deletes the manifests referring to a deleted subject,
+// their own referrers in turn, and the subject's referrers tag.
+func (r *Registry) deleteReferrersOf(ctx context.Context, name string, subject digest.Digest) error {
+	descriptors, err := r.Referrers(ctx, name, subject, "")
+	if err != nil {
+		return err
+	}
+	for _, desc := range descriptors {
+		if err := r.deleteManifest(ctx, name, desc.Digest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete referrer %s: %w", desc.Digest, err)
+		}
+	}
+	if err := r.deleteTag(ctx, name, referrersTag(subject)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete referrers tag: %w", err)
+	}
+	return r.db.DeleteReferrersOf(name, subject.String())
+}
+
+// manifestExists tells whether the repository has a revision of dgst.
+func (r *Registry) manifestExists(ctx context.Context, name string, dgst digest.Digest) (bool, error) {
+	if r.layout == LayoutOCI {
+		return r.ociHasManifest(ctx, name, dgst)
+	}
+	ctx, cancel := r.metadataContext(ctx)
+	defer cancel()
+	revisionKey := revisionLinkKey(name, dgst)
+	_, err := r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &r.bucket,
+		Key:    &revisionKey,
+	}, forcePathStyle)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
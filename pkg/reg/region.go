@@ -0,0 +1,416 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	regionCheckInterval = 5 * time.Second
+	regionProbeTimeout  = 3 * time.Second
+	// How long writes from other regions are waited for, the replication
+	// time S3 Replication Time Control commits to.
+	regionReplicationTimeout = 15 * time.Minute
+)
+
+var ErrTagConflict = errors.New("tag conflict")
+
+type TagConflictPolicy string
+
+const (
+	// Every tag write is accepted. Concurrent writes to one tag in two
+	// regions may leave them pointing at different digests.
+	TagConflictLastWriteWins TagConflictPolicy = "last-write-wins"
+	// Writes to a tag which another region wrote are rejected until that
+	// write has replicated here.
+	TagConflictReject TagConflictPolicy = "reject"
+)
+
+// RegionStatus is what a region reports to its peers, which only redirect
+// downloads to regions whose bucket is healthy.
+type RegionStatus struct {
+	Region         string            `json:"region"`
+	Healthy        bool              `json:"healthy"`
+	ConflictPolicy TagConflictPolicy `json:"conflictPolicy"`
+	// Writes from other regions not replicated here yet.
+	PendingWrites int          `json:"pendingWrites"`
+	Peers         []PeerStatus `json:"peers,omitempty"`
+}
+
+type PeerStatus struct {
+	Region    string     `json:"region"`
+	URL       string     `json:"url"`
+	Healthy   bool       `json:"healthy"`
+	LatencyMs int64      `json:"latencyMs"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+}
+
+type peerRegion struct {
+	name string
+	url  *url.URL
+
+	mu        sync.Mutex
+	healthy   bool
+	latency   time.Duration
+	checkedAt time.Time
+}
+
+// pendingWrite is a write made in another region, which the local bucket
+// only shows once S3 replicated it. Until then the database cache keeps
+// being evicted, so that it does not hold on to what the bucket had before.
+type pendingWrite struct {
+	region string
+	repo   string
+	// Empty for deletions of manifests and repositories.
+	tag string
+	// The digest the tag moved to, or the manifest deleted.
+	digest  string
+	deleted bool
+	at      time.Time
+}
+
+// replicated tells whether the local bucket shows the write.
+func (p *pendingWrite) replicated(ctx context.Context, r *Registry) (bool, error) {
+	switch {
+	case p.tag != "":
+		sha, _, err := r.readTagLink(ctx, p.repo, p.tag)
+		if errors.Is(err, fs.ErrNotExist) {
+			return p.deleted, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return !p.deleted && sha.String() == p.digest, nil
+	case p.digest != "":
+		exists, err := r.manifestExists(ctx, p.repo, digest.Digest(p.digest))
+		return !exists, err
+	default:
+		// Repository deletions are waited for until they time out.
+		return false, nil
+	}
+}
+
+// regionSet runs a registry as one region of an active/active deployment:
+// every region serves its own replicated bucket and database cache, tells
+// its peers about its tag writes, and redirects downloads to the nearest
+// healthy peer while its bucket fails.
+type regionSet struct {
+	name           string
+	conflictPolicy TagConflictPolicy
+	peers          []*peerRegion
+	client         *http.Client
+	logger         *slog.Logger
+
+	localHealthy atomic.Bool
+
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (r *Registry) regionSet() *regionSet {
+	if r.regions == nil {
+		r.regions = &regionSet{
+			conflictPolicy: TagConflictLastWriteWins,
+			client:         &http.Client{Timeout: regionProbeTimeout},
+			logger:         r.logger,
+			pending:        make(map[string]*pendingWrite),
+		}
+		r.regions.localHealthy.Store(true)
+	}
+	return r.regions
+}
+
+// regionSink forwards the writes of this region to a peer.
+type regionSink struct {
+	*WebhookSink
+}
+
+func (s regionSink) Send(ctx context.Context, event Event) error {
+	if event.Action == EventBlobUploaded || event.Action == EventBlobCorrupted {
+		return nil
+	}
+	return s.WebhookSink.Send(ctx, event)
+}
+
+func (r *Registry) startRegions() {
+	rs := r.regions
+	for _, peer := range rs.peers {
+		target := peer.url.JoinPath("/admin/regions/events")
+		target.RawQuery = url.Values{"region": {rs.name}}.Encode()
+		r.events.addSink(regionSink{NewWebhookSink(target.String(), 10*time.Second, 5)})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rs.cancel = cancel
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		ticker := time.NewTicker(regionCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.checkRegions(ctx)
+			}
+		}
+	}()
+}
+
+func (rs *regionSet) stop() {
+	if rs != nil && rs.cancel != nil {
+		rs.cancel()
+		rs.wg.Wait()
+	}
+}
+
+func (r *Registry) checkRegions(ctx context.Context) {
+	rs := r.regions
+	probeCtx, cancel := context.WithTimeout(ctx, regionProbeTimeout)
+	_, err := r.s3Client.HeadBucket(probeCtx, &s3.HeadBucketInput{Bucket: &r.bucket}, forcePathStyle)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+	if healthy := err == nil; rs.localHealthy.Swap(healthy) != healthy {
+		if healthy {
+			r.logger.Info("bucket recovered", "region", rs.name)
+		} else {
+			r.logger.Warn("bucket failing, redirecting downloads to other regions", "region", rs.name, "error", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, peer := range rs.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rs.probe(ctx, peer)
+		}()
+	}
+	wg.Wait()
+
+	rs.mu.Lock()
+	pending := make(map[string]*pendingWrite, len(rs.pending))
+	for key, write := range rs.pending {
+		pending[key] = write
+	}
+	rs.mu.Unlock()
+	for key, write := range pending {
+		done, err := write.replicated(ctx, r)
+		if err != nil {
+			r.logger.Debug("error checking replication", "repository", write.repo, "tag", write.tag, "error", err)
+			continue
+		}
+		expired := time.Since(write.at) > regionReplicationTimeout
+		if !done && !expired {
+			continue
+		}
+		if expired && !done && write.tag != "" {
+			r.logger.Warn("write from another region did not replicate in time", "region", write.region, "repository", write.repo, "tag", write.tag, "digest", write.digest)
+		}
+		if err := r.Evict(write.repo, write.tag); err != nil {
+			r.logger.Error("error evicting replicated write", "error", err)
+			continue
+		}
+		rs.mu.Lock()
+		if rs.pending[key] == write {
+			delete(rs.pending, key)
+		}
+		rs.mu.Unlock()
+	}
+}
+
+func (rs *regionSet) probe(ctx context.Context, peer *peerRegion) {
+	start := time.Now()
+	healthy := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer.url.JoinPath("/admin/regions").String(), nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = rs.client.Do(req)
+		if err == nil {
+			var status RegionStatus
+			if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&status) == nil {
+				healthy = status.Healthy
+			}
+			resp.Body.Close()
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.healthy != healthy && !peer.checkedAt.IsZero() {
+		rs.logger.Info("peer region health changed", "region", peer.name, "healthy", healthy, "error", err)
+	}
+	peer.healthy = healthy
+	peer.latency = time.Since(start)
+	peer.checkedAt = time.Now()
+}
+
+// nearestPeer is the healthy peer which answered its last probe fastest.
+func (rs *regionSet) nearestPeer() *peerRegion {
+	var nearest *peerRegion
+	var latency time.Duration
+	for _, peer := range rs.peers {
+		peer.mu.Lock()
+		healthy, peerLatency := peer.healthy, peer.latency
+		peer.mu.Unlock()
+		if healthy && (nearest == nil || peerLatency < latency) {
+			nearest, latency = peer, peerLatency
+		}
+	}
+	return nearest
+}
+
+// peerRedirect sends downloads to the nearest healthy region while the local
+// bucket fails. Requests which were redirected already are served here, so
+// two failing regions do not bounce clients back and forth. A fallback
+// bucket, when configured, takes care of failures instead.
+func (r *Registry) peerRedirect(req *http.Request, name string, dig string) (string, bool) {
+	rs := r.regions
+	if rs == nil || r.fallback != nil || rs.localHealthy.Load() || req.URL.Query().Has("region") {
+		return "", false
+	}
+	peer := rs.nearestPeer()
+	if peer == nil {
+		return "", false
+	}
+	target := peer.url.JoinPath("/v2", name, "blobs", dig)
+	target.RawQuery = url.Values{"region": {rs.name}}.Encode()
+	return target.String(), true
+}
+
+func pendingKey(repo string, tag string, dgst string) string {
+	return repo + "\x00" + tag + "\x00" + dgst
+}
+
+// applyRegionEvent records a write made in another region and drops what the
+// database cache knows about it.
+func (r *Registry) applyRegionEvent(region string, event Event) error {
+	write := &pendingWrite{region: region, repo: event.Repository, at: time.Now()}
+	var key string
+	switch event.Action {
+	case EventManifestPushed, EventTagDeleted:
+		if event.Tag == "" || isDigest(event.Tag) {
+			return nil
+		}
+		write.tag = event.Tag
+		write.deleted = event.Action == EventTagDeleted
+		if !write.deleted {
+			write.digest = event.Digest
+		}
+		key = pendingKey(write.repo, write.tag, "")
+	case EventManifestDeleted:
+		write.digest = event.Digest
+		key = pendingKey(write.repo, "", write.digest)
+	case EventRepoDeleted:
+		key = pendingKey(write.repo, "", "")
+	default:
+		return nil
+	}
+	r.logger.Debug("write from another region", "region", region, "action", event.Action, "repository", event.Repository, "tag", event.Tag)
+
+	rs := r.regions
+	rs.mu.Lock()
+	rs.pending[key] = write
+	rs.mu.Unlock()
+	r.storageUsage.Purge()
+	return r.Evict(write.repo, write.tag)
+}
+
+// checkTagConflict rejects, under the reject policy, writes to a tag which
+// another region wrote and whose write has not replicated here yet.
+func (r *Registry) checkTagConflict(repo string, tag string, newDigest digest.Digest) error {
+	rs := r.regions
+	if rs == nil || rs.conflictPolicy != TagConflictReject {
+		return nil
+	}
+	rs.mu.Lock()
+	write := rs.pending[pendingKey(repo, tag, "")]
+	rs.mu.Unlock()
+	if write == nil || write.digest == newDigest.String() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s:%s was written in region %s at %s, retry once it replicated", ErrTagConflict, repo, tag, write.region, write.at.UTC().Format(time.RFC3339))
+}
+
+func (r *Registry) RegionStatus() RegionStatus {
+	rs := r.regions
+	rs.mu.Lock()
+	pending := len(rs.pending)
+	rs.mu.Unlock()
+	status := RegionStatus{
+		Region:         rs.name,
+		Healthy:        rs.localHealthy.Load(),
+		ConflictPolicy: rs.conflictPolicy,
+		PendingWrites:  pending,
+	}
+	for _, peer := range rs.peers {
+		peer.mu.Lock()
+		ps := PeerStatus{
+			Region:    peer.name,
+			URL:       peer.url.String(),
+			Healthy:   peer.healthy,
+			LatencyMs: peer.latency.Milliseconds(),
+		}
+		if !peer.checkedAt.IsZero() {
+			checkedAt := peer.checkedAt
+			ps.CheckedAt = &checkedAt
+		}
+		peer.mu.Unlock()
+		status.Peers = append(status.Peers, ps)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool { return status.Peers[i].Region < status.Peers[j].Region })
+	return status
+}
+
+func (h *Handler) getRegionStatus(w http.ResponseWriter, r *http.Request) {
+	if h.registry.regions == nil {
+		http.Error(w, "multi-region deployment is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.registry.RegionStatus())
+}
+
+func (h *Handler) receiveRegionEvent(w http.ResponseWriter, r *http.Request) {
+	if h.registry.regions == nil {
+		http.Error(w, "multi-region deployment is not enabled", http.StatusNotFound)
+		return
+	}
+	region := r.URL.Query().Get("region")
+	if region == "" {
+		http.Error(w, "missing region", http.StatusBadRequest)
+		return
+	}
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, fmt.Sprintf("invalid event: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.registry.applyRegionEvent(region, event); err != nil {
+		h.registry.logger.Error("error applying event from another region", "region", region, "error", err)
+		http.Error(w, fmt.Sprintf("error applying event: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
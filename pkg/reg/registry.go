@@ -1,7 +1,6 @@
 package reg
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,9 +9,11 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
-	"runtime"
+	"net/netip"
+	"net/url"
+	"slices"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,77 +21,466 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/logging"
+	"github.com/hashicorp/golang-lru/v2/expirable"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 type Registry struct {
-	s3Client *s3.Client
-	bucket   string
-	db       *RegistryDB
+	awsConfig aws.Config
+	// Set by WithAWSConfig, otherwise the default configuration is loaded.
+	customAWSConfig *aws.Config
+	logger          *slog.Logger
+	dbPath          string
+	snsTopics       []string
+	sqsQueues       []string
+
+	handlerOnce sync.Once
+	handler     http.Handler
+
+	s3Policy  *S3Policy
+	s3Breaker *circuitBreaker
+	s3Limiter *adaptiveLimiter
+	s3Metrics *s3Metrics
+	s3Client  *s3.Client
+	bucket    string
+	fallback  *fallbackBucket
+	regions   *regionSet
+	db        *RegistryDB
+
+	cacheMetrics *cacheMetrics
+	httpMetrics  *httpMetrics
+
+	// Creates the bucket when it does not exist, if set.
+	provisioning *bucketProvisioning
+	// Buckets blobs are spread over in place of the primary one, if set.
+	blobShards *blobShards
+
+	// Identifies this replica to the others.
+	replicaID string
+	// Set when the database is shared with other replicas.
+	databaseURL string
+	election    *leaderElection
+	jobs        *periodicJobs
+	scrubber    *blobScrubber
+	// Set when replicas with a database of their own share the bucket.
+	cacheBus       *CacheBusConfig
+	bucketTagLocks bool
+	tagWriteLocks  tagLocker
+
+	// Serves the S3 operations in place of the bucket when set.
+	storagePlugin *storagePlugin
+	layout        StorageLayout
+	// Serializes the index updates of a repository in the OCI layout, which
+	// may happen while tagLocks are held.
+	ociIndexLocks tagLocks
+
+	// Endpoints of the requests carrying blob data.
+	s3Accelerate bool
+	s3DualStack  bool
+
+	immutableTags []repoTagPattern
+	tagExpiryDays int
+	// Only log what the periodic retention would delete.
+	retentionDryRun bool
+	htpasswd        *Htpasswd
+	auth            AuthFunc
+	hooks           []Hooks
+	anonymousPull   []repoTagPattern
+	admins          []string
+	proxies         []*pullThroughCache
+	// How long tags fetched by pull-through caches are served before upstream
+	// is asked whether they moved.
+	proxyTagTTL time.Duration
+	replicator  *replicator
+	webhooks    *webhookQueue
+	events      *eventDispatcher
+	broadcaster *eventBroadcaster
+
+	// Manifest types which may, or may not, be pushed to repositories.
+	allowedMediaTypes []mediaTypeRule
+	deniedMediaTypes  []mediaTypeRule
+	foreignLayers     ForeignLayerPolicy
+	webhookFormat     WebhookFormat
+
+	gcGracePeriod time.Duration
+
+	bootstrapMu sync.Mutex
+	bootstrap   *bootstrapper
+
+	flights   singleflight.Group
+	presigned *presignCache
+
+	tagLocks tagLocks
+
+	presignExpiry  time.Duration
+	redirectStatus int
+	redirectHead   bool
+	publicURL      *url.URL
+	trustedProxies []netip.Prefix
+
+	compressMinSize int
+
+	// Chunks are uploaded to S3 in parts of this size, this many at a time.
+	uploadPartSize        int64
+	uploadPartConcurrency int
+
+	digestCacheControl string
+	tagCacheControl    string
+
+	longRequestTimeout time.Duration
+	storageTimeouts    StorageTimeouts
+
+	maintenance maintenanceMode
+
+	pushPolicy     PushPolicy
+	policyFailOpen bool
+	signatures     *SignatureVerifier
+	notation       *NotationVerifier
+
+	scans      *scanQueue
+	quarantine []repoTagPattern
+	// Actor of the scanner's pulls, exempt from quarantine.
+	scanActor string
+
+	auditLog auditLog
+	usage    usageTracker
+	// Storage usage per repository, dropped on every push and delete since
+	// the shared bytes of one repository depend on the others.
+	storageUsage *expirable.LRU[string, *RepositoryStorage]
+
+	referrersFallbackTags bool
+	cascadeReferrers      bool
+
+	helmRepository bool
+	archiveRestore *archiveRestore
+	// Separate from tagLocks, which may already be held by the push that
+	// updates a referrers tag.
+	referrersLocks tagLocks
 }
 
 var forcePathStyle = func(o *s3.Options) {
 	o.UsePathStyle = true
 }
 
-func NewRegistry(ctx context.Context, bucket string) (*Registry, error) {
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config, %v", err)
+// NewRegistry creates a registry serving bucket.
+func NewRegistry(ctx context.Context, bucket string, opts ...Option) (*Registry, error) {
+	return New(ctx, append([]Option{WithBucket(bucket)}, opts...)...)
+}
+
+// New creates a registry from its options, of which WithBucket is required.
+// Serve it with Handler, and Close it once done.
+func New(ctx context.Context, opts ...Option) (*Registry, error) {
+	r := &Registry{
+		dbPath:    "registry.db",
+		events:    &eventDispatcher{},
+		presigned: newPresignCache(),
+		s3Metrics: newS3Metrics(),
+
+		cacheMetrics:   newCacheMetrics(),
+		httpMetrics:    newHTTPMetrics(),
+		layout:         LayoutDistribution,
+		foreignLayers:  ForeignLayersAllow,
+		webhookFormat:  WebhookFormatReg,
+		gcGracePeriod:  defaultGCGracePeriod,
+		presignExpiry:  15 * time.Minute,
+		proxyTagTTL:    defaultProxyTagTTL,
+		redirectStatus: http.StatusFound,
+
+		compressMinSize: 1024,
+
+		uploadPartSize:        defaultUploadPartSize,
+		uploadPartConcurrency: defaultUploadPartConcurrency,
+
+		storageUsage: expirable.NewLRU[string, *RepositoryStorage](1024, nil, storageUsageTTL),
+	}
+	r.broadcaster = newEventBroadcaster()
+	r.events.addSink(r.broadcaster)
+	r.hooks = []Hooks{r.eventHooks()}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.logger == nil {
+		r.logger = slog.Default()
+	}
+	r.events.logger = r.logger
+	if r.s3Breaker != nil {
+		r.s3Breaker.logger = r.logger
+	}
+	if r.s3Limiter != nil {
+		r.s3Limiter.logger = r.logger
+	}
+	if r.fallback != nil {
+		r.fallback.logger = r.logger
+	}
+	if r.regions != nil {
+		r.regions.logger = r.logger
+	}
+	if r.bucket == "" {
+		return nil, errors.New("no bucket configured")
+	}
+	if r.cacheBus != nil && r.databaseURL != "" {
+		return nil, errors.New("replicas sharing a database need no cache bus")
+	}
+	if r.bucketTagLocks && r.storagePlugin != nil && r.databaseURL == "" {
+		return nil, errors.New("tag locks in the bucket need conditional writes, which storage plugins do not support")
+	}
+	if r.provisioning != nil && r.storagePlugin != nil {
+		return nil, errors.New("storage plugins have no bucket to create")
+	}
+	if r.blobShards != nil {
+		if err := r.blobShards.validate(); err != nil {
+			return nil, err
+		}
+		if r.layout != LayoutDistribution {
+			return nil, errors.New("blob shards need the distribution layout")
+		}
+		if r.fallback != nil {
+			return nil, errors.New("blob shards do not support fallback buckets")
+		}
+		if r.storagePlugin != nil {
+			return nil, errors.New("storage plugins have no buckets to shard blobs over")
+		}
+	}
+	if r.scrubber != nil {
+		if r.storagePlugin != nil {
+			return nil, errors.New("storage plugins do not support blob scrubbing")
+		}
+		if r.scrubber.config.Interval <= 0 {
+			return nil, errors.New("blob scrubbing needs an interval")
+		}
+		if r.scrubber.config.Sample <= 0 {
+			r.scrubber.config.Sample = 100
+		}
+		if r.scrubber.config.Rate <= 0 {
+			r.scrubber.config.Rate = 10 << 20
+		}
+	}
+	if r.uploadPartSize < minPartSize {
+		return nil, fmt.Errorf("upload parts must be at least %d bytes", minPartSize)
+	}
+	if r.uploadPartConcurrency < 1 {
+		return nil, errors.New("at least one upload part must be uploaded at a time")
+	}
+	if r.gcGracePeriod < 0 {
+		return nil, errors.New("the gc grace period must not be negative")
+	}
+	switch r.foreignLayers {
+	case ForeignLayersAllow, ForeignLayersWarn, ForeignLayersReject:
+	default:
+		return nil, fmt.Errorf("unknown foreign layer policy %q", r.foreignLayers)
+	}
+	switch r.webhookFormat {
+	case WebhookFormatReg, WebhookFormatDistribution:
+	default:
+		return nil, fmt.Errorf("unknown webhook format %q", r.webhookFormat)
+	}
+	switch r.layout {
+	case LayoutDistribution:
+	case LayoutOCI:
+		// Both address blobs by digest alone, which the OCI layout stores
+		// once per repository.
+		if r.fallback != nil {
+			return nil, errors.New("the oci layout does not support fallback buckets")
+		}
+		if r.archiveRestore != nil {
+			return nil, errors.New("the oci layout does not support archive restores")
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage layout %q", r.layout)
+	}
+	r.replicaID = newReplicaID()
+
+	var cfg aws.Config
+	if r.customAWSConfig != nil {
+		cfg = r.customAWSConfig.Copy()
+	} else {
+		var err error
+		cfg, err = config.LoadDefaultConfig(ctx, config.WithLogger(awsLogger(r.logger)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to load SDK config, %v", err)
+		}
+		if r.logger.Enabled(ctx, slog.LevelDebug) {
+			cfg.ClientLogMode |= aws.LogRetries
+		}
 	}
 	cfg.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
-	s3Client := s3.NewFromConfig(cfg, forcePathStyle)
+	r.awsConfig = cfg
+	r.s3Client = s3.NewFromConfig(cfg, forcePathStyle, r.configureS3)
+	if r.provisioning != nil {
+		buckets := []string{r.bucket}
+		if r.blobShards != nil {
+			buckets = append(buckets, r.blobShards.buckets...)
+		}
+		for _, bucket := range buckets {
+			if err := r.ensureBucket(ctx, bucket); err != nil {
+				r.events.close()
+				return nil, err
+			}
+		}
+	}
+	for _, topicARN := range r.snsTopics {
+		r.events.addSink(NewSNSSink(cfg, topicARN))
+	}
+	for _, queueURL := range r.sqsQueues {
+		r.events.addSink(NewSQSSink(cfg, queueURL))
+	}
+	if err := r.checkEventFilters(); err != nil {
+		r.events.close()
+		return nil, err
+	}
 
-	db, err := initSQLite("registry.db")
+	var db *RegistryDB
+	var err error
+	if r.databaseURL != "" {
+		db, err = initLibSQL(r.databaseURL, r.logger)
+	} else {
+		db, err = initSQLite(r.dbPath, r.logger)
+	}
 	if err != nil {
+		r.events.close()
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
+	r.db = db
+	if r.databaseURL != "" {
+		r.election = &leaderElection{id: r.replicaID}
+		r.startLeaderElection()
+		r.tagWriteLocks = dbTagLocker{db: db}
+	} else if r.bucketTagLocks {
+		r.tagWriteLocks = s3TagLocker{r: r}
+	}
+	if r.cacheBus != nil {
+		if err := r.startCacheBus(*r.cacheBus); err != nil {
+			r.events.close()
+			db.Close()
+			return nil, err
+		}
+	}
+	r.checkTransferEndpoints()
+	if r.fallback != nil {
+		r.fallback.client = s3.NewFromConfig(cfg, forcePathStyle, r.fallback.configure(r.s3Policy))
+		r.startFallbackProbe()
+	}
+	if r.replicator != nil {
+		r.replicator.start()
+	}
+	if r.webhooks != nil {
+		r.webhooks.start()
+	}
+	if r.regions != nil {
+		r.startRegions()
+	}
+	if r.scans != nil {
+		r.scans.start()
+	}
+	r.startAuditExport()
+	r.startUsageFlush()
+	if r.jobs != nil {
+		r.startPeriodicJobs()
+	}
+	if r.scrubber != nil {
+		r.startBlobScrubbing()
+	}
+	return r, nil
+}
 
-	return &Registry{
-		s3Client: s3Client,
-		bucket:   bucket,
-		db:       db,
-	}, nil
+// awsLogger routes the log messages of the AWS SDK, like its warnings about
+// retries and response checksums, through logger.
+func awsLogger(logger *slog.Logger) logging.Logger {
+	return logging.LoggerFunc(func(classification logging.Classification, format string, v ...any) {
+		if classification == logging.Warn {
+			logger.Warn(fmt.Sprintf(format, v...), "component", "aws")
+			return
+		}
+		logger.Debug(fmt.Sprintf(format, v...), "component", "aws")
+	})
+}
+
+func isNotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return true
+	}
+	var nse *types.NotFound
+	return errors.As(err, &nse)
 }
 
-func (r *Registry) getBlobRedirect(ctx context.Context, name string, digest string, method string) (string, error) {
-	algo, hex, found := strings.Cut(digest, ":")
-	if !found {
-		return "", fmt.Errorf("invalid digest format")
+func (r *Registry) getBlobRedirect(ctx context.Context, name string, dig string, method string) (string, error) {
+	sha, err := digest.Parse(dig)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest format: %w", err)
 	}
 
-	blobKey := fmt.Sprintf("docker/registry/v2/blobs/%s/%s/%s/data", algo, hex[0:2], hex)
-	slog.Debug("getBlob", "name", name, "blobKey", blobKey, "method", method)
+	blobKey := r.layoutBlobKey(name, sha)
+	r.logger.Debug("getBlob", "name", name, "blobKey", blobKey, "method", method)
 
-	expires := 15 * time.Minute
+	// While the primary bucket fails, even its cached URLs are of no use.
+	if r.fallback != nil && r.fallback.active() {
+		return r.presignFallback(ctx, sha, method)
+	}
+
+	// URLs are cached by digest, which only names one object in the
+	// distribution layout.
+	cache := r.layout == LayoutDistribution
+	if url, ok := r.presigned.get(sha, method); ok && cache {
+		return url, nil
+	}
+
+	// Archived objects can be stat'ed, but not read until restored.
+	if method == http.MethodGet {
+		if _, err := r.ensureRestored(ctx, sha); err != nil {
+			return "", err
+		}
+	}
+
+	// S3 would answer a presigned URL for a missing key with an XML error the
+	// client cannot make sense of, so check the blob exists before signing.
+	if _, err := r.blobSize(ctx, name, dig); err != nil {
+		return "", err
+	}
+
+	url, err := r.presign(ctx, r.s3Client, r.bucketFor(blobKey), blobKey, method, r.transferEndpoint)
+	if err != nil {
+		return "", err
+	}
+	if cache {
+		r.presigned.put(sha, method, url, r.presignExpiry)
+	}
+	return url, nil
+}
+
+func (r *Registry) presign(ctx context.Context, client *s3.Client, bucket string, key string, method string, optFns ...func(*s3.Options)) (string, error) {
+	expires := r.presignExpiry
 
-	var err error
 	var presignedReq *v4.PresignedHTTPRequest
-	presignClient := s3.NewPresignClient(r.s3Client)
+	var err error
+	presignClient := s3.NewPresignClient(client)
 	switch method {
 	case http.MethodGet:
 		presignedReq, err = presignClient.PresignGetObject(ctx,
 			&s3.GetObjectInput{
-				Bucket: &r.bucket,
-				Key:    &blobKey,
+				Bucket: &bucket,
+				Key:    &key,
 			},
 			s3.WithPresignExpires(expires),
 			func(opts *s3.PresignOptions) {
 				opts.ClientOptions = append(opts.ClientOptions, forcePathStyle)
+				opts.ClientOptions = append(opts.ClientOptions, optFns...)
 			},
 		)
 	case http.MethodHead:
 		presignedReq, err = presignClient.PresignHeadObject(ctx,
 			&s3.HeadObjectInput{
-				Bucket: &r.bucket,
-				Key:    &blobKey,
+				Bucket: &bucket,
+				Key:    &key,
 			},
 			s3.WithPresignExpires(expires),
 			func(opts *s3.PresignOptions) {
 				opts.ClientOptions = append(opts.ClientOptions, forcePathStyle)
+				opts.ClientOptions = append(opts.ClientOptions, optFns...)
 			},
 		)
 	default:
@@ -102,25 +492,69 @@ func (r *Registry) getBlobRedirect(ctx context.Context, name string, digest stri
 	return presignedReq.URL, nil
 }
 
-func (r *Registry) hasBlob(ctx context.Context, digest string) (bool, error) {
-	algo, hex, found := strings.Cut(digest, ":")
-	if !found {
-		return false, fmt.Errorf("invalid digest format")
+func (r *Registry) openBlob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	return r.openBlobFrom(ctx, repo, dgst, 0)
+}
+
+// openBlobFrom opens a blob from offset on, returning the size of what is
+// left to read.
+func (r *Registry) openBlobFrom(ctx context.Context, repo string, dgst digest.Digest, offset int64) (io.ReadCloser, int64, error) {
+	ctx, watch, cancel := r.blobReadContext(ctx)
+	obj, err := r.getObjectFrom(ctx, r.layoutBlobKey(repo, dgst), offset)
+	if err != nil {
+		cancel()
+		if isNotFound(err) {
+			return nil, 0, errors.Join(err, fs.ErrNotExist)
+		}
+		return nil, 0, fmt.Errorf("failed to get blob: %w", err)
 	}
+	return watch(obj.Body), aws.ToInt64(obj.ContentLength), nil
+}
 
-	blobKey := fmt.Sprintf("docker/registry/v2/blobs/%s/%s/%s/data", algo, hex[0:2], hex)
-	_, err := r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: &r.bucket,
+// blobSize asks S3, which has the last word since a layers row outlives its
+// blob when a collection or repository delete removes it. The size recorded
+// in the layers table only answers while S3 fails.
+func (r *Registry) blobSize(ctx context.Context, repo string, dig string) (int64, error) {
+	sha, err := digest.Parse(dig)
+	if err != nil {
+		return 0, fmt.Errorf("invalid digest format: %w", err)
+	}
+	ctx, cancel := r.metadataContext(ctx)
+	defer cancel()
+	obj, err := r.headObject(ctx, r.layoutBlobKey(repo, sha))
+	if err == nil {
+		return aws.ToInt64(obj.ContentLength), nil
+	}
+	if isNotFound(err) {
+		return 0, errors.Join(err, fs.ErrNotExist)
+	}
+	// The layers table does not tell which repositories have a copy of a
+	// blob in the OCI layout.
+	if r.layout == LayoutDistribution {
+		if size, dbErr := r.db.GetBlobSize(sha.String()); dbErr == nil {
+			r.logger.Warn("failed to stat blob, answering from the database", "digest", sha, "error", err)
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to stat blob: %w", err)
+}
+
+func (r *Registry) hasBlob(ctx context.Context, repo string, dig string) (bool, error) {
+	sha, err := digest.Parse(dig)
+	if err != nil {
+		return false, fmt.Errorf("invalid digest format: %w", err)
+	}
+
+	ctx, cancel := r.metadataContext(ctx)
+	defer cancel()
+	blobKey := r.layoutBlobKey(repo, sha)
+	_, err = r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.bucketFor(blobKey)),
 		Key:    &blobKey,
 	}, forcePathStyle)
 
 	if err != nil {
-		var nsk *types.NoSuchKey
-		if errors.As(err, &nsk) {
-			return false, nil
-		}
-		var nse *types.NotFound
-		if errors.As(err, &nse) {
+		if isNotFound(err) {
 			return false, nil
 		}
 		return false, err
@@ -130,13 +564,25 @@ func (r *Registry) hasBlob(ctx context.Context, digest string) (bool, error) {
 }
 
 func (r *Registry) getManifestSHA(ctx context.Context, repo string, tag string) (digest.Digest, error) {
-	metaKey := fmt.Sprintf("docker/registry/v2/repositories/%s/_manifests/tags/%s/current/link", repo, tag)
-	slog.Debug("getting manifest SHA", "repo", repo, "tag", tag, "metaKey", metaKey)
+	return shared(ctx, &r.flights, "sha\x00"+repo+"\x00"+tag, func(ctx context.Context) (digest.Digest, error) {
+		return r.fetchManifestSHA(ctx, repo, tag)
+	})
+}
 
-	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &r.bucket,
-		Key:    &metaKey,
-	}, forcePathStyle)
+func (r *Registry) fetchManifestSHA(ctx context.Context, repo string, tag string) (digest.Digest, error) {
+	if r.layout == LayoutOCI {
+		sha, _, err := r.ociTagDigest(ctx, repo, tag)
+		if err != nil {
+			return "", fmt.Errorf("error getting sha: %w", err)
+		}
+		return sha, nil
+	}
+	metaKey := tagCurrentLinkKey(repo, tag)
+	r.logger.Debug("getting manifest SHA", "repo", repo, "tag", tag, "metaKey", metaKey)
+	ctx, cancel := r.metadataContext(ctx)
+	defer cancel()
+
+	obj, err := r.getObject(ctx, metaKey)
 	if err != nil {
 		return "", fmt.Errorf("error getting sha: %w", err)
 	}
@@ -148,8 +594,96 @@ func (r *Registry) getManifestSHA(ctx context.Context, repo string, tag string)
 	return digest.Parse(string(sha))
 }
 
+func (r *Registry) getManifestBlob(ctx context.Context, repo string, sha digest.Digest) ([]byte, error) {
+	blobKey := r.layoutBlobKey(repo, sha)
+	r.logger.Debug("getting manifest blob", "blobKey", blobKey)
+	ctx, cancel := r.metadataContext(ctx)
+	defer cancel()
+	obj, err := r.getObject(ctx, blobKey)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+	return io.ReadAll(obj.Body)
+}
+
+func (r *Registry) getManifestByDigest(ctx context.Context, name string, sha digest.Digest) (*v1.Manifest, []byte, error) {
+	start := time.Now()
+	readyManifestBytes, err := r.db.GetManifestByDigest(name, sha.String())
+	r.cacheMetrics.recordLookup(lookupManifestDigest, err == nil, time.Since(start))
+	if err == nil {
+		var manifest v1.Manifest
+		if err := json.Unmarshal([]byte(readyManifestBytes), &manifest); err != nil {
+			return nil, nil, err
+		}
+		return &manifest, []byte(readyManifestBytes), nil
+	}
+
+	if r.layout == LayoutOCI {
+		exists, err := r.ociHasManifest(ctx, name, sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists {
+			return nil, nil, fmt.Errorf("%w: manifest %s not found in %s", fs.ErrNotExist, sha, ociIndexKey(name))
+		}
+	} else {
+		headCtx, cancel := r.metadataContext(ctx)
+		_, err = r.headObject(headCtx, revisionLinkKey(name, sha))
+		cancel()
+		if err != nil {
+			if isNotFound(err) {
+				return nil, nil, errors.Join(err, fs.ErrNotExist)
+			}
+			return nil, nil, err
+		}
+	}
+
+	blobData, err := r.getManifestBlob(ctx, name, sha)
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(blobData, &manifest); err != nil {
+		return nil, nil, err
+	}
+	return &manifest, blobData, nil
+}
+
+type manifestResult struct {
+	manifest      *v1.Manifest
+	manifestBytes []byte
+}
+
 func (r *Registry) getManifest(ctx context.Context, name string, reference string) (*v1.Manifest, []byte, error) {
+	result, err := shared(ctx, &r.flights, "manifest\x00"+name+"\x00"+reference, func(ctx context.Context) (manifestResult, error) {
+		manifest, manifestBytes, err := r.fetchManifest(ctx, name, reference)
+		return manifestResult{manifest, manifestBytes}, err
+	})
+	return result.manifest, result.manifestBytes, err
+}
+
+func (r *Registry) fetchManifest(ctx context.Context, name string, reference string) (*v1.Manifest, []byte, error) {
+	manifest, manifestBytes, err := r.getStoredManifest(ctx, name, reference)
+	proxy, upstreamName := r.proxyFor(name)
+	switch {
+	case proxy == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		return r.fetchUpstreamManifest(ctx, proxy, name, upstreamName, reference)
+	case err == nil && !isDigest(reference):
+		return r.revalidateProxyTag(ctx, proxy, name, upstreamName, reference, manifest, manifestBytes)
+	}
+	return manifest, manifestBytes, err
+}
+
+func (r *Registry) getStoredManifest(ctx context.Context, name string, reference string) (*v1.Manifest, []byte, error) {
+	if isDigest(reference) {
+		return r.getManifestByDigest(ctx, name, digest.Digest(reference))
+	}
+
+	start := time.Now()
 	readyManifestBytes, err := r.db.GetManifest(name, reference)
+	r.cacheMetrics.recordLookup(lookupManifest, err == nil, time.Since(start))
 	if err == nil {
 		var manifest v1.Manifest
 		if err := json.Unmarshal([]byte(readyManifestBytes), &manifest); err != nil {
@@ -158,22 +692,34 @@ func (r *Registry) getManifest(ctx context.Context, name string, reference strin
 		return &manifest, []byte(readyManifestBytes), nil
 	}
 
-	sha, err := r.getManifestSHA(ctx, name, reference)
+	manifest, blobData, err := r.readTagManifest(ctx, name, reference)
 	if err != nil {
-		return nil, nil, errors.Join(err, fs.ErrNotExist)
+		return nil, nil, err
 	}
-	hex := sha.Hex()
-	blobKey := fmt.Sprintf("docker/registry/v2/blobs/sha256/%s/%s/data", hex[0:2], hex)
-	slog.Debug("getting manifest blob", "blobKey", blobKey)
-	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &r.bucket,
-		Key:    &blobKey,
-	}, forcePathStyle)
+
+	if err := r.db.PutManifest(name, reference, string(blobData), manifest); err != nil {
+		r.logger.Error("error storing manifest in database", "error", err)
+	}
+	// Indexing fetches the config, which a pull should not wait for.
+	go func() {
+		if err := r.indexConfig(context.WithoutCancel(ctx), name, manifest); err != nil {
+			r.logger.Error("error indexing image config", "error", err)
+		}
+	}()
+
+	return manifest, blobData, nil
+}
+
+func (r *Registry) readTagManifest(ctx context.Context, name string, tag string) (*v1.Manifest, []byte, error) {
+	sha, err := r.getManifestSHA(ctx, name, tag)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, errors.Join(err, fs.ErrNotExist)
 	}
-	defer obj.Body.Close()
-	blobData, err := io.ReadAll(obj.Body)
+	return r.readManifest(ctx, name, sha)
+}
+
+func (r *Registry) readManifest(ctx context.Context, name string, sha digest.Digest) (*v1.Manifest, []byte, error) {
+	blobData, err := r.getManifestBlob(ctx, name, sha)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -181,27 +727,143 @@ func (r *Registry) getManifest(ctx context.Context, name string, reference strin
 	if err := json.Unmarshal(blobData, &manifest); err != nil {
 		return nil, nil, err
 	}
+	return &manifest, blobData, nil
+}
 
-	if err := r.db.PutManifest(name, reference, string(blobData), &manifest); err != nil {
-		slog.Error("error storing manifest in database", "error", err)
-	}
+var (
+	ErrProxyReadOnly = errors.New("repository is a read-only pull-through cache")
+	// ErrManifestDigestMismatch rejects a manifest pushed by digest whose
+	// content has a different digest.
+	ErrManifestDigestMismatch = errors.New("manifest does not match the digest it was pushed by")
+)
 
-	return &manifest, blobData, nil
+// checkManifestDigest rejects a manifest referenced by a digest it does not
+// have. Tags reference any manifest.
+func checkManifestDigest(reference string, manifestBytes []byte) error {
+	if !isDigest(reference) {
+		return nil
+	}
+	expected := digest.Digest(reference)
+	if expected.Algorithm().FromBytes(manifestBytes) != expected {
+		return fmt.Errorf("%w: %s", ErrManifestDigestMismatch, expected)
+	}
+	return nil
 }
 
 func (r *Registry) putManifest(ctx context.Context, name string, reference string, manifestBytes []byte) error {
-	sha := digest.FromBytes(manifestBytes)
-	hex := sha.Hex()
-	blobKey := fmt.Sprintf("docker/registry/v2/blobs/sha256/%s/%s/data", hex[0:2], hex)
-	slog.Debug("putting manifest blob", "blobKey", blobKey)
+	return r.pushManifest(ctx, name, reference, manifestBytes, nil)
+}
 
+func (r *Registry) pushManifest(ctx context.Context, name string, reference string, manifestBytes []byte, precondition *linkPrecondition) error {
+	push, err := r.admitManifest(ctx, name, reference, manifestBytes)
+	if err != nil {
+		return err
+	}
 	var manifest v1.Manifest
 	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
 		return fmt.Errorf("error unmarshalling manifest: %w", err)
 	}
 
+	sha := push.Digest
+	// Checked again under the tag's lock, since another push may have
+	// written the tag since.
+	recheck := func(ctx context.Context) error { return r.checkTagWrite(ctx, name, reference, sha) }
+	if err := r.storeManifestIf(ctx, name, reference, manifestBytes, &manifest, precondition, recheck); err != nil {
+		return err
+	}
+	r.replicator.enqueue(name, reference, sha)
+	r.scans.enqueue(name, reference, manifestBytes)
+
+	r.manifestPushed(ctx, push)
+	r.audit(ctx, AuditManifestPush, name, reference, sha.String())
+	r.recordPush(name, reference)
+	return nil
+}
+
+// admitManifest runs the checks a manifest must pass before it is written to
+// a repository, however it gets there, and returns the push to report once it
+// is written.
+func (r *Registry) admitManifest(ctx context.Context, name string, reference string, manifestBytes []byte) (ManifestPush, error) {
+	if proxy, _ := r.proxyFor(name); proxy != nil {
+		return ManifestPush{}, ErrProxyReadOnly
+	}
+	if err := r.checkRepositoryName(name); err != nil {
+		return ManifestPush{}, err
+	}
+
+	sha := digest.FromBytes(manifestBytes)
+	if err := checkManifestDigest(reference, manifestBytes); err != nil {
+		return ManifestPush{}, err
+	}
+	parsed, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return ManifestPush{}, err
+	}
+	if err := r.checkMediaType(name, parsed); err != nil {
+		return ManifestPush{}, err
+	}
+	if err := r.checkForeignLayers(name, reference, parsed); err != nil {
+		return ManifestPush{}, err
+	}
+
+	isTag := !isDigest(reference)
+	if isTag {
+		if err := r.checkTagWrite(ctx, name, reference, sha); err != nil {
+			return ManifestPush{}, err
+		}
+	}
+
+	if err := r.admitPush(ctx, name, reference, sha, manifestBytes, parsed.mediaType()); err != nil {
+		return ManifestPush{}, err
+	}
+	push := ManifestPush{Repository: name, Digest: sha, MediaType: parsed.mediaType(), Manifest: manifestBytes}
+	if isTag {
+		push.Tag = reference
+	}
+	if err := r.beforeManifestPush(ctx, push); err != nil {
+		return ManifestPush{}, err
+	}
+	if err := r.checkQuota(name, parsed.Layers); err != nil {
+		return ManifestPush{}, err
+	}
+	if isTag {
+		if err := r.requireSignature(ctx, name, reference, manifestBytes, "push"); err != nil {
+			return ManifestPush{}, err
+		}
+		if err := r.requireNotationSignature(ctx, name, reference, manifestBytes); err != nil {
+			return ManifestPush{}, err
+		}
+	}
+	return push, nil
+}
+
+// checkTagWrite rejects writing a manifest to a tag which is immutable, or
+// which another region wrote.
+func (r *Registry) checkTagWrite(ctx context.Context, name string, tag string, sha digest.Digest) error {
+	if err := r.checkImmutableTag(ctx, name, tag, sha); err != nil {
+		return err
+	}
+	return r.checkTagConflict(name, tag, sha)
+}
+
+func (r *Registry) storeManifest(ctx context.Context, name string, reference string, manifestBytes []byte, manifest *v1.Manifest) error {
+	return r.storeManifestIf(ctx, name, reference, manifestBytes, manifest, nil, nil)
+}
+
+// storeManifestIf stores a manifest, and links its tag unless the precondition
+// fails, or checkTag, which runs under the tag's lock, rejects the write.
+func (r *Registry) storeManifestIf(ctx context.Context, name string, reference string, manifestBytes []byte, manifest *v1.Manifest, precondition *linkPrecondition, checkTag func(context.Context) error) error {
+	ctx, cancel := r.uploadContext(ctx)
+	defer cancel()
+	if err := r.claimManifestBlobs(ctx, manifestBytes); err != nil {
+		return err
+	}
+	sha := digest.FromBytes(manifestBytes)
+	blobKey := r.layoutBlobKey(name, sha)
+	r.logger.Debug("putting manifest blob", "blobKey", blobKey)
+
 	_, err := r.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &r.bucket,
+		Bucket: aws.String(r.bucketFor(blobKey)),
 		Key:    &blobKey,
 		Body:   strings.NewReader(string(manifestBytes)),
 	}, forcePathStyle)
@@ -209,49 +871,324 @@ func (r *Registry) putManifest(ctx context.Context, name string, reference strin
 		return err
 	}
 
+	switch {
+	case r.layout == LayoutDistribution:
+		revisionsKey := revisionLinkKey(name, sha)
+		r.logger.Debug("putting manifest revisions meta", "revisionsKey", revisionsKey)
+		_, err = r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &r.bucket,
+			Key:    &revisionsKey,
+			Body:   strings.NewReader(sha.String()),
+		}, forcePathStyle)
+		if err != nil {
+			return err
+		}
+	case isDigest(reference):
+		// A tagged manifest is added to the index along with its tag.
+		if err := r.putOCIRevision(ctx, name, manifestBytes); err != nil {
+			return err
+		}
+	}
+
+	if err := r.indexReferrers(ctx, name, reference, manifestBytes); err != nil {
+		r.logger.Error("error indexing referrers", "error", err)
+	}
+	if err := r.indexChildren(name, manifestBytes); err != nil {
+		r.logger.Error("error indexing index children", "error", err)
+	}
+	if err := r.indexExpiry(name, manifestBytes); err != nil {
+		r.logger.Error("error indexing manifest expiry", "error", err)
+	}
+
+	// Pushing by digest only creates the revision, there is no tag to link.
+	if isDigest(reference) {
+		return nil
+	}
+
+	lockCtx, unlock, err := r.lockTagWrite(ctx, name, reference)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if checkTag != nil {
+		if err := checkTag(lockCtx); err != nil {
+			return tagWriteErr(lockCtx, err)
+		}
+	}
+
+	if r.layout == LayoutOCI {
+		err = r.putOCITag(lockCtx, name, reference, manifestBytes, precondition)
+	} else {
+		err = r.putTagLinks(lockCtx, name, reference, sha, precondition)
+	}
+	if err != nil {
+		return tagWriteErr(lockCtx, err)
+	}
+
+	r.recordTagChange(name, reference, sha, false)
+	err = r.db.PutManifest(name, reference, string(manifestBytes), manifest)
+	if err != nil {
+		r.logger.Error("error storing manifest in database", "error", err)
+	}
+	r.storageUsage.Purge()
+	if err := r.indexConfig(ctx, name, manifest); err != nil {
+		r.logger.Error("error indexing image config", "error", err)
+	}
+	return nil
+}
+
+func (r *Registry) putTagLinks(ctx context.Context, name string, tag string, sha digest.Digest, precondition *linkPrecondition) error {
 	// TODO: check why on earth we need to put the same thing in at least 3 places... come on OCI
-	metaKey := fmt.Sprintf("docker/registry/v2/repositories/%s/_manifests/tags/%s/current/link", name, reference)
-	slog.Debug("putting manifest meta", "metaKey", metaKey)
+	metaKey := tagCurrentLinkKey(name, tag)
+	r.logger.Debug("putting manifest meta", "metaKey", metaKey)
 
-	_, err = r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+	linkInput := &s3.PutObjectInput{
 		Bucket: &r.bucket,
 		Key:    &metaKey,
 		Body:   strings.NewReader(sha.String()),
-	}, forcePathStyle)
+	}
+	precondition.apply(linkInput)
+	_, err := r.s3Client.PutObject(ctx, linkInput, forcePathStyle)
 	if err != nil {
 		return err
 	}
 
-	metaIndexKey := fmt.Sprintf("docker/registry/v2/repositories/%s/_manifests/tags/%s/index/%s/%s/link", name, reference, sha.Algorithm(), sha.Hex())
-	slog.Debug("putting manifest index meta", "metaIndexKey", metaIndexKey)
+	metaIndexKey := tagIndexLinkKey(name, tag, sha)
+	r.logger.Debug("putting manifest index meta", "metaIndexKey", metaIndexKey)
 	_, err = r.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: &r.bucket,
 		Key:    &metaIndexKey,
 		Body:   strings.NewReader(sha.String()),
 	}, forcePathStyle)
+	return err
+}
+
+func (r *Registry) deletePrefix(ctx context.Context, prefix string) (int, error) {
+	deleted := 0
+	var continuationToken *string
+	for {
+		req, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &r.bucket,
+			Prefix:            &prefix,
+			ContinuationToken: continuationToken,
+		}, forcePathStyle)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list objects: %w", err)
+		}
+
+		if len(req.Contents) > 0 {
+			objects := make([]types.ObjectIdentifier, 0, len(req.Contents))
+			for _, obj := range req.Contents {
+				objects = append(objects, types.ObjectIdentifier{Key: obj.Key})
+			}
+			_, err = r.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: &r.bucket,
+				Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			}, forcePathStyle)
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete objects: %w", err)
+			}
+			deleted += len(objects)
+		}
+
+		if req.IsTruncated == nil || !*req.IsTruncated {
+			break
+		}
+		continuationToken = req.NextContinuationToken
+	}
+	return deleted, nil
+}
+
+// Delete removes a tag, or a manifest along with every tag pointing at it when
+// reference is a digest. Immutable tags, and manifests they point at, are
+// never deleted.
+func (r *Registry) Delete(ctx context.Context, name string, reference string) error {
+	if isDigest(reference) {
+		if err := r.beforeDelete(ctx, Deletion{Repository: name, Digest: digest.Digest(reference)}); err != nil {
+			return err
+		}
+		return r.deleteManifest(ctx, name, digest.Digest(reference))
+	}
+	if r.isTagImmutable(name, reference) || r.isNamespaceImmutable(name) {
+		return fmt.Errorf("%w: %s:%s may not be deleted", ErrTagImmutable, name, reference)
+	}
+	if r.hasBeforeDelete() {
+		sha, err := r.getManifestSHA(ctx, name, reference)
+		if err != nil {
+			if isNotFound(err) {
+				return errors.Join(err, fs.ErrNotExist)
+			}
+			return err
+		}
+		if err := r.beforeDelete(ctx, Deletion{Repository: name, Tag: reference, Digest: sha}); err != nil {
+			return err
+		}
+	}
+	return r.deleteTag(ctx, name, reference)
+}
+
+func (r *Registry) deleteTag(ctx context.Context, name string, tag string) error {
+	return r.deleteTagIf(ctx, name, tag, "")
+}
+
+// errTagMoved is returned by deleteTagIf when the tag points at another
+// manifest than the expected one.
+var errTagMoved = errors.New("tag points at another manifest")
+
+// deleteTagIf deletes a tag under its write lock, as long as it still points
+// at expected, if given.
+func (r *Registry) deleteTagIf(ctx context.Context, name string, tag string, expected digest.Digest) error {
+	lockCtx, unlock, err := r.lockTagWrite(ctx, name, tag)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	revisionsKey := fmt.Sprintf("docker/registry/v2/repositories/%s/_manifests/revisions/%s/%s/link", name, sha.Algorithm(), sha.Hex())
-	slog.Debug("putting manifest revisions meta", "revisionsKey", revisionsKey)
-	_, err = r.s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &r.bucket,
-		Key:    &revisionsKey,
-		Body:   strings.NewReader(sha.String()),
-	}, forcePathStyle)
+	sha, err := r.getManifestSHA(lockCtx, name, tag)
+	if err != nil {
+		if isNotFound(err) {
+			return errors.Join(err, fs.ErrNotExist)
+		}
+		return err
+	}
+	if expected != "" && sha != expected {
+		return fmt.Errorf("%w: %s:%s", errTagMoved, name, tag)
+	}
+
+	if r.layout == LayoutOCI {
+		if err := r.deleteOCITag(lockCtx, name, tag); err != nil {
+			return fmt.Errorf("failed to delete tag from index: %w", tagWriteErr(lockCtx, err))
+		}
+	} else {
+		prefix := tagPrefix(name, tag)
+		deleted, err := r.deletePrefix(lockCtx, prefix)
+		if err != nil {
+			return fmt.Errorf("failed to delete tag links: %w", tagWriteErr(lockCtx, err))
+		}
+		r.logger.Debug("deleted tag", "name", name, "tag", tag, "objects", deleted)
+	}
+
+	if err := r.db.DeleteTag(name, tag); err != nil {
+		r.logger.Error("error deleting tag from database", "error", err)
+	}
+	r.storageUsage.Purge()
+
+	r.recordTagChange(name, tag, sha, true)
+	r.deleted(ctx, Deletion{Repository: name, Tag: tag, Digest: sha})
+	r.audit(ctx, AuditTagDelete, name, tag, sha.String())
+	return nil
+}
+
+func (r *Registry) deleteManifest(ctx context.Context, name string, sha digest.Digest) error {
+	tags, err := r.manifestTags(ctx, name, sha)
 	if err != nil {
 		return err
 	}
+	immutable, err := r.hasImmutableTag(ctx, name, sha, tags)
+	if err != nil {
+		return err
+	}
+	if immutable {
+		return fmt.Errorf("%w: %s@%s has an immutable tag", ErrTagImmutable, name, sha)
+	}
 
-	err = r.db.PutManifest(name, reference, string(manifestBytes), &manifest)
+	for _, tag := range tags {
+		err := r.deleteTagIf(ctx, name, tag, sha)
+		if errors.Is(err, errTagMoved) || errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete tag %s: %w", tag, err)
+		}
+	}
+
+	if r.layout == LayoutOCI {
+		err = r.deleteOCIManifest(ctx, name, sha)
+	} else {
+		revisionKey := revisionLinkKey(name, sha)
+		_, err = r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &r.bucket,
+			Key:    &revisionKey,
+		}, forcePathStyle)
+	}
 	if err != nil {
-		slog.Error("error storing manifest in database", "error", err)
+		return fmt.Errorf("failed to delete manifest revision: %w", err)
+	}
+	r.logger.Debug("deleted manifest", "name", name, "digest", sha)
+	r.forgetReferrer(ctx, name, sha)
+	if err := r.db.DeleteScan(name, sha.String()); err != nil {
+		r.logger.Error("error deleting scan", "error", err)
+	}
+	if err := r.db.DeleteIndexChildren(name, sha.String()); err != nil {
+		r.logger.Error("error deleting index children", "error", err)
+	}
+	if err := r.db.DeleteManifestExpiry(name, sha.String()); err != nil {
+		r.logger.Error("error deleting manifest expiry", "error", err)
 	}
+	if r.cascadeReferrers {
+		if err := r.deleteReferrersOf(ctx, name, sha); err != nil {
+			return fmt.Errorf("failed to delete referrers: %w", err)
+		}
+	}
+
+	r.deleted(ctx, Deletion{Repository: name, Digest: sha})
+	r.audit(ctx, AuditManifestDelete, name, sha.String(), sha.String())
 	return nil
 }
 
-func (r *Registry) startUpload(ctx context.Context, name string, reference string) error {
+// manifestTags returns the tags which may point at a manifest of the
+// repository, failing if the repository has no such manifest.
+func (r *Registry) manifestTags(ctx context.Context, name string, sha digest.Digest) ([]string, error) {
+	if r.layout == LayoutOCI {
+		return r.ociManifestTags(ctx, name, sha)
+	}
+	revisionKey := revisionLinkKey(name, sha)
+	_, err := r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &r.bucket,
+		Key:    &revisionKey,
+	}, forcePathStyle)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errors.Join(err, fs.ErrNotExist)
+		}
+		return nil, err
+	}
+
+	// Every tag which ever pointed at this digest has an index link for it,
+	// so only those need their current link checked.
+	prefix := tagsPrefix(name)
+	indexSuffix := fmt.Sprintf("/index/%s/%s/link", sha.Algorithm(), sha.Encoded())
+	var tags []string
+	var continuationToken *string
+	for {
+		req, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &r.bucket,
+			Prefix:            &prefix,
+			ContinuationToken: continuationToken,
+		}, forcePathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", err)
+		}
+		for _, obj := range req.Contents {
+			if strings.HasSuffix(*obj.Key, indexSuffix) {
+				tags = append(tags, strings.TrimSuffix(strings.TrimPrefix(*obj.Key, prefix), indexSuffix))
+			}
+		}
+		if req.IsTruncated == nil || !*req.IsTruncated {
+			return tags, nil
+		}
+		continuationToken = req.NextContinuationToken
+	}
+}
+
+// startUpload starts an upload of totalSize bytes, or of an unknown size if
+// it is not positive.
+func (r *Registry) startUpload(ctx context.Context, name string, reference string, totalSize int64) error {
+	if err := r.checkRepositoryName(name); err != nil {
+		return err
+	}
+	ctx, cancel := r.uploadContext(ctx)
+	defer cancel()
 	tempKey := fmt.Sprintf("uploads/%s.uploading", reference)
 
 	multipartInput := &s3.CreateMultipartUploadInput{
@@ -264,7 +1201,11 @@ func (r *Registry) startUpload(ctx context.Context, name string, reference strin
 		return fmt.Errorf("failed to create multipart upload: %w", err)
 	}
 
-	return r.db.CreateUploadSession(reference, name, tempKey)
+	if err := r.db.CreateUploadSession(reference, name, tempKey, totalSize); err != nil {
+		return err
+	}
+	r.audit(ctx, AuditUploadStart, name, reference, "")
+	return nil
 }
 
 func (r *Registry) uploadChunk(ctx context.Context, reference string, offset int64, body io.ReadCloser) (int64, error) {
@@ -282,7 +1223,9 @@ func (r *Registry) uploadChunk(ctx context.Context, reference string, offset int
 			Key:    &tempKey,
 		}
 
-		multipartOutput, err := r.s3Client.CreateMultipartUpload(ctx, multipartInput, forcePathStyle)
+		createCtx, cancel := r.uploadContext(ctx)
+		multipartOutput, err := r.s3Client.CreateMultipartUpload(createCtx, multipartInput, forcePathStyle)
+		cancel()
 		if err != nil {
 			return 0, fmt.Errorf("failed to create multipart upload: %w", err)
 		}
@@ -293,29 +1236,13 @@ func (r *Registry) uploadChunk(ctx context.Context, reference string, offset int
 		return 0, fmt.Errorf("invalid offset: expected %d, got %d", uploadedSize, offset)
 	}
 
-	partNumber := int32((offset / (5 * 1024 * 1024)) + 1)
-
-	buf := &bytes.Buffer{}
-	n, err := io.Copy(buf, body)
-	if err != nil {
-		return 0, fmt.Errorf("failed to read request body: %w", err)
-	}
-
-	uploadPartInput := &s3.UploadPartInput{
-		Bucket:     &r.bucket,
-		Key:        &s3Key,
-		PartNumber: &partNumber,
-		UploadId:   &s3UploadID,
-		Body:       bytes.NewReader(buf.Bytes()),
-	}
-
-	_, err = r.s3Client.UploadPart(ctx, uploadPartInput, forcePathStyle)
+	n, parts, err := r.uploadParts(ctx, s3Key, s3UploadID, offset, body)
 	if err != nil {
-		return 0, fmt.Errorf("failed to upload part: %w", err)
+		return 0, err
 	}
 
 	newUploadedSize := uploadedSize + n
-	err = r.db.UpdateUploadSession(reference, s3UploadID, newUploadedSize)
+	err = r.db.UpdateUploadSession(reference, s3UploadID, newUploadedSize, parts)
 	if err != nil {
 		return 0, fmt.Errorf("failed to update upload session: %w", err)
 	}
@@ -323,8 +1250,13 @@ func (r *Registry) uploadChunk(ctx context.Context, reference string, offset int
 	return n, nil
 }
 
-func (r *Registry) completeUpload(ctx context.Context, reference string, dig string) error {
-	s3UploadID, s3Key, _, err := r.db.GetUploadSession(reference)
+// completeUpload stores an upload as the blob dig. Unless verified, because it
+// was read through a verifying reader, the upload is read back and hashed
+// first, since chunks are not hashed as they arrive.
+func (r *Registry) completeUpload(ctx context.Context, name string, reference string, dig string, verified bool) error {
+	ctx, cancel := r.uploadContext(ctx)
+	defer cancel()
+	s3UploadID, s3Key, uploadedSize, err := r.db.GetUploadSession(reference)
 	if err != nil {
 		return fmt.Errorf("upload session not found: %w", err)
 	}
@@ -370,12 +1302,22 @@ func (r *Registry) completeUpload(ctx context.Context, reference string, dig str
 	if err != nil {
 		return fmt.Errorf("failed to parse digest: %w", err)
 	}
+	if !verified {
+		if err := r.verifyUpload(ctx, s3Key, sha); err != nil {
+			if errors.Is(err, errBlobDigestMismatch) {
+				r.discardUpload(ctx, reference, s3Key)
+			}
+			return err
+		}
+	}
 
-	hex := sha.Hex()
-	finalBlobKey := fmt.Sprintf("docker/registry/v2/blobs/sha256/%s/%s/data", hex[0:2], hex)
+	finalBlobKey := r.layoutBlobKey(name, sha)
+	if err := r.claimBlobs(ctx, []digest.Digest{sha}); err != nil {
+		return err
+	}
 
 	copyInput := &s3.CopyObjectInput{
-		Bucket:     &r.bucket,
+		Bucket:     aws.String(r.bucketFor(finalBlobKey)),
 		Key:        &finalBlobKey,
 		CopySource: aws.String(fmt.Sprintf("%s/%s", r.bucket, s3Key)),
 	}
@@ -384,6 +1326,11 @@ func (r *Registry) completeUpload(ctx context.Context, reference string, dig str
 	if err != nil {
 		return fmt.Errorf("failed to copy blob to final location: %w", err)
 	}
+	if r.layout == LayoutDistribution {
+		if err := r.putLink(ctx, layerLinkKey(name, sha), sha); err != nil {
+			return fmt.Errorf("failed to link blob: %w", err)
+		}
+	}
 
 	deleteInput := &s3.DeleteObjectInput{
 		Bucket: &r.bucket,
@@ -392,22 +1339,61 @@ func (r *Registry) completeUpload(ctx context.Context, reference string, dig str
 
 	_, err = r.s3Client.DeleteObject(ctx, deleteInput, forcePathStyle)
 	if err != nil {
-		slog.Warn("failed to delete temporary upload file", "key", s3Key, "error", err)
+		r.logger.Warn("failed to delete temporary upload file", "key", s3Key, "error", err)
 	}
 
 	err = r.db.DeleteUploadSession(reference)
 	if err != nil {
-		slog.Warn("failed to delete upload session", "reference", reference, "error", err)
+		r.logger.Warn("failed to delete upload session", "reference", reference, "error", err)
 	}
 
-	slog.Debug("completed upload", "tempKey", s3Key, "finalKey", finalBlobKey)
+	r.logger.Debug("completed upload", "tempKey", s3Key, "finalKey", finalBlobKey)
+
+	r.blobUploaded(ctx, BlobUpload{Repository: name, Digest: sha, Size: uploadedSize})
+	r.audit(ctx, AuditUploadComplete, name, reference, sha.String())
 	return nil
 }
 
+// verifyUpload hashes the assembled upload at s3Key, returning
+// errBlobDigestMismatch unless it matches sha.
+func (r *Registry) verifyUpload(ctx context.Context, s3Key string, sha digest.Digest) error {
+	obj, err := r.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &r.bucket,
+		Key:    &s3Key,
+	}, forcePathStyle)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer obj.Body.Close()
+	verifier := sha.Verifier()
+	if _, err := io.Copy(verifier, obj.Body); err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("%w %s", errBlobDigestMismatch, sha)
+	}
+	return nil
+}
+
+// discardUpload drops an upload whose multipart upload was completed, but
+// whose content turned out not to be the blob it was completed as.
+func (r *Registry) discardUpload(ctx context.Context, reference string, s3Key string) {
+	if _, err := r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &r.bucket, Key: &s3Key}, forcePathStyle); err != nil {
+		r.logger.Warn("failed to delete temporary upload file", "key", s3Key, "error", err)
+	}
+	if err := r.db.DeleteUploadSession(reference); err != nil {
+		r.logger.Warn("failed to delete upload session", "reference", reference, "error", err)
+	}
+}
+
 func (r *Registry) getUploadSession(uploadID string) (string, string, int64, error) {
 	return r.db.GetUploadSession(uploadID)
 }
 
+func (r *Registry) getUploadProgress(uploadID string) (*UploadProgress, error) {
+	return r.db.GetUploadProgress(uploadID)
+}
+
 func (r *Registry) abortUpload(ctx context.Context, uploadID string) error {
 	s3UploadID, s3Key, _, err := r.db.GetUploadSession(uploadID)
 	if err != nil {
@@ -423,20 +1409,20 @@ func (r *Registry) abortUpload(ctx context.Context, uploadID string) error {
 
 		_, err = r.s3Client.AbortMultipartUpload(ctx, abortInput, forcePathStyle)
 		if err != nil {
-			slog.Warn("failed to abort multipart upload", "uploadID", s3UploadID, "error", err)
+			r.logger.Warn("failed to abort multipart upload", "uploadID", s3UploadID, "error", err)
 		}
 	}
 
 	err = r.db.DeleteUploadSession(uploadID)
 	if err != nil {
-		slog.Warn("failed to delete upload session", "uploadID", uploadID, "error", err)
+		r.logger.Warn("failed to delete upload session", "uploadID", uploadID, "error", err)
 	}
 
 	return nil
 }
 
 func (r *Registry) CleanupStaleUploads(ctx context.Context) error {
-	uploadIDs, err := r.db.GetStaleUploadSessions("-24 hours")
+	uploadIDs, err := r.db.GetStaleUploadSessions(staleUploadAge)
 	if err != nil {
 		return fmt.Errorf("failed to get stale upload sessions: %w", err)
 	}
@@ -444,74 +1430,50 @@ func (r *Registry) CleanupStaleUploads(ctx context.Context) error {
 	for _, uploadID := range uploadIDs {
 		err := r.abortUpload(ctx, uploadID)
 		if err != nil {
-			slog.Warn("failed to cleanup stale upload", "uploadID", uploadID, "error", err)
+			r.logger.Warn("failed to cleanup stale upload", "uploadID", uploadID, "error", err)
 		}
 	}
 
-	slog.Info("cleaned up stale uploads", "count", len(uploadIDs))
+	r.logger.Info("cleaned up stale uploads", "count", len(uploadIDs))
 	return nil
 }
 
 func (r *Registry) listTags(ctx context.Context, name string) ([]string, error) {
+	tags, err := shared(ctx, &r.flights, "tags\x00"+name, func(ctx context.Context) ([]string, error) {
+		return r.fetchTags(ctx, name)
+	})
+	// Callers may sort or trim the result, so each gets its own copy.
+	return slices.Clone(tags), err
+}
+
+func (r *Registry) fetchTags(ctx context.Context, name string) ([]string, error) {
+	start := time.Now()
 	readyTags, err := r.db.ListTags(name)
+	r.cacheMetrics.recordLookup(lookupTags, err == nil && len(readyTags) > 0, time.Since(start))
 	if err == nil && len(readyTags) > 0 {
 		return readyTags, nil
 	}
 
-	var repoTags []string
-	var continuationToken *string
-	prefix := fmt.Sprintf("docker/registry/v2/repositories/%s/_manifests/tags/", name)
-	for {
-		req, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-			Bucket:            &r.bucket,
-			Prefix:            &prefix,
-			ContinuationToken: continuationToken,
-		}, forcePathStyle)
-		if err != nil {
-			return nil, err
-		}
-
-		for _, obj := range req.Contents {
-			if strings.HasSuffix(*obj.Key, "current/link") {
-				tag := strings.TrimSuffix(
-					strings.TrimPrefix(
-						*obj.Key,
-						fmt.Sprintf("docker/registry/v2/repositories/%s/_manifests/tags/", name),
-					),
-					"/current/link",
-				)
-				repoTags = append(repoTags, tag)
-			}
-		}
-		if req.IsTruncated == nil || !*req.IsTruncated {
-			break
-		}
-		continuationToken = req.NextContinuationToken
+	repoTags, err := r.listStoredTags(ctx, name)
+	if err != nil {
+		return nil, err
 	}
 
 	err = r.db.PutTags(name, repoTags)
 	if err != nil {
-		slog.Error("error storing tags in database", "error", err)
+		r.logger.Error("error storing tags in database", "error", err)
 	}
 
 	return repoTags, nil
 }
 
-func (r *Registry) listRepositories(_ context.Context, continuationToken *string, n int) ([]string, *string, error) {
-	return r.db.ListRepositories(continuationToken, n)
-}
-
-func (r *Registry) Bootstrap(ctx context.Context) error {
-	prefix := "docker/registry/v2/repositories/"
+func (r *Registry) listStoredTags(ctx context.Context, name string) ([]string, error) {
+	if r.layout == LayoutOCI {
+		return r.listOCITags(ctx, name)
+	}
+	var repoTags []string
 	var continuationToken *string
-
-	group, ctx := errgroup.WithContext(ctx)
-	group.SetLimit(runtime.NumCPU() * 4)
-
-	found := uint64(0)
-	skipped := uint64(0)
-	processed := uint64(0)
-	processing := int64(0)
+	prefix := tagsPrefix(name)
 	for {
 		req, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 			Bucket:            &r.bucket,
@@ -519,37 +1481,13 @@ func (r *Registry) Bootstrap(ctx context.Context) error {
 			ContinuationToken: continuationToken,
 		}, forcePathStyle)
 		if err != nil {
-			return err
+			return nil, err
 		}
+
 		for _, obj := range req.Contents {
 			if strings.HasSuffix(*obj.Key, "current/link") {
-				found++
-				noPrefix := strings.TrimPrefix(*obj.Key, "docker/registry/v2/repositories/")
-				repo, tag, ok := strings.Cut(noPrefix, "/_manifests/tags/")
-				if !ok {
-					continue
-				}
-				tag = strings.TrimSuffix(tag, "/current/link")
-				if r.db.Exists(repo, tag) {
-					skipped++
-					if skipped%10000 == 5000 {
-						slog.Info("Bootstrap progress", "skipped", skipped)
-					}
-					continue
-				}
-				group.Go(func() error {
-					atomic.AddInt64(&processing, 1)
-					defer atomic.AddInt64(&processing, -1)
-					_, _, err := r.getManifest(ctx, repo, tag)
-					atomic.AddUint64(&processed, 1)
-					if err != nil {
-						slog.Warn("error getting manifest", "repo", repo, "tag", tag, "error", err)
-					}
-					return nil
-				})
-				if found%1000 == 500 {
-					slog.Info("Bootstrap progress", "found", found, "processed", processed, "processing", processing)
-				}
+				tag := strings.TrimSuffix(strings.TrimPrefix(*obj.Key, prefix), "/current/link")
+				repoTags = append(repoTags, tag)
 			}
 		}
 		if req.IsTruncated == nil || !*req.IsTruncated {
@@ -557,30 +1495,64 @@ func (r *Registry) Bootstrap(ctx context.Context) error {
 		}
 		continuationToken = req.NextContinuationToken
 	}
-	return group.Wait()
+	return repoTags, nil
 }
 
-func (r *Registry) listAllTags(_ context.Context, continuationToken *string, n int) ([]map[string]string, *string, error) {
-	return r.db.ListAllTags(continuationToken, n)
+func (r *Registry) listRepositories(ctx context.Context, continuationToken *string, n int) ([]string, *string, error) {
+	repositories, next, err := r.db.ListRepositories(continuationToken, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	repositories, err = pullableOnly(ctx, r, repositories, func(repo string) string { return repo })
+	return repositories, next, err
+}
+
+func (r *Registry) listAllTags(ctx context.Context, continuationToken *string, n int) ([]map[string]string, *string, error) {
+	tags, next, err := r.db.ListAllTags(continuationToken, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	tags, err = pullableOnly(ctx, r, tags, func(tag map[string]string) string { return tag["repository"] })
+	return tags, next, err
 }
 
 func (r *Registry) listLayers(_ context.Context, continuationToken *string, n int) ([]map[string]interface{}, *string, error) {
 	return r.db.ListLayers(continuationToken, n)
 }
 
-func (r *Registry) listManifests(_ context.Context, continuationToken *string, n int) ([]map[string]string, *string, error) {
-	return r.db.ListManifests(continuationToken, n)
+func (r *Registry) listManifests(ctx context.Context, continuationToken *string, n int) ([]map[string]string, *string, error) {
+	manifests, next, err := r.db.ListManifests(continuationToken, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifests, err = pullableOnly(ctx, r, manifests, func(manifest map[string]string) string { return manifest["repository"] })
+	return manifests, next, err
 }
 
-func (r *Registry) listUploadSessions(_ context.Context) ([]map[string]interface{}, error) {
-	return r.db.ListUploadSessions()
+func (r *Registry) listUploadSessions(ctx context.Context) ([]map[string]interface{}, error) {
+	sessions, err := r.db.ListUploadSessions()
+	if err != nil {
+		return nil, err
+	}
+	return pullableOnly(ctx, r, sessions, func(session map[string]interface{}) string { return session["repository"].(string) })
 }
 
-func (r *Registry) getRegistryStats(_ context.Context) (map[string]interface{}, error) {
+func (r *Registry) Stats(_ context.Context) (map[string]interface{}, error) {
 	return r.db.GetRegistryStats()
 }
 
 func (r *Registry) Close() error {
+	r.jobs.stop()
+	r.scrubber.stop()
+	r.replicator.stop()
+	r.webhooks.stop()
+	r.scans.stop()
+	r.auditLog.stop()
+	r.usage.stop()
+	r.fallback.stop()
+	r.regions.stop()
+	r.events.close()
+	r.stopLeaderElection()
 	if err := r.db.Close(); err != nil {
 		return fmt.Errorf("failed to close database: %w", err)
 	}
@@ -0,0 +1,293 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rekorTimeout = 10 * time.Second
+
+// rekorLog is the Rekor transparency log signatures may be required to be
+// recorded in.
+type rekorLog struct {
+	key crypto.PublicKey
+	// Hex SHA-256 of the log's public key, which identifies its entries.
+	logID string
+	// Where inclusion proofs are fetched from, if set.
+	url    *url.URL
+	client *http.Client
+}
+
+func newRekorLog(keyPEM []byte, rawURL string) (*rekorLog, error) {
+	key, err := parsePublicKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Rekor public key: %w", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Rekor public key: %w", err)
+	}
+	logID := sha256.Sum256(der)
+	log := &rekorLog{key: key, logID: hex.EncodeToString(logID[:])}
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid Rekor URL %q", rawURL)
+		}
+		log.url = u
+		log.client = &http.Client{Timeout: rekorTimeout}
+	}
+	return log, nil
+}
+
+// rekorBundle is what cosign attaches to a signature it uploaded to Rekor:
+// the log entry, and the log's promise to include it.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte           `json:"SignedEntryTimestamp"`
+	Payload              rekorBundleEntry `json:"Payload"`
+}
+
+// rekorBundleEntry is signed by the log as canonical JSON, with its keys in
+// this order.
+type rekorBundleEntry struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// rekorEntryBody covers the hashedrekord and rekord entries cosign creates.
+type rekorEntryBody struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verify checks that the bundle of a signature records it in the log: the
+// log signed the entry, and the entry is of the same signature over the same
+// payload by the same signer. A keyless signature must have been logged while
+// its short-lived certificate was valid.
+func (l *rekorLog) verify(ctx context.Context, bundleJSON string, payload []byte, sig []byte, cert *x509.Certificate) error {
+	if bundleJSON == "" {
+		return errors.New("signature is not in the transparency log")
+	}
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(bundleJSON), &bundle); err != nil {
+		return fmt.Errorf("invalid transparency log bundle: %w", err)
+	}
+	entry := bundle.Payload
+	if entry.LogID != l.logID {
+		return errors.New("signature is in an untrusted transparency log")
+	}
+	canonical, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if !verifySignature(l.key, canonical, bundle.SignedEntryTimestamp) {
+		return errors.New("transparency log entry is not signed by the log")
+	}
+
+	bodyJSON, err := base64.StdEncoding.DecodeString(entry.Body)
+	if err != nil {
+		return fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+	var body rekorEntryBody
+	if err := json.Unmarshal(bodyJSON, &body); err != nil {
+		return fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+	if body.Kind != "hashedrekord" && body.Kind != "rekord" {
+		return fmt.Errorf("unsupported transparency log entry kind %q", body.Kind)
+	}
+	hash := sha256.Sum256(payload)
+	if body.Spec.Data.Hash.Algorithm != "sha256" || body.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) {
+		return errors.New("transparency log entry is for another payload")
+	}
+	if !bytes.Equal(body.Spec.Signature.Content, sig) {
+		return errors.New("transparency log entry is for another signature")
+	}
+	if cert != nil {
+		logged, err := parseCertificates(body.Spec.Signature.PublicKey.Content)
+		if err != nil || !logged[0].Equal(cert) {
+			return errors.New("transparency log entry is for another certificate")
+		}
+		integrated := time.Unix(entry.IntegratedTime, 0)
+		if integrated.Before(cert.NotBefore) || integrated.After(cert.NotAfter) {
+			return errors.New("signature was logged outside of its certificate's validity")
+		}
+	} else {
+		key, err := parsePublicKey(body.Spec.Signature.PublicKey.Content)
+		if err != nil || !verifySignature(key, payload, sig) {
+			return errors.New("transparency log entry is for another key")
+		}
+	}
+
+	if l.url != nil {
+		return l.verifyInclusion(ctx, entry)
+	}
+	return nil
+}
+
+type rekorLogEntry struct {
+	Body         string `json:"body"`
+	Verification struct {
+		InclusionProof *struct {
+			Checkpoint string   `json:"checkpoint"`
+			Hashes     []string `json:"hashes"`
+			LogIndex   int64    `json:"logIndex"`
+			RootHash   string   `json:"rootHash"`
+			TreeSize   int64    `json:"treeSize"`
+		} `json:"inclusionProof"`
+	} `json:"verification"`
+}
+
+// verifyInclusion fetches the entry from the log and checks its proof of
+// inclusion in a tree head signed by the log, so that the entry is public
+// rather than only promised to be.
+func (l *rekorLog) verifyInclusion(ctx context.Context, entry rekorBundleEntry) error {
+	u := l.url.JoinPath("api/v1/log/entries")
+	u.RawQuery = "logIndex=" + strconv.FormatInt(entry.LogIndex, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch transparency log entry: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("transparency log responded with status %d", resp.StatusCode)
+	}
+	var entries map[string]rekorLogEntry
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSignaturePayloadSize)).Decode(&entries); err != nil {
+		return fmt.Errorf("invalid transparency log response: %w", err)
+	}
+
+	for _, logged := range entries {
+		if logged.Body != entry.Body {
+			return errors.New("transparency log holds another entry at the index of the signature")
+		}
+		proof := logged.Verification.InclusionProof
+		if proof == nil {
+			return errors.New("transparency log returned no inclusion proof")
+		}
+		root, err := hex.DecodeString(proof.RootHash)
+		if err != nil {
+			return fmt.Errorf("invalid inclusion proof: %w", err)
+		}
+		hashes := make([][]byte, len(proof.Hashes))
+		for i, h := range proof.Hashes {
+			if hashes[i], err = hex.DecodeString(h); err != nil {
+				return fmt.Errorf("invalid inclusion proof: %w", err)
+			}
+		}
+		body, err := base64.StdEncoding.DecodeString(logged.Body)
+		if err != nil {
+			return fmt.Errorf("invalid transparency log entry: %w", err)
+		}
+		leaf := sha256.Sum256(append([]byte{0}, body...))
+		if err := verifyMerkleInclusion(uint64(proof.LogIndex), uint64(proof.TreeSize), leaf[:], hashes, root); err != nil {
+			return err
+		}
+		return l.verifyCheckpoint(proof.Checkpoint, proof.TreeSize, root)
+	}
+	return errors.New("transparency log entry not found")
+}
+
+// verifyMerkleInclusion checks an RFC 9162 inclusion proof of the leaf at
+// index in a tree of size leaves with the given root.
+func verifyMerkleInclusion(index uint64, size uint64, leaf []byte, proof [][]byte, root []byte) error {
+	if index >= size {
+		return errors.New("inclusion proof index is outside of the tree")
+	}
+	node := func(left []byte, right []byte) []byte {
+		h := sha256.New()
+		h.Write([]byte{1})
+		h.Write(left)
+		h.Write(right)
+		return h.Sum(nil)
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return errors.New("inclusion proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = node(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = node(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return errors.New("inclusion proof is too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("inclusion proof does not match the tree root")
+	}
+	return nil
+}
+
+// verifyCheckpoint checks that the log signed the tree head a proof leads to.
+// Checkpoints are signed notes: an origin line, the tree size and the base64
+// root hash, then after a blank line "— <name> <base64 key hint and
+// signature>" lines.
+func (l *rekorLog) verifyCheckpoint(checkpoint string, size int64, root []byte) error {
+	text, signatures, found := strings.Cut(checkpoint, "\n\n")
+	if !found {
+		return errors.New("invalid checkpoint")
+	}
+	text += "\n"
+	lines := strings.Split(text, "\n")
+	if len(lines) < 3 || lines[1] != strconv.FormatInt(size, 10) || lines[2] != base64.StdEncoding.EncodeToString(root) {
+		return errors.New("checkpoint is not of the proven tree")
+	}
+	for _, line := range strings.Split(signatures, "\n") {
+		line, ok := strings.CutPrefix(line, "— ")
+		if !ok {
+			continue
+		}
+		_, encoded, _ := strings.Cut(line, " ")
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(sig) < 5 {
+			continue
+		}
+		if verifySignature(l.key, []byte(text), sig[4:]) {
+			return nil
+		}
+	}
+	return errors.New("checkpoint is not signed by the transparency log")
+}
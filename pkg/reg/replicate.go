@@ -0,0 +1,199 @@
+package reg
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	replicationPollInterval = 30 * time.Second
+	replicationMaxBackoff   = time.Hour
+	replicationBatchSize    = 32
+)
+
+type replicationTarget struct {
+	name      string
+	namespace string
+	client    *upstreamClient
+}
+
+func newReplicationTarget(target *url.URL) *replicationTarget {
+	namespace := strings.Trim(target.Path, "/")
+	base := *target
+	base.Path = ""
+	client := newUpstreamClient(&base)
+	return &replicationTarget{
+		name:      strings.TrimSuffix(client.String()+"/"+namespace, "/"),
+		namespace: namespace,
+		client:    client,
+	}
+}
+
+func (t *replicationTarget) repository(name string) string {
+	if t.namespace == "" {
+		return name
+	}
+	return t.namespace + "/" + name
+}
+
+type replicator struct {
+	registry *Registry
+	targets  map[string]*replicationTarget
+	wake     chan struct{}
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func (r *Registry) addReplicationTarget(target *url.URL) {
+	if r.replicator == nil {
+		r.replicator = &replicator{
+			registry: r,
+			targets:  make(map[string]*replicationTarget),
+			wake:     make(chan struct{}, 1),
+		}
+	}
+	t := newReplicationTarget(target)
+	r.replicator.targets[t.name] = t
+}
+
+func (rp *replicator) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	rp.cancel = cancel
+	rp.wg.Add(1)
+	go func() {
+		defer rp.wg.Done()
+		rp.run(ctx)
+	}()
+}
+
+func (rp *replicator) stop() {
+	if rp == nil || rp.cancel == nil {
+		return
+	}
+	rp.cancel()
+	rp.wg.Wait()
+}
+
+func (rp *replicator) enqueue(name string, reference string, sha digest.Digest) {
+	if rp == nil {
+		return
+	}
+	for target := range rp.targets {
+		if err := rp.registry.db.EnqueueReplication(target, name, reference, sha.String()); err != nil {
+			rp.registry.logger.Error("failed to enqueue replication", "target", target, "name", name, "reference", reference, "error", err)
+		}
+	}
+	select {
+	case rp.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (rp *replicator) run(ctx context.Context) {
+	ticker := time.NewTicker(replicationPollInterval)
+	defer ticker.Stop()
+	for {
+		rp.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rp.wake:
+		}
+	}
+}
+
+func (rp *replicator) processDue(ctx context.Context) {
+	if !rp.registry.isLeader() {
+		return
+	}
+	for {
+		tasks, err := rp.registry.db.DueReplications(replicationBatchSize)
+		if err != nil {
+			rp.registry.logger.Error("failed to load replication queue", "error", err)
+			return
+		}
+		if len(tasks) == 0 {
+			return
+		}
+		for _, task := range tasks {
+			if ctx.Err() != nil {
+				return
+			}
+			rp.process(ctx, task)
+		}
+	}
+}
+
+func (rp *replicator) process(ctx context.Context, task ReplicationTask) {
+	target, ok := rp.targets[task.Target]
+	if !ok {
+		rp.registry.logger.Warn("dropping replication for unknown target", "target", task.Target, "id", task.ID)
+		if err := rp.registry.db.DeleteReplication(task.ID); err != nil {
+			rp.registry.logger.Error("failed to delete replication task", "id", task.ID, "error", err)
+		}
+		return
+	}
+
+	err := rp.registry.replicateManifest(ctx, target, task.Repository, task.Reference, digest.Digest(task.Digest))
+	if err == nil {
+		rp.registry.logger.Info("replicated manifest", "target", task.Target, "name", task.Repository, "reference", task.Reference)
+		if err := rp.registry.db.DeleteReplication(task.ID); err != nil {
+			rp.registry.logger.Error("failed to delete replication task", "id", task.ID, "error", err)
+		}
+		return
+	}
+
+	backoff := min(time.Duration(1<<min(task.Attempts, 12))*time.Second, replicationMaxBackoff)
+	rp.registry.logger.Warn("replication failed", "target", task.Target, "name", task.Repository, "reference", task.Reference, "attempt", task.Attempts+1, "retryIn", backoff, "error", err)
+	if err := rp.registry.db.RetryReplication(task.ID, err.Error(), backoff); err != nil {
+		rp.registry.logger.Error("failed to reschedule replication task", "id", task.ID, "error", err)
+	}
+}
+
+func (r *Registry) replicateManifest(ctx context.Context, target *replicationTarget, name string, reference string, sha digest.Digest) error {
+	_, manifestBytes, err := r.getStoredManifest(ctx, name, sha.String())
+	if err != nil {
+		return fmt.Errorf("failed to read manifest %s: %w", sha, err)
+	}
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+
+	targetRepo := target.repository(name)
+	for _, child := range manifest.Manifests {
+		if err := r.replicateManifest(ctx, target, name, child.Digest.String(), child.Digest); err != nil {
+			return fmt.Errorf("failed to replicate child manifest %s: %w", child.Digest, err)
+		}
+	}
+	for _, blob := range manifest.blobs() {
+		if err := r.replicateBlob(ctx, target, name, targetRepo, blob.Digest); err != nil {
+			return fmt.Errorf("failed to replicate blob %s: %w", blob.Digest, err)
+		}
+	}
+
+	return target.client.putManifest(ctx, targetRepo, reference, manifest.mediaType(), manifestBytes)
+}
+
+func (r *Registry) replicateBlob(ctx context.Context, target *replicationTarget, name string, targetRepo string, dgst digest.Digest) error {
+	exists, err := target.client.blobExists(ctx, targetRepo, dgst)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	body, size, err := r.openBlob(ctx, name, dgst)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return target.client.pushBlob(ctx, targetRepo, dgst, body, size)
+}
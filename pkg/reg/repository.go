@@ -0,0 +1,278 @@
+package reg
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+type RepositoryDeletion struct {
+	Repository string `json:"repository"`
+	Tags       int    `json:"tags"`
+	Objects    int    `json:"objects"`
+	Uploads    int    `json:"uploads"`
+	// Blobs which were linked from the repository and may be left unreferenced.
+	Blobs []digest.Digest `json:"-"`
+}
+
+// DeleteRepository removes every tag, manifest revision and layer link of a
+// repository from S3 and the database, and aborts its pending uploads. Blobs
+// stay in place; pass the returned candidates to CollectBlobs to reclaim them.
+func (r *Registry) DeleteRepository(ctx context.Context, name string) (*RepositoryDeletion, error) {
+	deletion := &RepositoryDeletion{Repository: name}
+	found := false
+	var tags []string
+	var links blobLinks
+	// Only the repository's own directories are listed and deleted, since a
+	// nested repository shares its prefix.
+	var prefixes []string
+	if r.layout == LayoutOCI {
+		index, err := r.readOCIIndex(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read repository index: %w", err)
+		}
+		found = index.etag != ""
+		tags = index.tags()
+		// The blobs are the repository's own copies, so they go along with it.
+		prefixes = []string{ociBlobsPrefix(name), ociIndexKey(name), ociLayoutKey(name)}
+	} else {
+		manifestsPrefix := fmt.Sprintf("%s%s/_manifests/", repositoriesPrefix, name)
+		layersPrefix := fmt.Sprintf("%s%s/_layers/", repositoriesPrefix, name)
+		uploadsPrefix := fmt.Sprintf("%s%s/_uploads/", repositoriesPrefix, name)
+		tagKeys := tagsPrefix(name)
+		prefixes = []string{manifestsPrefix, layersPrefix, uploadsPrefix}
+
+		for _, prefix := range []string{manifestsPrefix, layersPrefix} {
+			err := r.walkPrefix(ctx, prefix, "", func(key string) {
+				found = true
+				if strings.HasPrefix(key, tagKeys) && strings.HasSuffix(key, "/current/link") {
+					tags = append(tags, strings.TrimSuffix(strings.TrimPrefix(key, tagKeys), "/current/link"))
+				}
+				links.add(key)
+			}, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list repository: %w", err)
+			}
+		}
+	}
+	deletion.Tags = len(tags)
+	if !found {
+		cached, err := r.db.CacheEntries(name, "")
+		if err != nil {
+			return nil, err
+		}
+		if len(cached) == 0 {
+			return nil, fs.ErrNotExist
+		}
+	}
+	if err := r.beforeDelete(ctx, Deletion{Repository: name}); err != nil {
+		return nil, err
+	}
+
+	// Blobs pushed through the API have no layer link, so the manifests are
+	// read to find them before they are gone.
+	blobs, err := r.referencedBlobs(ctx, links, nil)
+	if err != nil {
+		return nil, err
+	}
+	for dgst := range blobs {
+		deletion.Blobs = append(deletion.Blobs, dgst)
+	}
+
+	uploadIDs, err := r.db.RepositoryUploadSessions(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, uploadID := range uploadIDs {
+		if err := r.abortUpload(ctx, uploadID); err != nil {
+			r.logger.Warn("failed to abort upload", "uploadID", uploadID, "error", err)
+			continue
+		}
+		deletion.Uploads++
+	}
+
+	for _, prefix := range prefixes {
+		deleted, err := r.deletePrefix(ctx, prefix)
+		deletion.Objects += deleted
+		if err != nil {
+			return deletion, fmt.Errorf("failed to delete repository objects: %w", err)
+		}
+	}
+
+	if err := r.db.EvictRepository(name); err != nil {
+		r.logger.Error("error deleting repository from database", "error", err)
+	}
+	if err := r.db.DeleteRepositoryReferrers(name); err != nil {
+		r.logger.Error("error deleting repository referrers", "error", err)
+	}
+	if err := r.db.DeleteRepositoryScans(name); err != nil {
+		r.logger.Error("error deleting repository scans", "error", err)
+	}
+	if err := r.db.DeleteRepositoryIndexChildren(name); err != nil {
+		r.logger.Error("error deleting repository index children", "error", err)
+	}
+	if err := r.db.DeleteRepositoryManifestExpiry(name); err != nil {
+		r.logger.Error("error deleting repository manifest expiry", "error", err)
+	}
+	r.storageUsage.Purge()
+	for _, tag := range tags {
+		r.recordTagChange(name, tag, "", true)
+	}
+
+	r.deleted(ctx, Deletion{Repository: name})
+	r.audit(ctx, AuditRepoDelete, name, "", "")
+	return deletion, nil
+}
+
+// CollectBlobs deletes those of the given blobs which no repository links to
+// anymore, and returns how many were deleted. Blobs written or referred to by
+// a push within the grace period, or since the oldest upload in progress
+// started, are kept, as the image they belong to may not be pushed yet.
+func (r *Registry) CollectBlobs(ctx context.Context, candidates []digest.Digest) (int, error) {
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	// Taken before the links are listed, so that blobs of manifests pushed
+	// after the listing are newer.
+	cutoff, err := r.collectionCutoff()
+	if err != nil {
+		return 0, err
+	}
+	unreferenced := make(map[digest.Digest]struct{}, len(candidates))
+	for _, dgst := range candidates {
+		unreferenced[dgst] = struct{}{}
+	}
+	var links blobLinks
+	err = r.walkPrefix(ctx, repositoriesPrefix, "", links.add, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list repositories: %w", err)
+	}
+	referenced, err := r.referencedBlobs(ctx, links, unreferenced)
+	if err != nil {
+		return 0, err
+	}
+	for dgst := range referenced {
+		delete(unreferenced, dgst)
+	}
+
+	deleted := 0
+	for dgst := range unreferenced {
+		collected, err := r.collectBlob(ctx, dgst, cutoff)
+		if err != nil {
+			return deleted, err
+		}
+		if collected {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// blobLinks collects the layer and manifest revision links, which are the
+// links that keep a blob alive.
+type blobLinks struct {
+	layers    []digest.Digest
+	revisions []digest.Digest
+}
+
+func (l *blobLinks) add(key string) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 4 || parts[len(parts)-1] != "link" {
+		return
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[len(parts)-3]), parts[len(parts)-2])
+	if dgst.Validate() != nil {
+		return
+	}
+	switch parts[len(parts)-4] {
+	case "_layers":
+		l.layers = append(l.layers, dgst)
+	case "revisions":
+		l.revisions = append(l.revisions, dgst)
+	}
+}
+
+// referencedBlobs returns the linked digests together with everything the
+// linked manifests refer to. With wanted set, it stops reading manifests as
+// soon as all of wanted were found.
+func (r *Registry) referencedBlobs(ctx context.Context, links blobLinks, wanted map[digest.Digest]struct{}) (map[digest.Digest]struct{}, error) {
+	referenced := make(map[digest.Digest]struct{})
+	visit := func(dgst digest.Digest) {
+		referenced[dgst] = struct{}{}
+	}
+	remaining := func() bool {
+		if wanted == nil {
+			return true
+		}
+		for dgst := range wanted {
+			if _, ok := referenced[dgst]; !ok {
+				return true
+			}
+		}
+		return false
+	}
+	for _, dgst := range links.layers {
+		visit(dgst)
+	}
+	for _, dgst := range links.revisions {
+		if _, ok := referenced[dgst]; ok {
+			continue
+		}
+		if !remaining() {
+			break
+		}
+		manifestBytes, err := r.getManifestBlob(ctx, "", dgst)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get manifest %s: %w", dgst, err)
+		}
+		if err := r.walkManifestBlobs(ctx, "", manifestBytes, visit); err != nil {
+			return nil, err
+		}
+	}
+	return referenced, nil
+}
+
+const storageUsageTTL = time.Minute
+
+// RepositoryStorage is the storage used by a repository, for chargeback.
+// Layers are counted once per repository and split between those only this
+// repository uses and those shared with others.
+type RepositoryStorage struct {
+	Repository string     `json:"repository"`
+	Tags       int        `json:"tags"`
+	Manifests  int        `json:"manifests"`
+	UniqueSize int64      `json:"uniqueSize"`
+	SharedSize int64      `json:"sharedSize"`
+	LastPushed *time.Time `json:"lastPushed,omitempty"`
+	ComputedAt time.Time  `json:"computedAt"`
+}
+
+// RepositoryStorage computes the storage usage of a repository from the
+// database, cached for a minute or until the next push or delete. Repositories
+// only known from a bootstrap have no last push time.
+func (r *Registry) RepositoryStorage(name string) (*RepositoryStorage, error) {
+	if storage, ok := r.storageUsage.Get(name); ok {
+		return storage, nil
+	}
+	summary, err := r.db.RepositorySummary(name)
+	if err != nil {
+		return nil, err
+	}
+	r.flushUsage()
+	storage, err := r.db.RepositoryStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	storage.Tags = summary.Tags
+	storage.Manifests = summary.Manifests
+	storage.ComputedAt = time.Now().UTC()
+	r.storageUsage.Add(name, storage)
+	return storage, nil
+}
@@ -0,0 +1,233 @@
+package reg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	RestoreInProgress = "restoring"
+	RestoreCompleted  = "restored"
+)
+
+var ErrBlobArchived = errors.New("blob is archived")
+
+// BlobRestore tracks the restore of a blob from an archive storage class.
+type BlobRestore struct {
+	Digest       string `db:"digest" json:"digest"`
+	StorageClass string `db:"storage_class" json:"storageClass"`
+	// One of restoring or restored.
+	Status      string     `db:"status" json:"status"`
+	RequestedAt time.Time  `db:"requested_at" json:"requestedAt"`
+	RestoredAt  *time.Time `db:"restored_at" json:"restoredAt,omitempty"`
+	// When S3 deletes the restored copy again.
+	ExpiresAt *time.Time `db:"expires_at" json:"expiresAt,omitempty"`
+}
+
+type archiveRestore struct {
+	days int32
+	tier types.Tier
+}
+
+// retryAfter is how long clients should wait before asking again for a blob
+// being restored, a fraction of the time restores of the tier take.
+func (a *archiveRestore) retryAfter() time.Duration {
+	switch a.tier {
+	case types.TierExpedited:
+		return time.Minute
+	case types.TierBulk:
+		return time.Hour
+	default:
+		return 15 * time.Minute
+	}
+}
+
+// isArchived tells whether a blob must be restored before it can be read:
+// Glacier Flexible Retrieval and Deep Archive objects, and Intelligent-Tiering
+// objects moved to one of its archive tiers. Glacier Instant Retrieval objects
+// are readable as they are.
+func isArchived(head *s3.HeadObjectOutput) bool {
+	switch head.StorageClass {
+	case types.StorageClassGlacier, types.StorageClassDeepArchive:
+		return true
+	}
+	return head.ArchiveStatus != ""
+}
+
+// parseRestoreHeader parses the x-amz-restore header of a HeadObject response,
+// e.g. `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`.
+func parseRestoreHeader(header string) (ongoing bool, expiry *time.Time) {
+	ongoing = strings.Contains(header, `ongoing-request="true"`)
+	if _, value, ok := strings.Cut(header, `expiry-date="`); ok {
+		value, _, _ = strings.Cut(value, `"`)
+		if t, err := http.ParseTime(value); err == nil {
+			expiry = &t
+		}
+	}
+	return ongoing, expiry
+}
+
+// ensureRestored checks whether a blob is archived and, if so, requests its
+// restore unless one is already in progress. It returns ErrBlobArchived until
+// the restored copy is readable.
+func (r *Registry) ensureRestored(ctx context.Context, dgst digest.Digest) (*BlobRestore, error) {
+	if r.archiveRestore == nil {
+		return nil, nil
+	}
+	restore, err := r.db.GetBlobRestore(dgst.String())
+	if err != nil {
+		return nil, err
+	}
+	if restore != nil && restore.Status == RestoreCompleted && restore.ExpiresAt != nil && restore.ExpiresAt.After(time.Now()) {
+		return restore, nil
+	}
+
+	key := blobKey(dgst)
+	head, err := r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.bucketFor(key)),
+		Key:    &key,
+	}, forcePathStyle)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errors.Join(err, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to stat blob: %w", err)
+	}
+	if !isArchived(head) {
+		if restore != nil {
+			if err := r.db.DeleteBlobRestore(dgst.String()); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	storageClass := string(head.StorageClass)
+	if head.ArchiveStatus != "" {
+		storageClass = string(head.ArchiveStatus)
+	}
+	ongoing, expiry := parseRestoreHeader(aws.ToString(head.Restore))
+	if head.Restore != nil && !ongoing {
+		if err := r.db.CompleteBlobRestore(dgst.String(), storageClass, expiry); err != nil {
+			return nil, err
+		}
+		return r.db.GetBlobRestore(dgst.String())
+	}
+
+	if !ongoing {
+		request := &types.RestoreRequest{
+			GlacierJobParameters: &types.GlacierJobParameters{Tier: r.archiveRestore.tier},
+		}
+		// Intelligent-Tiering moves restored objects back to its frequent
+		// access tier instead of keeping a copy for some days.
+		if head.ArchiveStatus == "" {
+			request.Days = aws.Int32(r.archiveRestore.days)
+		}
+		_, err := r.s3Client.RestoreObject(ctx, &s3.RestoreObjectInput{
+			Bucket:         aws.String(r.bucketFor(key)),
+			Key:            &key,
+			RestoreRequest: request,
+		}, forcePathStyle)
+		if err != nil && !isRestoreInProgress(err) {
+			return nil, fmt.Errorf("failed to restore blob: %w", err)
+		}
+		r.logger.Info("restoring archived blob", "digest", dgst, "storageClass", storageClass, "tier", r.archiveRestore.tier)
+	}
+	if err := r.db.StartBlobRestore(dgst.String(), storageClass); err != nil {
+		return nil, err
+	}
+	restore, err = r.db.GetBlobRestore(dgst.String())
+	if err != nil {
+		return nil, err
+	}
+	return restore, fmt.Errorf("%w in %s, restore requested at %s", ErrBlobArchived, storageClass, restore.RequestedAt.Format(time.RFC3339))
+}
+
+func isRestoreInProgress(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress"
+}
+
+// RestoreBlob requests the restore of an archived blob ahead of its pulls.
+func (r *Registry) RestoreBlob(ctx context.Context, dgst digest.Digest) (*BlobRestore, error) {
+	if r.archiveRestore == nil {
+		return nil, errors.New("archive restores are not enabled")
+	}
+	return r.ensureRestored(ctx, dgst)
+}
+
+func (r *Registry) BlobRestores() ([]BlobRestore, error) {
+	return r.db.ListBlobRestores()
+}
+
+// writeArchived answers requests for blobs being restored with 503, which
+// clients retry, after the Retry-After delay.
+func (h *Handler) writeArchived(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(h.registry.archiveRestore.retryAfter().Seconds())))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+func (h *Handler) listRestores(w http.ResponseWriter, r *http.Request) {
+	restores, err := h.registry.BlobRestores()
+	if err != nil {
+		h.registry.logger.Error("error listing blob restores", "error", err)
+		http.Error(w, fmt.Sprintf("error listing blob restores: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if restores == nil {
+		restores = []BlobRestore{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restores)
+}
+
+func (h *Handler) restoreBlob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	dgst, err := digest.Parse(vars["digest"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeDigestInvalid, err.Error())
+		return
+	}
+	if h.registry.archiveRestore == nil {
+		http.Error(w, "archive restores are not enabled", http.StatusConflict)
+		return
+	}
+
+	restore, err := h.registry.RestoreBlob(r.Context(), dgst)
+	status := http.StatusOK
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, errCodeBlobUnknown, "blob not found")
+			return
+		}
+		if !errors.Is(err, ErrBlobArchived) {
+			h.registry.logger.Error("error restoring blob", "error", err)
+			http.Error(w, fmt.Sprintf("error restoring blob: %v", err), http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusAccepted
+		w.Header().Set("Retry-After", strconv.Itoa(int(h.registry.archiveRestore.retryAfter().Seconds())))
+	}
+	if restore == nil {
+		// Not archived, nothing to restore.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(restore)
+}
@@ -0,0 +1,181 @@
+package reg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Upper bounds in seconds of the S3 operation latency histogram.
+var s3LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// s3Metrics counts the requests sent to S3 per operation, so that slow pulls
+// can be told apart from a slow bucket.
+type s3Metrics struct {
+	mu         sync.Mutex
+	operations map[string]*s3OperationMetrics
+}
+
+type s3OperationMetrics struct {
+	// Attempts by HTTP status, zero when no response arrived.
+	requests   map[int]uint64
+	throttled  uint64
+	retries    uint64
+	count      uint64
+	errors     uint64
+	buckets    []uint64
+	latencySum float64
+}
+
+func newS3Metrics() *s3Metrics {
+	return &s3Metrics{operations: make(map[string]*s3OperationMetrics)}
+}
+
+func (m *s3Metrics) operation(name string) *s3OperationMetrics {
+	op := m.operations[name]
+	if op == nil {
+		op = &s3OperationMetrics{requests: make(map[int]uint64), buckets: make([]uint64, len(s3LatencyBuckets))}
+		m.operations[name] = op
+	}
+	return op
+}
+
+func (m *s3Metrics) recordAttempt(operation string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op := m.operation(operation)
+	op.requests[status]++
+	if status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests {
+		op.throttled++
+	}
+}
+
+func (m *s3Metrics) recordOperation(operation string, latency time.Duration, attempts int32, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op := m.operation(operation)
+	op.count++
+	if err != nil {
+		op.errors++
+	}
+	if attempts > 1 {
+		op.retries += uint64(attempts - 1)
+	}
+	seconds := latency.Seconds()
+	op.latencySum += seconds
+	for i, bound := range s3LatencyBuckets {
+		if seconds <= bound {
+			op.buckets[i]++
+		}
+	}
+}
+
+type s3AttemptsKey struct{}
+
+// addMiddleware times whole operations, retries included, and counts each of
+// their attempts. Presigning sends no request and is not counted.
+func (m *s3Metrics) addMiddleware(stack *middleware.Stack) error {
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("OperationMetrics", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		attempts := &atomic.Int32{}
+		start := time.Now()
+		out, metadata, err := next.HandleInitialize(context.WithValue(ctx, s3AttemptsKey{}, attempts), in)
+		if n := attempts.Load(); n > 0 || err != nil {
+			m.recordOperation(middleware.GetOperationName(ctx), time.Since(start), n, err)
+		}
+		return out, metadata, err
+	}), middleware.Before)
+	if err != nil {
+		return err
+	}
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("AttemptMetrics", func(
+		ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler,
+	) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+		if attempts, ok := ctx.Value(s3AttemptsKey{}).(*atomic.Int32); ok {
+			attempts.Add(1)
+		}
+		status := 0
+		if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+			status = resp.StatusCode
+		}
+		m.recordAttempt(middleware.GetOperationName(ctx), status)
+		return out, metadata, err
+	}), middleware.Before)
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (m *s3Metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.operations))
+	for name := range m.operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP reg_s3_requests_total Requests sent to S3, retries included, by operation and HTTP status.")
+	fmt.Fprintln(w, "# TYPE reg_s3_requests_total counter")
+	for _, name := range names {
+		op := m.operations[name]
+		statuses := make([]int, 0, len(op.requests))
+		for status := range op.requests {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			label := strconv.Itoa(status)
+			if status == 0 {
+				label = "none"
+			}
+			fmt.Fprintf(w, "reg_s3_requests_total{operation=%q,status=%q} %d\n", name, label, op.requests[status])
+		}
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(*s3OperationMetrics) uint64
+	}{
+		{"reg_s3_throttled_total", "Requests S3 answered with 503 SlowDown or 429.", func(op *s3OperationMetrics) uint64 { return op.throttled }},
+		{"reg_s3_retries_total", "Requests retried by the S3 client.", func(op *s3OperationMetrics) uint64 { return op.retries }},
+		{"reg_s3_operation_errors_total", "S3 operations which failed after their retries.", func(op *s3OperationMetrics) uint64 { return op.errors }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{operation=%q} %d\n", c.name, name, c.value(m.operations[name]))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP reg_s3_operation_duration_seconds Duration of S3 operations, retries included.")
+	fmt.Fprintln(w, "# TYPE reg_s3_operation_duration_seconds histogram")
+	for _, name := range names {
+		op := m.operations[name]
+		for i, bound := range s3LatencyBuckets {
+			fmt.Fprintf(w, "reg_s3_operation_duration_seconds_bucket{operation=%q,le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), op.buckets[i])
+		}
+		fmt.Fprintf(w, "reg_s3_operation_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", name, op.count)
+		fmt.Fprintf(w, "reg_s3_operation_duration_seconds_sum{operation=%q} %g\n", name, op.latencySum)
+		fmt.Fprintf(w, "reg_s3_operation_duration_seconds_count{operation=%q} %d\n", name, op.count)
+	}
+}
+
+func (h *Handler) getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.registry.s3Metrics.writeTo(w)
+	h.registry.cacheMetrics.writeTo(w)
+	h.registry.httpMetrics.writeTo(w)
+	if h.registry.scrubber != nil {
+		h.registry.scrubber.writeTo(w, h.registry.db, h.registry.logger)
+	}
+}
@@ -0,0 +1,123 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+var errOperationTimeout = errors.New("S3 operation timed out")
+
+// S3Policy tunes how requests to S3 are retried and how long they may take.
+// Zero values keep the defaults of the AWS SDK, which also reads
+// AWS_RETRY_MODE and AWS_MAX_ATTEMPTS.
+type S3Policy struct {
+	// Either "standard" or "adaptive", which also rate limits requests
+	// after throttling errors.
+	RetryMode   string
+	MaxAttempts int
+	MaxBackoff  time.Duration
+
+	// Timeouts cover an operation with all its retries, until its response
+	// arrives: the body of a download is not bounded, only waited for.
+	Timeout time.Duration
+	// GetObject and HeadObject, the pull path.
+	GetObjectTimeout time.Duration
+	ListTimeout      time.Duration
+	// The parts of multipart uploads and copies.
+	MultipartTimeout time.Duration
+}
+
+func (p *S3Policy) timeout(operation string) time.Duration {
+	var timeout time.Duration
+	switch operation {
+	case "GetObject", "HeadObject":
+		timeout = p.GetObjectTimeout
+	case "ListObjectsV2", "ListObjects":
+		timeout = p.ListTimeout
+	case "CreateMultipartUpload", "UploadPart", "UploadPartCopy", "CompleteMultipartUpload",
+		"AbortMultipartUpload", "ListParts", "ListMultipartUploads":
+		timeout = p.MultipartTimeout
+	}
+	if timeout == 0 {
+		timeout = p.Timeout
+	}
+	return timeout
+}
+
+// apply configures an S3 client with the policy.
+func (p *S3Policy) apply(o *s3.Options) {
+	if p.RetryMode != "" || p.MaxAttempts > 0 || p.MaxBackoff > 0 {
+		standard := func(so *retry.StandardOptions) {
+			if p.MaxAttempts > 0 {
+				so.MaxAttempts = p.MaxAttempts
+			}
+			if p.MaxBackoff > 0 {
+				so.MaxBackoff = p.MaxBackoff
+			}
+		}
+		if p.RetryMode == string(aws.RetryModeAdaptive) {
+			o.Retryer = retry.NewAdaptiveMode(func(ao *retry.AdaptiveModeOptions) {
+				ao.StandardOptions = append(ao.StandardOptions, standard)
+			})
+		} else {
+			o.Retryer = retry.NewStandard(standard)
+		}
+		// Otherwise the SDK wraps the retryer with the attempts of the
+		// shared config.
+		o.RetryMaxAttempts = 0
+	}
+	if p.Timeout > 0 || p.GetObjectTimeout > 0 || p.ListTimeout > 0 || p.MultipartTimeout > 0 {
+		o.APIOptions = append(o.APIOptions, p.addTimeout)
+	}
+}
+
+func (p *S3Policy) addTimeout(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("OperationTimeout", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		operation := middleware.GetOperationName(ctx)
+		timeout := p.timeout(operation)
+		if timeout <= 0 {
+			return next.HandleInitialize(ctx, in)
+		}
+		ctx, cancelCause := context.WithCancelCause(ctx)
+		cancel := func() { cancelCause(nil) }
+		timer := time.AfterFunc(timeout, func() { cancelCause(errOperationTimeout) })
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		timedOut := !timer.Stop()
+		if err != nil {
+			cancel()
+			if timedOut {
+				err = fmt.Errorf("S3 %s timed out after %s: %w", operation, timeout, err)
+			}
+			return out, metadata, err
+		}
+		// Downloads are read after the operation returns, so their context
+		// lives until the body is closed.
+		if obj, ok := out.Result.(*s3.GetObjectOutput); ok && obj.Body != nil {
+			obj.Body = &cancelOnClose{ReadCloser: obj.Body, cancel: cancel}
+		} else {
+			cancel()
+		}
+		return out, metadata, err
+	}), middleware.Before)
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
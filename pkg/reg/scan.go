@@ -0,0 +1,349 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	scanPollInterval = 30 * time.Second
+	scanMaxBackoff   = 30 * time.Minute
+	scanMaxAttempts  = 5
+	scanBatchSize    = 8
+)
+
+const (
+	ScanPending = "pending"
+	ScanPassed  = "passed"
+	ScanFailed  = "failed"
+	ScanError   = "error"
+)
+
+var ErrQuarantined = errors.New("quarantined")
+
+type ScanRequest struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+}
+
+type Vulnerability struct {
+	ID               string `json:"id"`
+	Package          string `json:"package"`
+	InstalledVersion string `json:"installedVersion,omitempty"`
+	FixedVersion     string `json:"fixedVersion,omitempty"`
+	Severity         string `json:"severity"`
+	Title            string `json:"title,omitempty"`
+}
+
+type Scanner interface {
+	// Scan returns the vulnerabilities found in a manifest of the registry.
+	Scan(ctx context.Context, req ScanRequest) ([]Vulnerability, error)
+}
+
+type ScanResult struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	// One of pending, passed, failed or error.
+	Status string `json:"status"`
+	// Number of vulnerabilities per severity.
+	Summary         map[string]int  `json:"summary,omitempty"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	// Set while a scan, or rescan, is waiting for the scanner.
+	Queued      bool       `json:"queued"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	ScannedAt   *time.Time `json:"scannedAt,omitempty"`
+}
+
+// TrivyScanner scans images with the trivy CLI, pulling them from this
+// registry under registryHost. With a server URL, trivy runs in client mode
+// against a trivy server holding the vulnerability database. Registry
+// credentials are passed through TRIVY_USERNAME and TRIVY_PASSWORD.
+type TrivyScanner struct {
+	binary       string
+	server       string
+	registryHost string
+	insecure     bool
+	timeout      time.Duration
+}
+
+func NewTrivyScanner(binary string, server string, registryHost string, insecure bool, timeout time.Duration) *TrivyScanner {
+	return &TrivyScanner{
+		binary:       binary,
+		server:       server,
+		registryHost: strings.TrimSuffix(registryHost, "/"),
+		insecure:     insecure,
+		timeout:      timeout,
+	}
+}
+
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			VulnerabilityID  string `json:"VulnerabilityID"`
+			PkgName          string `json:"PkgName"`
+			InstalledVersion string `json:"InstalledVersion"`
+			FixedVersion     string `json:"FixedVersion"`
+			Severity         string `json:"Severity"`
+			Title            string `json:"Title"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+func (s *TrivyScanner) Scan(ctx context.Context, req ScanRequest) ([]Vulnerability, error) {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	args := []string{"image", "--quiet", "--format", "json"}
+	if s.server != "" {
+		args = append(args, "--server", s.server)
+	}
+	if s.insecure {
+		args = append(args, "--insecure")
+	}
+	args = append(args, fmt.Sprintf("%s/%s@%s", s.registryHost, req.Repository, req.Digest))
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("trivy failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var report trivyReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		return nil, fmt.Errorf("failed to decode trivy report: %w", err)
+	}
+	var vulnerabilities []Vulnerability
+	for _, result := range report.Results {
+		for _, v := range result.Vulnerabilities {
+			vulnerabilities = append(vulnerabilities, Vulnerability{
+				ID:               v.VulnerabilityID,
+				Package:          v.PkgName,
+				InstalledVersion: v.InstalledVersion,
+				FixedVersion:     v.FixedVersion,
+				Severity:         v.Severity,
+				Title:            v.Title,
+			})
+		}
+	}
+	return vulnerabilities, nil
+}
+
+type scanQueue struct {
+	registry *Registry
+	scanner  Scanner
+	// Severities failing a scan, upper case.
+	failOn []string
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (q *scanQueue) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.run(ctx)
+	}()
+}
+
+func (q *scanQueue) stop() {
+	if q == nil || q.cancel == nil {
+		return
+	}
+	q.cancel()
+	q.wg.Wait()
+}
+
+// enqueue queues a scan of a pushed manifest. Signatures, attestations and
+// other artifacts attached to an image are not scanned.
+func (q *scanQueue) enqueue(name string, reference string, manifestBytes []byte) {
+	if q == nil {
+		return
+	}
+	m, err := parseAnyManifest(manifestBytes)
+	if err != nil || isAttachedArtifact(m) {
+		return
+	}
+	sha := digest.FromBytes(manifestBytes)
+	if err := q.registry.db.EnqueueScan(name, sha.String(), false); err != nil {
+		q.registry.logger.Error("failed to enqueue scan", "name", name, "digest", sha, "error", err)
+		return
+	}
+	q.notify()
+}
+
+func (q *scanQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *scanQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(scanPollInterval)
+	defer ticker.Stop()
+	for {
+		q.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *scanQueue) processDue(ctx context.Context) {
+	if !q.registry.isLeader() {
+		return
+	}
+	for {
+		tasks, err := q.registry.db.DueScans(scanBatchSize)
+		if err != nil {
+			q.registry.logger.Error("failed to load scan queue", "error", err)
+			return
+		}
+		if len(tasks) == 0 {
+			return
+		}
+		for _, task := range tasks {
+			if ctx.Err() != nil {
+				return
+			}
+			q.process(ctx, task)
+		}
+	}
+}
+
+func (q *scanQueue) process(ctx context.Context, task ScanTask) {
+	db := q.registry.db
+	vulnerabilities, err := q.scanner.Scan(ctx, ScanRequest{Repository: task.Repository, Digest: task.Digest})
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if task.Attempts+1 >= scanMaxAttempts {
+			q.registry.logger.Error("scan failed", "name", task.Repository, "digest", task.Digest, "attempts", task.Attempts+1, "error", err)
+			if err := db.CompleteScan(task.Repository, task.Digest, ScanError, nil, nil, err.Error()); err != nil {
+				q.registry.logger.Error("failed to record scan", "error", err)
+			}
+			return
+		}
+		backoff := min(time.Duration(1<<min(task.Attempts, 12))*10*time.Second, scanMaxBackoff)
+		q.registry.logger.Warn("scan failed", "name", task.Repository, "digest", task.Digest, "attempt", task.Attempts+1, "retryIn", backoff, "error", err)
+		if err := db.RetryScan(task.Repository, task.Digest, err.Error(), backoff); err != nil {
+			q.registry.logger.Error("failed to reschedule scan", "error", err)
+		}
+		return
+	}
+
+	summary := make(map[string]int)
+	status := ScanPassed
+	for _, v := range vulnerabilities {
+		severity := strings.ToUpper(v.Severity)
+		summary[severity]++
+		if slices.Contains(q.failOn, severity) {
+			status = ScanFailed
+		}
+	}
+	if err := db.CompleteScan(task.Repository, task.Digest, status, summary, vulnerabilities, ""); err != nil {
+		q.registry.logger.Error("failed to record scan", "error", err)
+		return
+	}
+	q.registry.logger.Info("scanned manifest", "name", task.Repository, "digest", task.Digest, "status", status, "vulnerabilities", len(vulnerabilities))
+}
+
+// ScanResult returns the vulnerability scan of a manifest, or nil if it was
+// never scanned.
+func (r *Registry) ScanResult(ctx context.Context, name string, reference string) (*ScanResult, error) {
+	_, manifestBytes, err := r.getStoredManifest(ctx, name, reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	return r.db.GetScan(name, digest.FromBytes(manifestBytes).String())
+}
+
+// Rescan queues a new scan of a manifest, keeping its current status until
+// the scan completes.
+func (r *Registry) Rescan(ctx context.Context, name string, reference string) (*ScanResult, error) {
+	if r.scans == nil {
+		return nil, errors.New("no scanner configured")
+	}
+	_, manifestBytes, err := r.getStoredManifest(ctx, name, reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest: %w", err)
+	}
+	sha := digest.FromBytes(manifestBytes).String()
+	if err := r.db.EnqueueScan(name, sha, true); err != nil {
+		return nil, err
+	}
+	r.scans.notify()
+	return r.db.GetScan(name, sha)
+}
+
+// checkQuarantine denies pulls from quarantined repositories of manifests
+// whose scan has not passed. Manifests without a scan, e.g. pushed before
+// scanning was enabled, are queued for one and held back as pending. Neither
+// attached signatures, which are not scanned, nor the authenticated scanner
+// itself are held back.
+func (r *Registry) checkQuarantine(ctx context.Context, name string, reference string, manifestBytes []byte) error {
+	if r.scans == nil || !r.isQuarantined(name, reference) {
+		return nil
+	}
+	if r.scanActor != "" && r.auth != nil && requestInfoFrom(ctx).Actor == r.scanActor {
+		return nil
+	}
+	if m, err := parseAnyManifest(manifestBytes); err == nil && isAttachedArtifact(m) {
+		return nil
+	}
+	sha := digest.FromBytes(manifestBytes).String()
+	result, err := r.db.GetScan(name, sha)
+	if err != nil {
+		return err
+	}
+	status := ScanPending
+	if result == nil {
+		if err := r.db.EnqueueScan(name, sha, false); err != nil {
+			return err
+		}
+		r.scans.notify()
+	} else {
+		status = result.Status
+	}
+	if status == ScanPassed {
+		return nil
+	}
+	return fmt.Errorf("%w until its vulnerability scan passes: scan %s", ErrQuarantined, status)
+}
+
+// isQuarantined matches tag patterns against the tag pulled. A pull by
+// digest may be of any tag, so it is quarantined by repository.
+func (r *Registry) isQuarantined(name string, reference string) bool {
+	for _, pattern := range r.quarantine {
+		if isDigest(reference) {
+			if pattern.matchesRepo(name) {
+				return true
+			}
+		} else if pattern.matches(name, reference) {
+			return true
+		}
+	}
+	return false
+}
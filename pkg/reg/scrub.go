@@ -0,0 +1,351 @@
+package reg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// scrubRangeSize is how much of a blob is read per request while hashing it,
+// so that the scrubbing rate holds for blobs of any size.
+const scrubRangeSize = 8 << 20
+
+// Results of the verification of a blob by the scrubber.
+const (
+	scrubOK      = "ok"
+	scrubCorrupt = "corrupt"
+	scrubError   = "error"
+)
+
+var errBlobCorrupt = errors.New("blob is corrupt")
+
+type BlobScrubConfig struct {
+	// How often a sample of blobs is verified.
+	Interval time.Duration
+	// How many blobs each sample has, 100 by default.
+	Sample int
+	// Bytes per second blobs are read at, 10 MiB by default.
+	Rate int64
+}
+
+// blobScrubber verifies random samples of blobs in the background, on the
+// leader only, so that corrupted blobs are noticed before a pull fails on
+// them.
+type blobScrubber struct {
+	config BlobScrubConfig
+
+	mu sync.Mutex
+	// Verified blobs by result.
+	results map[string]uint64
+	bytes   uint64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (s *blobScrubber) record(result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[result]++
+}
+
+func (s *blobScrubber) recordRead(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes += uint64(bytes)
+}
+
+func (r *Registry) startBlobScrubbing() {
+	s := r.scrubber
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !r.isLeader() {
+				continue
+			}
+			if err := r.scrubBlobs(ctx); err != nil && ctx.Err() == nil {
+				r.logger.Error("error scrubbing blobs", "error", err)
+			}
+		}
+	}()
+}
+
+func (s *blobScrubber) stop() {
+	if s != nil && s.cancel != nil {
+		s.cancel()
+		s.wg.Wait()
+	}
+}
+
+// scrubBlobs verifies one sample of blobs.
+func (r *Registry) scrubBlobs(ctx context.Context) error {
+	sample, err := r.sampleBlobs(ctx, r.scrubber.config.Sample)
+	if err != nil {
+		return err
+	}
+	corrupt := 0
+	for _, blob := range sample {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !r.scrubBlob(ctx, blob.repo, blob.digest) {
+			corrupt++
+		}
+	}
+	r.logger.Debug("scrubbed blobs", "blobs", len(sample), "corrupt", corrupt)
+	return nil
+}
+
+// scrubBlob verifies a blob, records the result and reports corruption. It
+// returns false for corrupted blobs only, blobs which could not be read are
+// tried again in a later sample.
+func (r *Registry) scrubBlob(ctx context.Context, repo string, dgst digest.Digest) bool {
+	err := r.checkBlobIntegrity(ctx, repo, dgst)
+	switch {
+	case err == nil:
+		r.scrubber.record(scrubOK)
+	case errors.Is(err, errBlobCorrupt):
+		r.scrubber.record(scrubCorrupt)
+		r.logger.Error("blob is corrupt", "digest", dgst, "repository", repo, "error", err)
+		r.notify(ctx, Event{
+			Action:     EventBlobCorrupted,
+			Repository: repo,
+			Digest:     dgst.String(),
+			Error:      err.Error(),
+		})
+	case isNotFound(err), errors.Is(err, ErrBlobArchived), ctx.Err() != nil:
+		// Deleted since it was sampled, or not readable without a restore.
+		return true
+	default:
+		r.scrubber.record(scrubError)
+		r.logger.Warn("failed to verify blob", "digest", dgst, "error", err)
+		return true
+	}
+	verifyErr := ""
+	if err != nil {
+		verifyErr = err.Error()
+	}
+	if err := r.db.RecordBlobVerification(dgst.String(), verifyErr); err != nil {
+		r.logger.Error("error recording blob verification", "error", err)
+	}
+	return err == nil
+}
+
+// checkBlobIntegrity checks a blob against its digest: against the SHA-256
+// checksum S3 keeps of objects uploaded with one, and otherwise by hashing it
+// range by range, no faster than the scrubbing rate.
+func (r *Registry) checkBlobIntegrity(ctx context.Context, repo string, dgst digest.Digest) error {
+	key := r.layoutBlobKey(repo, dgst)
+	bucket := r.bucketFor(key)
+	headCtx, cancel := r.metadataContext(ctx)
+	head, err := r.s3Client.HeadObject(headCtx, &s3.HeadObjectInput{
+		Bucket:       &bucket,
+		Key:          &key,
+		ChecksumMode: types.ChecksumModeEnabled,
+	}, forcePathStyle)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if isArchived(head) {
+		return ErrBlobArchived
+	}
+	if sum, ok := objectSHA256(head); ok && dgst.Algorithm() == digest.SHA256 {
+		if sum != dgst.Encoded() {
+			return fmt.Errorf("%w: S3 checksum is sha256:%s", errBlobCorrupt, sum)
+		}
+		return nil
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	verifier := dgst.Verifier()
+	for offset := int64(0); offset < size; offset += scrubRangeSize {
+		start := time.Now()
+		end := min(offset+scrubRangeSize, size) - 1
+		n, err := r.hashBlobRange(ctx, bucket, key, aws.ToString(head.ETag), offset, end, verifier)
+		r.scrubber.recordRead(n)
+		if err != nil {
+			return err
+		}
+		if n != end-offset+1 {
+			return fmt.Errorf("%w: read %d bytes of range %d-%d", errBlobCorrupt, n, offset, end)
+		}
+		if err := r.scrubber.pace(ctx, n, time.Since(start)); err != nil {
+			return err
+		}
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("%w: content does not match digest", errBlobCorrupt)
+	}
+	return nil
+}
+
+// hashBlobRange reads the inclusive byte range of a blob into w, failing if
+// the blob was overwritten since its ETag was read.
+func (r *Registry) hashBlobRange(ctx context.Context, bucket string, key string, etag string, offset int64, end int64, w io.Writer) (int64, error) {
+	ctx, watch, cancel := r.blobReadContext(ctx)
+	defer cancel()
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+	}
+	if etag != "" {
+		input.IfMatch = &etag
+	}
+	obj, err := r.s3Client.GetObject(ctx, input, forcePathStyle)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get blob range: %w", err)
+	}
+	body := watch(obj.Body)
+	defer body.Close()
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return n, fmt.Errorf("failed to read blob range: %w", err)
+	}
+	return n, nil
+}
+
+// objectSHA256 returns the hex SHA-256 checksum S3 keeps of the whole object,
+// which objects uploaded without one, or in parts, do not have.
+func objectSHA256(head *s3.HeadObjectOutput) (string, bool) {
+	checksum := aws.ToString(head.ChecksumSHA256)
+	if checksum == "" || head.ChecksumType == types.ChecksumTypeComposite || strings.Contains(checksum, "-") {
+		return "", false
+	}
+	sum, err := base64.StdEncoding.DecodeString(checksum)
+	if err != nil || len(sum) != 32 {
+		return "", false
+	}
+	return hex.EncodeToString(sum), true
+}
+
+// pace waits for as long as reading n bytes takes at the scrubbing rate,
+// minus the time reading them took.
+func (s *blobScrubber) pace(ctx context.Context, n int64, took time.Duration) error {
+	wait := time.Duration(float64(n)/float64(s.config.Rate)*float64(time.Second)) - took
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type sampledBlob struct {
+	repo   string
+	digest digest.Digest
+}
+
+// sampleBlobs lists up to n blobs from a random digest on, wrapping around at
+// the last one. Digests are spread evenly, so every blob is as likely to be
+// sampled. In the OCI layout, the sample is of a random repository.
+func (r *Registry) sampleBlobs(ctx context.Context, n int) ([]sampledBlob, error) {
+	buckets := r.blobBuckets()
+	bucket := buckets[rand.IntN(len(buckets))]
+	var random [32]byte
+	for i := range random {
+		random[i] = byte(rand.UintN(256))
+	}
+	from := hex.EncodeToString(random[:])
+
+	prefix := blobsPrefix
+	startAfter := prefix + "sha256/" + from[:2] + "/" + from
+	if r.layout == LayoutOCI {
+		repos, err := r.db.RepositorySummaries()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list repositories: %w", err)
+		}
+		if len(repos) == 0 {
+			return nil, nil
+		}
+		prefix = repos[rand.IntN(len(repos))].Repository + "/blobs/"
+		startAfter = prefix + "sha256/" + from
+	}
+
+	var sample []sampledBlob
+	for _, wrapped := range []bool{false, true} {
+		input := &s3.ListObjectsV2Input{
+			Bucket:  &bucket,
+			Prefix:  &prefix,
+			MaxKeys: aws.Int32(int32(n - len(sample))),
+		}
+		if !wrapped {
+			input.StartAfter = &startAfter
+		}
+		listCtx, cancel := r.metadataContext(ctx)
+		out, err := r.s3Client.ListObjectsV2(listCtx, input, forcePathStyle)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, obj := range out.Contents {
+			key := aws.ToString(obj.Key)
+			if wrapped && key > startAfter {
+				break
+			}
+			if r.layout == LayoutOCI {
+				if repo, dgst, ok := ociBlobFromKey(key); ok {
+					sample = append(sample, sampledBlob{repo: repo, digest: dgst})
+				}
+			} else if dgst, ok := digestFromBlobKey(key); ok {
+				sample = append(sample, sampledBlob{digest: dgst})
+			}
+		}
+		if len(sample) >= n || aws.ToBool(out.IsTruncated) {
+			break
+		}
+	}
+	return sample, nil
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (s *blobScrubber) writeTo(w io.Writer, db *RegistryDB, logger *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(w, "# HELP reg_blob_scrub_blobs_total Blobs verified in the background, by result.")
+	fmt.Fprintln(w, "# TYPE reg_blob_scrub_blobs_total counter")
+	for _, result := range []string{scrubOK, scrubCorrupt, scrubError} {
+		fmt.Fprintf(w, "reg_blob_scrub_blobs_total{result=%q} %d\n", result, s.results[result])
+	}
+	fmt.Fprintln(w, "# HELP reg_blob_scrub_read_bytes_total Bytes of blobs read to verify them in the background.")
+	fmt.Fprintln(w, "# TYPE reg_blob_scrub_read_bytes_total counter")
+	fmt.Fprintf(w, "reg_blob_scrub_read_bytes_total %d\n", s.bytes)
+
+	failed, err := db.CountFailedBlobVerifications()
+	if err != nil {
+		logger.Error("error counting failed blob verifications", "error", err)
+		return
+	}
+	fmt.Fprintln(w, "# HELP reg_blob_verification_failures Blobs whose last verification failed, by any replica or reg verify.")
+	fmt.Fprintln(w, "# TYPE reg_blob_verification_failures gauge")
+	fmt.Fprintf(w, "reg_blob_verification_failures %d\n", failed)
+}
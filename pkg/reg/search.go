@@ -0,0 +1,78 @@
+package reg
+
+import (
+	"context"
+	"strings"
+)
+
+type SearchResult struct {
+	Repository string            `db:"repository" json:"repository"`
+	Tag        string            `db:"tag" json:"tag"`
+	LabelText  string            `db:"labels" json:"-"`
+	Labels     map[string]string `db:"-" json:"labels,omitempty"`
+	// Set for artifacts other than container images.
+	ArtifactType string `db:"artifact_type" json:"artifactType,omitempty"`
+	// Higher is better; always 0 without FTS5.
+	Score float64 `db:"score" json:"score"`
+}
+
+type SearchResults struct {
+	Query        string         `json:"query"`
+	Repositories []string       `json:"repositories"`
+	Results      []SearchResult `json:"results"`
+
+	// Offset of the next page, past the results which were left out.
+	next int
+}
+
+// Search finds tags by words in their repository name, tag and config labels.
+// Repositories lists the distinct repositories of the returned page. Searches
+// on behalf of a request leave out the repositories its actor may not pull.
+func (r *Registry) Search(ctx context.Context, query string, n int, offset int) (*SearchResults, error) {
+	results := &SearchResults{Query: query, Repositories: []string{}, Results: []SearchResult{}, next: offset}
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return results, nil
+	}
+	seen := make(map[string]bool)
+	visible := make(map[string]bool)
+	for len(results.Results) < n {
+		found, err := r.db.Search(terms, n, results.next)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range found {
+			if len(results.Results) == n {
+				break
+			}
+			results.next++
+			allowed, checked := visible[result.Repository]
+			if !checked {
+				allowed, err = r.canPull(ctx, result.Repository)
+				if err != nil {
+					return nil, err
+				}
+				visible[result.Repository] = allowed
+			}
+			if !allowed {
+				continue
+			}
+			if result.LabelText != "" {
+				result.Labels = make(map[string]string)
+				for _, label := range strings.Split(result.LabelText, "\n") {
+					key, value, _ := strings.Cut(label, "=")
+					result.Labels[key] = value
+				}
+			}
+			if !seen[result.Repository] {
+				seen[result.Repository] = true
+				results.Repositories = append(results.Repositories, result.Repository)
+			}
+			results.Results = append(results.Results, result)
+		}
+		if len(found) < n {
+			break
+		}
+	}
+	return results, nil
+}
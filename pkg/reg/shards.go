@@ -0,0 +1,66 @@
+package reg
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// blobShards spreads blobs over several buckets by digest, so that the
+// requests for them count against the request rate limits of every bucket
+// rather than only those of the primary one. Links, uploads and everything
+// else stay in the primary bucket.
+type blobShards struct {
+	buckets []string
+}
+
+func (s *blobShards) validate() error {
+	seen := make(map[string]bool)
+	for _, bucket := range s.buckets {
+		if bucket == "" {
+			return errors.New("blob shards need bucket names")
+		}
+		if seen[bucket] {
+			return fmt.Errorf("blob shard bucket %s is listed twice", bucket)
+		}
+		seen[bucket] = true
+	}
+	if len(s.buckets) == 0 {
+		return errors.New("no blob shard buckets configured")
+	}
+	return nil
+}
+
+// bucket returns the shard of a blob, by the first 16 bits of its digest, so
+// that blobs spread evenly whatever the number of shards. Changing the list
+// of shards moves blobs to other shards, which must be copied there.
+func (s *blobShards) bucket(dgst digest.Digest) string {
+	prefix, err := strconv.ParseUint(dgst.Encoded()[:4], 16, 16)
+	if err != nil {
+		return s.buckets[0]
+	}
+	return s.buckets[prefix%uint64(len(s.buckets))]
+}
+
+// bucketFor returns the bucket holding key: the shard of blobs, and the
+// primary bucket for everything else.
+func (r *Registry) bucketFor(key string) string {
+	if r.blobShards == nil {
+		return r.bucket
+	}
+	dgst, ok := digestFromBlobKey(key)
+	if !ok {
+		return r.bucket
+	}
+	return r.blobShards.bucket(dgst)
+}
+
+// blobBuckets returns the buckets blobs are stored in.
+func (r *Registry) blobBuckets() []string {
+	if r.blobShards == nil {
+		return []string{r.bucket}
+	}
+	return r.blobShards.buckets
+}
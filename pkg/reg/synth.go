@@ -0,0 +1,284 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// synthBaseLayers is the size of the pool of base layers synthesized images
+// pick theirs from, like images built on a handful of common base images.
+const synthBaseLayers = 16
+
+// SynthOptions describes the registry Synthesize plants. Each repository has
+// Tags images, made of BaseLayers layers from a pool shared by all
+// repositories, a layer shared by the images of the repository, and a layer
+// of their own.
+type SynthOptions struct {
+	// Repositories are named <Prefix>/repo-NNNNN.
+	Prefix     string
+	Repos      int
+	Tags       int
+	BaseLayers int
+	// Size of the base and repository layers.
+	LayerSize int64
+	// Size of the layer of each image.
+	TagLayerSize int64
+	Concurrency  int
+}
+
+// EstimatedSize returns how many bytes of blobs Synthesize uploads in the
+// given storage layout.
+func (o SynthOptions) EstimatedSize(layout StorageLayout) int64 {
+	size := int64(o.Repos)*o.LayerSize + int64(o.Repos)*int64(o.Tags)*o.TagLayerSize
+	switch {
+	case o.BaseLayers <= 0:
+	case layout == LayoutOCI:
+		// Every repository has a copy of the base layers it picked.
+		size += int64(o.Repos) * int64(o.BaseLayers) * o.LayerSize
+	default:
+		size += synthBaseLayers * o.LayerSize
+	}
+	return size
+}
+
+// SynthProgress is reported after each synthesized repository.
+type SynthProgress struct {
+	Repositories int   `json:"repositories"`
+	Manifests    int   `json:"manifests"`
+	Blobs        int   `json:"blobs"`
+	Bytes        int64 `json:"bytes"`
+}
+
+type synthesizer struct {
+	r    *Registry
+	opts SynthOptions
+	base []v1.Descriptor
+
+	mu       sync.Mutex
+	progress SynthProgress
+	report   func(SynthProgress)
+}
+
+// Synthesize plants a fake registry in the bucket, for benchmarking
+// bootstrap, garbage collection and listings at scale. Only the bucket is
+// written, as by another registry, so the database learns about the images
+// by bootstrapping. Blobs are random bytes derived from their names, so
+// running it again rewrites the same objects. In the OCI layout, the base
+// layers are only uploaded into the repositories picking them.
+func (r *Registry) Synthesize(ctx context.Context, opts SynthOptions, report func(SynthProgress)) (SynthProgress, error) {
+	if opts.Repos <= 0 || opts.Tags <= 0 {
+		return SynthProgress{}, errors.New("at least one repository and one tag are needed")
+	}
+	if opts.BaseLayers > synthBaseLayers {
+		return SynthProgress{}, fmt.Errorf("at most %d base layers are supported", synthBaseLayers)
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "synth"
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 16
+	}
+	if err := r.checkRepositoryName(opts.Prefix + "/repo"); err != nil {
+		return SynthProgress{}, err
+	}
+	s := &synthesizer{r: r, opts: opts, report: report}
+
+	if opts.BaseLayers > 0 {
+		s.base = make([]v1.Descriptor, synthBaseLayers)
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(opts.Concurrency)
+		for i := range s.base {
+			g.Go(func() error {
+				name := fmt.Sprintf("base-%02d", i)
+				if r.layout == LayoutOCI {
+					s.base[i] = describeBytes(synthBytes(name, opts.LayerSize), v1.MediaTypeImageLayerGzip)
+					return nil
+				}
+				desc, err := s.putBlob(gctx, "", name, opts.LayerSize, v1.MediaTypeImageLayerGzip)
+				s.base[i] = desc
+				return err
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return s.progress, err
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(opts.Concurrency)
+	for i := range opts.Repos {
+		g.Go(func() error {
+			return s.synthesizeRepository(gctx, i)
+		})
+	}
+	err := g.Wait()
+	return s.progress, err
+}
+
+func (s *synthesizer) synthesizeRepository(ctx context.Context, n int) error {
+	repo := fmt.Sprintf("%s/repo-%05d", s.opts.Prefix, n)
+	rng := rand.New(rand.NewPCG(uint64(n), 0))
+
+	var shared []v1.Descriptor
+	for _, i := range rng.Perm(len(s.base))[:s.opts.BaseLayers] {
+		if s.r.layout == LayoutOCI {
+			if _, err := s.putBlob(ctx, repo, fmt.Sprintf("base-%02d", i), s.opts.LayerSize, s.base[i].MediaType); err != nil {
+				return err
+			}
+		}
+		shared = append(shared, s.base[i])
+	}
+	repoLayer, err := s.putBlob(ctx, repo, repo, s.opts.LayerSize, v1.MediaTypeImageLayerGzip)
+	if err != nil {
+		return err
+	}
+	shared = append(shared, repoLayer)
+	if err := s.link(ctx, repo, shared...); err != nil {
+		return err
+	}
+
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(n) * time.Hour)
+	for t := range s.opts.Tags {
+		tag := fmt.Sprintf("v1.%d.%d", t/10, t%10)
+		if err := s.synthesizeImage(ctx, repo, tag, shared, created.Add(time.Duration(t)*time.Minute)); err != nil {
+			return fmt.Errorf("failed to synthesize %s:%s: %w", repo, tag, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.progress.Repositories++
+	progress := s.progress
+	s.mu.Unlock()
+	if s.report != nil {
+		s.report(progress)
+	}
+	return nil
+}
+
+func (s *synthesizer) synthesizeImage(ctx context.Context, repo string, tag string, shared []v1.Descriptor, created time.Time) error {
+	layer, err := s.putBlob(ctx, repo, repo+":"+tag, s.opts.TagLayerSize, v1.MediaTypeImageLayerGzip)
+	if err != nil {
+		return err
+	}
+	layers := append(append([]v1.Descriptor{}, shared...), layer)
+
+	diffIDs := make([]digest.Digest, len(layers))
+	for i, l := range layers {
+		diffIDs[i] = l.Digest
+	}
+	configBytes, err := json.Marshal(v1.Image{
+		Created:  &created,
+		Platform: v1.Platform{Architecture: "amd64", OS: "linux"},
+		Config: v1.ImageConfig{
+			Labels: map[string]string{"org.opencontainers.image.version": tag},
+		},
+		RootFS: v1.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	config, err := s.putBytes(ctx, repo, configBytes, v1.MediaTypeImageConfig)
+	if err != nil {
+		return err
+	}
+	if err := s.link(ctx, repo, config, layer); err != nil {
+		return err
+	}
+
+	manifestBytes, err := json.Marshal(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	manifest, err := s.putBytes(ctx, repo, manifestBytes, v1.MediaTypeImageManifest)
+	if err != nil {
+		return err
+	}
+	if s.r.layout == LayoutOCI {
+		if err := s.r.putOCITag(ctx, repo, tag, manifestBytes, nil); err != nil {
+			return fmt.Errorf("failed to tag manifest: %w", err)
+		}
+	} else {
+		for _, key := range []string{
+			revisionLinkKey(repo, manifest.Digest),
+			tagIndexLinkKey(repo, tag, manifest.Digest),
+			tagCurrentLinkKey(repo, tag),
+		} {
+			if err := s.r.putLink(ctx, key, manifest.Digest); err != nil {
+				return fmt.Errorf("failed to link manifest: %w", err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.progress.Manifests++
+	s.mu.Unlock()
+	return nil
+}
+
+// link links the layers into the repository, which the OCI layout does not
+// need as the repository has its own copies.
+func (s *synthesizer) link(ctx context.Context, repo string, layers ...v1.Descriptor) error {
+	if s.r.layout == LayoutOCI {
+		return nil
+	}
+	for _, layer := range layers {
+		if err := s.r.putLink(ctx, layerLinkKey(repo, layer.Digest), layer.Digest); err != nil {
+			return fmt.Errorf("failed to link layer: %w", err)
+		}
+	}
+	return nil
+}
+
+// synthBytes returns size random bytes derived from name.
+func synthBytes(name string, size int64) []byte {
+	data := make([]byte, size)
+	rng := rand.NewChaCha8(sha256.Sum256([]byte(name)))
+	rng.Read(data)
+	return data
+}
+
+func describeBytes(data []byte, mediaType string) v1.Descriptor {
+	return v1.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+}
+
+func (s *synthesizer) putBlob(ctx context.Context, repo string, name string, size int64, mediaType string) (v1.Descriptor, error) {
+	return s.putBytes(ctx, repo, synthBytes(name, size), mediaType)
+}
+
+func (s *synthesizer) putBytes(ctx context.Context, repo string, data []byte, mediaType string) (v1.Descriptor, error) {
+	desc := describeBytes(data, mediaType)
+	dgst := desc.Digest
+	key := s.r.layoutBlobKey(repo, dgst)
+	_, err := s.r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.r.bucketFor(key)),
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	}, forcePathStyle)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to upload blob %s: %w", dgst, err)
+	}
+	s.mu.Lock()
+	s.progress.Blobs++
+	s.progress.Bytes += int64(len(data))
+	s.mu.Unlock()
+	return desc, nil
+}
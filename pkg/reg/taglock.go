@@ -0,0 +1,269 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+var ErrTagLocked = errors.New("tag is being written by another replica")
+
+const (
+	tagLocksPrefix = "locks/tags/"
+	// tagLockTTL is how long a lock is held without being renewed, so how long
+	// a tag cannot be written after its writer died.
+	tagLockTTL = 30 * time.Second
+	// tagLockRenewal is how often a writer renews its lock.
+	tagLockRenewal = tagLockTTL / 3
+	// tagLockWait is how long a write waits for the lock before giving up.
+	tagLockWait = 10 * time.Second
+)
+
+// tagLocker serializes the writes and deletions of a tag across replicas, so
+// that the tag links and the database row of a tag all end up pointing at the
+// manifest of the last writer. tagLocks does the same within a process only.
+type tagLocker interface {
+	tryLock(ctx context.Context, repo string, tag string, holder string) (bool, error)
+	// renew extends a lock still held by holder, and tells whether it was.
+	renew(ctx context.Context, repo string, tag string, holder string) (bool, error)
+	unlock(ctx context.Context, repo string, tag string, holder string) error
+}
+
+// lockTagWrite waits until this replica holds the lock of the tag and returns
+// the context to write the tag with, along with the function releasing the
+// lock. The lock is renewed until released, and the context is canceled if it
+// is lost, so that a writer stalled past the TTL cannot clobber the next one.
+func (r *Registry) lockTagWrite(ctx context.Context, repo string, tag string) (context.Context, func(), error) {
+	if r.tagWriteLocks == nil {
+		return ctx, func() {}, nil
+	}
+	// Writes of the same tag within this replica must not share a holder,
+	// or they would take the lock together.
+	holder := r.replicaID + "-" + uuid.NewString()[:8]
+	waitCtx, cancelWait := context.WithTimeout(ctx, tagLockWait)
+	defer cancelWait()
+	backoff := 25 * time.Millisecond
+	for {
+		held, err := r.tagWriteLocks.tryLock(waitCtx, repo, tag, holder)
+		if err != nil {
+			return nil, nil, err
+		}
+		if held {
+			break
+		}
+		select {
+		case <-waitCtx.Done():
+			return nil, nil, fmt.Errorf("%w: %s:%s", ErrTagLocked, repo, tag)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 500*time.Millisecond)
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(tagLockRenewal)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			held, err := r.tagWriteLocks.renew(lockCtx, repo, tag, holder)
+			if lockCtx.Err() != nil {
+				return
+			}
+			if err != nil {
+				r.logger.Warn("failed to renew tag lock", "repository", repo, "tag", tag, "error", err)
+				continue
+			}
+			if !held {
+				cancel(fmt.Errorf("%w: lost the lock of %s:%s", ErrTagLocked, repo, tag))
+				return
+			}
+		}
+	}()
+	return lockCtx, func() {
+		cancel(nil)
+		<-done
+		ctx, cancelUnlock := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelUnlock()
+		if err := r.tagWriteLocks.unlock(ctx, repo, tag, holder); err != nil {
+			r.logger.Warn("failed to release tag lock", "repository", repo, "tag", tag, "error", err)
+		}
+	}, nil
+}
+
+// tagWriteErr returns why a write of a tag under lockCtx failed, which is the
+// loss of its lock if the write was canceled for it.
+func tagWriteErr(lockCtx context.Context, err error) error {
+	if err != nil && lockCtx.Err() != nil {
+		if cause := context.Cause(lockCtx); errors.Is(cause, ErrTagLocked) {
+			return cause
+		}
+	}
+	return err
+}
+
+// dbTagLocker keeps the locks as leases in the database shared by the
+// replicas.
+type dbTagLocker struct {
+	db *RegistryDB
+}
+
+func tagLockLease(repo string, tag string) string {
+	return "tag:" + repo + ":" + tag
+}
+
+func (l dbTagLocker) tryLock(_ context.Context, repo string, tag string, holder string) (bool, error) {
+	return l.db.AcquireLease(tagLockLease(repo, tag), holder, tagLockTTL)
+}
+
+func (l dbTagLocker) renew(_ context.Context, repo string, tag string, holder string) (bool, error) {
+	return l.db.AcquireLease(tagLockLease(repo, tag), holder, tagLockTTL)
+}
+
+func (l dbTagLocker) unlock(_ context.Context, repo string, tag string, holder string) error {
+	return l.db.ReleaseLease(tagLockLease(repo, tag), holder)
+}
+
+// s3TagLocker keeps the locks as objects in the bucket, created with a
+// conditional write so that only one replica gets each.
+type s3TagLocker struct {
+	r *Registry
+}
+
+type tagLockObject struct {
+	Holder  string `json:"holder"`
+	Expires int64  `json:"expires"`
+}
+
+func tagLockKey(repo string, tag string) string {
+	return fmt.Sprintf("%s%s/%s", tagLocksPrefix, repo, tag)
+}
+
+func (l s3TagLocker) tryLock(ctx context.Context, repo string, tag string, holder string) (bool, error) {
+	data, err := json.Marshal(tagLockObject{Holder: holder, Expires: time.Now().Add(tagLockTTL).UnixMilli()})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal tag lock: %w", err)
+	}
+	key := tagLockKey(repo, tag)
+	_, err = l.r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &l.r.bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		IfNoneMatch: aws.String("*"),
+	}, forcePathStyle)
+	if err == nil {
+		return true, nil
+	}
+	if !isPreconditionFailed(err) {
+		return false, fmt.Errorf("failed to put tag lock: %w", err)
+	}
+
+	// Held by another writer, which may have died holding it.
+	lock, etag, err := l.read(ctx, key)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if time.Now().UnixMilli() < lock.Expires {
+		return false, nil
+	}
+	_, err = l.r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  &l.r.bucket,
+		Key:     &key,
+		IfMatch: aws.String(etag),
+	}, forcePathStyle)
+	if err != nil && !isNotFound(err) && !isPreconditionFailed(err) {
+		return false, fmt.Errorf("failed to delete expired tag lock: %w", err)
+	}
+	return false, nil
+}
+
+func (l s3TagLocker) read(ctx context.Context, key string) (tagLockObject, string, error) {
+	var lock tagLockObject
+	obj, err := l.r.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &l.r.bucket,
+		Key:    &key,
+	}, forcePathStyle)
+	if err != nil {
+		return lock, "", err
+	}
+	defer obj.Body.Close()
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return lock, "", fmt.Errorf("failed to read tag lock: %w", err)
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return lock, "", fmt.Errorf("failed to unmarshal tag lock: %w", err)
+	}
+	return lock, aws.ToString(obj.ETag), nil
+}
+
+func (l s3TagLocker) renew(ctx context.Context, repo string, tag string, holder string) (bool, error) {
+	key := tagLockKey(repo, tag)
+	lock, etag, err := l.read(ctx, key)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if lock.Holder != holder {
+		return false, nil
+	}
+	data, err := json.Marshal(tagLockObject{Holder: holder, Expires: time.Now().Add(tagLockTTL).UnixMilli()})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal tag lock: %w", err)
+	}
+	_, err = l.r.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:  &l.r.bucket,
+		Key:     &key,
+		Body:    bytes.NewReader(data),
+		IfMatch: aws.String(etag),
+	}, forcePathStyle)
+	if err != nil {
+		if isPreconditionFailed(err) || isNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to renew tag lock: %w", err)
+	}
+	return true, nil
+}
+
+func (l s3TagLocker) unlock(ctx context.Context, repo string, tag string, holder string) error {
+	key := tagLockKey(repo, tag)
+	lock, etag, err := l.read(ctx, key)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	// Expired and taken over by another writer.
+	if lock.Holder != holder {
+		return nil
+	}
+	_, err = l.r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  &l.r.bucket,
+		Key:     &key,
+		IfMatch: aws.String(etag),
+	}, forcePathStyle)
+	if err != nil && !isNotFound(err) && !isPreconditionFailed(err) {
+		return fmt.Errorf("failed to delete tag lock: %w", err)
+	}
+	return nil
+}
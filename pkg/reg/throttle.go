@@ -0,0 +1,102 @@
+package reg
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// adaptiveLimiter bounds the requests in flight to S3. It halves its limit
+// when S3 throttles, at most once per second so that one burst of SlowDown
+// responses counts once, and raises it by one after as many successful
+// requests as the limit, back up to max.
+type adaptiveLimiter struct {
+	max    int
+	logger *slog.Logger
+
+	mu           sync.Mutex
+	limit        int
+	inFlight     int
+	successes    int
+	lastDecrease time.Time
+	// Closed and replaced whenever a slot may have freed up.
+	wake chan struct{}
+}
+
+func newAdaptiveLimiter(maxInFlight int) *adaptiveLimiter {
+	return &adaptiveLimiter{max: maxInFlight, limit: maxInFlight, wake: make(chan struct{})}
+}
+
+func (l *adaptiveLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	for l.inFlight >= l.limit {
+		wake := l.wake
+		l.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+		l.mu.Lock()
+	}
+	l.inFlight++
+	l.mu.Unlock()
+	return nil
+}
+
+// release frees a slot, adjusting the limit to whether S3 throttled the
+// request. Requests which got no response at all leave it alone.
+func (l *adaptiveLimiter) release(resp *smithyhttp.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	// S3 answers SlowDown with 503.
+	switch {
+	case resp == nil:
+	case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests:
+		if time.Since(l.lastDecrease) >= time.Second && l.limit > 1 {
+			l.limit = max(l.limit/2, 1)
+			l.lastDecrease = time.Now()
+			l.logger.Warn("S3 is throttling, lowering concurrency", "limit", l.limit)
+		}
+		l.successes = 0
+	case l.limit < l.max:
+		l.successes++
+		if l.successes >= l.limit {
+			l.limit++
+			l.successes = 0
+			if l.limit == l.max {
+				l.logger.Info("S3 concurrency restored", "limit", l.limit)
+			}
+		}
+	}
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+func (l *adaptiveLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// addMiddleware makes every attempt of a request, retries included, wait for
+// a slot. It sits in the deserialize step, which presigning skips.
+func (l *adaptiveLimiter) addMiddleware(stack *middleware.Stack) error {
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("AdaptiveConcurrency", func(
+		ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler,
+	) (middleware.DeserializeOutput, middleware.Metadata, error) {
+		if err := l.acquire(ctx); err != nil {
+			return middleware.DeserializeOutput{}, middleware.Metadata{}, err
+		}
+		out, metadata, err := next.HandleDeserialize(ctx, in)
+		resp, _ := out.RawResponse.(*smithyhttp.Response)
+		l.release(resp)
+		return out, metadata, err
+	}), middleware.Before)
+}
@@ -0,0 +1,100 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// longRunning lifts the server's read and write timeouts for routes that
+// legitimately outlive them, like uploads and downloads of large layers, which
+// blobs streamed through the registry make as slow as the client, and event
+// streams, replacing them with the configured long request timeout.
+func (h *Handler) longRunning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if timeout := h.registry.longRequestTimeout; timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			h.registry.logger.Debug("error extending read deadline", "error", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			h.registry.logger.Debug("error extending write deadline", "error", err)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var errBlobReadStalled = errors.New("blob download from S3 stalled")
+
+// StorageTimeouts bounds the storage calls of the registry by class. Unlike
+// the S3Policy timeouts, which bound single S3 operations until their
+// response arrives, these are derived inside the registry and also cover
+// reading the responses, so that a hung connection cannot hang a request.
+type StorageTimeouts struct {
+	// Reads of links, manifests and blob metadata, bodies included.
+	MetadataRead time.Duration
+	// How long a blob download may go without receiving any data.
+	BlobRead time.Duration
+	// Upload parts, upload completion and manifest and link writes.
+	Upload time.Duration
+}
+
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (r *Registry) metadataContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, r.storageTimeouts.MetadataRead)
+}
+
+func (r *Registry) uploadContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, r.storageTimeouts.Upload)
+}
+
+// blobReadContext returns a context canceled once the body returned by
+// watch went without data for the blob read timeout, or is closed.
+func (r *Registry) blobReadContext(ctx context.Context) (context.Context, func(io.ReadCloser) io.ReadCloser, context.CancelFunc) {
+	timeout := r.storageTimeouts.BlobRead
+	if timeout <= 0 {
+		return ctx, func(body io.ReadCloser) io.ReadCloser { return body }, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(timeout, func() { cancel(errBlobReadStalled) })
+	stop := func() {
+		timer.Stop()
+		cancel(nil)
+	}
+	watch := func(body io.ReadCloser) io.ReadCloser {
+		return &idleTimeoutReader{ReadCloser: body, timer: timer, timeout: timeout, stop: stop}
+	}
+	return ctx, watch, stop
+}
+
+type idleTimeoutReader struct {
+	io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	stop    func()
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.stop()
+	return err
+}
@@ -0,0 +1,390 @@
+package reg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var manifestAcceptTypes = []string{
+	v1.MediaTypeImageManifest,
+	v1.MediaTypeImageIndex,
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// upstreamClient is a minimal distribution-spec client used to talk to other
+// registries. It understands basic auth and the bearer token flow used by
+// Docker Hub and most hosted registries.
+type upstreamClient struct {
+	base     *url.URL
+	username string
+	password string
+	client   *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func newUpstreamClient(upstream *url.URL) *upstreamClient {
+	base := *upstream
+	c := &upstreamClient{
+		client: &http.Client{},
+		tokens: make(map[string]string),
+	}
+	if base.User != nil {
+		c.username = base.User.Username()
+		c.password, _ = base.User.Password()
+		base.User = nil
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	c.base = &base
+	return c
+}
+
+func (c *upstreamClient) String() string {
+	return c.base.String()
+}
+
+func (c *upstreamClient) url(format string, args ...any) string {
+	return c.base.String() + fmt.Sprintf(format, args...)
+}
+
+func (c *upstreamClient) do(req *http.Request, scope string) (*http.Response, error) {
+	c.authorize(req, scope)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.login(req.Context(), challenge, scope); err != nil {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	} else if req.Body != nil && req.Body != http.NoBody {
+		return nil, fmt.Errorf("upstream %s requires authentication and request body cannot be replayed", c.base.Host)
+	}
+	c.authorize(req, scope)
+	return c.client.Do(req)
+}
+
+func (c *upstreamClient) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	token, ok := c.tokens[scope]
+	c.mu.Unlock()
+	switch {
+	case ok && token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case ok && c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+func (c *upstreamClient) login(ctx context.Context, challenge string, scope string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("upstream %s requires credentials", c.base.Host)
+		}
+		c.mu.Lock()
+		c.tokens[scope] = ""
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported upstream auth challenge %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid upstream token realm %q", params["realm"])
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch upstream token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream token endpoint responded with status %d", resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("failed to decode upstream token: %w", err)
+	}
+	token := tokenResp.Token
+	if token == "" {
+		token = tokenResp.AccessToken
+	}
+	c.mu.Lock()
+	c.tokens[scope] = token
+	c.mu.Unlock()
+	return nil
+}
+
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	params := make(map[string]string)
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return scheme, params
+}
+
+func pullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull", repo)
+}
+
+func pushScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull,push", repo)
+}
+
+func upstreamError(resp *http.Response, what string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err := fmt.Errorf("upstream %s responded with status %d: %s", what, resp.StatusCode, strings.TrimSpace(string(body)))
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.Join(err, fs.ErrNotExist)
+	}
+	return err
+}
+
+func (c *upstreamClient) getManifest(ctx context.Context, repo string, reference string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/v2/%s/manifests/%s", repo, reference), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAcceptTypes, ", "))
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch upstream manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", upstreamError(resp, "manifest")
+	}
+	manifestBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read upstream manifest: %w", err)
+	}
+	if isDigest(reference) && digest.FromBytes(manifestBytes).String() != reference {
+		return nil, "", fmt.Errorf("upstream manifest does not match digest %s", reference)
+	}
+	return manifestBytes, resp.Header.Get("Content-Type"), nil
+}
+
+// manifestDigest asks upstream for the digest of a manifest with a HEAD
+// request, which Docker Hub does not count against pull rate limits.
+func (c *upstreamClient) manifestDigest(ctx context.Context, repo string, reference string) (digest.Digest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url("/v2/%s/manifests/%s", repo, reference), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAcceptTypes, ", "))
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return "", fmt.Errorf("failed to check upstream manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", upstreamError(resp, "manifest")
+	}
+	if dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest")); err == nil {
+		return dgst, nil
+	}
+	// The digest header is optional, so fall back to fetching the manifest.
+	manifestBytes, _, err := c.getManifest(ctx, repo, reference)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(manifestBytes), nil
+}
+
+func (c *upstreamClient) getBlob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/v2/%s/blobs/%s", repo, dgst), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch upstream blob: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, upstreamError(resp, "blob")
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (c *upstreamClient) blobExists(ctx context.Context, repo string, dgst digest.Digest) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url("/v2/%s/blobs/%s", repo, dgst), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return false, fmt.Errorf("failed to check upstream blob: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, upstreamError(resp, "blob check")
+}
+
+func (c *upstreamClient) pushBlob(ctx context.Context, repo string, dgst digest.Digest, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/v2/%s/blobs/uploads/", repo), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return fmt.Errorf("failed to start upstream upload: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return upstreamError(resp, "upload start")
+	}
+
+	location, err := c.base.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("invalid upstream upload location: %w", err)
+	}
+	query := location.Query()
+	query.Set("digest", dgst.String())
+	location.RawQuery = query.Encode()
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, location.String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do(req, pushScope(repo))
+	if err != nil {
+		return fmt.Errorf("failed to upload upstream blob: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return upstreamError(resp, "blob upload")
+	}
+	return nil
+}
+
+func (c *upstreamClient) putManifest(ctx context.Context, repo string, reference string, mediaType string, manifestBytes []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url("/v2/%s/manifests/%s", repo, reference), bytes.NewReader(manifestBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return fmt.Errorf("failed to push upstream manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return upstreamError(resp, "manifest push")
+	}
+	return nil
+}
+
+func (c *upstreamClient) list(ctx context.Context, path string, scope string, field string) ([]string, error) {
+	var result []string
+	next := c.url("%s", path)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, scope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", path, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, upstreamError(resp, path)
+		}
+		var page map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		var items []string
+		if raw, ok := page[field]; ok {
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+			}
+		}
+		result = append(result, items...)
+
+		next = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			target, _, _ := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+			nextURL, err := c.base.Parse(target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pagination link %q: %w", link, err)
+			}
+			next = nextURL.String()
+		}
+	}
+	return result, nil
+}
+
+func (c *upstreamClient) catalog(ctx context.Context) ([]string, error) {
+	return c.list(ctx, "/v2/_catalog", "registry:catalog:*", "repositories")
+}
+
+func (c *upstreamClient) listTags(ctx context.Context, repo string) ([]string, error) {
+	return c.list(ctx, fmt.Sprintf("/v2/%s/tags/list", repo), pullScope(repo), "tags")
+}
@@ -0,0 +1,134 @@
+package reg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const usageFlushInterval = 10 * time.Second
+
+type usageKey struct {
+	repository string
+	tag        string
+}
+
+type usageDelta struct {
+	Pulls      int64
+	Pushes     int64
+	LastPulled time.Time
+	LastPushed time.Time
+}
+
+// usageTracker aggregates pulls and pushes in memory and writes them in one
+// transaction per interval, so that counting does not slow down every pull.
+type usageTracker struct {
+	mu      sync.Mutex
+	pending map[usageKey]*usageDelta
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type UsageSummary struct {
+	Repository string     `db:"repository" json:"repository"`
+	Tag        string     `db:"tag" json:"tag,omitempty"`
+	Pulls      int64      `db:"pulls" json:"pulls"`
+	Pushes     int64      `db:"pushes" json:"pushes"`
+	LastPulled *time.Time `db:"last_pulled" json:"lastPulled,omitempty"`
+	LastPushed *time.Time `db:"last_pushed" json:"lastPushed,omitempty"`
+}
+
+type PopularityFilter struct {
+	Repository string
+	// Either "pulls" or "pushes".
+	OrderBy string
+	Since   time.Time
+	Limit   int
+}
+
+func (t *usageTracker) delta(repo string, tag string) *usageDelta {
+	if t.pending == nil {
+		t.pending = make(map[usageKey]*usageDelta)
+	}
+	key := usageKey{repo, tag}
+	d, ok := t.pending[key]
+	if !ok {
+		d = &usageDelta{}
+		t.pending[key] = d
+	}
+	return d
+}
+
+func (r *Registry) recordPull(repo string, reference string) {
+	t := &r.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.delta(repo, reference)
+	d.Pulls++
+	d.LastPulled = time.Now().UTC()
+}
+
+func (r *Registry) recordPush(repo string, reference string) {
+	t := &r.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.delta(repo, reference)
+	d.Pushes++
+	d.LastPushed = time.Now().UTC()
+}
+
+func (r *Registry) flushUsage() {
+	t := &r.usage
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if err := r.db.AddUsage(pending); err != nil {
+		r.logger.Error("error writing usage counters", "error", err)
+	}
+}
+
+func (r *Registry) startUsageFlush() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.usage.cancel = cancel
+	r.usage.wg.Add(1)
+	go func() {
+		defer r.usage.wg.Done()
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				r.flushUsage()
+				return
+			case <-ticker.C:
+				r.flushUsage()
+			}
+		}
+	}()
+}
+
+func (t *usageTracker) stop() {
+	if t.cancel != nil {
+		t.cancel()
+		t.wg.Wait()
+	}
+}
+
+// Popular ranks repositories, or the tags of one repository, by how often
+// they were pulled or pushed. Counts not flushed yet are included.
+func (r *Registry) Popular(filter PopularityFilter) ([]UsageSummary, error) {
+	r.flushUsage()
+	return r.db.Popular(filter)
+}
+
+// RepositoryUsage returns the usage of every tag, and of digests pulled
+// directly, of a repository.
+func (r *Registry) RepositoryUsage(repo string) ([]UsageSummary, error) {
+	r.flushUsage()
+	return r.db.Popular(PopularityFilter{Repository: repo})
+}
@@ -0,0 +1,199 @@
+package reg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
+)
+
+type VerifyOptions struct {
+	Repositories []string
+	Concurrency  int
+	// Resume skips blobs which already passed a previous verification run.
+	Resume bool
+}
+
+type BlobMismatch struct {
+	Digest digest.Digest `json:"digest"`
+	Key    string        `json:"key"`
+	Error  string        `json:"error"`
+}
+
+type VerifyResult struct {
+	Verified   uint64         `json:"verified"`
+	Skipped    uint64         `json:"skipped"`
+	Mismatches []BlobMismatch `json:"mismatches,omitempty"`
+}
+
+var errBlobMissing = errors.New("blob is missing")
+
+func (r *Registry) VerifyBlobs(ctx context.Context, opts VerifyOptions) (*VerifyResult, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	result := &VerifyResult{}
+	var mu sync.Mutex
+	group, gctx := errgroup.WithContext(ctx)
+	group.SetLimit(concurrency)
+	// In the OCI layout every repository has its own copy of a blob, so each
+	// copy is verified.
+	verify := func(repo string, dgst digest.Digest) {
+		if opts.Resume && r.db.IsBlobVerified(dgst.String()) {
+			atomic.AddUint64(&result.Skipped, 1)
+			return
+		}
+		group.Go(func() error {
+			err := r.verifyBlob(gctx, repo, dgst)
+			if gctx.Err() != nil {
+				return gctx.Err()
+			}
+			verifyErr := ""
+			if err != nil {
+				verifyErr = err.Error()
+				r.logger.Warn("blob verification failed", "digest", dgst, "error", err)
+				mu.Lock()
+				result.Mismatches = append(result.Mismatches, BlobMismatch{Digest: dgst, Key: r.layoutBlobKey(repo, dgst), Error: verifyErr})
+				mu.Unlock()
+			}
+			if err := r.db.RecordBlobVerification(dgst.String(), verifyErr); err != nil {
+				r.logger.Error("error recording blob verification", "error", err)
+			}
+			if n := atomic.AddUint64(&result.Verified, 1); n%1000 == 0 {
+				r.logger.Info("Verification progress", "verified", n)
+			}
+			return nil
+		})
+	}
+
+	var err error
+	if len(opts.Repositories) > 0 {
+		err = r.walkRepositoryBlobs(gctx, opts.Repositories, verify)
+	} else {
+		err = r.walkBlobs(gctx, verify)
+	}
+	if waitErr := group.Wait(); err == nil {
+		err = waitErr
+	}
+	return result, err
+}
+
+func (r *Registry) verifyBlob(ctx context.Context, repo string, dgst digest.Digest) error {
+	body, _, err := r.openBlob(ctx, repo, dgst)
+	if err != nil {
+		if isNotFound(err) {
+			return errBlobMissing
+		}
+		return err
+	}
+	defer body.Close()
+
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, body); err != nil {
+		return fmt.Errorf("failed to read blob: %w", err)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("content does not match digest")
+	}
+	return nil
+}
+
+func (r *Registry) walkBlobs(ctx context.Context, fn func(string, digest.Digest)) error {
+	for _, bucket := range r.blobBuckets() {
+		if err := r.walkBucketBlobs(ctx, bucket, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) walkBucketBlobs(ctx context.Context, bucket string, fn func(string, digest.Digest)) error {
+	prefix := blobsPrefix
+	if r.layout == LayoutOCI {
+		prefix = ""
+	}
+	var continuationToken *string
+	for {
+		req, err := r.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &bucket,
+			Prefix:            &prefix,
+			ContinuationToken: continuationToken,
+		}, forcePathStyle)
+		if err != nil {
+			return fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, obj := range req.Contents {
+			if r.layout == LayoutOCI {
+				if repo, dgst, ok := ociBlobFromKey(*obj.Key); ok {
+					fn(repo, dgst)
+				}
+			} else if dgst, ok := digestFromBlobKey(*obj.Key); ok {
+				fn("", dgst)
+			}
+		}
+		if req.IsTruncated == nil || !*req.IsTruncated {
+			return nil
+		}
+		continuationToken = req.NextContinuationToken
+	}
+}
+
+func (r *Registry) walkRepositoryBlobs(ctx context.Context, repos []string, fn func(string, digest.Digest)) error {
+	seen := make(map[string]bool)
+	for _, repo := range repos {
+		visit := func(dgst digest.Digest) {
+			key := r.layoutBlobKey(repo, dgst)
+			if !seen[key] {
+				seen[key] = true
+				fn(repo, dgst)
+			}
+		}
+		tags, err := r.listTags(ctx, repo)
+		if err != nil {
+			return fmt.Errorf("failed to list tags of %s: %w", repo, err)
+		}
+		for _, tag := range tags {
+			_, manifestBytes, err := r.getStoredManifest(ctx, repo, tag)
+			if err != nil {
+				return fmt.Errorf("failed to get manifest %s:%s: %w", repo, tag, err)
+			}
+			if err := r.walkManifestBlobs(ctx, repo, manifestBytes, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Registry) walkManifestBlobs(ctx context.Context, repo string, manifestBytes []byte, fn func(digest.Digest)) error {
+	fn(digest.FromBytes(manifestBytes))
+	manifest, err := parseAnyManifest(manifestBytes)
+	if err != nil {
+		return err
+	}
+	for _, child := range manifest.Manifests {
+		childBytes, err := r.getManifestBlob(ctx, repo, child.Digest)
+		if err != nil {
+			if isNotFound(err) {
+				fn(child.Digest)
+				continue
+			}
+			return fmt.Errorf("failed to get child manifest %s: %w", child.Digest, err)
+		}
+		if err := r.walkManifestBlobs(ctx, repo, childBytes, fn); err != nil {
+			return err
+		}
+	}
+	for _, blob := range manifest.blobs() {
+		fn(blob.Digest)
+	}
+	return nil
+}